@@ -2,6 +2,7 @@ package pie
 
 import (
 	"context"
+	"github.com/5xxxx/pie/geo"
 	"github.com/5xxxx/pie/schemas"
 	"go.mongodb.org/mongo-driver/bson/bsoncodec"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -48,6 +49,18 @@ type Aggregate interface {
 
 	Match(c Condition) Aggregate
 
+	// GeoNear appends a $geoNear stage, which must come first in the pipeline.
+	GeoNear(stage *geo.NearStage) Aggregate
+
+	// Project appends a { $project: spec } stage; spec values may be expressions built with package expr.
+	Project(spec any) Aggregate
+
+	// AddFields appends an { $addFields: fields } stage.
+	AddFields(fields any) Aggregate
+
+	// Group appends a { $group: { _id: id, <field>: <accumulator>, ... } } stage.
+	Group(id any, fields any) Aggregate
+
 	SetDatabase(db string) Aggregate
 
 	Collection(doc any) Aggregate
@@ -59,16 +72,20 @@ type Aggregate interface {
 	SetCollWriteConcern(wc *writeconcern.WriteConcern) Aggregate
 
 	SetReadConcern(rc *readconcern.ReadConcern) Aggregate
-	//AddFields() Aggregate
+
+	// Shell renders the aggregate command on the collection of doc, or the one
+	// set with Collection, as mongosh syntax.
+	Shell(doc any) (string, error)
+
+	// String renders the aggregate command on the collection set with Collection.
+	String() string
 	//Bucket() Aggregate
 	//BucketAuto() Aggregate
 	//CollStats() Aggregate
 	//Count() Aggregate
 	//CurrentOp() Aggregate
 	//Facet() Aggregate
-	//GeoNear() Aggregate
 	//GraphLookup() Aggregate
-	//Group() Aggregate
 	//IndexStats() Aggregate
 	//Limit() Aggregate
 	//ListLocalSession() Aggregate
@@ -78,7 +95,6 @@ type Aggregate interface {
 	//Merge() Aggregate
 	//Out() Aggregate
 	//PlanCacheStats() Aggregate
-	//Project() Aggregate
 	//Redact() Aggregate
 	//ReplaceRoot() Aggregate
 	//ReplaceWith() Aggregate
@@ -249,6 +265,63 @@ func (a *aggregate) Match(c Condition) Aggregate {
 	return a
 }
 
+// GeoNear appends the $geoNear stage built by stage, which sorts the
+// documents by distance and writes the distance to its distance field.
+//
+// Example usage:
+//
+//	var shops []struct {
+//		Shop     `bson:",inline"`
+//		Distance float64 `bson:"distance"`
+//	}
+//	err := client.Aggregate().Collection(&Shop{}).
+//		GeoNear(geo.NewNearStage(geo.NewPoint(13.4, 52.5), "distance").MaxDistance(5000)).
+//		All(&shops)
+func (a *aggregate) GeoNear(stage *geo.NearStage) Aggregate {
+	a.pipeline = append(a.pipeline, stage.Stage())
+	return a
+}
+
+// Project appends a $project stage, which reshapes each document: spec keeps
+// (1) or drops (0) fields, or computes them with expressions.
+//
+// Example usage:
+//
+//	client.Aggregate().Project(bson.D{
+//		{Key: "name", Value: 1},
+//		{Key: "total", Value: expr.Multiply(expr.Field("price"), expr.Field("qty"))},
+//	})
+func (a *aggregate) Project(spec any) Aggregate {
+	a.pipeline = append(a.pipeline, bson.D{{Key: "$project", Value: spec}})
+	return a
+}
+
+// AddFields appends an $addFields stage, which adds the computed fields to
+// each document and keeps the existing ones.
+//
+// Example usage:
+//
+//	client.Aggregate().AddFields(bson.M{"year": expr.Year(expr.Field("createdAt"))})
+func (a *aggregate) AddFields(fields any) Aggregate {
+	a.pipeline = append(a.pipeline, bson.D{{Key: "$addFields", Value: fields}})
+	return a
+}
+
+// Group appends a $group stage grouping the documents by id, an expression,
+// and computing each of fields with an accumulator. Maps are added in key order.
+//
+// Example usage:
+//
+//	client.Aggregate().Group(expr.Field("status"), bson.D{
+//		{Key: "total", Value: expr.Sum(expr.Field("amount"))},
+//		{Key: "orders", Value: expr.Count()},
+//	})
+func (a *aggregate) Group(id any, fields any) Aggregate {
+	spec := bson.D{{Key: "_id", Value: id}}
+	a.pipeline = append(a.pipeline, bson.D{{Key: "$group", Value: append(spec, entries(fields)...)}})
+	return a
+}
+
 // SetDatabase sets the value for the db field in the aggregate struct.
 func (a *aggregate) SetDatabase(db string) Aggregate {
 	a.db = db
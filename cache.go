@@ -0,0 +1,334 @@
+package pie
+
+import (
+	"container/list"
+	"context"
+	"encoding/gob"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/5xxxx/pie/internal/bsonstruct"
+	"github.com/5xxxx/pie/internal/mql"
+	"github.com/5xxxx/pie/schemas"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Cache stores encoded documents for read-through lookups.
+// Implementations must be safe for concurrent use.
+//
+// A client with a cache serves FindOne calls that select a single document by
+// _id, by a field tagged `pie:"unique"` or by every field of a `pie:"pk"`
+// primary key, from the cache and fills it on a miss.
+// Writes through the client drop the entries they may have changed: a write
+// keyed by _id deletes that entry, any other write invalidates every entry of
+// the collection. Writes made outside the client are not seen, so entries can be
+// stale until they expire.
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+	Delete(key string)
+}
+
+func init() {
+	// Cache keys are built with schemas.PK, which gob-encodes the key values.
+	gob.Register(primitive.ObjectID{})
+	gob.Register(primitive.DateTime(0))
+	gob.Register(primitive.Binary{})
+	gob.Register(bson.D{})
+	gob.Register(bson.A{})
+}
+
+// lruCache is an in-process Cache evicting the least recently used entry
+// once size entries are held. Entries older than ttl are treated as missing.
+type lruCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+	now   func() time.Time
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewLRUCache returns an in-process Cache holding at most size entries, each
+// for at most ttl. A size <= 0 means no limit and a ttl <= 0 means entries never expire.
+//
+// Example usage:
+//
+//	client.SetCache(pie.NewLRUCache(10000, time.Minute))
+func NewLRUCache(size int, ttl time.Duration) Cache {
+	return &lruCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+		now:   time.Now,
+	}
+}
+
+func (c *lruCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*lruEntry)
+	if c.ttl > 0 && !c.now().Before(entry.expires) {
+		c.removeElement(el)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return entry.value, true
+}
+
+func (c *lruCache) Set(key string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var expires time.Time
+	if c.ttl > 0 {
+		expires = c.now().Add(c.ttl)
+	}
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*lruEntry)
+		entry.value, entry.expires = value, expires
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	if c.size > 0 && c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *lruCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *lruCache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*lruEntry).key)
+}
+
+// cacheScope addresses the cache entries of one collection. Entry keys embed
+// a generation token; replacing the token invalidates the whole collection.
+type cacheScope struct {
+	cache  Cache
+	prefix string
+}
+
+func newCacheScope(cache Cache, coll *mongo.Collection) *cacheScope {
+	return &cacheScope{cache: cache, prefix: coll.Database().Name() + "." + coll.Name() + "/"}
+}
+
+func (c *cacheScope) generationKey() string {
+	return c.prefix + "@generation"
+}
+
+func (c *cacheScope) generation() string {
+	if gen, ok := c.cache.Get(c.generationKey()); ok {
+		return string(gen)
+	}
+	gen := []byte(primitive.NewObjectID().Hex())
+	c.cache.Set(c.generationKey(), gen)
+	return string(gen)
+}
+
+// bump invalidates every entry of the collection.
+func (c *cacheScope) bump() {
+	c.cache.Set(c.generationKey(), []byte(primitive.NewObjectID().Hex()))
+}
+
+// key returns the entry key of the document whose field equals value.
+func (c *cacheScope) key(field string, value any) (string, error) {
+	pk, err := schemas.NewPK(value).ToString()
+	if err != nil {
+		return "", err
+	}
+	return c.prefix + c.generation() + "/" + field + "/" + pk, nil
+}
+
+// cacheKeyOf reports whether filters select a single document by equality
+// on one field, returning the field and its normalized value. Binary keys,
+// such as uuids, and embedded documents, such as composite _id values, are
+// equalities too.
+func cacheKeyOf(filters bson.D) (string, any, bool) {
+	if len(filters) != 1 {
+		return "", nil, false
+	}
+	value, err := mql.Normalize(filters[0].Value)
+	if err != nil {
+		return "", nil, false
+	}
+	switch v := value.(type) {
+	case string, bool, int32, int64, float64, primitive.ObjectID, primitive.DateTime, primitive.Binary:
+		return filters[0].Key, value, true
+	case bson.D:
+		if len(v) > 0 && !strings.HasPrefix(v[0].Key, "$") {
+			return filters[0].Key, value, true
+		}
+	}
+	return "", nil, false
+}
+
+// primaryKeyOf reports whether filters select a single document of model
+// type t by equality on each field of its primary key, returning the key's
+// field names joined by commas and the ordered tuple of its normalized values.
+func primaryKeyOf(t reflect.Type, filters bson.D) (string, any, bool) {
+	if t == nil {
+		return "", nil, false
+	}
+	fields := primaryKeyFields(indirectType(t))
+	if len(fields) == 0 || len(filters) != len(fields) {
+		return "", nil, false
+	}
+	names := make([]string, len(fields))
+	values := make(bson.A, len(fields))
+	for i, f := range fields {
+		found := false
+		for _, e := range filters {
+			if e.Key != f.Name {
+				continue
+			}
+			if _, value, ok := cacheKeyOf(bson.D{e}); ok {
+				names[i], values[i], found = f.Name, value, true
+			}
+			break
+		}
+		if !found {
+			return "", nil, false
+		}
+	}
+	return strings.Join(names, ","), values, true
+}
+
+// isUniqueField reports whether the field of t stored under key is tagged `pie:"unique"`.
+func isUniqueField(t reflect.Type, key string) bool {
+	for _, f := range bsonstruct.Fields(t) {
+		if f.Name == key {
+			_, unique := bsonstruct.Tag(f.Field)["unique"]
+			return unique
+		}
+	}
+	return false
+}
+
+// cacheRead is a FindOne that selects a single document by _id, by a unique
+// field or by its primary key.
+type cacheRead struct {
+	scope *cacheScope
+	field string
+	value any
+}
+
+// cachedRead returns the cache lookup a FindOne of doc through filters can be
+// served from, or nil. Reads inside a transaction and projected reads bypass the cache.
+func (s *session) cachedRead(ctx context.Context, coll *mongo.Collection, doc any, filters bson.D) *cacheRead {
+	cache := s.engine.Cache()
+	if cache == nil || mongo.SessionFromContext(ctx) != nil {
+		return nil
+	}
+	if options.MergeFindOneOptions(s.findOneOptions...).Projection != nil {
+		return nil
+	}
+	field, value, ok := cacheKeyOf(filters)
+	if !ok || (field != "_id" && !isUniqueField(reflect.TypeOf(doc), field)) {
+		if field, value, ok = primaryKeyOf(reflect.TypeOf(doc), filters); !ok {
+			return nil
+		}
+	}
+	return &cacheRead{scope: newCacheScope(cache, coll), field: field, value: value}
+}
+
+// lookup returns the cached document, provided it still matches filters.
+func (r *cacheRead) lookup(filters bson.D) (bson.Raw, bool) {
+	key, err := r.scope.key(r.field, r.value)
+	if err != nil {
+		return nil, false
+	}
+	if r.field != "_id" {
+		ref, ok := r.scope.cache.Get(key)
+		if !ok {
+			return nil, false
+		}
+		key = string(ref)
+	}
+	raw, ok := r.scope.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	if ok, err := DefaultCondition().FilterBson(filters).Match(bson.Raw(raw)); err != nil || !ok {
+		return nil, false
+	}
+	return raw, true
+}
+
+// store caches raw under its _id and, for unique and primary key reads, maps
+// the key to that entry.
+func (r *cacheRead) store(raw bson.Raw) {
+	doc, err := mql.NormalizeDoc(raw)
+	if err != nil {
+		return
+	}
+	id, ok := mql.Get(doc, "_id")
+	if !ok {
+		return
+	}
+	idKey, err := r.scope.key("_id", id)
+	if err != nil {
+		return
+	}
+	r.scope.cache.Set(idKey, raw)
+	if r.field != "_id" {
+		if key, err := r.scope.key(r.field, r.value); err == nil {
+			r.scope.cache.Set(key, []byte(idKey))
+		}
+	}
+}
+
+// invalidate drops the cache entries a write through filters may have changed.
+func (s *session) invalidate(coll *mongo.Collection, filters bson.D) {
+	cache := s.engine.Cache()
+	if cache == nil {
+		return
+	}
+	scope := newCacheScope(cache, coll)
+	if field, value, ok := cacheKeyOf(filters); ok && field == "_id" {
+		if key, err := scope.key(field, value); err == nil {
+			cache.Delete(key)
+			return
+		}
+	}
+	scope.bump()
+}
+
+// registry returns the registry documents of the session's collections are decoded with.
+func (s *session) registry() *bsoncodec.Registry {
+	if r := options.MergeCollectionOptions(s.collOpts...).Registry; r != nil {
+		return r
+	}
+	if d, ok := s.engine.(*defaultClient); ok {
+		if r := options.MergeClientOptions(d.clientOpts...).Registry; r != nil {
+			return r
+		}
+	}
+	if r := s.engine.Codecs().Registry(); r != nil {
+		return r
+	}
+	return bson.DefaultRegistry
+}
@@ -0,0 +1,164 @@
+package pie
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/5xxxx/pie/names"
+	"github.com/5xxxx/pie/schemas"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type member struct {
+	ID    primitive.ObjectID `bson:"_id"`
+	Email string             `bson:"email" pie:"unique"`
+	Name  string             `bson:"name"`
+}
+
+func TestLRUCache(t *testing.T) {
+	Convey("The LRU cache evicts and expires entries", t, func() {
+		now := time.Now()
+		c := NewLRUCache(2, time.Minute).(*lruCache)
+		c.now = func() time.Time { return now }
+
+		c.Set("a", []byte("1"))
+		c.Set("b", []byte("2"))
+		_, ok := c.Get("a")
+		So(ok, ShouldBeTrue)
+
+		c.Set("c", []byte("3"))
+		_, ok = c.Get("b")
+		So(ok, ShouldBeFalse)
+		v, ok := c.Get("a")
+		So(ok, ShouldBeTrue)
+		So(string(v), ShouldEqual, "1")
+
+		c.Delete("a")
+		_, ok = c.Get("a")
+		So(ok, ShouldBeFalse)
+
+		now = now.Add(time.Minute)
+		_, ok = c.Get("c")
+		So(ok, ShouldBeFalse)
+		So(c.ll.Len(), ShouldEqual, 0)
+	})
+}
+
+func TestCacheKeys(t *testing.T) {
+	Convey("Only single equality filters on _id or unique fields are cacheable", t, func() {
+		id := primitive.NewObjectID()
+		field, value, ok := cacheKeyOf(bson.D{{Key: "_id", Value: id}})
+		So(ok, ShouldBeTrue)
+		So(field, ShouldEqual, "_id")
+		So(value, ShouldEqual, id)
+
+		_, _, ok = cacheKeyOf(bson.D{{Key: "_id", Value: bson.M{"$in": bson.A{id}}}})
+		So(ok, ShouldBeFalse)
+		_, _, ok = cacheKeyOf(bson.D{{Key: "_id", Value: id}, {Key: "name", Value: "a"}})
+		So(ok, ShouldBeFalse)
+
+		uuid := primitive.Binary{Subtype: 4, Data: make([]byte, 16)}
+		_, value, ok = cacheKeyOf(bson.D{{Key: "_id", Value: uuid}})
+		So(ok, ShouldBeTrue)
+		So(value, ShouldResemble, uuid)
+		_, value, ok = cacheKeyOf(bson.D{{Key: "_id", Value: bson.D{{Key: "tenant", Value: "acme"}, {Key: "n", Value: 1}}}})
+		So(ok, ShouldBeTrue)
+		_, err := schemas.NewPK(value).ToString()
+		So(err, ShouldBeNil)
+
+		field, value, ok = primaryKeyOf(reflect.TypeOf(&membership{}),
+			bson.D{{Key: "user_id", Value: int64(42)}, {Key: "tenant", Value: "acme"}})
+		So(ok, ShouldBeTrue)
+		So(field, ShouldEqual, "tenant,user_id")
+		So(value, ShouldResemble, bson.A{"acme", int64(42)})
+		_, _, ok = primaryKeyOf(reflect.TypeOf(&membership{}), bson.D{{Key: "tenant", Value: "acme"}})
+		So(ok, ShouldBeFalse)
+		_, _, ok = primaryKeyOf(reflect.TypeOf(&membership{}),
+			bson.D{{Key: "tenant", Value: "acme"}, {Key: "user_id", Value: bson.M{"$gt": 1}}})
+		So(ok, ShouldBeFalse)
+
+		So(isUniqueField(reflect.TypeOf(member{}), "email"), ShouldBeTrue)
+		So(isUniqueField(reflect.TypeOf(member{}), "name"), ShouldBeFalse)
+	})
+}
+
+func TestCachedReads(t *testing.T) {
+	Convey("Given a session on a client with a cache", t, func() {
+		mc, err := mongo.NewClient(options.Client().ApplyURI("mongodb://127.0.0.1:27017"))
+		So(err, ShouldBeNil)
+		mapper := names.NewCacheMapper(new(names.SnakeMapper))
+		client := &defaultClient{client: mc, parser: NewParser(mapper, mapper), db: "test"}
+		client.SetCache(NewLRUCache(100, time.Minute))
+
+		s := client.NewSession().(*session)
+		coll, err := s.collectionForStruct(&member{})
+		So(err, ShouldBeNil)
+
+		m := member{ID: primitive.NewObjectID(), Email: "a@example.com", Name: "a"}
+		raw, err := bson.Marshal(m)
+		So(err, ShouldBeNil)
+		byID := bson.D{{Key: "_id", Value: m.ID}}
+		byEmail := bson.D{{Key: "email", Value: m.Email}}
+
+		read := s.cachedRead(context.Background(), coll, &member{}, byEmail)
+		So(read, ShouldNotBeNil)
+		read.store(raw)
+
+		Convey("By-ID and unique-key reads hit the stored document", func() {
+			got, ok := s.cachedRead(context.Background(), coll, &member{}, byID).lookup(byID)
+			So(ok, ShouldBeTrue)
+			So(got, ShouldResemble, bson.Raw(raw))
+			_, ok = read.lookup(byEmail)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Composite primary key reads are cached", func() {
+			coll, err := s.collectionForStruct(&membership{})
+			So(err, ShouldBeNil)
+			byKey, err := IDFilter(reflect.TypeOf(membership{}), schemas.NewPK("acme", 42), s.registry())
+			So(err, ShouldBeNil)
+			raw, err := bson.Marshal(bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "tenant", Value: "acme"}, {Key: "user_id", Value: int64(42)}})
+			So(err, ShouldBeNil)
+
+			read := s.cachedRead(context.Background(), coll, &membership{}, byKey)
+			So(read, ShouldNotBeNil)
+			_, ok := read.lookup(byKey)
+			So(ok, ShouldBeFalse)
+			read.store(raw)
+			got, ok := s.cachedRead(context.Background(), coll, &membership{}, byKey).lookup(byKey)
+			So(ok, ShouldBeTrue)
+			So(got, ShouldResemble, bson.Raw(raw))
+		})
+
+		Convey("Other reads bypass the cache", func() {
+			So(s.cachedRead(context.Background(), coll, &member{}, bson.D{{Key: "name", Value: "a"}}), ShouldBeNil)
+			So(client.NewSession().Project(bson.M{"name": 1}).(*session).cachedRead(context.Background(), coll, &member{}, byID), ShouldBeNil)
+		})
+
+		Convey("A write keyed by _id drops the entry", func() {
+			s.invalidate(coll, byID)
+			_, ok := read.lookup(byEmail)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Any other write invalidates the collection", func() {
+			s.invalidate(coll, bson.D{{Key: "name", Value: "a"}})
+			_, ok := s.cachedRead(context.Background(), coll, &member{}, byID).lookup(byID)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("A cached document that no longer matches is a miss", func() {
+			changed, err := bson.Marshal(member{ID: m.ID, Email: "b@example.com"})
+			So(err, ShouldBeNil)
+			s.cachedRead(context.Background(), coll, &member{}, byID).store(changed)
+			_, ok := read.lookup(byEmail)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
@@ -3,17 +3,18 @@ package pie
 import (
 	"context"
 	"errors"
-	"github.com/5xxxx/pie/names"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"io/fs"
 	"reflect"
 	"strings"
 
-	"go.mongodb.org/mongo-driver/bson"
-
+	"github.com/5xxxx/pie/geo"
+	"github.com/5xxxx/pie/names"
 	"github.com/5xxxx/pie/schemas"
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 // Client is an interface that represents a MongoDB client. It provides methods for querying, updating, deleting, and managing data in a MongoDB database.
@@ -37,7 +38,7 @@ import (
 // FindOneAndUpdateBson is a method that finds a single document in a specific collection that matches a query and updates it with the provided BSON document.
 // It returns a SingleResult object that contains the updated document. It takes the collection interface (coll), the BSON document (bson), and optional context parameter (ctx).
 // InsertOne is a method that inserts a single document into a collection.
-// It takes the document to insert (v) and optional context parameter (ctx). It returns the ObjectID of the inserted document.
+// It takes the document to insert (v) and optional context parameter (ctx). It returns the id of the inserted document.
 // InsertMany is a method that inserts multiple documents into a collection.
 // It takes the documents to insert (v) as a slice and optional context parameter (ctx).
 // It returns an InsertManyResult object that contains the ObjectIDs of the inserted documents.
@@ -111,10 +112,10 @@ import (
 // It takes the key (key) and the type (t) to compare.
 // It returns a Session object.
 // Expr is a method that applies an additional filter using MongoDB's expression syntax.
-// It takes a Condition object (filter).
+// It takes a Condition or a value built with package expr (expression).
 // It returns a Session object.
 // Regex is a method that filters documents based on a regular expression pattern applied to a specific key.
-// It takes the key (key) and the pattern (value) to match.
+// It takes the key (key), the pattern and its options (opts) to match.
 // It returns a Session object.
 // ID is a method that filters documents based on their ObjectID.
 // It takes the ObjectID (id) to match.
@@ -181,6 +182,16 @@ import (
 // TransactionWithOptions is a method that executes a transaction using the provided transaction function and transaction options.
 // It takes the context (ctx), the transaction function (f), and optional transaction options (opt).
 // It returns an error if the transaction fails.
+// SetCache is a method that installs a read-through Cache for by-ID, unique-key and primary-key FindOne calls.
+// Passing nil disables caching.
+// Cache is a method that returns the Cache installed with SetCache, or nil.
+// Codecs is a method that returns the codecs added to the client's collections, see RegisterVariant.
+// RegisterCodec is a method that sets the encoder and decoder of a type for the client's collections.
+// IDGenerators is a method that returns the id generators of the client's inserts, see IDStrategy.
+// RegisterIDGenerator is a method that names an id generator for `pie:"id:<name>"` field tags.
+// Fixtures is a method that returns the models fixture files are loaded into, see Fixtures.Load.
+// RegisterFixtureModels is a method that adds the models fixture files are loaded into.
+// LoadFixtures is a method that inserts the documents of fixture files through the registered models.
 type Client interface {
 	FindPagination(needCount bool, doc any, ctx ...context.Context) (int64, error)
 	FindOneAndReplace(doc any, ctx ...context.Context) error
@@ -192,7 +203,7 @@ type Client interface {
 	Distinct(doc any, columns string, ctx ...context.Context) ([]any, error)
 	FindOneAndUpdateBson(coll any, bson any, ctx ...context.Context) (*mongo.SingleResult, error)
 
-	InsertOne(v any, ctx ...context.Context) (primitive.ObjectID, error)
+	InsertOne(v any, ctx ...context.Context) (any, error)
 	InsertMany(v any, ctx ...context.Context) (*mongo.InsertManyResult, error)
 	BulkWrite(docs any, ctx ...context.Context) (*mongo.BulkWriteResult, error)
 	ReplaceOne(doc any, ctx ...context.Context) (*mongo.UpdateResult, error)
@@ -225,30 +236,54 @@ type Client interface {
 	Eq(key string, value any) Session
 	Ne(key string, ne any) Session
 	Nin(key string, nin any) Session
-	Nor(c Condition) Session
+	Nor(c ...Condition) Session
 	Exists(key string, exists bool, filter ...Condition) Session
+	ElemMatch(key string, c Condition) Session
+	All(key string, values any) Session
+	Size(key string, n int) Session
+	Mod(key string, divisor, remainder int64) Session
+	BitsAllSet(key string, bits any) Session
+	BitsAnySet(key string, bits any) Session
+	BitsAllClear(key string, bits any) Session
+	BitsAnyClear(key string, bits any) Session
+	JSONSchema(schema any) Session
+	Comment(comment string) Session
 	Type(key string, t any) Session
-	Expr(filter Condition) Session
-	Regex(key string, value string) Session
+	Expr(expression any) Session
+	Regex(key string, pattern string, opts string) Session
+	StartsWith(key string, prefix string) Session
+	EndsWith(key string, suffix string) Session
+	Contains(key string, substr string) Session
+	EqualFold(key string, s string) Session
+	Text(search, language string, caseSensitive, diacriticSensitive bool) Session
+	Near(key string, point geo.Point, maxDistance, minDistance float64) Session
+	NearSphere(key string, point geo.Point, maxDistance, minDistance float64) Session
+	GeoWithin(key string, shape geo.Shape) Session
+	GeoIntersects(key string, geometry geo.Geometry) Session
 	ID(id any) Session
 	Gt(key string, value any) Session
 	Gte(key string, value any) Session
 	Lt(key string, value any) Session
 	Lte(key string, value any) Session
 	In(key string, value any) Session
-	And(filter Condition) Session
+	And(filter ...Condition) Session
 	Not(key string, value any) Session
-	Or(filter Condition) Session
+	Or(filter ...Condition) Session
 	Limit(limit int64) Session
 	Skip(skip int64) Session
 	Count(i any, ctx ...context.Context) (int64, error)
 	Desc(s1 ...string) Session
 	FilterBson(d bson.D) Session
 	Project(d any) Session
+	Select(dto any) Session
+	Populate(paths ...string) Session
 	NewIndexes() Indexes
 	DropAll(doc any, ctx ...context.Context) error
 	DropOne(doc any, name string, ctx ...context.Context) error
 	AddIndex(keys any, opt ...*options.IndexOptions) Indexes
+	AddTextIndex(weights map[string]int32, opt ...*options.IndexOptions) Indexes
+	AddIndex2dsphere(key string, opt ...*options.IndexOptions) Indexes
+	AddIndex2d(key string, opt ...*options.IndexOptions) Indexes
 
 	NewSession() Session
 	Aggregate() Aggregate
@@ -257,6 +292,17 @@ type Client interface {
 	CollectionNameForSlice(doc any) (*schemas.Collection, error)
 	Transaction(ctx context.Context, f schemas.TransFunc) error
 	TransactionWithOptions(ctx context.Context, f schemas.TransFunc, opt ...*options.SessionOptions) error
+
+	SetCache(cache Cache)
+	Cache() Cache
+	Codecs() *Codecs
+	RegisterCodec(t reflect.Type, enc bsoncodec.ValueEncoder, dec bsoncodec.ValueDecoder)
+	IDGenerators() *IDGenerators
+	RegisterIDGenerator(name string, gen IDGenerator)
+
+	Fixtures() *Fixtures
+	RegisterFixtureModels(models ...any)
+	LoadFixtures(ctx context.Context, fsys fs.FS, patterns ...string) (FixtureIDs, error)
 }
 
 // defaultClient is a struct that represents a default client.
@@ -265,6 +311,10 @@ type defaultClient struct {
 	parser     *Parser
 	db         string
 	clientOpts []*options.ClientOptions
+	cache      Cache
+	codecs     *Codecs
+	ids        *IDGenerators
+	fixtures   *Fixtures
 }
 
 // NewClient creates a new client with the specified database name and options.
@@ -290,6 +340,9 @@ func NewClient(db string, opts ...*options.ClientOptions) (Client, error) {
 		parser:     parser,
 		client:     client,
 		db:         db,
+		codecs:     NewCodecs(),
+		ids:        NewIDGenerators(),
+		fixtures:   NewFixtures(),
 	}
 	return &d, nil
 }
@@ -312,6 +365,16 @@ func (d *defaultClient) Project(p any) Session {
 	return d.NewSession().Project(p)
 }
 
+// Select creates a new session projecting the bson fields of dto.
+func (d *defaultClient) Select(dto any) Session {
+	return d.NewSession().Select(dto)
+}
+
+// Populate creates a new session loading the relations named by paths.
+func (d *defaultClient) Populate(paths ...string) Session {
+	return d.NewSession().Populate(paths...)
+}
+
 func (d *defaultClient) Disconnect(ctx ...context.Context) error {
 	c := context.Background()
 	if len(ctx) > 0 {
@@ -512,7 +575,7 @@ func (d *defaultClient) Eq(key string, value any) Session {
 // Returns:
 // - Session: a session that can be used to execute the query.
 func (d *defaultClient) Ne(key string, ne any) Session {
-	return d.NewSession().Gt(key, ne)
+	return d.NewSession().Ne(key, ne)
 }
 
 // Nin returns a new Session where the specified key does not match the specified value(s).
@@ -539,8 +602,8 @@ func (d *defaultClient) Nin(key string, nin any) Session {
 }
 
 // Nor constructs a negation condition and returns a new Session with the negation condition applied.
-func (d *defaultClient) Nor(c Condition) Session {
-	return d.NewSession().Nor(c)
+func (d *defaultClient) Nor(c ...Condition) Session {
+	return d.NewSession().Nor(c...)
 }
 
 // Exists checks whether a key exists in the specified collection. It returns a Session object for further operations.
@@ -560,24 +623,119 @@ func (d *defaultClient) Exists(key string, exists bool, filter ...Condition) Ses
 	return d.NewSession().Exists(key, exists, filter...)
 }
 
-// Type executes a GT command with the given key and value and returns a Session.
-// This method is used to filter the results of a find command based on a type field in the documents.
+// ElemMatch creates a new session matching arrays with an element satisfying c; see Condition.ElemMatch.
+func (d *defaultClient) ElemMatch(key string, c Condition) Session {
+	return d.NewSession().ElemMatch(key, c)
+}
+
+// All creates a new session matching arrays holding every value of values.
+func (d *defaultClient) All(key string, values any) Session {
+	return d.NewSession().All(key, values)
+}
+
+// Size creates a new session matching arrays with exactly n elements.
+func (d *defaultClient) Size(key string, n int) Session {
+	return d.NewSession().Size(key, n)
+}
+
+// Mod creates a new session with a $mod condition on key.
+func (d *defaultClient) Mod(key string, divisor, remainder int64) Session {
+	return d.NewSession().Mod(key, divisor, remainder)
+}
+
+// BitsAllSet creates a new session with a $bitsAllSet condition on key.
+func (d *defaultClient) BitsAllSet(key string, bits any) Session {
+	return d.NewSession().BitsAllSet(key, bits)
+}
+
+// BitsAnySet creates a new session with a $bitsAnySet condition on key.
+func (d *defaultClient) BitsAnySet(key string, bits any) Session {
+	return d.NewSession().BitsAnySet(key, bits)
+}
+
+// BitsAllClear creates a new session with a $bitsAllClear condition on key.
+func (d *defaultClient) BitsAllClear(key string, bits any) Session {
+	return d.NewSession().BitsAllClear(key, bits)
+}
+
+// BitsAnyClear creates a new session with a $bitsAnyClear condition on key.
+func (d *defaultClient) BitsAnyClear(key string, bits any) Session {
+	return d.NewSession().BitsAnyClear(key, bits)
+}
+
+// JSONSchema creates a new session with a $jsonSchema condition.
+func (d *defaultClient) JSONSchema(schema any) Session {
+	return d.NewSession().JSONSchema(schema)
+}
+
+// Comment creates a new session with a $comment.
+func (d *defaultClient) Comment(comment string) Session {
+	return d.NewSession().Comment(comment)
+}
+
+// Type executes a $type command with the given key and value and returns a Session.
+// This method is used to filter the results of a find command based on the BSON type of a field in the documents.
 func (d *defaultClient) Type(key string, t any) Session {
-	return d.NewSession().Gt(key, t)
+	return d.NewSession().Type(key, t)
 }
 
 // Expr creates and returns a new session with the given filter expression.
 // The session can be used to execute operations using the given filter condition.
-// The filter parameter specifies the condition to be used for the session.
+// The expression parameter is a Condition or a value built with package expr.
 // Returns a Session object that allows executing operations using the provided filter.
-func (d *defaultClient) Expr(filter Condition) Session {
-	return d.NewSession().Expr(filter)
+func (d *defaultClient) Expr(expression any) Session {
+	return d.NewSession().Expr(expression)
+}
+
+// Regex constructs a regular expression using the specified key, pattern and
+// options and returns a Session with the regular expression applied.
+func (d *defaultClient) Regex(key string, pattern string, opts string) Session {
+	return d.NewSession().Regex(key, pattern, opts)
 }
 
-// Regex constructs a regular expression using the specified key and value
-// and returns a Session with the regular expression applied.
-func (d *defaultClient) Regex(key string, value string) Session {
-	return d.NewSession().Regex(key, value)
+// StartsWith returns a Session matching strings that begin with prefix.
+func (d *defaultClient) StartsWith(key string, prefix string) Session {
+	return d.NewSession().StartsWith(key, prefix)
+}
+
+// EndsWith returns a Session matching strings that end with suffix.
+func (d *defaultClient) EndsWith(key string, suffix string) Session {
+	return d.NewSession().EndsWith(key, suffix)
+}
+
+// Contains returns a Session matching strings that contain substr.
+func (d *defaultClient) Contains(key string, substr string) Session {
+	return d.NewSession().Contains(key, substr)
+}
+
+// EqualFold returns a Session matching strings equal to s ignoring case.
+func (d *defaultClient) EqualFold(key string, s string) Session {
+	return d.NewSession().EqualFold(key, s)
+}
+
+// Text creates a new session searching the collection's text index; see Condition.Text.
+func (d *defaultClient) Text(search, language string, caseSensitive, diacriticSensitive bool) Session {
+	return d.NewSession().Text(search, language, caseSensitive, diacriticSensitive)
+}
+
+// Near creates a new session matching documents near point; see Condition.Near.
+func (d *defaultClient) Near(key string, point geo.Point, maxDistance, minDistance float64) Session {
+	return d.NewSession().Near(key, point, maxDistance, minDistance)
+}
+
+// NearSphere creates a new session matching documents near point with $nearSphere.
+func (d *defaultClient) NearSphere(key string, point geo.Point, maxDistance, minDistance float64) Session {
+	return d.NewSession().NearSphere(key, point, maxDistance, minDistance)
+}
+
+// GeoWithin creates a new session matching documents lying within shape.
+func (d *defaultClient) GeoWithin(key string, shape geo.Shape) Session {
+	return d.NewSession().GeoWithin(key, shape)
+}
+
+// GeoIntersects creates a new session matching documents intersecting geometry.
+func (d *defaultClient) GeoIntersects(key string, geometry geo.Geometry) Session {
+	return d.NewSession().GeoIntersects(key, geometry)
 }
 
 // DataBase returns a reference to the MongoDB database that is being used by the default client.
@@ -588,12 +746,16 @@ func (d *defaultClient) DataBase() *mongo.Database {
 // Collection returns a new Collection with the specified name and options.
 // If a database name is provided, it will use that database; otherwise, it will use the default database of the defaultClient.
 // The collOpts parameter is optional and allows for specifying additional collection options.
+// The registry of the client's Codecs applies, once it is needed, unless collOpts set another one; see Codecs.
 // It returns a *mongo.Collection.
 func (d *defaultClient) Collection(name string, collOpts []*options.CollectionOptions, db ...string) *mongo.Collection {
 	var database = d.db
 	if len(db) > 0 && len(db[0]) > 0 {
 		database = db[0]
 	}
+	if r := d.codecs.Registry(); r != nil && options.MergeClientOptions(d.clientOpts...).Registry == nil {
+		collOpts = append([]*options.CollectionOptions{options.Collection().SetRegistry(r)}, collOpts...)
+	}
 
 	return d.client.Database(database).Collection(name, collOpts...)
 }
@@ -688,7 +850,7 @@ func (d *defaultClient) In(key string, value any) Session {
 // And appends an additional filter to the existing filter list in the session
 // and returns the updated session.
 //
-// filter is the Condition to be added to the existing filter list in the session.
+// Each Condition in filter becomes one operand of the $and added to the session.
 //
 // Example:
 // addFilter := Eq("name", "John")
@@ -703,8 +865,8 @@ func (d *defaultClient) In(key string, value any) Session {
 //
 // Returns:
 // The updated session with the additional filter applied.
-func (d *defaultClient) And(filter Condition) Session {
-	return d.NewSession().And(filter)
+func (d *defaultClient) And(filter ...Condition) Session {
+	return d.NewSession().And(filter...)
 }
 
 // Not excludes documents from a find command that have the specified key-value pair.
@@ -716,19 +878,20 @@ func (d *defaultClient) Not(key string, value any) Session {
 
 // Or adds an additional filter condition to the current session using the OR logical operator.
 // It returns a new session with the added filter condition.
-func (d *defaultClient) Or(filter Condition) Session {
-	return d.NewSession().Or(filter)
+func (d *defaultClient) Or(filter ...Condition) Session {
+	return d.NewSession().Or(filter...)
 }
 
 // InsertOne inserts a single document into the collectionByName.
-// It returns the generated ObjectID for the inserted document and an error, if any.
+// It returns the id of the inserted document, as its model types it, and an error, if any.
 // The document to be inserted is passed as the "v" parameter.
 // An optional context can be provided using the "ctx" parameter.
 // Example usage:
 //
 //	doc := bson.M{"name": "John Doe", "age": 30}
-//	objID, err := client.InsertOne(doc)
-func (d *defaultClient) InsertOne(v any, ctx ...context.Context) (primitive.ObjectID, error) {
+//	id, err := client.InsertOne(doc)
+//	objID := id.(primitive.ObjectID)
+func (d *defaultClient) InsertOne(v any, ctx ...context.Context) (any, error) {
 	return d.NewSession().InsertOne(v, ctx...)
 }
 
@@ -766,7 +929,7 @@ func (d *defaultClient) Limit(limit int64) Session {
 
 // Skip returns a new session with the number of documents to skip set to the provided value.
 // The skip parameter determines the number of documents to skip before starting to return documents.
-// It creates a new session using NewSession() method, and then sets the limit on the session using Limit() method with the skip value.
+// It creates a new session using NewSession() method, and then sets the skip on the session using Skip() method with the skip value.
 // The session is returned as a Session interface.
 // Example usage:
 //
@@ -775,7 +938,7 @@ func (d *defaultClient) Limit(limit int64) Session {
 //
 // Note: The Skip method is specific to the defaultClient type and can only be called on instances of that type.
 func (d *defaultClient) Skip(skip int64) Session {
-	return d.NewSession().Limit(skip)
+	return d.NewSession().Skip(skip)
 }
 
 // Count executes a count command and returns the number of documents that match the provided filter in the collection.
@@ -879,6 +1042,21 @@ func (d *defaultClient) AddIndex(keys any, opt ...*options.IndexOptions) Indexes
 	return d.NewIndexes().AddIndex(keys, opt...)
 }
 
+// AddTextIndex adds a text index on the fields of weights; see Indexes.AddTextIndex.
+func (d *defaultClient) AddTextIndex(weights map[string]int32, opt ...*options.IndexOptions) Indexes {
+	return d.NewIndexes().AddTextIndex(weights, opt...)
+}
+
+// AddIndex2dsphere adds a 2dsphere index on key, for GeoJSON geometries.
+func (d *defaultClient) AddIndex2dsphere(key string, opt ...*options.IndexOptions) Indexes {
+	return d.NewIndexes().AddIndex2dsphere(key, opt...)
+}
+
+// AddIndex2d adds a 2d index on key, for legacy coordinate pairs; see Indexes.AddIndex2d.
+func (d *defaultClient) AddIndex2d(key string, opt ...*options.IndexOptions) Indexes {
+	return d.NewIndexes().AddIndex2d(key, opt...)
+}
+
 // NewIndexes returns a Indexes implementation.
 // It creates a new instance of the index struct with the provided Client.
 // The index struct is used to perform index-related operations on the collection.
@@ -903,6 +1081,79 @@ func (d *defaultClient) NewIndexes() Indexes {
 	return NewIndexes(d)
 }
 
+// SetCache installs cache as the read-through cache of the client.
+// FindOne calls selecting a single document by _id, by a field tagged `pie:"unique"`
+// or by its primary key are served from it, and writes through the client invalidate the entries they touch.
+// Passing nil disables caching.
+//
+// Example usage:
+//
+//	client.SetCache(pie.NewLRUCache(10000, time.Minute))
+//	err := client.ID(id).FindOne(&user) // reads through the cache
+func (d *defaultClient) SetCache(cache Cache) {
+	d.cache = cache
+}
+
+// Cache returns the cache installed with SetCache, or nil.
+func (d *defaultClient) Cache() Cache {
+	return d.cache
+}
+
+// Codecs returns the codecs added to the client's collections.
+func (d *defaultClient) Codecs() *Codecs {
+	return d.codecs
+}
+
+// RegisterCodec sets the encoder and decoder of values of type t, see Codecs.Register.
+//
+// Example usage:
+//
+//	client.RegisterCodec(reflect.TypeOf(Money{}), moneyCodec, moneyCodec)
+func (d *defaultClient) RegisterCodec(t reflect.Type, enc bsoncodec.ValueEncoder, dec bsoncodec.ValueDecoder) {
+	d.codecs.Register(t, enc, dec)
+}
+
+// IDGenerators returns the id generators of the client's inserts.
+func (d *defaultClient) IDGenerators() *IDGenerators {
+	return d.ids
+}
+
+// RegisterIDGenerator names gen for use in `pie:"id:<name>"` field tags, see IDGenerators.Register.
+//
+// Example usage:
+//
+//	node, err := pie.NewSnowflake(7)
+//	client.RegisterIDGenerator("snowflake", node)
+func (d *defaultClient) RegisterIDGenerator(name string, gen IDGenerator) {
+	d.ids.Register(name, gen)
+}
+
+// Fixtures returns the models the client's fixture files are loaded into.
+func (d *defaultClient) Fixtures() *Fixtures {
+	return d.fixtures
+}
+
+// RegisterFixtureModels adds the models fixture files are loaded into, see Fixtures.Register.
+func (d *defaultClient) RegisterFixtureModels(models ...any) {
+	d.fixtures.Register(models...)
+}
+
+// LoadFixtures inserts the documents of the fixture files in fsys matching
+// patterns into the client's database, decoded into the registered models,
+// and returns the generated symbolic IDs. See Fixtures.Load for the format.
+//
+// Example usage:
+//
+//	//go:embed testdata/fixtures
+//	var fixtures embed.FS
+//
+//	client.RegisterFixtureModels(User{}, Post{})
+//	ids, err := client.LoadFixtures(ctx, fixtures, "testdata/fixtures/*.yaml")
+//	err = client.ID(ids["alice"]).FindOne(&user)
+func (d *defaultClient) LoadFixtures(ctx context.Context, fsys fs.FS, patterns ...string) (FixtureIDs, error) {
+	return d.fixtures.Load(ctx, d, fsys, patterns...)
+}
+
 // NewSession creates a new session using the provided defaultClient instance.
 // It calls the NewSession function passing the defaultClient instance as the parameter.
 // It returns a Session instance which represents the new session.
@@ -963,15 +1214,33 @@ func (d *defaultClient) CollectionNameForStruct(doc any) (*schemas.Collection, e
 		return nil, errors.New("a pointer to a pointer is not allowed")
 	}
 
+	if beanValue.Elem().Kind() == reflect.Interface {
+		return d.prepare(d.codecs.CollectionOf(d.parser, beanValue.Elem().Type()))
+	}
 	if beanValue.Elem().Kind() != reflect.Struct {
 		return nil, errors.New("needs a struct pointer")
 	}
-	t, err := d.parser.Parse(beanValue)
+	return d.prepare(d.parser.Parse(beanValue))
+}
+
+// errCodecsIgnored is returned for models needing the client's codecs when
+// the client options set a registry, which would take precedence over them.
+var errCodecsIgnored = errors.New("the client options set a registry, which ignores the codecs registered with pie; " +
+	"register the codecs on that registry and leave pie's unused")
+
+// prepare readies the client's codecs for the model of coll, see
+// Codecs.Prepare, and refuses it if they are needed but overridden.
+func (d *defaultClient) prepare(coll *schemas.Collection, err error) (*schemas.Collection, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	return t, nil
+	if err := d.codecs.Prepare(coll.Type); err != nil {
+		return nil, err
+	}
+	if d.codecs.Registry() != nil && options.MergeClientOptions(d.clientOpts...).Registry != nil {
+		return nil, errCodecsIgnored
+	}
+	return coll, nil
 }
 
 //func (d *defaultClient) NewSession() Session {
@@ -995,7 +1264,7 @@ func (d *defaultClient) CollectionNameForSlice(doc any) (*schemas.Collection, er
 	}
 
 	if savedValue.Kind() == reflect.Slice {
-		return d.parseCollectionFromSlice(savedValue)
+		return d.prepare(d.parseCollectionFromSlice(savedValue))
 	}
 	return d.parseCollectionFromMap(savedValue)
 }
@@ -1029,6 +1298,9 @@ func (d *defaultClient) parseCollectionFromSlice(sliceValue reflect.Value) (*sch
 		pv := reflect.New(sliceElementType)
 		return d.parser.Parse(pv)
 	}
+	if sliceElementType.Kind() == reflect.Interface {
+		return d.codecs.CollectionOf(d.parser, sliceElementType)
+	}
 	return nil, ErrUnsupportedType
 }
 
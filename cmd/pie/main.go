@@ -0,0 +1,33 @@
+// Command pie runs maintenance tasks against a MongoDB database.
+//
+// Usage:
+//
+//	pie [-uri URI] [-db NAME] migrate up|down|status [-to VERSION]
+//
+// The connection defaults to the PIE_URI and PIE_DB environment variables.
+//
+// Migrations are Go code, and this build of pie links none, so it can only
+// report the status of a database: migrate up refuses to run. Build your
+// own copy around migrate.Main that imports your migrations package for its
+// side effects:
+//
+//	package main
+//
+//	import (
+//		"github.com/5xxxx/pie/migrate"
+//
+//		_ "example.com/app/migrations"
+//	)
+//
+//	func main() {
+//		migrate.Main()
+//	}
+//
+// or call migrate.Command from your own program.
+package main
+
+import "github.com/5xxxx/pie/migrate"
+
+func main() {
+	migrate.Main()
+}
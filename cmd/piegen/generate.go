@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/types"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const piePath = "github.com/5xxxx/pie"
+
+// generator renders the field references of the models of one package.
+type generator struct {
+	pkg     *types.Package
+	imports map[string]string // import path -> name used in the output
+	names   map[string]bool   // names taken by imports
+	decls   bytes.Buffer
+}
+
+func newGenerator(pkg *types.Package) *generator {
+	g := &generator{pkg: pkg, imports: map[string]string{}, names: map[string]bool{}}
+	g.importName(piePath, "pie")
+	return g
+}
+
+// importName records an import of path and returns the name it is referred to by.
+func (g *generator) importName(path, name string) string {
+	if n, ok := g.imports[path]; ok {
+		return n
+	}
+	n := name
+	for i := 2; g.names[n] || (g.pkg.Scope().Lookup(n) != nil); i++ {
+		n = name + strconv.Itoa(i)
+	}
+	g.imports[path] = n
+	g.names[n] = true
+	return n
+}
+
+func (g *generator) qualifier(p *types.Package) string {
+	if p == g.pkg {
+		return ""
+	}
+	return g.importName(p.Path(), p.Name())
+}
+
+// typeString returns the Go spelling of t in the generated file, or "any" when
+// t cannot be named there.
+func (g *generator) typeString(t types.Type) string {
+	if !accessible(t, g.pkg) {
+		return "any"
+	}
+	return types.TypeString(t, g.qualifier)
+}
+
+// accessible reports whether every named type in t can be referred to from pkg.
+func accessible(t types.Type, pkg *types.Package) bool {
+	switch t := t.(type) {
+	case *types.Named:
+		obj := t.Obj()
+		if obj.Pkg() != nil && obj.Pkg() != pkg && !obj.Exported() {
+			return false
+		}
+		args := t.TypeArgs()
+		for i := 0; i < args.Len(); i++ {
+			if !accessible(args.At(i), pkg) {
+				return false
+			}
+		}
+		return true
+	case *types.Pointer:
+		return accessible(t.Elem(), pkg)
+	case *types.Slice:
+		return accessible(t.Elem(), pkg)
+	case *types.Array:
+		return accessible(t.Elem(), pkg)
+	case *types.Map:
+		return accessible(t.Key(), pkg) && accessible(t.Elem(), pkg)
+	case *types.Struct:
+		for i := 0; i < t.NumFields(); i++ {
+			if !t.Field(i).Exported() || !accessible(t.Field(i).Type(), pkg) {
+				return false
+			}
+		}
+		return true
+	case *types.Basic:
+		return true
+	}
+	return false
+}
+
+// models returns the exported, non-generic struct types of pkg that have at
+// least one bson tag, restricted to only when it is not empty.
+func models(pkg *types.Package, only map[string]bool) []*types.TypeName {
+	var out []*types.TypeName
+	scope := pkg.Scope()
+	for _, name := range scope.Names() {
+		obj, ok := scope.Lookup(name).(*types.TypeName)
+		if !ok || !obj.Exported() || obj.IsAlias() {
+			continue
+		}
+		if len(only) > 0 && !only[name] {
+			continue
+		}
+		named, ok := obj.Type().(*types.Named)
+		if !ok || named.TypeParams().Len() > 0 {
+			continue
+		}
+		if st, ok := named.Underlying().(*types.Struct); ok && hasBsonTags(st) {
+			out = append(out, obj)
+		}
+	}
+	return out
+}
+
+func hasBsonTags(st *types.Struct) bool {
+	for i := 0; i < st.NumFields(); i++ {
+		if _, ok := reflect.StructTag(st.Tag(i)).Lookup("bson"); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// bsonField is a field of a model struct under its bson name.
+type bsonField struct {
+	goName string
+	name   string
+	typ    types.Type
+}
+
+// bsonFields lists the fields of st the way the default struct codec sees them:
+// untagged fields use the lowercased Go name, fields named "-" and unexported
+// fields are skipped and ",inline" structs are flattened.
+func bsonFields(st *types.Struct) []bsonField {
+	var fields []bsonField
+	for i := 0; i < st.NumFields(); i++ {
+		f := st.Field(i)
+		if !f.Exported() {
+			continue
+		}
+		parts := strings.Split(reflect.StructTag(st.Tag(i)).Get("bson"), ",")
+		if parts[0] == "-" {
+			continue
+		}
+		inline := false
+		for _, opt := range parts[1:] {
+			inline = inline || opt == "inline"
+		}
+		if inline {
+			if inner, ok := deref(f.Type()).Underlying().(*types.Struct); ok {
+				fields = append(fields, bsonFields(inner)...)
+			}
+			continue
+		}
+		name := parts[0]
+		if name == "" {
+			name = strings.ToLower(f.Name())
+		}
+		fields = append(fields, bsonField{goName: f.Name(), name: name, typ: f.Type()})
+	}
+	return fields
+}
+
+func deref(t types.Type) types.Type {
+	for {
+		p, ok := t.(*types.Pointer)
+		if !ok {
+			return t
+		}
+		t = p.Elem()
+	}
+}
+
+// arrayElem returns the element type of slice and array types stored as BSON arrays.
+func arrayElem(t types.Type) (types.Type, bool) {
+	var elem types.Type
+	switch u := t.Underlying().(type) {
+	case *types.Slice:
+		elem = u.Elem()
+	case *types.Array:
+		elem = u.Elem()
+	default:
+		return nil, false
+	}
+	if b, ok := elem.Underlying().(*types.Basic); ok && b.Kind() == types.Byte {
+		return nil, false
+	}
+	return elem, true
+}
+
+// document returns the struct type of t when values of t are stored as
+// embedded documents whose fields are worth referencing.
+func document(t types.Type) (*types.Struct, bool) {
+	t = deref(t)
+	if named, ok := t.(*types.Named); ok {
+		obj := named.Obj()
+		if obj.Pkg() != nil && obj.Pkg().Path() == "time" && obj.Name() == "Time" {
+			return nil, false
+		}
+		if obj.Pkg() != nil && obj.Pkg().Path() == "go.mongodb.org/mongo-driver/bson/primitive" {
+			return nil, false
+		}
+	}
+	st, ok := t.Underlying().(*types.Struct)
+	if !ok || len(bsonFields(st)) == 0 {
+		return nil, false
+	}
+	return st, true
+}
+
+// group is the field set of a model or of an embedded document.
+type group struct {
+	typeName string
+	self     string // embedded pie field type of the document itself, if any
+	selfInit string
+	fields   []member
+}
+
+type member struct {
+	name string
+	typ  string
+	init string
+}
+
+// model renders the field set of model m and the variable holding it.
+func (g *generator) model(m *types.TypeName) {
+	st := m.Type().Underlying().(*types.Struct)
+	typeName := lowerFirst(m.Name()) + "Fields"
+	init := g.group(typeName, "", "", "", st, map[types.Type]bool{m.Type(): true})
+	fmt.Fprintf(&g.decls, "// %sFields references the bson fields of %s.\n", m.Name(), m.Name())
+	fmt.Fprintf(&g.decls, "var %sFields = %s\n\n", m.Name(), init)
+}
+
+// group declares the field set type for the fields of st under prefix and returns its initializer.
+func (g *generator) group(typeName, prefix, self, selfInit string, st *types.Struct, seen map[types.Type]bool) string {
+	grp := group{typeName: typeName, self: self, selfInit: selfInit}
+	for _, f := range bsonFields(st) {
+		path := prefix + f.name
+		typ, init := g.fieldRef(f.typ, path)
+		elem, isArray := arrayElem(deref(f.typ))
+		docType := deref(f.typ)
+		if isArray {
+			docType = deref(elem)
+		}
+		if doc, ok := document(docType); ok && !seen[docType] && !shadowsEmbedded(doc) {
+			seen[docType] = true
+			sub := typeName[:len(typeName)-len("Fields")] + f.goName + "Fields"
+			init = g.group(sub, path+".", typ, init, doc, seen)
+			typ = sub
+			delete(seen, docType)
+		}
+		grp.fields = append(grp.fields, member{name: f.goName, typ: typ, init: init})
+	}
+	g.declare(grp)
+
+	var b strings.Builder
+	b.WriteString(typeName + "{\n")
+	if self != "" {
+		fmt.Fprintf(&b, "%s: %s,\n", embeddedName(self), selfInit)
+	}
+	for _, m := range grp.fields {
+		fmt.Fprintf(&b, "%s: %s,\n", m.name, m.init)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func (g *generator) declare(grp group) {
+	fmt.Fprintf(&g.decls, "type %s struct {\n", grp.typeName)
+	if grp.self != "" {
+		fmt.Fprintf(&g.decls, "%s\n", grp.self)
+	}
+	for _, m := range grp.fields {
+		fmt.Fprintf(&g.decls, "%s %s\n", m.name, m.typ)
+	}
+	g.decls.WriteString("}\n\n")
+}
+
+// fieldRef returns the pie field type referencing a field of type t at path, and its initializer.
+func (g *generator) fieldRef(t types.Type, path string) (string, string) {
+	t = deref(t)
+	if elem, ok := arrayElem(t); ok {
+		typ := fmt.Sprintf("pie.ArrayField[%s]", g.typeString(deref(elem)))
+		return typ, fmt.Sprintf("pie.NewArrayField[%s](%q)", g.typeString(deref(elem)), path)
+	}
+	typ := fmt.Sprintf("pie.Field[%s]", g.typeString(t))
+	return typ, fmt.Sprintf("pie.NewField[%s](%q)", g.typeString(t), path)
+}
+
+// embeddedName returns the field name of an embedded pie.Field or pie.ArrayField type.
+func embeddedName(typ string) string {
+	name := strings.TrimPrefix(typ, "pie.")
+	return name[:strings.IndexByte(name, '[')]
+}
+
+// shadowsEmbedded reports whether a field of st would collide with the
+// embedded pie.Field or pie.ArrayField of its field set.
+func shadowsEmbedded(st *types.Struct) bool {
+	for _, f := range bsonFields(st) {
+		if f.goName == "Field" || f.goName == "ArrayField" {
+			return true
+		}
+	}
+	return false
+}
+
+func lowerFirst(s string) string {
+	r := []rune(s)
+	r[0] = unicode.ToLower(r[0])
+	return string(r)
+}
+
+func isStd(path string) bool {
+	return !strings.Contains(strings.SplitN(path, "/", 2)[0], ".")
+}
+
+// source returns the formatted generated file.
+func (g *generator) source() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString("// Code generated by piegen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package %s\n\n", g.pkg.Name())
+
+	paths := make([]string, 0, len(g.imports))
+	for path := range g.imports {
+		paths = append(paths, path)
+	}
+	// Standard library imports go first, in their own group.
+	sort.Slice(paths, func(i, j int) bool {
+		if si, sj := isStd(paths[i]), isStd(paths[j]); si != sj {
+			return si
+		}
+		return paths[i] < paths[j]
+	})
+	b.WriteString("import (\n")
+	for i, path := range paths {
+		if i > 0 && isStd(path) != isStd(paths[i-1]) {
+			b.WriteString("\n")
+		}
+		name := g.imports[path]
+		if name == path[strings.LastIndexByte(path, '/')+1:] {
+			fmt.Fprintf(&b, "%q\n", path)
+		} else {
+			fmt.Fprintf(&b, "%s %q\n", name, path)
+		}
+	}
+	b.WriteString(")\n\n")
+	b.Write(g.decls.Bytes())
+	return format.Source(b.Bytes())
+}
+
+// generate returns the field references of the models of pkg, or nil when it has none.
+func generate(pkg *types.Package, only map[string]bool) ([]byte, error) {
+	ms := models(pkg, only)
+	if len(ms) == 0 {
+		return nil, nil
+	}
+	g := newGenerator(pkg)
+	for _, m := range ms {
+		g.model(m)
+	}
+	return g.source()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/tools/go/packages"
+)
+
+func TestGenerate(t *testing.T) {
+	Convey("Given the testdata models package", t, func() {
+		pkgs, err := load([]string{"./testdata/models"}, "pie_fields.go")
+		So(err, ShouldBeNil)
+		So(pkgs, ShouldHaveLength, 1)
+
+		Convey("The generated file matches the checked-in one", func() {
+			src, err := generate(pkgs[0].Types, nil)
+			So(err, ShouldBeNil)
+			want, err := os.ReadFile(filepath.Join("testdata", "models", "pie_fields.go"))
+			So(err, ShouldBeNil)
+			So(string(src), ShouldEqual, string(want))
+		})
+
+		Convey("The checked-in file compiles against the models", func() {
+			checked, err := packages.Load(&packages.Config{Mode: loadMode}, "./testdata/models")
+			So(err, ShouldBeNil)
+			So(checked[0].Errors, ShouldBeEmpty)
+			So(checked[0].Types.Scope().Lookup("UserFields"), ShouldNotBeNil)
+		})
+
+		Convey("-type restricts the models", func() {
+			src, err := generate(pkgs[0].Types, map[string]bool{"Order": true})
+			So(err, ShouldBeNil)
+			So(string(src), ShouldContainSubstring, "var OrderFields")
+			So(string(src), ShouldNotContainSubstring, "UserFields")
+
+			src, err = generate(pkgs[0].Types, map[string]bool{"Untagged": true})
+			So(err, ShouldBeNil)
+			So(src, ShouldBeNil)
+		})
+	})
+}
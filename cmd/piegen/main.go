@@ -0,0 +1,125 @@
+// Command piegen generates typed field references for pie models.
+//
+// For every exported struct with bson tags in the given packages it writes a
+// variable named after the model, holding a pie.Field for each bson field:
+//
+//	//go:generate go run github.com/5xxxx/pie/cmd/piegen
+//
+//	filters, err := UserFields.Age.Gte(18).Filters()
+//	err = client.FilterBson(filters).Sort(UserFields.Name.Asc()).FindAll(&users)
+//
+// Embedded documents get nested field sets, so UserFields.Address.City refers to
+// "address.city". Renaming a bson tag changes the generated names and breaks the
+// code using them at compile time.
+//
+// Usage:
+//
+//	piegen [-output pie_fields.go] [-type User,Order] [packages]
+//
+// Packages default to the one in the current directory.
+//
+// piegen is a module of its own, so that programs using pie do not depend on
+// its requirements; add it to the module running it with
+//
+//	go get github.com/5xxxx/pie/cmd/piegen
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func main() {
+	output := flag.String("output", "pie_fields.go", "name of the generated file in each package directory")
+	typeNames := flag.String("type", "", "comma-separated model names; all models when empty")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: piegen [flags] [packages]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	patterns := flag.Args()
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+	only := map[string]bool{}
+	for _, name := range strings.Split(*typeNames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			only[name] = true
+		}
+	}
+	if err := run(patterns, *output, only); err != nil {
+		fmt.Fprintf(os.Stderr, "piegen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(patterns []string, output string, only map[string]bool) error {
+	pkgs, err := load(patterns, output)
+	if err != nil {
+		return err
+	}
+	for _, pkg := range pkgs {
+		src, err := generate(pkg.Types, only)
+		if err != nil {
+			return fmt.Errorf("%s: %w", pkg.PkgPath, err)
+		}
+		if src == nil {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(pkgDir(pkg), output), src, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadMode type-checks dependencies from source too, which does not depend on
+// the export data format of the installed toolchain.
+const loadMode = packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps |
+	packages.NeedTypes | packages.NeedSyntax | packages.NeedTypesInfo
+
+// load type-checks the packages matching patterns. A previously generated
+// output file is replaced by an empty one, so that stale references to
+// renamed or removed fields do not stop the package from loading.
+func load(patterns []string, output string) ([]*packages.Package, error) {
+	pkgs, err := packages.Load(&packages.Config{Mode: packages.NeedName | packages.NeedFiles}, patterns...)
+	if err != nil {
+		return nil, err
+	}
+	overlay := map[string][]byte{}
+	for _, pkg := range pkgs {
+		if dir := pkgDir(pkg); dir != "" {
+			overlay[filepath.Join(dir, output)] = []byte("package " + pkg.Name + "\n")
+		}
+	}
+
+	cfg := &packages.Config{Mode: loadMode, Overlay: overlay}
+	pkgs, err = packages.Load(cfg, patterns...)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		for _, e := range pkg.Errors {
+			errs = append(errs, e)
+		}
+	})
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return pkgs, nil
+}
+
+func pkgDir(pkg *packages.Package) string {
+	if len(pkg.GoFiles) == 0 {
+		return ""
+	}
+	return filepath.Dir(pkg.GoFiles[0])
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type Address struct {
+	City string `bson:"city"`
+	Zip  string `bson:"zip"`
+}
+
+type Base struct {
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+type User struct {
+	Base     `bson:",inline"`
+	ID       primitive.ObjectID `bson:"_id,omitempty"`
+	Name     string             `bson:"name"`
+	Age      int                `bson:"age"`
+	Nick     *string
+	Tags     []string `bson:"tags"`
+	Address  Address  `bson:"address"`
+	Friends  []*User  `bson:"friends"`
+	Orders   []Order  `bson:"orders"`
+	Secret   string   `bson:"-"`
+	internal string
+}
+
+type Order struct {
+	Total float64 `bson:"total"`
+}
+
+// Untagged has no bson tags and is not a model.
+type Untagged struct {
+	Name string
+}
@@ -0,0 +1,82 @@
+// Code generated by piegen. DO NOT EDIT.
+
+package models
+
+import (
+	"time"
+
+	"github.com/5xxxx/pie"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type addressFields struct {
+	City pie.Field[string]
+	Zip  pie.Field[string]
+}
+
+// AddressFields references the bson fields of Address.
+var AddressFields = addressFields{
+	City: pie.NewField[string]("city"),
+	Zip:  pie.NewField[string]("zip"),
+}
+
+type baseFields struct {
+	CreatedAt pie.Field[time.Time]
+}
+
+// BaseFields references the bson fields of Base.
+var BaseFields = baseFields{
+	CreatedAt: pie.NewField[time.Time]("created_at"),
+}
+
+type orderFields struct {
+	Total pie.Field[float64]
+}
+
+// OrderFields references the bson fields of Order.
+var OrderFields = orderFields{
+	Total: pie.NewField[float64]("total"),
+}
+
+type userAddressFields struct {
+	pie.Field[Address]
+	City pie.Field[string]
+	Zip  pie.Field[string]
+}
+
+type userOrdersFields struct {
+	pie.ArrayField[Order]
+	Total pie.Field[float64]
+}
+
+type userFields struct {
+	CreatedAt pie.Field[time.Time]
+	ID        pie.Field[primitive.ObjectID]
+	Name      pie.Field[string]
+	Age       pie.Field[int]
+	Nick      pie.Field[string]
+	Tags      pie.ArrayField[string]
+	Address   userAddressFields
+	Friends   pie.ArrayField[User]
+	Orders    userOrdersFields
+}
+
+// UserFields references the bson fields of User.
+var UserFields = userFields{
+	CreatedAt: pie.NewField[time.Time]("created_at"),
+	ID:        pie.NewField[primitive.ObjectID]("_id"),
+	Name:      pie.NewField[string]("name"),
+	Age:       pie.NewField[int]("age"),
+	Nick:      pie.NewField[string]("nick"),
+	Tags:      pie.NewArrayField[string]("tags"),
+	Address: userAddressFields{
+		Field: pie.NewField[Address]("address"),
+		City:  pie.NewField[string]("address.city"),
+		Zip:   pie.NewField[string]("address.zip"),
+	},
+	Friends: pie.NewArrayField[User]("friends"),
+	Orders: userOrdersFields{
+		ArrayField: pie.NewArrayField[Order]("orders"),
+		Total:      pie.NewField[float64]("orders.total"),
+	},
+}
@@ -0,0 +1,369 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/5xxxx/pie/internal/bsonstruct"
+	"github.com/5xxxx/pie/schemas"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// Codecs holds the codecs a client adds to the driver's defaults: codecs of
+// types, named codecs selected by `pie:"codec:<name>"` field tags, and
+// variants of interface types. Once one is registered, or a model using a
+// field codec is prepared, they are assembled into the registry every
+// collection of the client is opened with; until then collections keep the
+// driver's registry. A registry set with SetCollRegistry takes precedence,
+// and a client whose options set a registry refuses models needing codecs.
+//
+// Register codecs before using the client: collections opened earlier keep
+// the registry they were opened with.
+type Codecs struct {
+	mu       sync.Mutex
+	types    map[reflect.Type]typeCodec
+	fields   map[string]bsoncodec.ValueCodec
+	families map[reflect.Type]*family
+	variants map[reflect.Type]*variant
+	registry *bsoncodec.Registry
+	// used reports whether the registry is needed.
+	used bool
+	// prepared holds the result of Prepare by model type.
+	prepared map[reflect.Type]error
+}
+
+// typeCodec is the encoder and decoder registered for a type; either may be nil.
+type typeCodec struct {
+	enc bsoncodec.ValueEncoder
+	dec bsoncodec.ValueDecoder
+}
+
+// family is the set of variants of an interface type, told apart by the
+// string value of field.
+type family struct {
+	iface reflect.Type
+	field string
+	types map[string]reflect.Type
+}
+
+// variant is a struct type stored with field set to value.
+type variant struct {
+	field   string
+	value   string
+	structs *structCodec
+}
+
+// NewCodecs returns a set of codecs holding the built-in field codecs.
+func NewCodecs() *Codecs {
+	return &Codecs{
+		types:    make(map[reflect.Type]typeCodec),
+		fields:   builtinFieldCodecs(),
+		families: make(map[reflect.Type]*family),
+		variants: make(map[reflect.Type]*variant),
+		prepared: make(map[reflect.Type]error),
+	}
+}
+
+// Register sets the encoder and decoder of values of type t, replacing the
+// driver's. A nil enc or dec keeps the default for that direction.
+//
+// Example usage:
+//
+//	client.Codecs().Register(reflect.TypeOf(Money{}), moneyCodec, moneyCodec)
+func (c *Codecs) Register(t reflect.Type, enc bsoncodec.ValueEncoder, dec bsoncodec.ValueDecoder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tc := c.types[t]
+	if enc != nil {
+		tc.enc = enc
+	}
+	if dec != nil {
+		tc.dec = dec
+	}
+	c.types[t] = tc
+	c.used = true
+	c.registry = nil
+}
+
+// RegisterField names codec for use in `pie:"codec:<name>"` field tags,
+// replacing a codec of the same name. The codec is given the field value,
+// or the value a non-nil pointer field points to.
+func (c *Codecs) RegisterField(name string, codec bsoncodec.ValueCodec) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fields[name] = codec
+	c.prepared = make(map[reflect.Type]error)
+	c.used = true
+	c.registry = nil
+}
+
+// RegisterVariant registers variant, a struct or struct pointer, as the
+// concrete type of interface I stored with the string field set to value.
+// Documents decoded into a value of type I, a field, a slice element or a
+// result, are decoded into the variant their field names; variants are
+// encoded with the field first, replacing any value it holds.
+//
+// The variants of I share one field, and a type stores one value. FindOne,
+// FindAll and Aggregate on I use the collection of its variants, which must
+// then agree on it, unless SetCollection or Aggregate.Collection names another.
+//
+// Example usage:
+//
+//	type Event interface{ At() time.Time }
+//
+//	pie.RegisterVariant[Event](client, "kind", "click", ClickEvent{})
+//	pie.RegisterVariant[Event](client, "kind", "view", &ViewEvent{})
+//
+//	var events []Event // holds ClickEvent and *ViewEvent values
+//	err := client.Gte("at", since).FindAll(&events)
+func RegisterVariant[I any](c Client, field, value string, variant I) error {
+	return c.Codecs().registerVariant(reflect.TypeOf((*I)(nil)).Elem(), field, value, reflect.TypeOf(variant))
+}
+
+func (c *Codecs) registerVariant(iface reflect.Type, field, value string, t reflect.Type) error {
+	if iface.Kind() != reflect.Interface || iface.NumMethod() == 0 {
+		return fmt.Errorf("register variant: %s is not an interface with methods", iface)
+	}
+	if field == "" || value == "" {
+		return errors.New("register variant: the field and value cannot be empty")
+	}
+	if t == nil || t.Kind() == reflect.Ptr && t.Elem().Kind() != reflect.Struct || t.Kind() != reflect.Ptr && t.Kind() != reflect.Struct {
+		return fmt.Errorf("register variant of %s: %v is not a struct or struct pointer", iface, t)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.families[iface]
+	if f == nil {
+		f = &family{iface: iface, field: field, types: make(map[string]reflect.Type)}
+	}
+	if f.field != field {
+		return fmt.Errorf("register variant of %s: variants are told apart by %q, not %q", iface, f.field, field)
+	}
+	if existing, ok := f.types[value]; ok && existing != t {
+		return fmt.Errorf("register variant of %s: %q is already %s", iface, value, existing)
+	}
+	st := indirectType(t)
+	v := c.variants[st]
+	if v != nil && (v.field != field || v.value != value) {
+		return fmt.Errorf("register variant %s: already stored with %s %q", st, v.field, v.value)
+	}
+	if v == nil {
+		c.variants[st] = &variant{field: field, value: value}
+	}
+	f.types[value] = t
+	c.families[iface] = f
+	c.used = true
+	c.registry = nil
+	return nil
+}
+
+// Prepare readies the codecs for the models of type t, a struct type or a
+// pointer to one: a model with fields tagged `pie:"codec:<name>"`, directly
+// or in the structs it holds, needs the registry. It reports tags naming no
+// codec. Clients prepare the models they resolve collections for.
+func (c *Codecs) Prepare(t reflect.Type) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t = indirectType(t)
+	if err, ok := c.prepared[t]; ok {
+		return err
+	}
+	tagged, err := c.codecTags(t, make(map[reflect.Type]bool))
+	c.prepared[t] = err
+	if tagged && err == nil && !c.used {
+		c.used = true
+		c.registry = nil
+	}
+	return err
+}
+
+// codecTags reports whether values of t hold struct fields tagged with a codec.
+func (c *Codecs) codecTags(t reflect.Type, seen map[reflect.Type]bool) (bool, error) {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return c.codecTags(t.Elem(), seen)
+	case reflect.Struct:
+	default:
+		return false, nil
+	}
+	if seen[t] {
+		return false, nil
+	}
+	seen[t] = true
+	tagged := false
+	for _, f := range bsonstruct.Fields(t) {
+		if name, ok := bsonstruct.Tag(f.Field)["codec"]; ok {
+			if c.fields[name] == nil {
+				return false, fmt.Errorf("field %s of %s: unknown codec %q", f.Field.Name, t, name)
+			}
+			tagged = true
+			continue
+		}
+		inner, err := c.codecTags(f.Field.Type, seen)
+		if err != nil {
+			return false, err
+		}
+		tagged = tagged || inner
+	}
+	return tagged, nil
+}
+
+// Registry returns the driver's default registry extended with the
+// registered codecs, or nil while the driver's registry does: until a codec
+// or variant is registered or a prepared model uses a field codec. It is
+// built on first use and again after a registration.
+func (c *Codecs) Registry() *bsoncodec.Registry {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.used {
+		return nil
+	}
+	if c.registry != nil {
+		return c.registry
+	}
+	fields := make(map[string]bsoncodec.ValueCodec, len(c.fields))
+	for name, codec := range c.fields {
+		fields[name] = codec
+	}
+	structs, err := newStructCodec(fields)
+	if err != nil {
+		// The default struct tag parser cannot fail.
+		panic(err)
+	}
+	rb := bson.NewRegistryBuilder()
+	rb.RegisterDefaultEncoder(reflect.Struct, structs)
+	rb.RegisterDefaultDecoder(reflect.Struct, structs)
+	for t, tc := range c.types {
+		if tc.enc != nil {
+			rb.RegisterTypeEncoder(t, tc.enc)
+		}
+		if tc.dec != nil {
+			rb.RegisterTypeDecoder(t, tc.dec)
+		}
+	}
+	for t, v := range c.variants {
+		rb.RegisterTypeEncoder(t, &variant{field: v.field, value: v.value, structs: structs})
+	}
+	for t, f := range c.families {
+		types := make(map[string]reflect.Type, len(f.types))
+		for value, vt := range f.types {
+			types[value] = vt
+		}
+		rb.RegisterTypeDecoder(t, &family{iface: f.iface, field: f.field, types: types})
+	}
+	c.registry = rb.Build()
+	return c.registry
+}
+
+// CollectionOf returns the collection of interface type t: the collection
+// its registered variants, parsed with parser, are stored in.
+func (c *Codecs) CollectionOf(parser *Parser, t reflect.Type) (*schemas.Collection, error) {
+	var variants []reflect.Type
+	if c != nil {
+		c.mu.Lock()
+		if f := c.families[t]; f != nil {
+			for _, vt := range f.types {
+				variants = append(variants, indirectType(vt))
+			}
+		}
+		c.mu.Unlock()
+	}
+	if len(variants) == 0 {
+		return nil, fmt.Errorf("%s has no registered variants: %w", t, ErrUnsupportedType)
+	}
+	var coll *schemas.Collection
+	for _, vt := range variants {
+		vc, err := parser.Parse(reflect.New(vt))
+		if err != nil {
+			return nil, err
+		}
+		if coll != nil && coll.Name != vc.Name {
+			return nil, fmt.Errorf("the variants of %s are stored in %q and %q, name one with SetCollection", t, coll.Name, vc.Name)
+		}
+		coll = vc
+	}
+	return coll, nil
+}
+
+// EncodeValue encodes the struct val with the field of its variant first.
+func (v *variant) EncodeValue(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	encoded, err := v.structs.encode(ec, val)
+	if err != nil {
+		return err
+	}
+	elems, err := encoded.Elements()
+	if err != nil {
+		return err
+	}
+	idx, doc := bsoncore.AppendDocumentStart(nil)
+	doc = bsoncore.AppendStringElement(doc, v.field, v.value)
+	for _, e := range elems {
+		if e.Key() != v.field {
+			doc = append(doc, e...)
+		}
+	}
+	doc, err = bsoncore.AppendDocumentEnd(doc, idx)
+	if err != nil {
+		return err
+	}
+	return bsonrw.Copier{}.CopyDocumentFromBytes(vw, doc)
+}
+
+// DecodeValue decodes a document into the variant its field names.
+func (f *family) DecodeValue(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	switch vr.Type() {
+	case bsontype.Null:
+		val.Set(reflect.Zero(val.Type()))
+		return vr.ReadNull()
+	case bsontype.Undefined:
+		val.Set(reflect.Zero(val.Type()))
+		return vr.ReadUndefined()
+	case bsontype.EmbeddedDocument, bsontype.Type(0): // a top-level document has no type
+	default:
+		return fmt.Errorf("cannot decode %v into %s", vr.Type(), f.iface)
+	}
+	doc, err := bsonrw.Copier{}.CopyDocumentToBytes(vr)
+	if err != nil {
+		return err
+	}
+	raw, err := bsoncore.Document(doc).LookupErr(f.field)
+	if err != nil {
+		return fmt.Errorf("cannot decode into %s: the document has no %q field", f.iface, f.field)
+	}
+	value, ok := raw.StringValueOK()
+	if !ok {
+		return fmt.Errorf("cannot decode into %s: %q is a %v, not a string", f.iface, f.field, raw.Type)
+	}
+	t, ok := f.types[value]
+	if !ok {
+		return fmt.Errorf("cannot decode into %s: no variant is registered for %s %q", f.iface, f.field, value)
+	}
+
+	v := reflect.New(indirectType(t))
+	decoder, err := dc.LookupDecoder(v.Elem().Type())
+	if err != nil {
+		return err
+	}
+	if err := decoder.DecodeValue(dc, bsonrw.NewBSONDocumentReader(doc), v.Elem()); err != nil {
+		return err
+	}
+	if t.Kind() == reflect.Ptr {
+		val.Set(v)
+	} else {
+		val.Set(v.Elem())
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package pie
+
+import (
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/5xxxx/pie/names"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type shape interface {
+	Area() float64
+}
+
+type square struct {
+	Kind string  `bson:"kind"`
+	Side float64 `bson:"side"`
+}
+
+func (s square) Area() float64 { return s.Side * s.Side }
+
+type circle struct {
+	R float64 `bson:"r"`
+}
+
+func (c *circle) Area() float64 { return 3 * c.R * c.R }
+
+type drawing struct {
+	Shapes []shape `bson:"shapes"`
+	Main   shape   `bson:"main"`
+}
+
+type level int
+
+const (
+	levelLow level = iota
+	levelHigh
+)
+
+func (l level) MarshalText() ([]byte, error) {
+	return []byte([]string{"low", "high"}[l]), nil
+}
+
+func (l *level) UnmarshalText(b []byte) error {
+	switch string(b) {
+	case "low":
+		*l = levelLow
+	case "high":
+		*l = levelHigh
+	default:
+		return errors.New("unknown level")
+	}
+	return nil
+}
+
+type Audit struct {
+	Took time.Duration `bson:"took" pie:"codec:millis"`
+}
+
+type ticket struct {
+	Audit   `bson:",inline"`
+	ID      string        `bson:"_id" pie:"codec:uuid"`
+	Key     [16]byte      `bson:"key" pie:"codec:uuid"`
+	Level   level         `bson:"level" pie:"codec:string"`
+	Count   *big.Int      `bson:"count" pie:"codec:string"`
+	Missing *big.Int      `bson:"missing,omitempty" pie:"codec:string"`
+	Price   string        `bson:"price" pie:"codec:decimal"`
+	Ratio   float64       `bson:"ratio" pie:"codec:decimal"`
+	Plain   time.Duration `bson:"plain"`
+}
+
+type cents int64
+
+func TestCodecs(t *testing.T) {
+	Convey("Field codecs store tagged fields", t, func() {
+		codecs := NewCodecs()
+		So(codecs.Registry(), ShouldBeNil)
+		So(codecs.Prepare(reflect.TypeOf(&drawing{})), ShouldBeNil)
+		So(codecs.Registry(), ShouldBeNil)
+		So(codecs.Prepare(reflect.TypeOf(&[]ticket{})), ShouldBeNil)
+		reg := codecs.Registry()
+		So(reg, ShouldNotBeNil)
+		count, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+		in := ticket{
+			Audit: Audit{Took: 1500 * time.Millisecond},
+			ID:    "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+			Key:   [16]byte{1, 2, 3},
+			Level: levelHigh,
+			Count: count,
+			Price: "19.99",
+			Ratio: 0.25,
+			Plain: time.Second,
+		}
+		raw, err := bson.MarshalWithRegistry(reg, in)
+		So(err, ShouldBeNil)
+		doc := bson.Raw(raw)
+		So(doc.Lookup("took").Int64(), ShouldEqual, 1500)
+		subtype, id := doc.Lookup("_id").Binary()
+		So(subtype, ShouldEqual, 4)
+		So(id[:2], ShouldResemble, []byte{0x6b, 0xa7})
+		So(doc.Lookup("level").StringValue(), ShouldEqual, "high")
+		So(doc.Lookup("count").StringValue(), ShouldEqual, "123456789012345678901234567890")
+		_, err = doc.LookupErr("missing")
+		So(err, ShouldNotBeNil)
+		So(doc.Lookup("price").Decimal128().String(), ShouldEqual, "19.99")
+		So(doc.Lookup("ratio").Decimal128().String(), ShouldEqual, "0.25")
+		So(doc.Lookup("plain").Int64(), ShouldEqual, int64(time.Second))
+
+		var out ticket
+		So(bson.UnmarshalWithRegistry(reg, raw, &out), ShouldBeNil)
+		So(out, ShouldResemble, in)
+
+		Convey("Unknown codecs and unsupported values are errors", func() {
+			type nested struct {
+				N int `pie:"codec:nope"`
+			}
+			So(NewCodecs().Prepare(reflect.TypeOf(struct{ In []nested }{})), ShouldNotBeNil)
+			_, err := bson.MarshalWithRegistry(reg, struct {
+				N int `pie:"codec:nope"`
+			}{})
+			So(err, ShouldNotBeNil)
+			_, err = bson.MarshalWithRegistry(reg, struct {
+				N int `pie:"codec:uuid"`
+			}{})
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Type codecs replace the driver's", t, func() {
+		codecs := NewCodecs()
+		enc := bsoncodec.ValueEncoderFunc(func(_ bsoncodec.EncodeContext, vw bsonrw.ValueWriter, v reflect.Value) error {
+			d, err := primitive.ParseDecimal128(big.NewRat(v.Int(), 100).FloatString(2))
+			if err != nil {
+				return err
+			}
+			return vw.WriteDecimal128(d)
+		})
+		codecs.Register(reflect.TypeOf(cents(0)), enc, nil)
+		raw, err := bson.MarshalWithRegistry(codecs.Registry(), bson.M{"total": cents(1999)})
+		So(err, ShouldBeNil)
+		So(bson.Raw(raw).Lookup("total").Decimal128().String(), ShouldEqual, "19.99")
+	})
+
+	Convey("Variants round-trip through the registry", t, func() {
+		codecs := NewCodecs()
+
+		shapeType := reflect.TypeOf((*shape)(nil)).Elem()
+		So(codecs.registerVariant(shapeType, "kind", "square", reflect.TypeOf(square{})), ShouldBeNil)
+		So(codecs.registerVariant(shapeType, "kind", "circle", reflect.TypeOf(&circle{})), ShouldBeNil)
+		reg := codecs.Registry()
+		So(reg, ShouldNotBeNil)
+
+		raw, err := bson.MarshalWithRegistry(reg, drawing{
+			Shapes: []shape{square{Kind: "stale", Side: 2}, &circle{R: 1}},
+		})
+		So(err, ShouldBeNil)
+		var d bson.D
+		So(bson.Unmarshal(raw, &d), ShouldBeNil)
+		So(d, ShouldResemble, bson.D{
+			{Key: "shapes", Value: bson.A{
+				bson.D{{Key: "kind", Value: "square"}, {Key: "side", Value: 2.0}},
+				bson.D{{Key: "kind", Value: "circle"}, {Key: "r", Value: 1.0}},
+			}},
+			{Key: "main", Value: nil},
+		})
+
+		var out drawing
+		So(bson.UnmarshalWithRegistry(reg, raw, &out), ShouldBeNil)
+		So(out.Shapes, ShouldResemble, []shape{square{Kind: "square", Side: 2}, &circle{R: 1}})
+		So(out.Main, ShouldBeNil)
+
+		var s shape
+		raw, err = bson.Marshal(bson.D{{Key: "r", Value: 2.0}})
+		So(err, ShouldBeNil)
+		So(bson.UnmarshalWithRegistry(reg, raw, &s), ShouldNotBeNil)
+	})
+
+	Convey("A registry in the client options refuses models needing codecs", t, func() {
+		mc, err := mongo.NewClient(options.Client().ApplyURI("mongodb://127.0.0.1:27017"))
+		So(err, ShouldBeNil)
+		mapper := names.NewCacheMapper(new(names.SnakeMapper))
+		opts := options.Client().SetRegistry(bson.DefaultRegistry)
+		client := &defaultClient{client: mc, parser: NewParser(mapper, mapper), db: "test", clientOpts: []*options.ClientOptions{opts}, codecs: NewCodecs()}
+
+		_, err = client.CollectionNameForStruct(&drawing{})
+		So(err, ShouldBeNil)
+		_, err = client.CollectionNameForSlice(&[]ticket{})
+		So(err, ShouldEqual, errCodecsIgnored)
+	})
+}
@@ -0,0 +1,102 @@
+package expr
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Filter returns the elements of input for which cond is true. Within cond
+// the element is Var(as), or This when as is empty.
+//
+// Example usage:
+//
+//	expr.Filter(expr.Field("items"), "item", expr.Gte(expr.Var("item.price"), 100))
+func Filter(input any, as string, cond any) bson.D {
+	spec := bson.D{{Key: "input", Value: input}}
+	if as != "" {
+		spec = append(spec, bson.E{Key: "as", Value: as})
+	}
+	return op("$filter", append(spec, bson.E{Key: "cond", Value: cond}))
+}
+
+// Map returns in evaluated for each element of input, bound as for Filter.
+func Map(input any, as string, in any) bson.D {
+	spec := bson.D{{Key: "input", Value: input}}
+	if as != "" {
+		spec = append(spec, bson.E{Key: "as", Value: as})
+	}
+	return op("$map", append(spec, bson.E{Key: "in", Value: in}))
+}
+
+// Reduce folds input into a single value: in is evaluated for each element,
+// This, with Value holding the result so far, starting with initial.
+//
+// Example usage:
+//
+//	expr.Reduce(expr.Field("items"), 0, expr.Add(expr.Value, expr.Var("this.qty")))
+func Reduce(input, initial, in any) bson.D {
+	return op("$reduce", bson.D{{Key: "input", Value: input}, {Key: "initialValue", Value: initial}, {Key: "in", Value: in}})
+}
+
+// Size returns the number of elements of array.
+func Size(array any) bson.D { return op("$size", array) }
+
+// ElemAt returns the element of array at index; a negative index counts
+// from the end.
+func ElemAt(array, index any) bson.D { return op("$arrayElemAt", list(array, index)) }
+
+// In reports whether array contains v.
+func In(v, array any) bson.D { return op("$in", list(v, array)) }
+
+// ConcatArrays joins the arrays exprs.
+func ConcatArrays(exprs ...any) bson.D { return op("$concatArrays", list(exprs...)) }
+
+// Slice returns n elements of array from its start, or from its end when n
+// is negative.
+func Slice(array, n any) bson.D { return op("$slice", list(array, n)) }
+
+// SliceFrom returns n elements of array starting at position; a negative
+// position counts from the end.
+func SliceFrom(array, position, n any) bson.D { return op("$slice", list(array, position, n)) }
+
+// IsArray reports whether e is an array.
+func IsArray(e any) bson.D { return op("$isArray", list(e)) }
+
+// The accumulators below are used with Group, and Sum, Avg, Min, Max,
+// First and Last also as expressions over an array.
+
+// Sum returns the sum of the numbers among exprs; with a single operand in
+// Group, the sum over the group.
+func Sum(exprs ...any) bson.D { return accumulator("$sum", exprs) }
+
+// Avg returns the average of the numbers among exprs.
+func Avg(exprs ...any) bson.D { return accumulator("$avg", exprs) }
+
+// Min returns the smallest of exprs.
+func Min(exprs ...any) bson.D { return accumulator("$min", exprs) }
+
+// Max returns the largest of exprs.
+func Max(exprs ...any) bson.D { return accumulator("$max", exprs) }
+
+func accumulator(name string, exprs []any) bson.D {
+	if len(exprs) == 1 {
+		return op(name, exprs[0])
+	}
+	return op(name, list(exprs...))
+}
+
+// First returns the first element of an array, or e for the first document
+// of a group.
+func First(e any) bson.D { return op("$first", e) }
+
+// Last returns the last element of an array, or e for the last document of
+// a group.
+func Last(e any) bson.D { return op("$last", e) }
+
+// Push collects e for every document of a group.
+func Push(e any) bson.D { return op("$push", e) }
+
+// AddToSet collects the distinct values of e in a group.
+func AddToSet(e any) bson.D { return op("$addToSet", e) }
+
+// Count returns the number of documents in a group.
+func Count() bson.D { return op("$count", bson.D{}) }
@@ -0,0 +1,97 @@
+package expr
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The date part builders take an optional timezone, an Olson name such as
+// "Europe/Berlin" or an offset such as "+02:00"; dates are read in UTC
+// otherwise.
+
+// Year returns the year of date.
+func Year(date any, timezone ...string) bson.D { return datePart("$year", date, timezone) }
+
+// Month returns the month of date, 1 to 12.
+func Month(date any, timezone ...string) bson.D { return datePart("$month", date, timezone) }
+
+// DayOfMonth returns the day of the month of date, 1 to 31.
+func DayOfMonth(date any, timezone ...string) bson.D {
+	return datePart("$dayOfMonth", date, timezone)
+}
+
+// DayOfWeek returns the day of the week of date, 1 (Sunday) to 7 (Saturday).
+func DayOfWeek(date any, timezone ...string) bson.D {
+	return datePart("$dayOfWeek", date, timezone)
+}
+
+// DayOfYear returns the day of the year of date, 1 to 366.
+func DayOfYear(date any, timezone ...string) bson.D {
+	return datePart("$dayOfYear", date, timezone)
+}
+
+// Hour returns the hour of date, 0 to 23.
+func Hour(date any, timezone ...string) bson.D { return datePart("$hour", date, timezone) }
+
+// Minute returns the minute of date, 0 to 59.
+func Minute(date any, timezone ...string) bson.D { return datePart("$minute", date, timezone) }
+
+// Second returns the second of date, 0 to 59.
+func Second(date any, timezone ...string) bson.D { return datePart("$second", date, timezone) }
+
+// Millisecond returns the millisecond of date, 0 to 999.
+func Millisecond(date any, timezone ...string) bson.D {
+	return datePart("$millisecond", date, timezone)
+}
+
+func datePart(name string, date any, timezone []string) bson.D {
+	if len(timezone) == 0 {
+		return op(name, date)
+	}
+	return op(name, bson.D{{Key: "date", Value: date}, {Key: "timezone", Value: timezone[0]}})
+}
+
+func withTimezone(spec bson.D, timezone []string) bson.D {
+	if len(timezone) > 0 {
+		spec = append(spec, bson.E{Key: "timezone", Value: timezone[0]})
+	}
+	return spec
+}
+
+// DateToString formats date with format, which uses the server's specifiers
+// such as %Y-%m-%d; an empty format gives ISO 8601.
+func DateToString(date any, format string, timezone ...string) bson.D {
+	spec := bson.D{{Key: "date", Value: date}}
+	if format != "" {
+		spec = append(spec, bson.E{Key: "format", Value: format})
+	}
+	return op("$dateToString", withTimezone(spec, timezone))
+}
+
+// DateFromString parses s as a date, with format when it is not empty and as
+// ISO 8601 otherwise.
+func DateFromString(s any, format string, timezone ...string) bson.D {
+	spec := bson.D{{Key: "dateString", Value: s}}
+	if format != "" {
+		spec = append(spec, bson.E{Key: "format", Value: format})
+	}
+	return op("$dateFromString", withTimezone(spec, timezone))
+}
+
+// DateAdd adds amount units to date. unit is one of year, quarter, month,
+// week, day, hour, minute, second and millisecond.
+func DateAdd(date any, unit string, amount any, timezone ...string) bson.D {
+	spec := bson.D{{Key: "startDate", Value: date}, {Key: "unit", Value: unit}, {Key: "amount", Value: amount}}
+	return op("$dateAdd", withTimezone(spec, timezone))
+}
+
+// DateSubtract subtracts amount units from date.
+func DateSubtract(date any, unit string, amount any, timezone ...string) bson.D {
+	spec := bson.D{{Key: "startDate", Value: date}, {Key: "unit", Value: unit}, {Key: "amount", Value: amount}}
+	return op("$dateSubtract", withTimezone(spec, timezone))
+}
+
+// DateDiff returns the number of unit boundaries between start and end.
+func DateDiff(start, end any, unit string, timezone ...string) bson.D {
+	spec := bson.D{{Key: "startDate", Value: start}, {Key: "endDate", Value: end}, {Key: "unit", Value: unit}}
+	return op("$dateDiff", withTimezone(spec, timezone))
+}
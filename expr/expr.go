@@ -0,0 +1,203 @@
+// Package expr builds aggregation expressions, for $expr queries and for the
+// Project, AddFields and Group stages of an aggregate.
+//
+// Every builder returns the expression document the server expects, so
+// builders nest and mix freely with hand-written bson.D and bson.M values.
+// Operands are expressions too: Field references a field of the current
+// document, Var a variable, and any other value is a constant.
+//
+//	client.Expr(expr.Gt(expr.Field("spent"), expr.Field("budget"))).FindAll(&over)
+//
+//	client.Aggregate().
+//		AddFields(bson.M{"total": expr.Multiply(expr.Field("price"), expr.Field("qty"))}).
+//		Group(expr.Year(expr.Field("createdAt")), bson.M{"revenue": expr.Sum(expr.Field("total"))})
+//
+// A string operand starting with $ is read as a field path, so strings that
+// may start with $ must be wrapped in Literal.
+package expr
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The system variables.
+const (
+	// Root is the top-level document being processed.
+	Root = "$$ROOT"
+	// Current is the document being processed, Root unless rebound.
+	Current = "$$CURRENT"
+	// Remove removes the field it is assigned to in Project and AddFields.
+	Remove = "$$REMOVE"
+	// This is the element bound by Filter and Map by default, and by Reduce.
+	This = "$$this"
+	// Value is the accumulated value in Reduce.
+	Value = "$$value"
+)
+
+// Field returns a reference to the field at the dotted path.
+func Field(path string) string {
+	return "$" + path
+}
+
+// Var returns a reference to the variable name, as bound by Let, Filter,
+// Map or Reduce. Dotted paths reach into a variable holding a document.
+func Var(name string) string {
+	return "$$" + name
+}
+
+// Literal returns v unevaluated, for constants that would otherwise be read
+// as expressions, such as strings starting with $.
+func Literal(v any) bson.D {
+	return op("$literal", v)
+}
+
+func op(name string, arg any) bson.D {
+	return bson.D{{Key: name, Value: arg}}
+}
+
+func list(args ...any) bson.A {
+	if args == nil {
+		return bson.A{}
+	}
+	return bson.A(args)
+}
+
+// Eq reports whether a equals b.
+func Eq(a, b any) bson.D { return op("$eq", list(a, b)) }
+
+// Ne reports whether a does not equal b.
+func Ne(a, b any) bson.D { return op("$ne", list(a, b)) }
+
+// Gt reports whether a is greater than b.
+func Gt(a, b any) bson.D { return op("$gt", list(a, b)) }
+
+// Gte reports whether a is greater than or equal to b.
+func Gte(a, b any) bson.D { return op("$gte", list(a, b)) }
+
+// Lt reports whether a is less than b.
+func Lt(a, b any) bson.D { return op("$lt", list(a, b)) }
+
+// Lte reports whether a is less than or equal to b.
+func Lte(a, b any) bson.D { return op("$lte", list(a, b)) }
+
+// Cmp returns -1, 0 or 1 as a is less than, equal to or greater than b.
+func Cmp(a, b any) bson.D { return op("$cmp", list(a, b)) }
+
+// And reports whether all of exprs are true.
+func And(exprs ...any) bson.D { return op("$and", list(exprs...)) }
+
+// Or reports whether any of exprs is true.
+func Or(exprs ...any) bson.D { return op("$or", list(exprs...)) }
+
+// Not negates e.
+func Not(e any) bson.D { return op("$not", list(e)) }
+
+// Cond returns then when cond is true and otherwise else.
+func Cond(cond, then, otherwise any) bson.D {
+	return op("$cond", bson.D{{Key: "if", Value: cond}, {Key: "then", Value: then}, {Key: "else", Value: otherwise}})
+}
+
+// IfNull returns e, or replacement when e is null or missing.
+func IfNull(e, replacement any) bson.D { return op("$ifNull", list(e, replacement)) }
+
+// Branch is a case of Switch, made with Case or Default.
+type Branch struct {
+	cond, then any
+	isDefault  bool
+}
+
+// Case returns the branch returning then when cond is true.
+func Case(cond, then any) Branch {
+	return Branch{cond: cond, then: then}
+}
+
+// Default returns the value Switch returns when no case is true. Without
+// one, the server fails when no case matches.
+func Default(v any) Branch {
+	return Branch{then: v, isDefault: true}
+}
+
+// Switch returns the value of the first true case of branches, or the default.
+//
+// Example usage:
+//
+//	expr.Switch(
+//		expr.Case(expr.Gte(expr.Field("score"), 90), "A"),
+//		expr.Case(expr.Gte(expr.Field("score"), 80), "B"),
+//		expr.Default("C"),
+//	)
+func Switch(branches ...Branch) bson.D {
+	cases := bson.A{}
+	spec := bson.D{{Key: "branches", Value: nil}}
+	for _, b := range branches {
+		if b.isDefault {
+			spec = append(spec, bson.E{Key: "default", Value: b.then})
+			continue
+		}
+		cases = append(cases, bson.D{{Key: "case", Value: b.cond}, {Key: "then", Value: b.then}})
+	}
+	spec[0].Value = cases
+	return op("$switch", spec)
+}
+
+// Let binds vars, a bson.D or bson.M of names to expressions, for use with
+// Var in in.
+func Let(vars any, in any) bson.D {
+	return op("$let", bson.D{{Key: "vars", Value: vars}, {Key: "in", Value: in}})
+}
+
+// Add returns the sum of exprs; a date plus numbers adds milliseconds.
+func Add(exprs ...any) bson.D { return op("$add", list(exprs...)) }
+
+// Subtract returns a minus b.
+func Subtract(a, b any) bson.D { return op("$subtract", list(a, b)) }
+
+// Multiply returns the product of exprs.
+func Multiply(exprs ...any) bson.D { return op("$multiply", list(exprs...)) }
+
+// Divide returns a divided by b.
+func Divide(a, b any) bson.D { return op("$divide", list(a, b)) }
+
+// Mod returns the remainder of a divided by b.
+func Mod(a, b any) bson.D { return op("$mod", list(a, b)) }
+
+// Abs returns the absolute value of e.
+func Abs(e any) bson.D { return op("$abs", e) }
+
+// Ceil returns the smallest integer greater than or equal to e.
+func Ceil(e any) bson.D { return op("$ceil", e) }
+
+// Floor returns the largest integer less than or equal to e.
+func Floor(e any) bson.D { return op("$floor", e) }
+
+// Sqrt returns the square root of e.
+func Sqrt(e any) bson.D { return op("$sqrt", e) }
+
+// Pow returns base raised to exponent.
+func Pow(base, exponent any) bson.D { return op("$pow", list(base, exponent)) }
+
+// Round rounds e to place decimal places, half to even; a negative place
+// rounds to the left of the decimal point.
+func Round(e any, place int) bson.D { return op("$round", list(e, place)) }
+
+// Trunc truncates e to place decimal places.
+func Trunc(e any, place int) bson.D { return op("$trunc", list(e, place)) }
+
+// ToString converts e to a string.
+func ToString(e any) bson.D { return op("$toString", e) }
+
+// ToInt converts e to a 32-bit integer.
+func ToInt(e any) bson.D { return op("$toInt", e) }
+
+// ToLong converts e to a 64-bit integer.
+func ToLong(e any) bson.D { return op("$toLong", e) }
+
+// ToDouble converts e to a double.
+func ToDouble(e any) bson.D { return op("$toDouble", e) }
+
+// ToBool converts e to a boolean.
+func ToBool(e any) bson.D { return op("$toBool", e) }
+
+// ToDate converts e, milliseconds since the epoch, an ObjectID or a date
+// string, to a date.
+func ToDate(e any) bson.D { return op("$toDate", e) }
@@ -0,0 +1,65 @@
+package expr
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Concat joins the strings exprs.
+func Concat(exprs ...any) bson.D { return op("$concat", list(exprs...)) }
+
+// Substr returns count code points of s starting at code point start.
+func Substr(s, start, count any) bson.D { return op("$substrCP", list(s, start, count)) }
+
+// StrLen returns the number of code points in s.
+func StrLen(s any) bson.D { return op("$strLenCP", s) }
+
+// IndexOf returns the code point index of the first occurrence of sub in s,
+// or -1.
+func IndexOf(s, sub any) bson.D { return op("$indexOfCP", list(s, sub)) }
+
+// ToLower lowercases s.
+func ToLower(s any) bson.D { return op("$toLower", s) }
+
+// ToUpper uppercases s.
+func ToUpper(s any) bson.D { return op("$toUpper", s) }
+
+// Split splits s around delimiter into an array.
+func Split(s, delimiter any) bson.D { return op("$split", list(s, delimiter)) }
+
+// Trim removes whitespace, or the characters in chars when it is not empty,
+// from both ends of s.
+func Trim(s any, chars string) bson.D { return trim("$trim", s, chars) }
+
+// TrimLeft is Trim for the start of s.
+func TrimLeft(s any, chars string) bson.D { return trim("$ltrim", s, chars) }
+
+// TrimRight is Trim for the end of s.
+func TrimRight(s any, chars string) bson.D { return trim("$rtrim", s, chars) }
+
+func trim(name string, s any, chars string) bson.D {
+	spec := bson.D{{Key: "input", Value: s}}
+	if chars != "" {
+		spec = append(spec, bson.E{Key: "chars", Value: chars})
+	}
+	return op(name, spec)
+}
+
+// RegexMatch reports whether s matches pattern, with the options i, m, s
+// and x as for Condition.Regex.
+func RegexMatch(s any, pattern string, opts string) bson.D {
+	spec := bson.D{{Key: "input", Value: s}, {Key: "regex", Value: pattern}}
+	if opts != "" {
+		spec = append(spec, bson.E{Key: "options", Value: opts})
+	}
+	return op("$regexMatch", spec)
+}
+
+// ReplaceOne replaces the first occurrence of find in s with replacement.
+func ReplaceOne(s, find, replacement any) bson.D {
+	return op("$replaceOne", bson.D{{Key: "input", Value: s}, {Key: "find", Value: find}, {Key: "replacement", Value: replacement}})
+}
+
+// ReplaceAll replaces every occurrence of find in s with replacement.
+func ReplaceAll(s, find, replacement any) bson.D {
+	return op("$replaceAll", bson.D{{Key: "input", Value: s}, {Key: "find", Value: find}, {Key: "replacement", Value: replacement}})
+}
@@ -0,0 +1,131 @@
+package pie
+
+import (
+	"github.com/5xxxx/pie/internal/mql"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// JSONFormat selects the JSON representation a Condition is written in.
+type JSONFormat int
+
+const (
+	// CanonicalJSON is canonical Extended JSON: every value keeps its exact BSON type.
+	CanonicalJSON JSONFormat = iota
+	// RelaxedJSON is relaxed Extended JSON: numbers and most dates are written as plain JSON.
+	RelaxedJSON
+	// CompactJSON is relaxed Extended JSON in which dates are always ISO-8601 strings
+	// and regular expressions use the shell's {"$regex": ..., "$options": ...} form.
+	CompactJSON
+)
+
+// iso8601Milli is the date layout of CompactJSON; the Extended JSON parser accepts it.
+const iso8601Milli = "2006-01-02T15:04:05.999Z07:00"
+
+// MarshalExtJSON returns the filter conditions encoded in the given JSON format.
+// Regular expressions, ObjectIDs, dates and nested $and/$or/$nor documents are preserved,
+// so UnmarshalExtJSON rebuilds an equivalent condition.
+//
+// Example usage:
+//
+//	data, err := DefaultCondition().Eq("name", "frank").Gte("age", 18).MarshalExtJSON(pie.RelaxedJSON)
+//	// data is {"name":"frank","age":{"$gte":18}}
+func (f *filter) MarshalExtJSON(format JSONFormat) ([]byte, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	d, err := mql.NormalizeDoc(f.d)
+	if err != nil {
+		return nil, err
+	}
+	if format == CompactJSON {
+		d = compactValue(d).(bson.D)
+	}
+	return bson.MarshalExtJSON(d, format == CanonicalJSON, false)
+}
+
+// MarshalJSON encodes the filter conditions as CompactJSON.
+func (f *filter) MarshalJSON() ([]byte, error) {
+	return f.MarshalExtJSON(CompactJSON)
+}
+
+// UnmarshalExtJSON replaces the filter conditions with the ones encoded in data,
+// which may be in any of the JSONFormat forms. The filter can be chained further afterwards.
+//
+// Example usage:
+//
+//	cond := DefaultCondition()
+//	err := cond.UnmarshalExtJSON(saved)
+//	cond.Eq("tenant", tenant)
+func (f *filter) UnmarshalExtJSON(data []byte) error {
+	var d bson.D
+	if err := bson.UnmarshalExtJSON(data, false, &d); err != nil {
+		return err
+	}
+	f.d = expandValue(d).(bson.D)
+	f.err = nil
+	return nil
+}
+
+// UnmarshalJSON decodes conditions written by MarshalJSON or MarshalExtJSON.
+func (f *filter) UnmarshalJSON(data []byte) error {
+	return f.UnmarshalExtJSON(data)
+}
+
+// ParseCondition returns a new Condition holding the conditions encoded in data.
+func ParseCondition(data []byte) (Condition, error) {
+	f := &filter{d: bson.D{}}
+	if err := f.UnmarshalExtJSON(data); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// compactValue rewrites the values CompactJSON spells differently from relaxed Extended JSON.
+func compactValue(v any) any {
+	switch x := v.(type) {
+	case bson.D:
+		out := make(bson.D, len(x))
+		for i, e := range x {
+			out[i] = bson.E{Key: e.Key, Value: compactValue(e.Value)}
+		}
+		return out
+	case bson.A:
+		out := make(bson.A, len(x))
+		for i, e := range x {
+			out[i] = compactValue(e)
+		}
+		return out
+	case primitive.Regex:
+		return bson.D{{Key: "$regex", Value: x.Pattern}, {Key: "$options", Value: x.Options}}
+	case primitive.DateTime:
+		return bson.D{{Key: "$date", Value: x.Time().UTC().Format(iso8601Milli)}}
+	}
+	return v
+}
+
+// expandValue turns the shell regular expression form back into primitive.Regex values.
+func expandValue(v any) any {
+	switch x := v.(type) {
+	case bson.D:
+		if len(x) == 2 && x[0].Key == "$regex" && x[1].Key == "$options" {
+			pattern, ok1 := x[0].Value.(string)
+			options, ok2 := x[1].Value.(string)
+			if ok1 && ok2 {
+				return primitive.Regex{Pattern: pattern, Options: options}
+			}
+		}
+		out := make(bson.D, len(x))
+		for i, e := range x {
+			out[i] = bson.E{Key: e.Key, Value: expandValue(e.Value)}
+		}
+		return out
+	case bson.A:
+		out := make(bson.A, len(x))
+		for i, e := range x {
+			out[i] = expandValue(e)
+		}
+		return out
+	}
+	return v
+}
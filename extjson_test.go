@@ -0,0 +1,93 @@
+package pie
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestConditionExtJSON(t *testing.T) {
+	Convey("Conditions round-trip through Extended JSON", t, func() {
+		id, _ := primitive.ObjectIDFromHex("5f1d7a3c9d1e8a2b3c4d5e6f")
+		at := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+		cond := func() Condition {
+			return DefaultCondition().
+				ID(id).
+				RegexFilter("name", "^fr").
+				Gte("created_at", at).
+				FilterBson(bson.D{{Key: "$or", Value: bson.A{
+					bson.D{{Key: "age", Value: bson.D{{Key: "$lt", Value: 18}}}},
+					bson.D{{Key: "tags", Value: bson.D{{Key: "$in", Value: bson.A{"vip", "gold"}}}}},
+				}}})
+		}
+
+		Convey("Every format decodes to the same filters", func() {
+			want, err := cond().Filters()
+			So(err, ShouldBeNil)
+			for _, format := range []JSONFormat{CanonicalJSON, RelaxedJSON, CompactJSON} {
+				data, err := cond().MarshalExtJSON(format)
+				So(err, ShouldBeNil)
+				parsed, err := ParseCondition(data)
+				So(err, ShouldBeNil)
+
+				got, err := parsed.Filters()
+				So(err, ShouldBeNil)
+				So(got, ShouldHaveLength, len(want))
+				So(got[0], ShouldResemble, bson.E{Key: "_id", Value: id})
+				So(got[1], ShouldResemble, bson.E{Key: "name", Value: primitive.Regex{Pattern: "^fr", Options: "i"}})
+				gte := got[2].Value.(bson.D)
+				So(gte[0].Value, ShouldEqual, primitive.NewDateTimeFromTime(at))
+				or := got[3].Value.(bson.A)
+				So(or[1], ShouldResemble, bson.D{{Key: "tags", Value: bson.D{{Key: "$in", Value: bson.A{"vip", "gold"}}}}})
+
+				for _, doc := range []bson.M{{"_id": id, "name": "Frank", "created_at": at, "age": 12}, {"_id": id, "name": "frank", "created_at": at}} {
+					wantMatch, err := cond().Match(doc)
+					So(err, ShouldBeNil)
+					gotMatch, err := parsed.Match(doc)
+					So(err, ShouldBeNil)
+					So(gotMatch, ShouldEqual, wantMatch)
+				}
+			}
+		})
+
+		Convey("The formats differ in how they spell types", func() {
+			canonical, err := DefaultCondition().Eq("n", 1).MarshalExtJSON(CanonicalJSON)
+			So(err, ShouldBeNil)
+			So(string(canonical), ShouldEqual, `{"n":{"$numberInt":"1"}}`)
+
+			relaxed, err := DefaultCondition().Eq("n", 1).MarshalExtJSON(RelaxedJSON)
+			So(err, ShouldBeNil)
+			So(string(relaxed), ShouldEqual, `{"n":1}`)
+
+			compact, err := DefaultCondition().RegexFilter("name", "^a").Lt("at", at).MarshalExtJSON(CompactJSON)
+			So(err, ShouldBeNil)
+			So(string(compact), ShouldEqual, `{"name":{"$regex":"^a","$options":"i"},"at":{"$lt":{"$date":"2024-03-01T12:30:00Z"}}}`)
+		})
+
+		Convey("A decoded condition can be chained and embedded in JSON", func() {
+			parsed := DefaultCondition()
+			So(parsed.UnmarshalExtJSON([]byte(`{"name":"frank"}`)), ShouldBeNil)
+			parsed.Gt("age", 20)
+			got, err := parsed.Filters()
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, bson.D{{Key: "name", Value: "frank"}, {Key: "age", Value: bson.M{"$gt": 20}}})
+
+			data, err := json.Marshal(struct {
+				Filter Condition `json:"filter"`
+			}{parsed})
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, `{"filter":{"name":"frank","age":{"$gt":20}}}`)
+		})
+
+		Convey("Filter errors are returned instead of JSON", func() {
+			_, err := DefaultCondition().ID(0).MarshalExtJSON(RelaxedJSON)
+			So(err, ShouldNotBeNil)
+			_, err = ParseCondition([]byte(`{"name":`))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,536 @@
+package pie
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/5xxxx/pie/internal/bsonstruct"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// The built-in field codecs, selected with `pie:"codec:<name>"`:
+//
+//   - string stores a value as a string: its MarshalText form when it
+//     implements encoding.TextMarshaler and TextUnmarshaler, as enums and
+//     big.Int do, or the formatted number or bool.
+//   - uuid stores a [16]byte, a 16-byte []byte or a UUID string as binary
+//     subtype 4.
+//   - decimal stores a number, a numeric string or a TextMarshaler, such as
+//     big.Float, as Decimal128.
+//   - millis stores a time.Duration as int64 milliseconds.
+//
+// Example usage:
+//
+//	type Order struct {
+//		ID      string        `bson:"_id" pie:"codec:uuid"`
+//		Status  Status        `bson:"status" pie:"codec:string"`
+//		Total   string        `bson:"total" pie:"codec:decimal"`
+//		Timeout time.Duration `bson:"timeout" pie:"codec:millis"`
+//	}
+func builtinFieldCodecs() map[string]bsoncodec.ValueCodec {
+	return map[string]bsoncodec.ValueCodec{
+		"string":  stringCodec{},
+		"uuid":    uuidCodec{},
+		"decimal": decimalCodec{},
+		"millis":  millisCodec{},
+	}
+}
+
+// structCodec is the driver's struct codec, with the fields tagged
+// `pie:"codec:<name>"` encoded and decoded by the named codecs.
+type structCodec struct {
+	sc     *bsoncodec.StructCodec
+	fields map[string]bsoncodec.ValueCodec
+	plans  sync.Map // map[reflect.Type][]codecField
+}
+
+// codecField is a struct field stored with a named codec.
+type codecField struct {
+	name  string
+	index []int
+	codec bsoncodec.ValueCodec
+}
+
+func newStructCodec(fields map[string]bsoncodec.ValueCodec) (*structCodec, error) {
+	sc, err := bsoncodec.NewStructCodec(bsoncodec.DefaultStructTagParser)
+	if err != nil {
+		return nil, err
+	}
+	return &structCodec{sc: sc, fields: fields}, nil
+}
+
+// plan returns the codec fields of struct type t.
+func (s *structCodec) plan(t reflect.Type) ([]codecField, error) {
+	if p, ok := s.plans.Load(t); ok {
+		return p.([]codecField), nil
+	}
+	fields, err := s.codecFields(t)
+	if err != nil {
+		return nil, err
+	}
+	s.plans.Store(t, fields)
+	return fields, nil
+}
+
+// codecFields lists the fields of t tagged with a codec. Fields of inlined
+// struct pointers are not considered.
+func (s *structCodec) codecFields(t reflect.Type) ([]codecField, error) {
+	var fields []codecField
+	for _, f := range bsonstruct.Fields(t) {
+		name, ok := bsonstruct.Tag(f.Field)["codec"]
+		if !ok || f.Indirect {
+			continue
+		}
+		codec := s.fields[name]
+		if codec == nil {
+			return nil, fmt.Errorf("field %s of %s: unknown codec %q", f.Field.Name, t, name)
+		}
+		fields = append(fields, codecField{name: f.Name, index: f.Index, codec: codec})
+	}
+	return fields, nil
+}
+
+func (s *structCodec) EncodeValue(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	fields, err := s.plan(val.Type())
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return s.sc.EncodeValue(ec, vw, val)
+	}
+	doc, err := s.encode(ec, val)
+	if err != nil {
+		return err
+	}
+	return bsonrw.Copier{}.CopyDocumentFromBytes(vw, doc)
+}
+
+// encode returns the document of the struct val, with the fields the struct
+// codec wrote replaced by their codec's encoding.
+func (s *structCodec) encode(ec bsoncodec.EncodeContext, val reflect.Value) (bsoncore.Document, error) {
+	var buf bytes.Buffer
+	bw, err := bsonrw.NewBSONValueWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.sc.EncodeValue(ec, bw, val); err != nil {
+		return nil, err
+	}
+	doc := bsoncore.Document(buf.Bytes())
+	fields, err := s.plan(val.Type())
+	if err != nil || len(fields) == 0 {
+		return doc, err
+	}
+
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+	idx, out := bsoncore.AppendDocumentStart(nil)
+	for _, e := range elems {
+		f := fieldNamed(fields, e.Key())
+		if f == nil {
+			out = append(out, e...)
+			continue
+		}
+		v, err := encodeField(ec, f, val.FieldByIndex(f.index))
+		if err != nil {
+			return nil, fmt.Errorf("field %s of %s: %w", f.name, val.Type(), err)
+		}
+		out = bsoncore.AppendValueElement(out, f.name, v)
+	}
+	return bsoncore.AppendDocumentEnd(out, idx)
+}
+
+// encodeField encodes v, the value of a codec field, on its own.
+func encodeField(ec bsoncodec.EncodeContext, f *codecField, v reflect.Value) (bsoncore.Value, error) {
+	var buf bytes.Buffer
+	bw, err := bsonrw.NewBSONValueWriter(&buf)
+	if err != nil {
+		return bsoncore.Value{}, err
+	}
+	dw, err := bw.WriteDocument()
+	if err != nil {
+		return bsoncore.Value{}, err
+	}
+	ew, err := dw.WriteDocumentElement(f.name)
+	if err != nil {
+		return bsoncore.Value{}, err
+	}
+	switch {
+	case v.Kind() == reflect.Ptr && v.IsNil():
+		err = ew.WriteNull()
+	case v.Kind() == reflect.Ptr:
+		err = f.codec.EncodeValue(ec, ew, v.Elem())
+	default:
+		// Codecs may need the address of the value, for pointer methods.
+		addressable := reflect.New(v.Type()).Elem()
+		addressable.Set(v)
+		err = f.codec.EncodeValue(ec, ew, addressable)
+	}
+	if err != nil {
+		return bsoncore.Value{}, err
+	}
+	if err := dw.WriteDocumentEnd(); err != nil {
+		return bsoncore.Value{}, err
+	}
+	return bsoncore.Document(buf.Bytes()).Index(0).Value(), nil
+}
+
+func (s *structCodec) DecodeValue(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	fields, err := s.plan(val.Type())
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 || (vr.Type() != bsontype.EmbeddedDocument && vr.Type() != bsontype.Type(0)) {
+		return s.sc.DecodeValue(dc, vr, val)
+	}
+	doc, err := bsonrw.Copier{}.CopyDocumentToBytes(vr)
+	if err != nil {
+		return err
+	}
+	elems, err := bsoncore.Document(doc).Elements()
+	if err != nil {
+		return err
+	}
+
+	// The struct codec decodes the other fields, then each codec its own.
+	idx, rest := bsoncore.AppendDocumentStart(nil)
+	var coded []bsoncore.Element
+	for _, e := range elems {
+		if fieldNamed(fields, e.Key()) != nil {
+			coded = append(coded, e)
+		} else {
+			rest = append(rest, e...)
+		}
+	}
+	if rest, err = bsoncore.AppendDocumentEnd(rest, idx); err != nil {
+		return err
+	}
+	if err := s.sc.DecodeValue(dc, bsonrw.NewBSONDocumentReader(rest), val); err != nil {
+		return err
+	}
+	for _, e := range coded {
+		f := fieldNamed(fields, e.Key())
+		if err := decodeField(dc, f, e.Value(), val.FieldByIndex(f.index)); err != nil {
+			return fmt.Errorf("field %s of %s: %w", f.name, val.Type(), err)
+		}
+	}
+	return nil
+}
+
+// decodeField decodes v into field with the codec of f, allocating pointers.
+func decodeField(dc bsoncodec.DecodeContext, f *codecField, v bsoncore.Value, field reflect.Value) error {
+	vr := bsonrw.NewBSONValueReader(v.Type, v.Data)
+	if field.Kind() != reflect.Ptr {
+		return f.codec.DecodeValue(dc, vr, field)
+	}
+	if v.Type == bsontype.Null {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+	p := reflect.New(field.Type().Elem())
+	if err := f.codec.DecodeValue(dc, vr, p.Elem()); err != nil {
+		return err
+	}
+	field.Set(p)
+	return nil
+}
+
+func fieldNamed(fields []codecField, name string) *codecField {
+	for i := range fields {
+		if fields[i].name == name {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+// decodeNull zeroes val when vr holds null, and reports whether it did.
+func decodeNull(vr bsonrw.ValueReader, val reflect.Value) (bool, error) {
+	if vr.Type() != bsontype.Null {
+		return false, nil
+	}
+	val.Set(reflect.Zero(val.Type()))
+	return true, vr.ReadNull()
+}
+
+var (
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// formatText returns the text form of val: its MarshalText result, or the
+// formatted string, number or bool. val is addressable.
+func formatText(val reflect.Value) (string, error) {
+	if val.Addr().Type().Implements(textMarshalerType) {
+		b, err := val.Addr().Interface().(encoding.TextMarshaler).MarshalText()
+		return string(b), err
+	}
+	switch val.Kind() {
+	case reflect.String:
+		return val.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(val.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(val.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(val.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(val.Float(), 'g', -1, val.Type().Bits()), nil
+	}
+	return "", fmt.Errorf("cannot format %s as text", val.Type())
+}
+
+// parseText sets val from its text form s, the reverse of formatText.
+func parseText(val reflect.Value, s string) error {
+	if val.Addr().Type().Implements(textUnmarshalerType) {
+		return val.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+	switch val.Kind() {
+	case reflect.String:
+		val.SetString(s)
+		return nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		val.SetBool(b)
+		return err
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, val.Type().Bits())
+		val.SetInt(n)
+		return err
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, val.Type().Bits())
+		val.SetUint(n)
+		return err
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, val.Type().Bits())
+		val.SetFloat(f)
+		return err
+	}
+	return fmt.Errorf("cannot parse text into %s", val.Type())
+}
+
+type stringCodec struct{}
+
+func (stringCodec) EncodeValue(_ bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	s, err := formatText(val)
+	if err != nil {
+		return err
+	}
+	return vw.WriteString(s)
+}
+
+func (stringCodec) DecodeValue(_ bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if null, err := decodeNull(vr, val); null || err != nil {
+		return err
+	}
+	s, err := vr.ReadString()
+	if err != nil {
+		return err
+	}
+	return parseText(val, s)
+}
+
+type uuidCodec struct{}
+
+func (uuidCodec) EncodeValue(_ bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	var b []byte
+	switch {
+	case val.Kind() == reflect.String:
+		if val.String() == "" {
+			return vw.WriteNull()
+		}
+		var err error
+		if b, err = parseUUID(val.String()); err != nil {
+			return err
+		}
+	case isByteArray(val.Type(), 16):
+		b = make([]byte, 16)
+		reflect.Copy(reflect.ValueOf(b), val)
+	case val.Kind() == reflect.Slice && val.Type().Elem().Kind() == reflect.Uint8:
+		if val.Len() == 0 {
+			return vw.WriteNull()
+		}
+		if val.Len() != 16 {
+			return fmt.Errorf("a uuid has 16 bytes, got %d", val.Len())
+		}
+		b = val.Bytes()
+	default:
+		return fmt.Errorf("cannot store %s as a uuid", val.Type())
+	}
+	return vw.WriteBinaryWithSubtype(b, bsontype.BinaryUUID)
+}
+
+func (uuidCodec) DecodeValue(_ bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if null, err := decodeNull(vr, val); null || err != nil {
+		return err
+	}
+	var b []byte
+	switch vr.Type() {
+	case bsontype.Binary:
+		data, subtype, err := vr.ReadBinary()
+		if err != nil {
+			return err
+		}
+		if subtype != bsontype.BinaryUUID && subtype != bsontype.BinaryUUIDOld {
+			return fmt.Errorf("binary subtype %d is not a uuid", subtype)
+		}
+		b = data
+	case bsontype.String:
+		s, err := vr.ReadString()
+		if err != nil {
+			return err
+		}
+		if b, err = parseUUID(s); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("cannot decode %v into a uuid", vr.Type())
+	}
+	if len(b) != 16 {
+		return fmt.Errorf("a uuid has 16 bytes, got %d", len(b))
+	}
+	switch {
+	case val.Kind() == reflect.String:
+		val.SetString(formatUUID(b))
+	case isByteArray(val.Type(), 16):
+		reflect.Copy(val, reflect.ValueOf(b))
+	case val.Kind() == reflect.Slice && val.Type().Elem().Kind() == reflect.Uint8:
+		val.SetBytes(append([]byte(nil), b...))
+	default:
+		return fmt.Errorf("cannot decode a uuid into %s", val.Type())
+	}
+	return nil
+}
+
+func isByteArray(t reflect.Type, n int) bool {
+	return t.Kind() == reflect.Array && t.Len() == n && t.Elem().Kind() == reflect.Uint8
+}
+
+// parseUUID parses the hex form of a uuid, with or without dashes.
+func parseUUID(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		return nil, fmt.Errorf("%q is not a uuid", s)
+	}
+	return b, nil
+}
+
+func formatUUID(b []byte) string {
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+type decimalCodec struct{}
+
+func (decimalCodec) EncodeValue(_ bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	s, err := formatText(val)
+	if err != nil {
+		return err
+	}
+	if s == "" && val.Kind() == reflect.String {
+		return vw.WriteNull()
+	}
+	d, err := primitive.ParseDecimal128(s)
+	if err != nil {
+		return err
+	}
+	return vw.WriteDecimal128(d)
+}
+
+func (decimalCodec) DecodeValue(_ bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if null, err := decodeNull(vr, val); null || err != nil {
+		return err
+	}
+	var s string
+	switch vr.Type() {
+	case bsontype.Decimal128:
+		d, err := vr.ReadDecimal128()
+		if err != nil {
+			return err
+		}
+		s = d.String()
+	case bsontype.Double:
+		f, err := vr.ReadDouble()
+		if err != nil {
+			return err
+		}
+		s = strconv.FormatFloat(f, 'g', -1, 64)
+	case bsontype.Int32:
+		n, err := vr.ReadInt32()
+		if err != nil {
+			return err
+		}
+		s = strconv.FormatInt(int64(n), 10)
+	case bsontype.Int64:
+		n, err := vr.ReadInt64()
+		if err != nil {
+			return err
+		}
+		s = strconv.FormatInt(n, 10)
+	case bsontype.String:
+		var err error
+		if s, err = vr.ReadString(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("cannot decode %v into a decimal", vr.Type())
+	}
+	return parseText(val, s)
+}
+
+type millisCodec struct{}
+
+func (millisCodec) EncodeValue(_ bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if val.Kind() != reflect.Int64 {
+		return fmt.Errorf("cannot store %s as milliseconds", val.Type())
+	}
+	return vw.WriteInt64(val.Int() / int64(time.Millisecond))
+}
+
+func (millisCodec) DecodeValue(_ bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if val.Kind() != reflect.Int64 {
+		return fmt.Errorf("cannot decode milliseconds into %s", val.Type())
+	}
+	if null, err := decodeNull(vr, val); null || err != nil {
+		return err
+	}
+	var ms float64
+	switch vr.Type() {
+	case bsontype.Int32:
+		n, err := vr.ReadInt32()
+		if err != nil {
+			return err
+		}
+		ms = float64(n)
+	case bsontype.Int64:
+		n, err := vr.ReadInt64()
+		if err != nil {
+			return err
+		}
+		val.SetInt(n * int64(time.Millisecond))
+		return nil
+	case bsontype.Double:
+		f, err := vr.ReadDouble()
+		if err != nil {
+			return err
+		}
+		ms = f
+	default:
+		return fmt.Errorf("cannot decode %v into milliseconds", vr.Type())
+	}
+	val.SetInt(int64(ms * float64(time.Millisecond)))
+	return nil
+}
@@ -0,0 +1,98 @@
+package pie
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/5xxxx/pie/internal/bsonstruct"
+)
+
+// resolveFieldPath returns the Go type stored at the dotted bson path of
+// model type t. Arrays are traversed transparently, as query paths are, and
+// numeric components index into them. Paths into maps and interfaces cannot
+// be checked and resolve to the map value or interface type.
+func resolveFieldPath(t reflect.Type, path string) (reflect.Type, bool) {
+	for _, part := range strings.Split(path, ".") {
+		t = indirectType(t)
+		if isArrayType(t) {
+			if _, err := strconv.Atoi(part); err == nil {
+				t = t.Elem()
+				continue
+			}
+			t = indirectType(t.Elem())
+		}
+		switch t.Kind() {
+		case reflect.Struct:
+			found := false
+			for _, f := range bsonstruct.Fields(t) {
+				if f.Name == part {
+					t, found = f.Field.Type, true
+					break
+				}
+			}
+			if !found {
+				return nil, false
+			}
+		case reflect.Map:
+			if t.Key().Kind() != reflect.String {
+				return nil, false
+			}
+			t = t.Elem()
+		case reflect.Interface:
+			return t, true
+		default:
+			return nil, false
+		}
+	}
+	return t, true
+}
+
+// fieldPaths lists every dotted bson path of struct type t that resolveFieldPath accepts,
+// without descending into maps, interfaces or recursive types.
+func fieldPaths(t reflect.Type) []string {
+	var paths []string
+	var walk func(t reflect.Type, prefix string, seen map[reflect.Type]bool)
+	walk = func(t reflect.Type, prefix string, seen map[reflect.Type]bool) {
+		t = indirectType(t)
+		if isArrayType(t) {
+			t = indirectType(t.Elem())
+		}
+		if t.Kind() != reflect.Struct || seen[t] || isValueStruct(t) {
+			return
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		for _, f := range bsonstruct.Fields(t) {
+			path := prefix + f.Name
+			paths = append(paths, path)
+			walk(f.Field.Type, path+".", seen)
+		}
+	}
+	walk(t, "", map[reflect.Type]bool{})
+	return paths
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// isArrayType reports whether values of t are stored as BSON arrays.
+func isArrayType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Slice:
+		return t.Elem().Kind() != reflect.Uint8
+	case reflect.Array:
+		return t.Elem().Kind() != reflect.Uint8
+	}
+	return false
+}
+
+// isValueStruct reports whether struct type t is stored as a single BSON value
+// rather than as an embedded document, like time.Time.
+func isValueStruct(t reflect.Type) bool {
+	return t.PkgPath() == "time" && t.Name() == "Time"
+}
@@ -0,0 +1,103 @@
+package pie
+
+// Field is a typed reference to the bson path of a model field. Values of it
+// are generated by cmd/piegen, so renaming a bson tag breaks compilation
+// instead of silently breaking queries.
+//
+// Example usage:
+//
+//	filters, err := UserFields.Age.Gte(18).Filters()
+//	err = client.FilterBson(filters).Sort(UserFields.Name.Asc(), UserFields.Age.Desc()).FindAll(&users)
+type Field[T any] struct {
+	path string
+}
+
+// NewField returns a reference to the field at the dotted bson path.
+func NewField[T any](path string) Field[T] {
+	return Field[T]{path: path}
+}
+
+// Path returns the dotted bson path of the field.
+func (f Field[T]) Path() string {
+	return f.path
+}
+
+func (f Field[T]) String() string {
+	return f.path
+}
+
+// Eq returns a condition matching documents whose field equals value.
+func (f Field[T]) Eq(value T) Condition {
+	return DefaultCondition().Eq(f.path, value)
+}
+
+// Ne returns a condition matching documents whose field does not equal value.
+func (f Field[T]) Ne(value T) Condition {
+	return DefaultCondition().Ne(f.path, value)
+}
+
+// Gt returns a condition matching documents whose field is greater than value.
+func (f Field[T]) Gt(value T) Condition {
+	return DefaultCondition().Gt(f.path, value)
+}
+
+// Gte returns a condition matching documents whose field is greater than or equal to value.
+func (f Field[T]) Gte(value T) Condition {
+	return DefaultCondition().Gte(f.path, value)
+}
+
+// Lt returns a condition matching documents whose field is less than value.
+func (f Field[T]) Lt(value T) Condition {
+	return DefaultCondition().Lt(f.path, value)
+}
+
+// Lte returns a condition matching documents whose field is less than or equal to value.
+func (f Field[T]) Lte(value T) Condition {
+	return DefaultCondition().Lte(f.path, value)
+}
+
+// In returns a condition matching documents whose field equals any of values.
+func (f Field[T]) In(values ...T) Condition {
+	return DefaultCondition().In(f.path, values)
+}
+
+// Nin returns a condition matching documents whose field equals none of values.
+func (f Field[T]) Nin(values ...T) Condition {
+	return DefaultCondition().Nin(f.path, values)
+}
+
+// Exists returns a condition matching documents that have the field, or lack it.
+func (f Field[T]) Exists(exists bool) Condition {
+	return DefaultCondition().Exists(f.path, exists)
+}
+
+// Asc returns the field as an ascending key for Session.Sort.
+func (f Field[T]) Asc() string {
+	return f.path
+}
+
+// Desc returns the field as a descending key for Session.Sort.
+func (f Field[T]) Desc() string {
+	return "-" + f.path
+}
+
+// ArrayField is a typed reference to an array field with elements of type E.
+// Eq, In and the other Field methods compare the whole array.
+type ArrayField[E any] struct {
+	Field[[]E]
+}
+
+// NewArrayField returns a reference to the array field at the dotted bson path.
+func NewArrayField[E any](path string) ArrayField[E] {
+	return ArrayField[E]{Field: NewField[[]E](path)}
+}
+
+// Contains returns a condition matching documents whose array holds value.
+func (f ArrayField[E]) Contains(value E) Condition {
+	return DefaultCondition().Eq(f.path, value)
+}
+
+// ContainsAny returns a condition matching documents whose array holds any of values.
+func (f ArrayField[E]) ContainsAny(values ...E) Condition {
+	return DefaultCondition().In(f.path, values)
+}
@@ -0,0 +1,35 @@
+package pie
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestFields(t *testing.T) {
+	Convey("Typed fields build conditions on their bson path", t, func() {
+		age := NewField[int]("age")
+		tags := NewArrayField[string]("tags")
+
+		filters, err := age.Gte(18).Filters()
+		So(err, ShouldBeNil)
+		So(filters, ShouldResemble, bson.D{{Key: "age", Value: bson.M{"$gte": 18}}})
+
+		filters, err = age.In(1, 2).Filters()
+		So(err, ShouldBeNil)
+		So(filters, ShouldResemble, bson.D{{Key: "age", Value: bson.M{"$in": []int{1, 2}}}})
+
+		filters, err = tags.Contains("go").Filters()
+		So(err, ShouldBeNil)
+		So(filters, ShouldResemble, bson.D{{Key: "tags", Value: "go"}})
+
+		filters, err = tags.Eq([]string{"a", "b"}).Filters()
+		So(err, ShouldBeNil)
+		So(filters, ShouldResemble, bson.D{{Key: "tags", Value: []string{"a", "b"}}})
+
+		So(age.Asc(), ShouldEqual, "age")
+		So(tags.Desc(), ShouldEqual, "-tags")
+		So(NewField[string]("address.city").Path(), ShouldEqual, "address.city")
+	})
+}
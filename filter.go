@@ -3,10 +3,15 @@ package pie
 import (
 	"errors"
 	"fmt"
+	"github.com/5xxxx/pie/geo"
+	"github.com/5xxxx/pie/internal/mql"
+	"github.com/5xxxx/pie/schemas"
 	"github.com/5xxxx/pie/utils"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math"
 	"reflect"
+	"regexp"
 	"strings"
 )
 
@@ -49,22 +54,56 @@ type Condition interface {
 	//        { $or: [ { qty: { $lt : 10 } }, { qty : { $gt: 50 } } ] },
 	//        { $or: [ { sale: true }, { price : { $lt : 5 } } ] }
 	// ]
-	And(filter Condition) Condition
+	// each of conds becomes one operand; And(Or(a, b), Or(c, d)) builds the filter above
+	And(conds ...Condition) Condition
 
 	// Not { field: { $not: { <operator-expression> } } }
 	//not and Regular Expressions
 	//{ item: { $not: /^p.*/ } }
+	// not may be a Condition on key or on the empty key, e.g. DefaultCondition().Size("", 0)
 	Not(key string, not any) Condition
 
 	// Nor { $nor: [ { price: 1.99 }, { price: { $exists: false } },
 	// { sale: true }, { sale: { $exists: false } } ] }
 	// price != 1.99 || sale != true || sale exists || sale exists
-	Nor(filter Condition) Condition
+	Nor(conds ...Condition) Condition
 	// Or { $or: [ { quantity: { $lt: 20 } }, { price: 10 } ] }
-	Or(filter Condition) Condition
+	// each of conds becomes one operand, so Or(And(a, b), And(c, d)) is (a AND b) OR (c AND d)
+	Or(conds ...Condition) Condition
 
 	Exists(key string, exists bool, filter ...Condition) Condition
 
+	// ElemMatch { field: { $elemMatch: { <query1>, <query2>, ... } } }
+	// matches arrays with an element satisfying every condition of c: conditions
+	// on the empty key apply to the element itself, { results: { $elemMatch: { $gte: 80, $lt: 85 } } },
+	// others to the fields of embedded documents, { items: { $elemMatch: { name: "x", qty: { $gt: 1 } } } }
+	ElemMatch(key string, c Condition) Condition
+
+	// All { tags: { $all: [ "ssl", "security" ] } } matches arrays holding every value
+	All(key string, values any) Condition
+
+	// Size { field: { $size: 2 } } matches arrays with exactly n elements
+	Size(key string, n int) Condition
+
+	// Mod { field: { $mod: [ divisor, remainder ] } }
+	Mod(key string, divisor, remainder int64) Condition
+
+	// BitsAllSet { field: { $bitsAllSet: <bits> } }; bits is an integer mask,
+	// a slice of bit positions or a binary mask
+	BitsAllSet(key string, bits any) Condition
+	// BitsAnySet { field: { $bitsAnySet: <bits> } }
+	BitsAnySet(key string, bits any) Condition
+	// BitsAllClear { field: { $bitsAllClear: <bits> } }
+	BitsAllClear(key string, bits any) Condition
+	// BitsAnyClear { field: { $bitsAnyClear: <bits> } }
+	BitsAnyClear(key string, bits any) Condition
+
+	// JSONSchema { $jsonSchema: <schema> } matches documents valid against schema
+	JSONSchema(schema any) Condition
+
+	// Comment { $comment: <string> } tags the query in logs and profiles
+	Comment(comment string) Condition
+
 	// Type { field: { $type: <BSON type> } }
 	// { "_id" : 1, address : "2030 Martian Way", zipCode : "90698345" },
 	// { "_id" : 2, address: "156 Lunar Place", zipCode : 43339374 },
@@ -74,12 +113,35 @@ type Condition interface {
 
 	// Expr Allows the use of aggregation expressions within the query language.
 	//{ $expr: { <expression> } }
-	//$expr can build query expressions that compare fields from the same document in a $match stage
-	//todo 没用过，不知道行不行。。https://docs.mongodb.com/manual/reference/operator/query/expr/#op._S_expr
-	Expr(filter Condition) Condition
+	//$expr can build query expressions that compare fields from the same document in a $match stage;
+	//the expression is a Condition or a value built with package expr
+	Expr(expression any) Condition
+
+	// Regex { field: { $regex: pattern, $options: opts } }; opts holds the options i, m, s and x
+	Regex(key string, pattern string, opts string) Condition
+
+	// StartsWith { field: /^prefix/ } matches a literal, case-sensitive prefix and can use an index
+	StartsWith(key string, prefix string) Condition
+	// EndsWith { field: /suffix\z/ } matches a literal suffix
+	EndsWith(key string, suffix string) Condition
+	// Contains { field: /substr/ } matches a literal substring
+	Contains(key string, substr string) Condition
+	// EqualFold { field: /^s\z/i } matches s ignoring case
+	EqualFold(key string, s string) Condition
 
-	// Regex todo 简单实现，后续增加支持
-	Regex(key string, value string) Condition
+	// Text { $text: { $search: <string>, $language: <string>, $caseSensitive: <bool>, $diacriticSensitive: <bool> } }
+	// searches the fields of the collection's text index; an empty language uses the index's.
+	Text(search, language string, caseSensitive, diacriticSensitive bool) Condition
+
+	// Near { field: { $near: { $geometry: <point>, $maxDistance: <m>, $minDistance: <m> } } }
+	// sorts by distance from point; zero distances are left out.
+	Near(key string, point geo.Point, maxDistance, minDistance float64) Condition
+	// NearSphere is Near with $nearSphere.
+	NearSphere(key string, point geo.Point, maxDistance, minDistance float64) Condition
+	// GeoWithin { field: { $geoWithin: <shape> } }
+	GeoWithin(key string, shape geo.Shape) Condition
+	// GeoIntersects { field: { $geoIntersects: { $geometry: <geometry> } } }
+	GeoIntersects(key string, geometry geo.Geometry) Condition
 
 	Filters() (bson.D, error)
 	A() bson.A
@@ -88,6 +150,19 @@ type Condition interface {
 	FilterBy(object any) Condition
 
 	Clone() Condition
+
+	// Match evaluates the filters against doc in memory, using MongoDB query semantics.
+	// doc may be a struct, a bson.M, a bson.D or a bson.Raw.
+	Match(doc any) (bool, error)
+
+	// MarshalExtJSON encodes the filters as canonical, relaxed or compact JSON.
+	MarshalExtJSON(format JSONFormat) ([]byte, error)
+	// UnmarshalExtJSON replaces the filters with the ones encoded in data.
+	UnmarshalExtJSON(data []byte) error
+	// Shell renders the filters as a mongosh document.
+	Shell() (string, error)
+	// String renders the filters like Shell, or the error in angle brackets.
+	String() string
 }
 
 // filter is a type used to build query filters for MongoDB.
@@ -198,8 +273,33 @@ func (f *filter) Filters() (bson.D, error) {
 	return f.d, f.err
 }
 
+// Match reports whether doc satisfies the filter conditions, evaluated in memory
+// the way the server would evaluate them: values are compared across BSON types,
+// dotted paths reach into embedded documents and arrays, and $in, $nin, $exists,
+// $type, $regex, $not, $size, $all, $elemMatch, $and, $or, $nor and $expr are supported.
+// An error is returned when the filter carries an error or uses an unsupported operator.
+//
+// Example usage:
+//
+//	ok, err := DefaultCondition().Gte("age", 18).In("tags", []string{"go"}).Match(user)
+func (f *filter) Match(doc any) (bool, error) {
+	if f.err != nil {
+		return false, f.err
+	}
+	query, err := mql.NormalizeDoc(f.d)
+	if err != nil {
+		return false, err
+	}
+	d, err := mql.NormalizeDoc(doc)
+	if err != nil {
+		return false, err
+	}
+	return mql.Match(query, d)
+}
+
 // RegexFilter applies a regular expression filter to a specified key
-// and pattern. The "i" option is used to make the regular expression case-insensitive.
+// and pattern. The "i" option is used to make the regular expression case-insensitive;
+// use Regex to choose the options.
 // Example:
 // { name: /^J/i }
 // Field that Starts with a Case-Insensitive Letter "J"
@@ -220,6 +320,11 @@ func (f *filter) RegexFilter(key, pattern string) Condition {
 	return f
 }
 
+// ID matches the document whose _id is the ObjectID id, given as a
+// primitive.ObjectID or its hex string. A condition has no model to tell
+// how the key is stored, so keys of other types, strings that are not
+// ObjectIDs and composite keys need Session.ID, which stores the key the
+// way the model declares it, see PrimaryKey.
 func (f *filter) ID(id any) Condition {
 	if id == nil {
 		return f
@@ -229,8 +334,10 @@ func (f *filter) ID(id any) Condition {
 		f.processStringID(id.(string))
 	case primitive.ObjectID:
 		f.processObjectID(id.(primitive.ObjectID))
+	case schemas.PK, *schemas.PK:
+		f.err = f.generateError("composite id needs the model, use Session.ID", id)
 	default:
-		f.err = f.generateError("id type must be string or primitive.ObjectID", id)
+		f.err = f.generateError("id type must be string or primitive.ObjectID, use Session.ID for other keys", id)
 	}
 	return f
 }
@@ -377,19 +484,45 @@ func (f *filter) Nin(key string, nin any) Condition {
 	return f
 }
 
-// And accepts a Condition object and adds it to the filter condition using the "$and" operator.
-// The filter condition is updated by appending a bson.E element with key "$and" and value filter.A().
-// Returns the updated filter condition.
-func (f *filter) And(filter Condition) Condition {
-	f.d = append(f.d, bson.E{Key: "$and", Value: filter.A()})
+// And adds conds to the filter joined by the "$and" operator, each Condition
+// becoming one operand document. Empty conditions are dropped and operands that
+// are themselves a lone $and are spliced in. When no field appears twice the
+// operands are merged into the filter directly, as top-level fields are already
+// joined by AND; otherwise they are kept in a $and array, which also takes the
+// fields of the filter they repeat.
+//
+// Example usage:
+//
+//	filter.And(DefaultCondition().Gt("qty", 10), DefaultCondition().Lt("qty", 50))
+//	// filter.d is now {$and: [{qty: {$gt: 10}}, {qty: {$lt: 50}}]}
+func (f *filter) And(conds ...Condition) Condition {
+	f.logical("$and", conds)
 	return f
 }
 
-// Not adds a condition to the filter where the specified key's value is not equal to the given value.
+// Not adds a condition to the filter where the specified key's value does not satisfy not.
 // The key is used as the field to apply the not condition to.
-// The not any parameter represents the value that the key's value is not equal to.
+// not is a regular expression, an operator document such as bson.M{"$gt": 1.99},
+// or a Condition whose conditions on key, or on the empty key, are negated together.
 // It creates a bson.M map with the "$not" operator and the given value, and appends it as a bson.E element in the filter.
+//
+// Example usage:
+//
+//	filter.Not("tags", DefaultCondition().Size("", 0))
+//	// filter.d is now {tags: {$not: {$size: 0}}}
 func (f *filter) Not(key string, not any) Condition {
+	if c, ok := not.(Condition); ok {
+		ops, rest, err := operatorsOf(key, c)
+		if err != nil {
+			f.err = err
+			return f
+		}
+		if len(rest) > 0 {
+			f.err = fmt.Errorf("not on %q cannot negate a condition on %q", key, rest[0].Key)
+			return f
+		}
+		not = ops
+	}
 	v := bson.M{
 		"$not": not,
 	}
@@ -397,14 +530,86 @@ func (f *filter) Not(key string, not any) Condition {
 	return f
 }
 
-func (f *filter) Nor(filter Condition) Condition {
-	f.d = append(f.d, bson.E{Key: "$nor", Value: filter.A()})
+// ElemMatch matches documents whose array field key has an element
+// satisfying every condition of c. Conditions on the empty key apply to the
+// element itself; conditions on other keys apply to the fields of embedded
+// document elements. The two forms cannot be mixed.
+//
+// Example usage:
+//
+//	filter.ElemMatch("results", DefaultCondition().Gte("", 80).Lt("", 85))
+//	// filter.d is now {results: {$elemMatch: {$gte: 80, $lt: 85}}}
+//
+//	filter.ElemMatch("items", DefaultCondition().Eq("name", "pen").Gt("qty", 1))
+//	// filter.d is now {items: {$elemMatch: {name: "pen", qty: {$gt: 1}}}}
+func (f *filter) ElemMatch(key string, c Condition) Condition {
+	filters, err := c.Filters()
+	if err != nil {
+		f.err = err
+		return f
+	}
+	var ops, fields bson.D
+	for _, e := range filters {
+		if e.Key == "" {
+			ops = append(ops, valueOperators(e.Value)...)
+		} else {
+			fields = append(fields, e)
+		}
+	}
+	switch {
+	case len(ops) > 0 && len(fields) > 0:
+		f.err = fmt.Errorf("elemMatch on %q cannot mix conditions on the element and on its fields", key)
+		return f
+	case len(ops) > 0:
+		fields = ops
+	case fields == nil:
+		fields = bson.D{}
+	}
+	f.d = append(f.d, bson.E{Key: key, Value: bson.M{"$elemMatch": fields}})
 	return f
 }
 
-// Or performs a logical OR operation on a filter condition.
-// This method appends the filter condition to the existing filter
-// using the $or operator.
+// All matches documents whose array field key holds every value of values,
+// in any order. values is a slice such as []string{"ssl", "security"}.
+//
+// Example usage:
+//
+//	filter.All("tags", []string{"ssl", "security"})
+//	// filter.d is now {tags: {$all: ["ssl", "security"]}}
+func (f *filter) All(key string, values any) Condition {
+	f.d = append(f.d, bson.E{Key: key, Value: bson.M{"$all": values}})
+	return f
+}
+
+// Size matches documents whose array field key has exactly n elements.
+//
+// Example usage:
+//
+//	filter.Size("tags", 2)
+//	// filter.d is now {tags: {$size: 2}}
+func (f *filter) Size(key string, n int) Condition {
+	f.d = append(f.d, bson.E{Key: key, Value: bson.M{"$size": n}})
+	return f
+}
+
+// Nor adds conds to the filter joined by the "$nor" operator: documents match
+// when they satisfy none of conds. Each Condition becomes one operand document.
+//
+// Example usage:
+//
+//	filter.Nor(DefaultCondition().Eq("price", 1.99), DefaultCondition().Eq("sale", true))
+//	// filter.d is now {$nor: [{price: 1.99}, {sale: true}]}
+func (f *filter) Nor(conds ...Condition) Condition {
+	f.logical("$nor", conds)
+	return f
+}
+
+// Or performs a logical OR operation on filter conditions.
+// This method appends conds to the existing filter using the $or operator,
+// each Condition becoming one operand document, so conditions built with
+// several fields express (a AND b) OR (c AND d). Operands that are themselves
+// a lone $or are spliced in, a single operand is merged as And would, and an
+// empty operand, which matches every document, makes the $or a no-op.
 //
 // Example:
 //
@@ -417,79 +622,234 @@ func (f *filter) Nor(filter Condition) Condition {
 //	}
 //
 // Parameters:
-// - filter: The filter condition to be logically OR'ed with.
+// - conds: The filter conditions to be logically OR'ed with.
 //
 // Returns:
 // The updated filter condition after the logical OR operation.
-func (f *filter) Or(filter Condition) Condition {
-	f.d = append(f.d, bson.E{Key: "$or", Value: filter.A()})
+func (f *filter) Or(conds ...Condition) Condition {
+	f.logical("$or", conds)
 	return f
 }
 
+// logical adds the operands of the logical operator op, one of $and, $or and
+// $nor, built from conds and simplified as the methods document.
+func (f *filter) logical(op string, conds []Condition) {
+	var clauses []bson.D
+	for _, c := range conds {
+		if c == nil {
+			continue
+		}
+		d, err := c.Filters()
+		if err != nil {
+			f.err = err
+			return
+		}
+		if len(d) == 0 {
+			switch op {
+			case "$and":
+				continue
+			case "$or":
+				return
+			}
+		}
+		if op != "$nor" {
+			if nested, ok := operandsOf(d, op); ok {
+				clauses = append(clauses, nested...)
+				continue
+			}
+		}
+		clauses = append(clauses, append(bson.D{}, d...))
+	}
+	if len(clauses) == 0 {
+		return
+	}
+	if op == "$or" && len(clauses) == 1 {
+		op = "$and"
+	}
+	if op == "$and" {
+		if f.disjoint(clauses) {
+			for _, c := range clauses {
+				f.d = append(f.d, c...)
+			}
+			return
+		}
+		// The fields of the filter that the operands repeat become an
+		// operand of their own, so no operand is joined to the filter twice.
+		if own := f.take(clauses); len(own) > 0 {
+			clauses = append([]bson.D{own}, clauses...)
+		}
+	}
+	operands := make(bson.A, len(clauses))
+	for i, c := range clauses {
+		operands[i] = c
+	}
+	f.addOperator(op, operands)
+}
+
+// operandsOf returns the operands of d when it is a lone {op: [...]}.
+func operandsOf(d bson.D, op string) ([]bson.D, bool) {
+	if len(d) != 1 || d[0].Key != op {
+		return nil, false
+	}
+	operands, ok := d[0].Value.(bson.A)
+	if !ok {
+		return nil, false
+	}
+	out := make([]bson.D, len(operands))
+	for i, o := range operands {
+		if out[i], ok = o.(bson.D); !ok {
+			return nil, false
+		}
+	}
+	return out, true
+}
+
+// disjoint reports whether no key appears twice among the filter and clauses.
+func (f *filter) disjoint(clauses []bson.D) bool {
+	seen := map[string]bool{}
+	for _, e := range f.d {
+		seen[e.Key] = true
+	}
+	for _, c := range clauses {
+		for _, e := range c {
+			if seen[e.Key] {
+				return false
+			}
+			seen[e.Key] = true
+		}
+	}
+	return true
+}
+
+// take removes the fields of the filter whose keys appear in clauses and
+// returns them.
+func (f *filter) take(clauses []bson.D) bson.D {
+	keys := map[string]bool{}
+	for _, c := range clauses {
+		for _, e := range c {
+			keys[e.Key] = true
+		}
+	}
+	var taken, kept bson.D
+	for _, e := range f.d {
+		if keys[e.Key] {
+			taken = append(taken, e)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	f.d = kept
+	return taken
+}
+
+// addOperator adds {op: operands} to the filter. A second $and or $nor is
+// merged into the first; a second $or is joined to it by $and.
+func (f *filter) addOperator(op string, operands bson.A) {
+	for i, e := range f.d {
+		if e.Key != op {
+			continue
+		}
+		existing, ok := e.Value.(bson.A)
+		if !ok {
+			break
+		}
+		if op != "$or" {
+			f.d[i].Value = append(append(bson.A{}, existing...), operands...)
+			return
+		}
+		f.d = append(f.d[:i:i], f.d[i+1:]...)
+		f.addOperator("$and", bson.A{bson.D{e}, bson.D{{Key: op, Value: operands}}})
+		return
+	}
+	f.d = append(f.d, bson.E{Key: op, Value: operands})
+}
+
 // Exists specifies whether a field exists or not in a document.
 // The `key` parameter specifies the field name to be checked.
 // The `exists` parameter specifies whether the field should exist (true) or not (false).
-// Additional filters can be passed as variadic arguments to further refine the query.
-// The returned result is a filter condition.
+// Additional conditions can be passed as variadic arguments. Their conditions
+// on key, or on the empty key, join $exists in the same operator document;
+// conditions on other fields are added to the filter alongside.
 //
 // Example:
-// To check if the "qty" field exists and has a value, use the following code:
-//
-//	filter := &filter{}
-//	condition := filter.Exists("qty", true)
-//
-// To check if the "item.name" field exists and has a value, use the following code:
-//
-//	filter := &filter{}
-//	condition := filter.Exists("item.name", true)
-//
-// To check if the "tags" field exists and has an array value, use the following code:
-//
-//	filter := &filter{}
-//	condition := filter.Exists("tags", true)
+// To check if the "qty" field exists, use the following code:
 //
-// Multiple conditions can be chained together by passing them as variadic arguments:
+//	filter.Exists("qty", true)
+//	// {qty: {$exists: true}}
 //
-//	filter := &filter{}
-//	condition := filter.Exists("qty", true, filter.Eq("status", "active"))
+// To require that "tags" exists and holds two elements:
 //
-// If an error occurs while processing the provided filters, the function sets
-// the error in the filter itself and returns the filter with the error:
+//	filter.Exists("tags", true, DefaultCondition().Size("", 2))
+//	// {tags: {$exists: true, $size: 2}}
 //
-//	filter := &filter{}
-//	condition := filter.Exists("qty", true, filter.Eq("status", "active"), filter.Lt("price", 10))
+// Conditions on other fields are ANDed with it:
 //
-// The returned condition can be used in query operations.
-// The filter can be applied later to filter the query results.
+//	filter.Exists("qty", true, DefaultCondition().Eq("status", "active"))
+//	// {qty: {$exists: true}, status: "active"}
 //
-//	query := collection.Find(condition)
-//	result, err := query.All()
-//	if err != nil {
-//	    // Handle error
-//	}
-//	// Process the query result
+// If an error occurs while processing the provided conditions, it is set on
+// the filter, which is returned unchanged otherwise.
 //
-// Note: When using the `exists` parameter, if it is set to false and the field exists but has a value of null or an array is empty, it will still match the condition as true.
+// Note: {$exists: true} also matches fields holding null.
 func (f *filter) Exists(key string, exists bool, filter ...Condition) Condition {
-	m := bson.M{
-		"$exists": exists,
-	}
-
-	for _, v := range filter {
-		filters, err := v.Filters()
+	ops := bson.D{{Key: "$exists", Value: exists}}
+	var rest bson.D
+	for _, c := range filter {
+		o, r, err := operatorsOf(key, c)
 		if err != nil {
 			f.err = err
 			return f
 		}
-		for _, fv := range filters {
-			m[fv.Key] = fv.Value
-		}
+		ops = append(ops, o...)
+		rest = append(rest, r...)
 	}
 
-	f.d = append(f.d, bson.E{Key: key, Value: m})
+	f.d = append(f.d, bson.E{Key: key, Value: ops})
+	f.d = append(f.d, rest...)
 	return f
 }
 
+// operatorsOf returns the conditions of c on key, or on the empty key, as one
+// operator document, and its conditions on other keys apart.
+func operatorsOf(key string, c Condition) (ops, rest bson.D, err error) {
+	filters, err := c.Filters()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range filters {
+		if e.Key == "" || e.Key == key {
+			ops = append(ops, valueOperators(e.Value)...)
+		} else {
+			rest = append(rest, e)
+		}
+	}
+	return ops, rest, nil
+}
+
+// valueOperators returns the condition a filter value puts on its field as
+// operators: operator documents as they are, regular expressions as $regex
+// and other values as $eq.
+func valueOperators(v any) bson.D {
+	switch x := v.(type) {
+	case bson.M, bson.D:
+		if ops := entries(x); len(ops) > 0 && isOperators(ops) {
+			return ops
+		}
+	case primitive.Regex:
+		return bson.D{{Key: "$regex", Value: x}}
+	}
+	return bson.D{{Key: "$eq", Value: v}}
+}
+
+func isOperators(d []bson.E) bool {
+	for _, e := range d {
+		if !strings.HasPrefix(e.Key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
 // Type Specifies the BSON type for a specific field
 // Example:
 //
@@ -503,17 +863,43 @@ func (f *filter) Type(key string, t any) Condition {
 	return f
 }
 
-// Expr appends a bson.E element with the key "$expr" and the value of the filter's A() method to the filter condition.
-// The filter's A() method is expected to return a Condition object.
+// Expr appends a bson.E element with the key "$expr" and the aggregation
+// expression. The expression is usually built with package expr; a Condition
+// is taken to hold expression documents, and a Condition holding several is
+// turned into their $and since an expression document has a single operator.
+// A nil expression sets the filter's error.
 // Returns the updated filter condition.
 // Example usage:
 //
-//	filter := &filter{}
-//	cond := bson.M{"$gt": bson.A{"$field1", "$field2"}}
-//	filter.Expr(cond)
-//	// filter.d is now []bson.E{bson.E{Key: "$expr", Value: bson.M{"$gt": bson.A{"$field1", "$field2"}}}}
-func (f *filter) Expr(filter Condition) Condition {
-	f.d = append(f.d, bson.E{Key: "$expr", Value: filter.A()})
+//	filter.Expr(expr.Gt(expr.Field("spent"), expr.Field("budget")))
+//	// filter.d is now {$expr: {$gt: ["$spent", "$budget"]}}
+func (f *filter) Expr(expression any) Condition {
+	if expression == nil {
+		f.err = errors.New("nil $expr expression")
+		return f
+	}
+	filter, ok := expression.(Condition)
+	if !ok {
+		f.d = append(f.d, bson.E{Key: "$expr", Value: expression})
+		return f
+	}
+	d, err := filter.Filters()
+	if err != nil {
+		f.err = err
+		return f
+	}
+	switch len(d) {
+	case 0:
+		return f
+	case 1:
+		f.d = append(f.d, bson.E{Key: "$expr", Value: d})
+	default:
+		operands := make(bson.A, len(d))
+		for i, e := range d {
+			operands[i] = bson.D{e}
+		}
+		f.d = append(f.d, bson.E{Key: "$expr", Value: bson.D{{Key: "$and", Value: operands}}})
+	}
 	return f
 }
 
@@ -521,18 +907,288 @@ func (f *filter) Expr(filter Condition) Condition {
 //
 // The key parameter is the name of the field to match against.
 //
-// The value parameter is the regular expression pattern to match.
+// The pattern parameter is the regular expression pattern to match. It is
+// passed to the server as is, so user input should go through StartsWith,
+// EndsWith, Contains or EqualFold, or be escaped with regexp.QuoteMeta.
+//
+// The opts parameter holds the options: i ignores case, m makes ^ and $ match
+// at line breaks, s lets . match newlines and x ignores whitespace and
+// comments in the pattern. Other options set the filter's error.
 //
 // Returns the updated filter condition.
 //
 // Example usage:
 //
 //	filter := &filter{}
-//	filter.Regex("name", "^J") // Matches names that start with "J"
-//	// filter.d is now []bson.E{bson.E{Key: "name", Value: primitive.Regex{Pattern: "^J", Options: ""}}}
-func (f *filter) Regex(key string, value string) Condition {
-	v := primitive.Regex{Pattern: value, Options: ""}
-	f.d = append(f.d, bson.E{Key: key, Value: v})
+//	filter.Regex("name", "^J", "i") // Matches names that start with "J" or "j"
+//	// filter.d is now []bson.E{bson.E{Key: "name", Value: primitive.Regex{Pattern: "^J", Options: "i"}}}
+func (f *filter) Regex(key string, pattern string, opts string) Condition {
+	options, err := regexOptions(opts)
+	if err != nil {
+		f.err = err
+		return f
+	}
+	f.d = append(f.d, bson.E{Key: key, Value: primitive.Regex{Pattern: pattern, Options: options}})
+	return f
+}
+
+// StartsWith matches strings beginning with prefix, taken literally. The
+// pattern is anchored and case-sensitive, so the server can answer it from
+// an index on key.
+//
+// Example usage:
+//
+//	filter.StartsWith("name", "J.")
+//	// filter.d is now {name: /^J\./}
+func (f *filter) StartsWith(key string, prefix string) Condition {
+	return f.Regex(key, "^"+regexp.QuoteMeta(prefix), "")
+}
+
+// EndsWith matches strings ending with suffix, taken literally.
+//
+// Example usage:
+//
+//	filter.EndsWith("email", "@example.com")
+//	// filter.d is now {email: /@example\.com\z/}
+func (f *filter) EndsWith(key string, suffix string) Condition {
+	return f.Regex(key, regexp.QuoteMeta(suffix)+`\z`, "")
+}
+
+// Contains matches strings containing substr, taken literally.
+//
+// Example usage:
+//
+//	filter.Contains("title", "(draft)")
+//	// filter.d is now {title: /\(draft\)/}
+func (f *filter) Contains(key string, substr string) Condition {
+	return f.Regex(key, regexp.QuoteMeta(substr), "")
+}
+
+// EqualFold matches strings equal to s ignoring case. Unlike StartsWith it
+// cannot use an ordinary index; a collation with strength 2 can.
+//
+// Example usage:
+//
+//	filter.EqualFold("email", "Ann@Example.com")
+//	// filter.d is now {email: /^Ann@Example\.com\z/i}
+func (f *filter) EqualFold(key string, s string) Condition {
+	return f.Regex(key, "^"+regexp.QuoteMeta(s)+`\z`, "i")
+}
+
+// regexOptions validates opts and returns them sorted and without repeats.
+func regexOptions(opts string) (string, error) {
+	var set [4]bool
+	for _, o := range opts {
+		i := strings.IndexRune("imsx", o)
+		if i < 0 {
+			return "", fmt.Errorf("invalid regex option %q", o)
+		}
+		set[i] = true
+	}
+	var b strings.Builder
+	for i, ok := range set {
+		if ok {
+			b.WriteByte("imsx"[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// Text adds a $text search over the fields of the collection's text index.
+// Words match in any order and any of them suffices; a quoted "phrase" must
+// appear as is and a -word excludes documents containing it. An empty
+// language uses the index's default language, and "none" turns stemming and
+// stop words off. The flags are only written when set.
+//
+// Example usage:
+//
+//	filter.Text(`coffee -decaf "fair trade"`, "", false, false)
+//	// filter.d is now {$text: {$search: "coffee -decaf \"fair trade\""}}
+func (f *filter) Text(search, language string, caseSensitive, diacriticSensitive bool) Condition {
+	text := bson.D{{Key: "$search", Value: search}}
+	if language != "" {
+		text = append(text, bson.E{Key: "$language", Value: language})
+	}
+	if caseSensitive {
+		text = append(text, bson.E{Key: "$caseSensitive", Value: true})
+	}
+	if diacriticSensitive {
+		text = append(text, bson.E{Key: "$diacriticSensitive", Value: true})
+	}
+	f.d = append(f.d, bson.E{Key: "$text", Value: text})
+	return f
+}
+
+// Near matches documents near a point, nearest first. The field needs a
+// 2dsphere index; distances are in meters and left out when zero.
+//
+// Example usage:
+//
+//	filter.Near("location", geo.NewPoint(13.4, 52.5), 1000, 0)
+//	// filter.d is now {location: {$near: {$geometry: {type: "Point", coordinates: [13.4, 52.5]}, $maxDistance: 1000}}}
+func (f *filter) Near(key string, point geo.Point, maxDistance, minDistance float64) Condition {
+	f.d = append(f.d, bson.E{Key: key, Value: bson.M{"$near": geo.Near(point, maxDistance, minDistance)}})
+	return f
+}
+
+// NearSphere is Near with $nearSphere. The point is written as GeoJSON, so
+// like Near it needs a 2dsphere index; fields indexed with AddIndex2d are
+// queried with GeoWithin instead.
+func (f *filter) NearSphere(key string, point geo.Point, maxDistance, minDistance float64) Condition {
+	f.d = append(f.d, bson.E{Key: key, Value: bson.M{"$nearSphere": geo.Near(point, maxDistance, minDistance)}})
+	return f
+}
+
+// GeoWithin matches documents whose field lies entirely within shape: a
+// geo.Polygon or geo.MultiPolygon, or a geo.Box, geo.LegacyPolygon or
+// geo.CenterSphere.
+//
+// Example usage:
+//
+//	filter.GeoWithin("location", geo.CenterSphere{Center: geo.Position{13.4, 52.5}, Radius: geo.Radians(5000)})
+func (f *filter) GeoWithin(key string, shape geo.Shape) Condition {
+	if shape == nil {
+		f.err = errors.New("geoWithin needs a shape")
+		return f
+	}
+	f.d = append(f.d, bson.E{Key: key, Value: bson.M{"$geoWithin": shape.Within()}})
+	return f
+}
+
+// GeoIntersects matches documents whose field intersects geometry.
+//
+// Example usage:
+//
+//	filter.GeoIntersects("area", geo.NewPoint(13.4, 52.5))
+func (f *filter) GeoIntersects(key string, geometry geo.Geometry) Condition {
+	if geometry == nil {
+		f.err = errors.New("geoIntersects needs a geometry")
+		return f
+	}
+	f.d = append(f.d, bson.E{Key: key, Value: bson.M{"$geoIntersects": bson.M{"$geometry": geometry}}})
+	return f
+}
+
+// Mod matches documents whose field key divided by divisor leaves remainder.
+// The divisor cannot be zero.
+//
+// Example usage:
+//
+//	filter.Mod("qty", 4, 0)
+//	// filter.d is now {qty: {$mod: [4, 0]}}
+func (f *filter) Mod(key string, divisor, remainder int64) Condition {
+	if divisor == 0 {
+		f.err = fmt.Errorf("mod on %q: divisor cannot be 0", key)
+		return f
+	}
+	f.d = append(f.d, bson.E{Key: key, Value: bson.M{"$mod": bson.A{divisor, remainder}}})
+	return f
+}
+
+// BitsAllSet matches documents whose integer or binary field key has all of
+// bits set. bits is one of
+//
+//	an integer mask     BitsAllSet("perm", 0b101) tests bits 0 and 2
+//	bit positions       BitsAllSet("perm", []int{0, 2}) tests the same bits
+//	a binary mask       BitsAllSet("perm", []byte{0x05}) or a primitive.Binary
+//
+// Masks and positions cannot be negative.
+func (f *filter) BitsAllSet(key string, bits any) Condition {
+	return f.bits("$bitsAllSet", key, bits)
+}
+
+// BitsAnySet matches documents whose field key has any of bits set; see BitsAllSet.
+func (f *filter) BitsAnySet(key string, bits any) Condition {
+	return f.bits("$bitsAnySet", key, bits)
+}
+
+// BitsAllClear matches documents whose field key has all of bits clear; see BitsAllSet.
+func (f *filter) BitsAllClear(key string, bits any) Condition {
+	return f.bits("$bitsAllClear", key, bits)
+}
+
+// BitsAnyClear matches documents whose field key has any of bits clear; see BitsAllSet.
+func (f *filter) BitsAnyClear(key string, bits any) Condition {
+	return f.bits("$bitsAnyClear", key, bits)
+}
+
+func (f *filter) bits(op, key string, bits any) Condition {
+	v, err := bitsOperand(bits)
+	if err != nil {
+		f.err = fmt.Errorf("%s on %q: %w", op, key, err)
+		return f
+	}
+	f.d = append(f.d, bson.E{Key: key, Value: bson.M{op: v}})
+	return f
+}
+
+// bitsOperand validates the operand of a bitwise operator: integers are masks,
+// integer slices bit positions and byte slices binary masks.
+func bitsOperand(bits any) (any, error) {
+	switch x := bits.(type) {
+	case primitive.Binary:
+		return x, nil
+	case []byte:
+		return primitive.Binary{Data: x}, nil
+	}
+	v := reflect.ValueOf(bits)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := nonNegative(v)
+		if !ok {
+			return nil, errors.New("bit mask must be a nonnegative integer that fits in 64 bits")
+		}
+		return n, nil
+	case reflect.Slice, reflect.Array:
+		positions := make([]int64, v.Len())
+		for i := range positions {
+			n, ok := nonNegative(v.Index(i))
+			if !ok {
+				return nil, fmt.Errorf("bit position %v must be a nonnegative integer", v.Index(i).Interface())
+			}
+			positions[i] = n
+		}
+		return positions, nil
+	}
+	return nil, fmt.Errorf("bits must be an integer mask, a slice of bit positions or a binary mask, not %T", bits)
+}
+
+func nonNegative(v reflect.Value) (int64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), v.Int() >= 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int64(v.Uint()), v.Uint() <= math.MaxInt64
+	}
+	return 0, false
+}
+
+// JSONSchema matches documents that validate against schema, a $jsonSchema
+// document given as bson.M, bson.D or a struct.
+//
+// Example usage:
+//
+//	filter.JSONSchema(bson.M{"required": bson.A{"name"}, "properties": bson.M{"name": bson.M{"bsonType": "string"}}})
+//
+// Match does not evaluate $jsonSchema and reports it as unsupported.
+func (f *filter) JSONSchema(schema any) Condition {
+	if schema == nil {
+		f.err = errors.New("jsonSchema needs a schema")
+		return f
+	}
+	if _, err := mql.NormalizeDoc(schema); err != nil {
+		f.err = fmt.Errorf("invalid $jsonSchema: %w", err)
+		return f
+	}
+	f.d = append(f.d, bson.E{Key: "$jsonSchema", Value: schema})
+	return f
+}
+
+// Comment attaches comment to the query, which the server writes to its
+// logs, profiler and currentOp output.
+func (f *filter) Comment(comment string) Condition {
+	f.d = append(f.d, bson.E{Key: "$comment", Value: comment})
 	return f
 }
 
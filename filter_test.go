@@ -2,9 +2,12 @@ package pie
 
 import (
 	"testing"
+	"time"
 
+	"github.com/5xxxx/pie/expr"
 	. "github.com/smartystreets/goconvey/convey"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type person struct {
@@ -40,3 +43,416 @@ func TestFilterBySkipsIgnoredFields(t *testing.T) {
 		So(d, ShouldResemble, bson.D{{Key: "name", Value: "Alice"}})
 	})
 }
+
+type account struct {
+	Name    string   `bson:"name"`
+	Age     int      `bson:"age"`
+	Tags    []string `bson:"tags,omitempty"`
+	Address struct {
+		City string `bson:"city"`
+	} `bson:"address"`
+}
+
+func TestConditionMatch(t *testing.T) {
+	Convey("Match evaluates filters against in-memory documents", t, func() {
+		a := account{Name: "alice", Age: 30, Tags: []string{"admin", "dev"}}
+		a.Address.City = "Paris"
+
+		Convey("Structs, bson.M and bson.Raw are accepted", func() {
+			ok, err := DefaultCondition().Eq("name", "alice").Gte("age", 18).Match(&a)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+
+			ok, err = DefaultCondition().Lt("age", 30.5).Match(bson.M{"age": int64(30)})
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+
+			raw, err := bson.Marshal(a)
+			So(err, ShouldBeNil)
+			ok, err = DefaultCondition().Ne("name", "alice").Match(bson.Raw(raw))
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Dotted paths reach into embedded documents and arrays", func() {
+			ok, err := DefaultCondition().Eq("address.city", "Paris").Eq("tags", "dev").Match(a)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+
+			ok, err = DefaultCondition().Eq("tags.1", "admin").Match(a)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Set, existence, type and regex operators are supported", func() {
+			ok, err := DefaultCondition().In("tags", []string{"ops", "admin"}).Nin("name", []string{"bob"}).Match(a)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+
+			ok, err = DefaultCondition().Exists("email", false).Type("age", "number").Match(a)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+
+			ok, err = DefaultCondition().RegexFilter("name", "^AL").Match(a)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+
+			ok, err = DefaultCondition().Not("age", bson.M{"$gt": 20}).Match(a)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Logical operators combine clauses", func() {
+			f := DefaultCondition().FilterBson(bson.D{{Key: "$or", Value: bson.A{
+				bson.M{"age": bson.M{"$lt": 18}},
+				bson.M{"address.city": "Paris"},
+			}}})
+			ok, err := f.Match(a)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+
+			f = DefaultCondition().FilterBson(bson.D{{Key: "$nor", Value: bson.A{bson.M{"name": "alice"}}}})
+			ok, err = f.Match(a)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Filter errors and unsupported operators are reported", func() {
+			_, err := DefaultCondition().FilterBy(1).Match(a)
+			So(err, ShouldNotBeNil)
+
+			_, err = DefaultCondition().FilterBson(bson.M{"age": bson.M{"$where": "1"}}).Match(a)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestTextCondition(t *testing.T) {
+	Convey("Text writes only the options that are set", t, func() {
+		d, err := DefaultCondition().Text("coffee -decaf", "", false, false).Filters()
+		So(err, ShouldBeNil)
+		So(d, ShouldResemble, bson.D{{Key: "$text", Value: bson.D{{Key: "$search", Value: "coffee -decaf"}}}})
+
+		d, err = DefaultCondition().Text("café", "french", true, true).Filters()
+		So(err, ShouldBeNil)
+		So(d, ShouldResemble, bson.D{{Key: "$text", Value: bson.D{
+			{Key: "$search", Value: "café"},
+			{Key: "$language", Value: "french"},
+			{Key: "$caseSensitive", Value: true},
+			{Key: "$diacriticSensitive", Value: true},
+		}}})
+	})
+}
+
+func TestArrayConditions(t *testing.T) {
+	Convey("Array conditions", t, func() {
+		Convey("ElemMatch builds the operator form from conditions on the empty key", func() {
+			d, err := DefaultCondition().ElemMatch("results", DefaultCondition().Gte("", 80).Lt("", 85)).Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{{Key: "results", Value: bson.M{"$elemMatch": bson.D{
+				{Key: "$gte", Value: 80}, {Key: "$lt", Value: 85},
+			}}}})
+		})
+
+		Convey("ElemMatch builds the field form from conditions on fields", func() {
+			d, err := DefaultCondition().ElemMatch("items", DefaultCondition().Eq("name", "pen").Gt("qty", 1)).Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{{Key: "items", Value: bson.M{"$elemMatch": bson.D{
+				{Key: "name", Value: "pen"}, {Key: "qty", Value: bson.M{"$gt": 1}},
+			}}}})
+			So(DefaultCondition().ElemMatch("items", DefaultCondition().Eq("", 1).Eq("name", "pen")).Err(), ShouldNotBeNil)
+		})
+
+		Convey("Exists and Not merge conditions on their field", func() {
+			d, err := DefaultCondition().Exists("tags", true, DefaultCondition().Size("", 2).Eq("status", "active")).Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{
+				{Key: "tags", Value: bson.D{{Key: "$exists", Value: true}, {Key: "$size", Value: 2}}},
+				{Key: "status", Value: "active"},
+			})
+
+			d, err = DefaultCondition().Not("tags", DefaultCondition().Size("tags", 0)).Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{{Key: "tags", Value: bson.M{"$not": bson.D{{Key: "$size", Value: 0}}}}})
+			So(DefaultCondition().Not("tags", DefaultCondition().Eq("name", "x")).Err(), ShouldNotBeNil)
+		})
+
+		Convey("Match evaluates them in memory", func() {
+			doc := bson.M{
+				"tags":    bson.A{"ssl", "security", "go"},
+				"results": bson.A{82, 90},
+				"items":   bson.A{bson.M{"name": "pen", "qty": 2}, bson.M{"name": "ink", "qty": 1}},
+			}
+			cases := []struct {
+				c    Condition
+				want bool
+			}{
+				{DefaultCondition().All("tags", []string{"security", "ssl"}), true},
+				{DefaultCondition().All("tags", []string{"ssl", "rust"}), false},
+				{DefaultCondition().Size("tags", 3), true},
+				{DefaultCondition().Size("tags", 2), false},
+				{DefaultCondition().ElemMatch("results", DefaultCondition().Gte("", 80).Lt("", 85)), true},
+				{DefaultCondition().ElemMatch("results", DefaultCondition().Gte("", 91)), false},
+				{DefaultCondition().ElemMatch("items", DefaultCondition().Eq("name", "ink").Gt("qty", 1)), false},
+				{DefaultCondition().ElemMatch("items", DefaultCondition().Eq("name", "pen").Gt("qty", 1)), true},
+				{DefaultCondition().Not("tags", DefaultCondition().Size("", 0)), true},
+				{DefaultCondition().Exists("tags", true, DefaultCondition().Size("", 3)), true},
+			}
+			for _, tc := range cases {
+				ok, err := tc.c.Match(doc)
+				So(err, ShouldBeNil)
+				So(ok, ShouldEqual, tc.want)
+			}
+		})
+	})
+}
+
+func TestModAndBitsConditions(t *testing.T) {
+	Convey("$mod and bitwise conditions", t, func() {
+		Convey("Arguments are validated", func() {
+			So(DefaultCondition().Mod("qty", 0, 1).Err(), ShouldNotBeNil)
+			So(DefaultCondition().BitsAllSet("perm", -1).Err(), ShouldNotBeNil)
+			So(DefaultCondition().BitsAnySet("perm", []int{1, -2}).Err(), ShouldNotBeNil)
+			So(DefaultCondition().BitsAllClear("perm", "5").Err(), ShouldNotBeNil)
+			So(DefaultCondition().JSONSchema(nil).Err(), ShouldNotBeNil)
+		})
+
+		Convey("Masks, positions and binary masks are encoded as given", func() {
+			d, err := DefaultCondition().
+				BitsAllSet("perm", uint8(0b101)).
+				BitsAnyClear("perm", []int{0, 2}).
+				BitsAnySet("flags", []byte{0x05}).
+				Mod("qty", 4, 1).
+				Comment("permissions").
+				Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{
+				{Key: "perm", Value: bson.M{"$bitsAllSet": int64(5)}},
+				{Key: "perm", Value: bson.M{"$bitsAnyClear": []int64{0, 2}}},
+				{Key: "flags", Value: bson.M{"$bitsAnySet": primitive.Binary{Data: []byte{0x05}}}},
+				{Key: "qty", Value: bson.M{"$mod": bson.A{int64(4), int64(1)}}},
+				{Key: "$comment", Value: "permissions"},
+			})
+		})
+
+		Convey("Match evaluates them in memory", func() {
+			doc := bson.M{"perm": 0b0110, "qty": 9, "flags": primitive.Binary{Data: []byte{0x01, 0x80}}}
+			cases := []struct {
+				c    Condition
+				want bool
+			}{
+				{DefaultCondition().Mod("qty", 4, 1), true},
+				{DefaultCondition().Mod("qty", 4, 0), false},
+				{DefaultCondition().BitsAllSet("perm", 0b0110), true},
+				{DefaultCondition().BitsAllSet("perm", []int{1, 3}), false},
+				{DefaultCondition().BitsAnySet("perm", []int{0, 2}), true},
+				{DefaultCondition().BitsAllClear("perm", 0b1001), true},
+				{DefaultCondition().BitsAnyClear("perm", 0b0110), false},
+				{DefaultCondition().BitsAllSet("flags", []int{0, 15}), true},
+				{DefaultCondition().BitsAnySet("flags", []byte{0x02}), false},
+				{DefaultCondition().Comment("ignored").Eq("qty", 9), true},
+			}
+			for _, tc := range cases {
+				ok, err := tc.c.Match(doc)
+				So(err, ShouldBeNil)
+				So(ok, ShouldEqual, tc.want)
+			}
+		})
+	})
+}
+
+func TestLogicalConditions(t *testing.T) {
+	Convey("$and, $or and $nor", t, func() {
+		c := DefaultCondition
+		Convey("Each operand becomes its own document", func() {
+			d, err := c().Or(c().Eq("a", 1).Eq("b", 2), c().Eq("c", 3).Eq("d", 4)).Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{{Key: "$or", Value: bson.A{
+				bson.D{{Key: "a", Value: 1}, {Key: "b", Value: 2}},
+				bson.D{{Key: "c", Value: 3}, {Key: "d", Value: 4}},
+			}}})
+
+			d, err = c().Nor(c().Eq("price", 1.99), c().Eq("sale", true)).Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{{Key: "$nor", Value: bson.A{
+				bson.D{{Key: "price", Value: 1.99}},
+				bson.D{{Key: "sale", Value: true}},
+			}}})
+		})
+
+		Convey("Redundant nesting is simplified", func() {
+			d, err := c().Or(c().Or(c().Eq("a", 1), c().Eq("b", 2)), c().Eq("c", 3)).Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{{Key: "$or", Value: bson.A{
+				bson.D{{Key: "a", Value: 1}},
+				bson.D{{Key: "b", Value: 2}},
+				bson.D{{Key: "c", Value: 3}},
+			}}})
+
+			d, err = c().Eq("a", 1).And(c().Eq("b", 2), c(), c().Or(c().Eq("c", 3))).Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{{Key: "a", Value: 1}, {Key: "b", Value: 2}, {Key: "c", Value: 3}})
+
+			d, err = c().Eq("a", 1).Or(c().Eq("b", 2), c()).Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{{Key: "a", Value: 1}})
+		})
+
+		Convey("Operands on the same field are kept apart", func() {
+			d, err := c().Eq("a", 1).And(c().Eq("a", 2)).Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{{Key: "$and", Value: bson.A{
+				bson.D{{Key: "a", Value: 1}},
+				bson.D{{Key: "a", Value: 2}},
+			}}})
+
+			d, err = c().Gt("qty", 10).Eq("b", 1).And(c().Lt("qty", 50)).And(c().Ne("qty", 20)).Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{
+				{Key: "b", Value: 1},
+				{Key: "$and", Value: bson.A{
+					bson.D{{Key: "qty", Value: bson.M{"$gt": 10}}},
+					bson.D{{Key: "qty", Value: bson.M{"$lt": 50}}},
+				}},
+				{Key: "qty", Value: bson.M{"$ne": 20}},
+			})
+
+			d, err = c().Or(c().Eq("a", 1), c().Eq("b", 2)).Or(c().Eq("c", 3), c().Eq("d", 4)).Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{{Key: "$and", Value: bson.A{
+				bson.D{{Key: "$or", Value: bson.A{bson.D{{Key: "a", Value: 1}}, bson.D{{Key: "b", Value: 2}}}}},
+				bson.D{{Key: "$or", Value: bson.A{bson.D{{Key: "c", Value: 3}}, bson.D{{Key: "d", Value: 4}}}}},
+			}}})
+		})
+
+		Convey("Operand errors are kept", func() {
+			So(c().Or(c().Eq("a", 1), c().Mod("b", 0, 0)).Err(), ShouldNotBeNil)
+		})
+
+		Convey("Expr holds a single expression", func() {
+			gt := bson.E{Key: "$gt", Value: bson.A{"$spent", "$budget"}}
+			lt := bson.E{Key: "$lt", Value: bson.A{"$spent", 100}}
+			d, err := c().Expr(c().FilterBson(bson.D{gt})).Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{{Key: "$expr", Value: bson.D{gt}}})
+
+			d, err = c().Expr(c().FilterBson(bson.D{gt, lt})).Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{{Key: "$expr", Value: bson.D{{Key: "$and", Value: bson.A{bson.D{gt}, bson.D{lt}}}}}})
+		})
+
+		Convey("Match evaluates nested operands", func() {
+			doc := bson.M{"a": 1, "b": 5, "c": 3, "d": 4}
+			cases := []struct {
+				c    Condition
+				want bool
+			}{
+				{c().Or(c().Eq("a", 1).Eq("b", 2), c().Eq("c", 3).Eq("d", 4)), true},
+				{c().Or(c().Eq("a", 1).Eq("b", 2), c().Eq("c", 3).Eq("d", 5)), false},
+				{c().And(c().Or(c().Eq("a", 2), c().Eq("b", 5)), c().Nor(c().Eq("c", 4), c().Eq("d", 5))), true},
+				{c().Nor(c().Or(c().Eq("a", 2), c().Eq("b", 5))), false},
+			}
+			for _, tc := range cases {
+				ok, err := tc.c.Match(doc)
+				So(err, ShouldBeNil)
+				So(ok, ShouldEqual, tc.want)
+			}
+		})
+	})
+}
+
+func TestRegexConditions(t *testing.T) {
+	Convey("Regular expressions", t, func() {
+		Convey("Options are validated and normalized", func() {
+			d, err := DefaultCondition().Regex("name", "^j", "xii").Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{{Key: "name", Value: primitive.Regex{Pattern: "^j", Options: "ix"}}})
+			So(DefaultCondition().Regex("name", "^j", "g").Err(), ShouldNotBeNil)
+		})
+
+		Convey("Helpers escape their input", func() {
+			d, err := DefaultCondition().
+				StartsWith("name", "a.b*").
+				EndsWith("email", "@x.com").
+				Contains("title", "(draft)").
+				EqualFold("city", "São Paulo?").
+				Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{
+				{Key: "name", Value: primitive.Regex{Pattern: `^a\.b\*`}},
+				{Key: "email", Value: primitive.Regex{Pattern: `@x\.com\z`}},
+				{Key: "title", Value: primitive.Regex{Pattern: `\(draft\)`}},
+				{Key: "city", Value: primitive.Regex{Pattern: `^São Paulo\?\z`, Options: "i"}},
+			})
+		})
+
+		Convey("Match treats the input literally", func() {
+			doc := bson.M{"name": "a.b*c", "email": "ann@x.com\n", "title": "Notes (draft)", "city": "SÃO PAULO?"}
+			cases := []struct {
+				c    Condition
+				want bool
+			}{
+				{DefaultCondition().StartsWith("name", "a.b*"), true},
+				{DefaultCondition().StartsWith("name", "A.b"), false},
+				{DefaultCondition().StartsWith("name", "axb"), false},
+				{DefaultCondition().EndsWith("email", "@x.com"), false},
+				{DefaultCondition().EndsWith("email", "@x.com\n"), true},
+				{DefaultCondition().Contains("title", "(draft)"), true},
+				{DefaultCondition().Contains("title", "draft)."), false},
+				{DefaultCondition().EqualFold("city", "são paulo?"), true},
+				{DefaultCondition().EqualFold("city", "são paulo"), false},
+			}
+			for _, tc := range cases {
+				ok, err := tc.c.Match(doc)
+				So(err, ShouldBeNil)
+				So(ok, ShouldEqual, tc.want)
+			}
+		})
+	})
+}
+
+func TestExprConditions(t *testing.T) {
+	Convey("Aggregation expressions in $expr", t, func() {
+		Convey("Builder values are sent as they are", func() {
+			d, err := DefaultCondition().Expr(expr.Gt(expr.Field("spent"), expr.Field("budget"))).Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{{Key: "$expr", Value: bson.D{{Key: "$gt", Value: bson.A{"$spent", "$budget"}}}}})
+			So(DefaultCondition().Expr(nil).Err(), ShouldNotBeNil)
+		})
+
+		Convey("Match evaluates them in memory", func() {
+			created := time.Date(2024, time.March, 31, 23, 30, 0, 0, time.UTC)
+			doc := bson.M{"spent": 120, "budget": 100, "name": "  Ann Lee ", "created": created,
+				"items": bson.A{bson.M{"qty": 2, "price": 10.0}, bson.M{"qty": 1, "price": 99.5}}}
+			cases := []struct {
+				e    any
+				want bool
+			}{
+				{expr.Gt(expr.Field("spent"), expr.Field("budget")), true},
+				{expr.Eq(expr.Cond(expr.Gte(expr.Field("spent"), 100), "over", "under"), "over"), true},
+				{expr.Eq(expr.Switch(expr.Case(expr.Lt(expr.Field("spent"), 50), "low"), expr.Default("high")), "high"), true},
+				{expr.Eq(expr.IfNull(expr.Field("missing"), 7), 7), true},
+				{expr.Eq(expr.Trim(expr.ToUpper(expr.Field("name")), ""), "ANN LEE"), true},
+				{expr.RegexMatch(expr.Field("name"), `^\s*ann`, "i"), true},
+				{expr.Eq(expr.Split(expr.Trim(expr.Field("name"), " "), " "), bson.A{"Ann", "Lee"}), true},
+				{expr.Eq(expr.Reduce(expr.Field("items"), 0, expr.Add(expr.Value, expr.Var("this.qty"))), 3), true},
+				{expr.Eq(expr.Size(expr.Filter(expr.Field("items"), "i", expr.Gt(expr.Var("i.price"), 50))), 1), true},
+				{expr.Eq(expr.Sum(expr.Map(expr.Field("items"), "", expr.Multiply(expr.Var("this.qty"), expr.Var("this.price")))), 119.5), true},
+				{expr.Eq(expr.Month(expr.Field("created")), 3), true},
+				{expr.Eq(expr.Month(expr.Field("created"), "+02:00"), 4), true},
+				{expr.Eq(expr.DateToString(expr.Field("created"), "%Y-%m-%d"), "2024-03-31"), true},
+				{expr.Eq(expr.DayOfMonth(expr.DateAdd(expr.Field("created"), "month", -1)), 29), true},
+				{expr.Eq(expr.DateDiff(expr.Field("created"), expr.DateAdd(expr.Field("created"), "hour", 1), "day"), 1), true},
+				{expr.Lt(expr.Field("spent"), expr.Field("budget")), false},
+			}
+			for _, tc := range cases {
+				ok, err := DefaultCondition().Expr(tc.e).Match(doc)
+				So(err, ShouldBeNil)
+				So(ok, ShouldEqual, tc.want)
+			}
+
+			_, err := DefaultCondition().Expr(expr.Switch(expr.Case(false, 1))).Match(doc)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
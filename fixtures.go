@@ -0,0 +1,386 @@
+package pie
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/5xxxx/pie/internal/bsonstruct"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/yaml.v3"
+)
+
+// FixtureIDs maps the symbolic IDs used in fixture files to the ObjectIDs generated for them.
+type FixtureIDs map[string]primitive.ObjectID
+
+// defaultFixturePatterns are the files Load reads when no patterns are given.
+var defaultFixturePatterns = []string{"*.json", "*.yaml", "*.yml"}
+
+// Fixtures holds the models fixture files are loaded into. A file is named
+// after a collection, and its documents are decoded into the model stored
+// in it, so that they are inserted the way the application inserts them.
+type Fixtures struct {
+	mu     sync.Mutex
+	models []reflect.Type
+}
+
+// NewFixtures returns a set of fixtures without models.
+func NewFixtures() *Fixtures {
+	return &Fixtures{}
+}
+
+// Register adds the model structs or struct pointers the fixture files of
+// their collections are decoded into.
+func (f *Fixtures) Register(models ...any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, model := range models {
+		f.models = append(f.models, reflect.TypeOf(model))
+	}
+}
+
+// Load inserts the documents of the fixture files in fsys matching
+// patterns, "*.json", "*.yaml" and "*.yml" by default, through client. Each
+// file is named after the collection of a registered model, e.g. users.yaml,
+// and holds either a list of documents or an object
+// {"truncate": false, "documents": [...]}. Collections are emptied before
+// their first file is loaded unless truncate is false. JSON files are
+// Extended JSON; YAML files may use Extended JSON wrappers such as
+// {$oid: ...} as well.
+//
+// Two kinds of string values are replaced before inserting:
+//
+//	"$oid:alice"              an ObjectID generated for the symbol alice, the same
+//	                          in every file, so documents can refer to each other
+//	"$now", "$now-24h"        the current time, or a time relative to it; units
+//	"$today+7d"               are those of time.ParseDuration plus d for days,
+//	                          and $today is midnight UTC
+//
+// Each document is decoded into a new model with the client's codecs, so
+// keys are written the way the model's fields are stored and a key that
+// names no field is an error. The models of a file are inserted with
+// Session.InsertMany, which generates the ids left zero, and the truncation
+// goes through Session.DeleteMany. The generated symbolic IDs are returned.
+func (f *Fixtures) Load(ctx context.Context, client Client, fsys fs.FS, patterns ...string) (FixtureIDs, error) {
+	models, err := f.collections(client)
+	if err != nil {
+		return nil, err
+	}
+	if len(patterns) == 0 {
+		patterns = defaultFixturePatterns
+	}
+	seen := map[string]bool{}
+	var files []string
+	for _, pattern := range patterns {
+		matches, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				files = append(files, m)
+			}
+		}
+	}
+	sort.Strings(files)
+
+	registry := client.Codecs().Registry()
+	if registry == nil {
+		registry = bson.DefaultRegistry
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	ids := FixtureIDs{}
+	truncated := map[string]bool{}
+	for _, file := range files {
+		name := strings.TrimSuffix(path.Base(file), path.Ext(file))
+		model, ok := models[name]
+		if !ok {
+			return nil, fmt.Errorf("fixture %s: no model is registered for collection %q", file, name)
+		}
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		fixture, err := parseFixture(file, data)
+		if err != nil {
+			return nil, fmt.Errorf("fixture %s: %w", file, err)
+		}
+		docs := reflect.MakeSlice(reflect.SliceOf(model), 0, len(fixture.Documents))
+		for _, doc := range fixture.Documents {
+			if err := resolveFixtureDoc(doc, ids, now); err != nil {
+				return nil, fmt.Errorf("fixture %s: %w", file, err)
+			}
+			v, err := decodeFixture(registry, doc, model)
+			if err != nil {
+				return nil, fmt.Errorf("fixture %s: %w", file, err)
+			}
+			docs = reflect.Append(docs, v.Elem())
+		}
+
+		if (fixture.Truncate == nil || *fixture.Truncate) && !truncated[name] {
+			truncated[name] = true
+			if _, err := client.NewSession().DeleteMany(reflect.New(model).Interface(), ctx); err != nil {
+				return nil, fmt.Errorf("fixture %s: %w", file, err)
+			}
+		}
+		if docs.Len() == 0 {
+			continue
+		}
+		if _, err := client.NewSession().InsertMany(docs.Interface(), ctx); err != nil {
+			return nil, fmt.Errorf("fixture %s: %w", file, err)
+		}
+	}
+	return ids, nil
+}
+
+// collections returns the registered models by the collection client stores them in.
+func (f *Fixtures) collections(client Client) (map[string]reflect.Type, error) {
+	var models []reflect.Type
+	if f != nil {
+		f.mu.Lock()
+		models = append(models, f.models...)
+		f.mu.Unlock()
+	}
+	byName := make(map[string]reflect.Type, len(models))
+	for _, model := range models {
+		if model == nil {
+			return nil, errors.New("a fixture model is nil")
+		}
+		model = indirectType(model)
+		coll, err := client.CollectionNameForStruct(reflect.New(model).Interface())
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := byName[coll.Name]; ok && other != model {
+			return nil, fmt.Errorf("fixture models %s and %s are both stored in %q", other, model, coll.Name)
+		}
+		byName[coll.Name] = model
+	}
+	return byName, nil
+}
+
+// decodeFixture decodes doc into a new model of type t, refusing keys that
+// name no field of it.
+func decodeFixture(registry *bsoncodec.Registry, doc bson.D, t reflect.Type) (reflect.Value, error) {
+	if keys := fixtureKeys(t); keys != nil {
+		for _, e := range doc {
+			if !keys[e.Key] {
+				return reflect.Value{}, fmt.Errorf("%q is not a field of %s", e.Key, t)
+			}
+		}
+	}
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	v := reflect.New(t)
+	if err := bson.UnmarshalWithRegistry(registry, data, v.Interface()); err != nil {
+		return reflect.Value{}, fmt.Errorf("decoding into %s: %w", t, err)
+	}
+	return v, nil
+}
+
+// fixtureKeys returns the keys of the fields of struct type t, or nil when
+// an inlined map of t takes any key.
+func fixtureKeys(t reflect.Type) map[string]bool {
+	if hasInlineMap(t) {
+		return nil
+	}
+	keys := make(map[string]bool)
+	for _, f := range bsonstruct.Fields(t) {
+		keys[f.Name] = true
+	}
+	return keys
+}
+
+func hasInlineMap(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() || !strings.Contains(field.Tag.Get("bson"), ",inline") {
+			continue
+		}
+		ft := indirectType(field.Type)
+		if ft.Kind() == reflect.Map || ft.Kind() == reflect.Struct && hasInlineMap(ft) {
+			return true
+		}
+	}
+	return false
+}
+
+type fixtureFile struct {
+	Truncate  *bool    `bson:"truncate"`
+	Documents []bson.D `bson:"documents"`
+}
+
+func parseFixture(file string, data []byte) (*fixtureFile, error) {
+	switch path.Ext(file) {
+	case ".yaml", ".yml":
+		var node yaml.Node
+		if err := yaml.Unmarshal(data, &node); err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if len(node.Content) > 0 {
+			if err := yamlToJSON(&buf, node.Content[0]); err != nil {
+				return nil, err
+			}
+		}
+		data = buf.Bytes()
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return &fixtureFile{}, nil
+	}
+	if data[0] == '[' {
+		data = append(append([]byte(`{"documents":`), data...), '}')
+	}
+	var f fixtureFile
+	if err := bson.UnmarshalExtJSON(data, false, &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// yamlToJSON writes a YAML node as JSON, keeping the key order of mappings.
+// Timestamps become Extended JSON dates.
+func yamlToJSON(buf *bytes.Buffer, n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		return yamlToJSON(buf, n.Content[0])
+	case yaml.AliasNode:
+		return yamlToJSON(buf, n.Alias)
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(n.Content[i].Value)
+			buf.Write(key)
+			buf.WriteByte(':')
+			if err := yamlToJSON(buf, n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, c := range n.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := yamlToJSON(buf, c); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case yaml.ScalarNode:
+		var v any
+		if err := n.Decode(&v); err != nil {
+			return err
+		}
+		switch x := v.(type) {
+		case time.Time:
+			v = map[string]string{"$date": x.UTC().Format(iso8601Milli)}
+		case float64:
+			// Keep integral floats such as 1.0 doubles rather than integers.
+			if f := strconv.FormatFloat(x, 'g', -1, 64); !strings.ContainsAny(f, ".eEnN") {
+				v = json.Number(f + ".0")
+			}
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n.Line, err)
+		}
+		buf.Write(data)
+	}
+	return nil
+}
+
+var fixtureTime = regexp.MustCompile(`^\$(now|today)(?:([+-])(?:(\d+)d)?(.*))?$`)
+
+// resolveFixtureValue replaces symbolic IDs and relative dates in v.
+func resolveFixtureValue(v any, ids FixtureIDs, now time.Time) (any, error) {
+	switch x := v.(type) {
+	case bson.D:
+		return x, resolveFixtureDoc(x, ids, now)
+	case bson.A:
+		for i := range x {
+			r, err := resolveFixtureValue(x[i], ids, now)
+			if err != nil {
+				return nil, err
+			}
+			x[i] = r
+		}
+		return x, nil
+	case string:
+		if sym, ok := strings.CutPrefix(x, "$oid:"); ok {
+			id, ok := ids[sym]
+			if !ok {
+				id = primitive.NewObjectID()
+				ids[sym] = id
+			}
+			return id, nil
+		}
+		m := fixtureTime.FindStringSubmatch(x)
+		if m == nil {
+			return x, nil
+		}
+		t := now
+		if m[1] == "today" {
+			t = t.Truncate(24 * time.Hour)
+		}
+		if m[2] == "" {
+			return t, nil
+		}
+		if m[3] == "" && m[4] == "" {
+			return nil, fmt.Errorf("invalid date %q", x)
+		}
+		var offset time.Duration
+		if m[3] != "" {
+			days, err := strconv.Atoi(m[3])
+			if err != nil {
+				return nil, fmt.Errorf("invalid date %q", x)
+			}
+			offset = time.Duration(days) * 24 * time.Hour
+		}
+		if m[4] != "" {
+			d, err := time.ParseDuration(m[4])
+			if err != nil {
+				return nil, fmt.Errorf("invalid date %q", x)
+			}
+			offset += d
+		}
+		if m[2] == "-" {
+			offset = -offset
+		}
+		return t.Add(offset), nil
+	}
+	return v, nil
+}
+
+func resolveFixtureDoc(d bson.D, ids FixtureIDs, now time.Time) error {
+	for i := range d {
+		v, err := resolveFixtureValue(d[i].Value, ids, now)
+		if err != nil {
+			return err
+		}
+		d[i].Value = v
+	}
+	return nil
+}
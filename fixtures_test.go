@@ -0,0 +1,77 @@
+package pie
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseFixture(t *testing.T) {
+	Convey("Fixture files parse as Extended JSON or YAML", t, func() {
+		Convey("A JSON list of documents", func() {
+			f, err := parseFixture("users.json", []byte(`[{"_id": "$oid:alice", "age": 30, "born": {"$date": "1990-01-02T00:00:00Z"}}]`))
+			So(err, ShouldBeNil)
+			So(f.Truncate, ShouldBeNil)
+			So(f.Documents, ShouldHaveLength, 1)
+			So(f.Documents[0][0], ShouldResemble, bson.E{Key: "_id", Value: "$oid:alice"})
+			So(f.Documents[0][2].Value, ShouldHaveSameTypeAs, primitive.DateTime(0))
+		})
+
+		Convey("A YAML object with options, keeping key order and types", func() {
+			f, err := parseFixture("posts.yaml", []byte(`
+truncate: false
+documents:
+  - title: hello
+    price: 1.0
+    tags: [a, b]
+    author: {$oid: "5f1d7f1e2a6b3c0001a1b2c3"}
+    at: 2024-03-01T10:00:00Z
+`))
+			So(err, ShouldBeNil)
+			So(*f.Truncate, ShouldBeFalse)
+			d := f.Documents[0]
+			So(d[0].Key, ShouldEqual, "title")
+			So(d[1].Value, ShouldEqual, 1.0)
+			So(d[2].Value, ShouldResemble, bson.A{"a", "b"})
+			So(d[3].Value, ShouldHaveSameTypeAs, primitive.ObjectID{})
+			So(d[4].Value.(primitive.DateTime).Time().UTC(), ShouldEqual, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))
+		})
+
+		Convey("Malformed files are reported", func() {
+			_, err := parseFixture("users.json", []byte(`[{"name": }]`))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestResolveFixtureValue(t *testing.T) {
+	Convey("Symbolic IDs and relative dates are replaced", t, func() {
+		now := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)
+		ids := FixtureIDs{}
+
+		doc := bson.D{
+			{Key: "_id", Value: "$oid:alice"},
+			{Key: "friends", Value: bson.A{"$oid:bob", "$oid:alice"}},
+			{Key: "created", Value: "$now-1d2h"},
+			{Key: "due", Value: "$today+7d"},
+			{Key: "seen", Value: "$now"},
+			{Key: "note", Value: "$nowhere"},
+		}
+		So(resolveFixtureDoc(doc, ids, now), ShouldBeNil)
+		So(ids, ShouldHaveLength, 2)
+		So(doc[0].Value, ShouldEqual, ids["alice"])
+		So(doc[1].Value, ShouldResemble, bson.A{ids["bob"], ids["alice"]})
+		So(doc[2].Value, ShouldEqual, now.Add(-26*time.Hour))
+		So(doc[3].Value, ShouldEqual, time.Date(2024, 3, 8, 0, 0, 0, 0, time.UTC))
+		So(doc[4].Value, ShouldEqual, now)
+		So(doc[5].Value, ShouldEqual, "$nowhere")
+
+		_, err := resolveFixtureValue("$now+", ids, now)
+		So(err, ShouldNotBeNil)
+		_, err = resolveFixtureValue("$now+3x", ids, now)
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,348 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// QueryRules restricts what FromQuery accepts.
+type QueryRules struct {
+	// Fields lists the bson paths that may be filtered on. Empty means every field of the model.
+	Fields []string
+	// SortFields lists the bson paths that may be sorted on. Empty means the filterable fields.
+	SortFields []string
+	// DefaultSort is used when the query has no sort parameter, e.g. []string{"-created_at"}.
+	DefaultSort []string
+	// DefaultLimit is the page size used when the query has no limit parameter.
+	DefaultLimit int64
+	// MaxLimit is the largest page size a query may ask for. Zero means unlimited.
+	MaxLimit int64
+	// IgnoreUnknown skips parameters that are neither reserved nor model fields instead of rejecting them.
+	IgnoreUnknown bool
+}
+
+// QueryParamError reports an invalid query parameter.
+type QueryParamError struct {
+	Param string
+	Msg   string
+}
+
+func (e *QueryParamError) Error() string {
+	return fmt.Sprintf("query parameter %q: %s", e.Param, e.Msg)
+}
+
+// BoundQuery is the filter, sort order and page FromQuery read from a query string.
+type BoundQuery struct {
+	Filter Condition
+	Sort   []string
+	Skip   int64
+	Limit  int64
+}
+
+// Apply adds the filter, sort order and page of q to s and returns s. An
+// error of the filter is kept by s and returned by the query that runs it.
+//
+// Example usage:
+//
+//	var users []User
+//	err = q.Apply(client.NewSession()).FindAll(&users)
+func (q *BoundQuery) Apply(s Session) Session {
+	s.And(q.Filter)
+	s.Sort(q.Sort...)
+	if q.Skip > 0 {
+		s.Skip(q.Skip)
+	}
+	if q.Limit > 0 {
+		s.Limit(q.Limit)
+	}
+	return s
+}
+
+// queryOperatorParams maps the operators of field[op]=value parameters to their query operators.
+var queryOperatorParams = map[string]string{
+	"eq":     "$eq",
+	"ne":     "$ne",
+	"gt":     "$gt",
+	"gte":    "$gte",
+	"lt":     "$lt",
+	"lte":    "$lte",
+	"in":     "$in",
+	"nin":    "$nin",
+	"exists": "$exists",
+}
+
+// FromQuery binds HTTP query parameters to a filter, a sort order and a page
+// of model, which must be a struct or a pointer to one. It understands
+//
+//	field=value               equality; a repeated parameter matches any of its values
+//	field[op]=value           op is eq, ne, gt, gte, lt, lte, in, nin or exists;
+//	                          in and nin take comma-separated lists
+//	sort=-created_at,name     sort order, "-" for descending
+//	limit=20                  page size, defaulting to rules.DefaultLimit
+//	page=2                    1-based page number, or
+//	offset=40                 number of documents to skip
+//
+// Field names are dotted bson paths checked against model, and values are
+// converted to the Go type of the field. Errors are *QueryParamError values.
+//
+// Example usage:
+//
+//	q, err := pie.FromQuery(r.URL.Query(), &User{}, &pie.QueryRules{MaxLimit: 100, DefaultLimit: 20})
+//	if err != nil {
+//		http.Error(w, err.Error(), http.StatusBadRequest)
+//		return
+//	}
+//	err = q.Apply(client.NewSession()).FindAll(&users)
+func FromQuery(values url.Values, model any, rules *QueryRules) (*BoundQuery, error) {
+	if rules == nil {
+		rules = &QueryRules{}
+	}
+	modelType := reflect.TypeOf(model)
+	if modelType == nil || indirectType(modelType).Kind() != reflect.Struct {
+		return nil, errors.New("needs a struct")
+	}
+	if rules.MaxLimit > 0 && rules.DefaultLimit > rules.MaxLimit {
+		return nil, fmt.Errorf("query rules: the default limit %d exceeds the maximum of %d", rules.DefaultLimit, rules.MaxLimit)
+	}
+
+	q := &BoundQuery{Filter: DefaultCondition(), Sort: rules.DefaultSort, Limit: rules.DefaultLimit}
+	var page, offset int64
+	// Operators on the same field are merged into one document, in parameter order.
+	var fields []string
+	ops := map[string]bson.D{}
+
+	params := make([]string, 0, len(values))
+	for param := range values {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+
+	for _, param := range params {
+		vals := values[param]
+		var err error
+		switch param {
+		case "sort":
+			q.Sort, err = bindSort(vals, modelType, rules)
+		case "limit":
+			q.Limit, err = bindCount(param, vals)
+		case "page":
+			page, err = bindCount(param, vals)
+			if err == nil && page < 1 {
+				err = &QueryParamError{Param: param, Msg: "must be at least 1"}
+			}
+		case "offset":
+			offset, err = bindCount(param, vals)
+		default:
+			var field string
+			var op bson.E
+			field, op, err = bindFilter(param, vals, modelType, rules)
+			if err == nil && field != "" {
+				if _, ok := ops[field]; !ok {
+					fields = append(fields, field)
+				}
+				ops[field] = append(ops[field], op)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, field := range fields {
+		if len(ops[field]) == 1 && ops[field][0].Key == "$eq" {
+			q.Filter.Eq(field, ops[field][0].Value)
+		} else {
+			q.Filter.FilterBson(bson.D{{Key: field, Value: ops[field]}})
+		}
+	}
+
+	if rules.MaxLimit > 0 {
+		if q.Limit > rules.MaxLimit {
+			return nil, &QueryParamError{Param: "limit", Msg: fmt.Sprintf("exceeds the maximum of %d", rules.MaxLimit)}
+		}
+		if q.Limit == 0 {
+			q.Limit = rules.MaxLimit
+		}
+	}
+	switch {
+	case page > 0 && offset > 0:
+		return nil, &QueryParamError{Param: "page", Msg: "cannot be combined with offset"}
+	case page > 0 && q.Limit == 0:
+		return nil, &QueryParamError{Param: "page", Msg: "requires a limit"}
+	case page > 0 && page-1 > math.MaxInt64/q.Limit:
+		return nil, &QueryParamError{Param: "page", Msg: "is too large"}
+	case page > 0:
+		q.Skip = (page - 1) * q.Limit
+	default:
+		q.Skip = offset
+	}
+	return q, q.Filter.Err()
+}
+
+func bindCount(param string, vals []string) (int64, error) {
+	n, err := strconv.ParseInt(vals[len(vals)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, &QueryParamError{Param: param, Msg: "must be a non-negative integer"}
+	}
+	return n, nil
+}
+
+func bindSort(vals []string, modelType reflect.Type, rules *QueryRules) ([]string, error) {
+	allowed := rules.SortFields
+	if len(allowed) == 0 {
+		allowed = rules.Fields
+	}
+	var fields []string
+	for _, v := range vals {
+		for _, field := range strings.Split(v, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			name := strings.TrimPrefix(strings.TrimPrefix(field, "-"), "+")
+			if _, ok := resolveFieldPath(modelType, name); !ok || !allowedField(allowed, name) {
+				return nil, &QueryParamError{Param: "sort", Msg: fmt.Sprintf("cannot sort by %q", name)}
+			}
+			fields = append(fields, strings.TrimPrefix(field, "+"))
+		}
+	}
+	return fields, nil
+}
+
+func allowedField(allowed []string, field string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if a == field {
+			return true
+		}
+	}
+	return false
+}
+
+// bindFilter returns the field a filter parameter applies to and the operator it adds.
+// An empty field means the parameter is ignored.
+func bindFilter(param string, vals []string, modelType reflect.Type, rules *QueryRules) (string, bson.E, error) {
+	field, op := param, "eq"
+	if i := strings.IndexByte(param, '['); i > 0 && strings.HasSuffix(param, "]") {
+		field, op = param[:i], param[i+1:len(param)-1]
+	}
+	fieldType, ok := resolveFieldPath(modelType, field)
+	if !ok || !allowedField(rules.Fields, field) {
+		if rules.IgnoreUnknown && !ok {
+			return "", bson.E{}, nil
+		}
+		return "", bson.E{}, &QueryParamError{Param: param, Msg: fmt.Sprintf("unknown field %q", field)}
+	}
+	name, ok := queryOperatorParams[op]
+	if !ok {
+		return "", bson.E{}, &QueryParamError{Param: param, Msg: fmt.Sprintf("unknown operator %q", op)}
+	}
+
+	switch name {
+	case "$exists":
+		b, err := strconv.ParseBool(vals[len(vals)-1])
+		if err != nil {
+			return "", bson.E{}, &QueryParamError{Param: param, Msg: "must be true or false"}
+		}
+		return field, bson.E{Key: name, Value: b}, nil
+	case "$in", "$nin":
+		var list []string
+		for _, v := range vals {
+			list = append(list, strings.Split(v, ",")...)
+		}
+		vals = list
+	default:
+		if len(vals) > 1 {
+			if name != "$eq" {
+				return "", bson.E{}, &QueryParamError{Param: param, Msg: "must be given once"}
+			}
+			name = "$in"
+		}
+	}
+
+	converted := make(bson.A, len(vals))
+	for i, v := range vals {
+		c, err := convertParam(v, fieldType)
+		if err != nil {
+			return "", bson.E{}, &QueryParamError{Param: param, Msg: err.Error()}
+		}
+		converted[i] = c
+	}
+	if name == "$in" || name == "$nin" {
+		return field, bson.E{Key: name, Value: converted}, nil
+	}
+	return field, bson.E{Key: name, Value: converted[0]}, nil
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	objectIDType = reflect.TypeOf(primitive.ObjectID{})
+)
+
+// convertParam converts a query parameter to the Go type of the field it filters.
+// Array fields take values of their element type, since equality on an array field
+// matches its elements.
+func convertParam(v string, t reflect.Type) (any, error) {
+	t = indirectType(t)
+	if isArrayType(t) {
+		t = indirectType(t.Elem())
+	}
+	switch t {
+	case timeType:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+			if tm, err := time.Parse(layout, v); err == nil {
+				return tm, nil
+			}
+		}
+		return nil, fmt.Errorf("%q is not a date", v)
+	case objectIDType:
+		id, err := primitive.ObjectIDFromHex(v)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an ObjectID", v)
+		}
+		return id, nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return reflect.ValueOf(v).Convert(t).Interface(), nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", v)
+		}
+		return b, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(v, 10, t.Bits())
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid %s", v, t)
+		}
+		return reflect.ValueOf(n).Convert(t).Interface(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(v, 10, t.Bits())
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid %s", v, t)
+		}
+		return reflect.ValueOf(n).Convert(t).Interface(), nil
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(v, t.Bits())
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid %s", v, t)
+		}
+		return reflect.ValueOf(f).Convert(t).Interface(), nil
+	case reflect.Interface:
+		return v, nil
+	}
+	return nil, fmt.Errorf("cannot filter a %s field", t)
+}
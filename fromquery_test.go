@@ -0,0 +1,115 @@
+package pie
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type article struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Title     string             `bson:"title"`
+	Views     int32              `bson:"views"`
+	Score     float64            `bson:"score"`
+	Tags      []string           `bson:"tags"`
+	Published bool               `bson:"published"`
+	CreatedAt time.Time          `bson:"created_at"`
+	Author    struct {
+		Name string `bson:"name"`
+	} `bson:"author"`
+	Secret string `bson:"-"`
+}
+
+func TestFromQuery(t *testing.T) {
+	Convey("FromQuery binds query parameters to the model", t, func() {
+		Convey("Filters are converted to the field types and merged per field", func() {
+			values, _ := url.ParseQuery("views[gte]=10&views[lt]=100&published=true&tags=go&tags=db" +
+				"&author.name[ne]=bob&created_at[gt]=2024-03-01&_id=5f1d7a3c9d1e8a2b3c4d5e6f&score[in]=1.5,2")
+			q, err := FromQuery(values, &article{}, nil)
+			So(err, ShouldBeNil)
+			d, err := q.Filter.Filters()
+			So(err, ShouldBeNil)
+			id, _ := primitive.ObjectIDFromHex("5f1d7a3c9d1e8a2b3c4d5e6f")
+			So(d, ShouldResemble, bson.D{
+				{Key: "_id", Value: id},
+				{Key: "author.name", Value: bson.D{{Key: "$ne", Value: "bob"}}},
+				{Key: "created_at", Value: bson.D{{Key: "$gt", Value: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)}}},
+				{Key: "published", Value: true},
+				{Key: "score", Value: bson.D{{Key: "$in", Value: bson.A{1.5, 2.0}}}},
+				{Key: "tags", Value: bson.D{{Key: "$in", Value: bson.A{"go", "db"}}}},
+				{Key: "views", Value: bson.D{{Key: "$gte", Value: int32(10)}, {Key: "$lt", Value: int32(100)}}},
+			})
+		})
+
+		Convey("Sort and pagination follow the rules", func() {
+			rules := &QueryRules{DefaultLimit: 20, MaxLimit: 50, DefaultSort: []string{"-created_at"}}
+			q, err := FromQuery(url.Values{"page": {"3"}}, &article{}, rules)
+			So(err, ShouldBeNil)
+			So(q.Sort, ShouldResemble, []string{"-created_at"})
+			So(q.Limit, ShouldEqual, 20)
+			So(q.Skip, ShouldEqual, 40)
+
+			q, err = FromQuery(url.Values{"sort": {"-views,title"}, "limit": {"5"}, "offset": {"7"}}, &article{}, rules)
+			So(err, ShouldBeNil)
+			So(q.Sort, ShouldResemble, []string{"-views", "title"})
+			So(q.Limit, ShouldEqual, 5)
+			So(q.Skip, ShouldEqual, 7)
+		})
+
+		Convey("Invalid parameters are reported", func() {
+			rules := &QueryRules{MaxLimit: 50, Fields: []string{"title", "views"}}
+			for _, raw := range []string{
+				"limit=51",
+				"views=ten",
+				"secret=x",
+				"score=1",
+				"title[like]=x",
+				"sort=score",
+				"page=0",
+				"page=1&offset=2",
+				"views[gt]=1&views[gt]=2",
+				"page=9223372036854775807&limit=2",
+			} {
+				values, _ := url.ParseQuery(raw)
+				_, err := FromQuery(values, &article{}, rules)
+				var pe *QueryParamError
+				So(errors.As(err, &pe), ShouldBeTrue)
+			}
+
+			_, err := FromQuery(url.Values{}, &article{}, &QueryRules{DefaultLimit: 60, MaxLimit: 50})
+			var pe *QueryParamError
+			So(err, ShouldNotBeNil)
+			So(errors.As(err, &pe), ShouldBeFalse)
+
+			_, err = FromQuery(url.Values{"views": {"x"}}, &article{}, nil)
+			So(err.Error(), ShouldEqual, `query parameter "views": "x" is not a valid int32`)
+
+			q, err := FromQuery(url.Values{"utm_source": {"mail"}}, &article{}, &QueryRules{IgnoreUnknown: true})
+			So(err, ShouldBeNil)
+			d, _ := q.Filter.Filters()
+			So(d, ShouldBeEmpty)
+		})
+
+		Convey("Apply keeps filter errors for the query", func() {
+			mc, err := mongo.NewClient(options.Client().ApplyURI("mongodb://127.0.0.1:27017"))
+			So(err, ShouldBeNil)
+			client := &defaultClient{client: mc, db: "test"}
+
+			q := &BoundQuery{Filter: DefaultCondition().Eq("title", "a"), Sort: []string{"title"}, Limit: 5}
+			d, err := q.Apply(client.NewSession()).(*session).filter.Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{{Key: "title", Value: "a"}})
+
+			q.Filter = DefaultCondition().Mod("views", 0, 1)
+			_, err = q.Apply(client.NewSession()).(*session).filter.Filters()
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,200 @@
+// Package geo holds GeoJSON geometries and the shapes and stages of
+// MongoDB's geospatial queries.
+//
+// The geometry types encode as GeoJSON, so they can be used as model fields
+// indexed with 2dsphere as well as in queries:
+//
+//	type Shop struct {
+//		Name     string    `bson:"name"`
+//		Location geo.Point `bson:"location"`
+//	}
+//
+//	client.AddIndex2dsphere("location").CreateIndexes(&Shop{})
+//	client.NewSession().Near("location", geo.NewPoint(13.4, 52.5), 1000, 0).FindAll(&shops)
+//
+// Coordinates are longitude first, then latitude. The geometries encode with
+// their GeoJSON type whatever their Type field holds, so a zero Point is the
+// point at 0, 0.
+package geo
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// EarthRadius is the equatorial radius of the Earth in meters, the figure
+// MongoDB's documentation uses to convert distances to the radians
+// $centerSphere and legacy coordinates expect.
+const EarthRadius = 6378100.0
+
+// Radians converts a distance in meters on the Earth's surface to radians.
+func Radians(meters float64) float64 {
+	return meters / EarthRadius
+}
+
+// Position is a longitude, latitude pair.
+type Position [2]float64
+
+// Geometry is a GeoJSON object usable with $geoIntersects.
+type Geometry interface {
+	geometryType() string
+}
+
+// Shape is an area usable with $geoWithin.
+type Shape interface {
+	// Within returns the operand of $geoWithin, e.g. {$box: [...]}.
+	Within() bson.D
+}
+
+// Point is a GeoJSON Point.
+type Point struct {
+	Type        string   `bson:"type" json:"type"`
+	Coordinates Position `bson:"coordinates" json:"coordinates"`
+}
+
+// NewPoint returns the point at lng, lat.
+func NewPoint(lng, lat float64) Point {
+	return Point{Type: "Point", Coordinates: Position{lng, lat}}
+}
+
+// Lng returns the longitude of p.
+func (p Point) Lng() float64 { return p.Coordinates[0] }
+
+// Lat returns the latitude of p.
+func (p Point) Lat() float64 { return p.Coordinates[1] }
+
+func (p Point) geometryType() string { return "Point" }
+
+// MarshalBSON encodes p as a GeoJSON Point.
+func (p Point) MarshalBSON() ([]byte, error) {
+	return marshalGeometry(p.geometryType(), p.Coordinates)
+}
+
+// LineString is a GeoJSON LineString.
+type LineString struct {
+	Type        string     `bson:"type" json:"type"`
+	Coordinates []Position `bson:"coordinates" json:"coordinates"`
+}
+
+// NewLineString returns the line through positions.
+func NewLineString(positions ...Position) LineString {
+	return LineString{Type: "LineString", Coordinates: positions}
+}
+
+func (l LineString) geometryType() string { return "LineString" }
+
+// MarshalBSON encodes l as a GeoJSON LineString.
+func (l LineString) MarshalBSON() ([]byte, error) {
+	return marshalGeometry(l.geometryType(), l.Coordinates)
+}
+
+// Polygon is a GeoJSON Polygon: an exterior ring followed by optional holes.
+// Each ring is closed, its last position equal to the first. It is both a
+// Geometry and a Shape.
+type Polygon struct {
+	Type        string       `bson:"type" json:"type"`
+	Coordinates [][]Position `bson:"coordinates" json:"coordinates"`
+}
+
+// NewPolygon returns the polygon bounded by rings. Rings that are not
+// closed are closed by repeating their first position.
+func NewPolygon(rings ...[]Position) Polygon {
+	closed := make([][]Position, len(rings))
+	for i, r := range rings {
+		if len(r) > 0 && r[0] != r[len(r)-1] {
+			r = append(r[:len(r):len(r)], r[0])
+		}
+		closed[i] = r
+	}
+	return Polygon{Type: "Polygon", Coordinates: closed}
+}
+
+func (p Polygon) geometryType() string { return "Polygon" }
+
+// MarshalBSON encodes p as a GeoJSON Polygon.
+func (p Polygon) MarshalBSON() ([]byte, error) {
+	return marshalGeometry(p.geometryType(), p.Coordinates)
+}
+
+// Within returns {$geometry: p}.
+func (p Polygon) Within() bson.D { return geometry(p) }
+
+// MultiPolygon is a GeoJSON MultiPolygon. It is both a Geometry and a Shape.
+type MultiPolygon struct {
+	Type        string         `bson:"type" json:"type"`
+	Coordinates [][][]Position `bson:"coordinates" json:"coordinates"`
+}
+
+// NewMultiPolygon returns the union of polygons.
+func NewMultiPolygon(polygons ...Polygon) MultiPolygon {
+	m := MultiPolygon{Type: "MultiPolygon"}
+	for _, p := range polygons {
+		m.Coordinates = append(m.Coordinates, p.Coordinates)
+	}
+	return m
+}
+
+func (m MultiPolygon) geometryType() string { return "MultiPolygon" }
+
+// MarshalBSON encodes m as a GeoJSON MultiPolygon.
+func (m MultiPolygon) MarshalBSON() ([]byte, error) {
+	return marshalGeometry(m.geometryType(), m.Coordinates)
+}
+
+// Within returns {$geometry: m}.
+func (m MultiPolygon) Within() bson.D { return geometry(m) }
+
+func marshalGeometry(typ string, coordinates any) ([]byte, error) {
+	return bson.Marshal(bson.D{{Key: "type", Value: typ}, {Key: "coordinates", Value: coordinates}})
+}
+
+func geometry(g any) bson.D {
+	return bson.D{{Key: "$geometry", Value: g}}
+}
+
+// Box is a rectangle on legacy coordinate pairs, for 2d indexes.
+type Box struct {
+	BottomLeft, TopRight Position
+}
+
+// Within returns {$box: [bottomLeft, topRight]}.
+func (b Box) Within() bson.D {
+	return bson.D{{Key: "$box", Value: bson.A{b.BottomLeft, b.TopRight}}}
+}
+
+// LegacyPolygon is a polygon on legacy coordinate pairs, for 2d indexes.
+// Unlike Polygon it needs not be closed.
+type LegacyPolygon []Position
+
+// Within returns {$polygon: [...]}.
+func (p LegacyPolygon) Within() bson.D {
+	points := make(bson.A, len(p))
+	for i, pos := range p {
+		points[i] = pos
+	}
+	return bson.D{{Key: "$polygon", Value: points}}
+}
+
+// CenterSphere is a spherical cap: the points within Radius radians of
+// Center. It works with both 2dsphere and 2d indexes; see Radians.
+type CenterSphere struct {
+	Center Position
+	Radius float64
+}
+
+// Within returns {$centerSphere: [center, radius]}.
+func (c CenterSphere) Within() bson.D {
+	return bson.D{{Key: "$centerSphere", Value: bson.A{c.Center, c.Radius}}}
+}
+
+// Near returns the operand of $near and $nearSphere: the point and the
+// distance bounds in meters, left out when zero.
+func Near(point Point, maxDistance, minDistance float64) bson.D {
+	d := bson.D{{Key: "$geometry", Value: point}}
+	if maxDistance > 0 {
+		d = append(d, bson.E{Key: "$maxDistance", Value: maxDistance})
+	}
+	if minDistance > 0 {
+		d = append(d, bson.E{Key: "$minDistance", Value: minDistance})
+	}
+	return d
+}
@@ -0,0 +1,94 @@
+package geo
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// NearStage builds a $geoNear aggregation stage, which sorts documents by
+// distance from a point and writes the distance to a field.
+//
+// Example usage:
+//
+//	stage := geo.NewNearStage(geo.NewPoint(13.4, 52.5), "distance").MaxDistance(5000)
+//	err := client.Aggregate().GeoNear(stage).All(&shops)
+type NearStage struct {
+	near               Point
+	distanceField      string
+	key                string
+	query              any
+	maxDistance        float64
+	minDistance        float64
+	distanceMultiplier float64
+	includeLocs        string
+}
+
+// NewNearStage returns a stage sorting by distance from near, in meters,
+// and writing it to distanceField.
+func NewNearStage(near Point, distanceField string) *NearStage {
+	return &NearStage{near: near, distanceField: distanceField}
+}
+
+// Key sets the indexed field to use when the collection has several geo indexes.
+func (n *NearStage) Key(field string) *NearStage {
+	n.key = field
+	return n
+}
+
+// Query limits the stage to the documents matching filter, a bson.D or bson.M.
+func (n *NearStage) Query(filter any) *NearStage {
+	n.query = filter
+	return n
+}
+
+// MaxDistance sets the greatest distance, in meters, of the returned documents.
+func (n *NearStage) MaxDistance(meters float64) *NearStage {
+	n.maxDistance = meters
+	return n
+}
+
+// MinDistance sets the smallest distance, in meters, of the returned documents.
+func (n *NearStage) MinDistance(meters float64) *NearStage {
+	n.minDistance = meters
+	return n
+}
+
+// DistanceMultiplier scales the distances written to the distance field,
+// e.g. 0.001 for kilometers.
+func (n *NearStage) DistanceMultiplier(m float64) *NearStage {
+	n.distanceMultiplier = m
+	return n
+}
+
+// IncludeLocs writes the location used to compute the distance to field.
+func (n *NearStage) IncludeLocs(field string) *NearStage {
+	n.includeLocs = field
+	return n
+}
+
+// Stage returns the {$geoNear: {...}} stage.
+func (n *NearStage) Stage() bson.D {
+	spec := bson.D{
+		{Key: "near", Value: n.near},
+		{Key: "distanceField", Value: n.distanceField},
+		{Key: "spherical", Value: true},
+	}
+	if n.key != "" {
+		spec = append(spec, bson.E{Key: "key", Value: n.key})
+	}
+	if n.query != nil {
+		spec = append(spec, bson.E{Key: "query", Value: n.query})
+	}
+	if n.maxDistance > 0 {
+		spec = append(spec, bson.E{Key: "maxDistance", Value: n.maxDistance})
+	}
+	if n.minDistance > 0 {
+		spec = append(spec, bson.E{Key: "minDistance", Value: n.minDistance})
+	}
+	if n.distanceMultiplier != 0 {
+		spec = append(spec, bson.E{Key: "distanceMultiplier", Value: n.distanceMultiplier})
+	}
+	if n.includeLocs != "" {
+		spec = append(spec, bson.E{Key: "includeLocs", Value: n.includeLocs})
+	}
+	return bson.D{{Key: "$geoNear", Value: spec}}
+}
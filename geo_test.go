@@ -0,0 +1,75 @@
+package pie
+
+import (
+	"testing"
+
+	"github.com/5xxxx/pie/geo"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func geoJSON(c Condition) string {
+	data, err := c.MarshalExtJSON(RelaxedJSON)
+	So(err, ShouldBeNil)
+	return string(data)
+}
+
+func TestGeoConditions(t *testing.T) {
+	Convey("Geo conditions encode as GeoJSON query operators", t, func() {
+		berlin := geo.NewPoint(13.4, 52.5)
+
+		Convey("Near leaves out zero distances", func() {
+			So(geoJSON(DefaultCondition().Near("loc", berlin, 1000, 0)), ShouldEqual,
+				`{"loc":{"$near":{"$geometry":{"type":"Point","coordinates":[13.4,52.5]},"$maxDistance":1000.0}}}`)
+			So(geoJSON(DefaultCondition().NearSphere("loc", berlin, 0, 10)), ShouldEqual,
+				`{"loc":{"$nearSphere":{"$geometry":{"type":"Point","coordinates":[13.4,52.5]},"$minDistance":10.0}}}`)
+		})
+
+		Convey("GeoWithin takes GeoJSON polygons and legacy shapes", func() {
+			square := geo.NewPolygon([]geo.Position{{0, 0}, {1, 0}, {1, 1}, {0, 1}})
+			So(geoJSON(DefaultCondition().GeoWithin("loc", square)), ShouldEqual,
+				`{"loc":{"$geoWithin":{"$geometry":{"type":"Polygon","coordinates":[[[0.0,0.0],[1.0,0.0],[1.0,1.0],[0.0,1.0],[0.0,0.0]]]}}}}`)
+			So(geoJSON(DefaultCondition().GeoWithin("loc", geo.Box{BottomLeft: geo.Position{0, 0}, TopRight: geo.Position{2, 2}})), ShouldEqual,
+				`{"loc":{"$geoWithin":{"$box":[[0.0,0.0],[2.0,2.0]]}}}`)
+			So(geoJSON(DefaultCondition().GeoWithin("loc", geo.CenterSphere{Center: berlin.Coordinates, Radius: 0.5})), ShouldEqual,
+				`{"loc":{"$geoWithin":{"$centerSphere":[[13.4,52.5],0.5]}}}`)
+		})
+
+		Convey("Geometries are written with their GeoJSON type", func() {
+			So(geoJSON(DefaultCondition().Near("loc", geo.Point{Coordinates: geo.Position{1, 2}}, 0, 0)), ShouldEqual,
+				`{"loc":{"$near":{"$geometry":{"type":"Point","coordinates":[1.0,2.0]}}}}`)
+			type shop struct {
+				Loc  geo.Point   `bson:"loc"`
+				Area geo.Polygon `bson:"area"`
+			}
+			data, err := bson.MarshalExtJSON(shop{}, false, false)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, `{"loc":{"type":"Point","coordinates":[0.0,0.0]},"area":{"type":"Polygon","coordinates":null}}`)
+
+			raw, err := bson.Marshal(shop{})
+			So(err, ShouldBeNil)
+			var s shop
+			So(bson.Unmarshal(raw, &s), ShouldBeNil)
+			So(s.Loc, ShouldResemble, geo.NewPoint(0, 0))
+		})
+
+		Convey("GeoIntersects wraps the geometry", func() {
+			line := geo.NewLineString(geo.Position{0, 0}, geo.Position{1, 1})
+			So(geoJSON(DefaultCondition().GeoIntersects("route", line)), ShouldEqual,
+				`{"route":{"$geoIntersects":{"$geometry":{"type":"LineString","coordinates":[[0.0,0.0],[1.0,1.0]]}}}}`)
+		})
+
+		Convey("Missing shapes are reported", func() {
+			So(DefaultCondition().GeoWithin("loc", nil).Err(), ShouldNotBeNil)
+			So(DefaultCondition().GeoIntersects("loc", nil).Err(), ShouldNotBeNil)
+		})
+
+		Convey("The $geoNear stage sets only what was given", func() {
+			stage := geo.NewNearStage(berlin, "dist").MaxDistance(5000).Key("loc").DistanceMultiplier(0.001)
+			data, err := bson.MarshalExtJSON(stage.Stage(), false, false)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual,
+				`{"$geoNear":{"near":{"type":"Point","coordinates":[13.4,52.5]},"distanceField":"dist","spherical":true,"key":"loc","maxDistance":5000.0,"distanceMultiplier":0.001}}`)
+		})
+	})
+}
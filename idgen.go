@@ -0,0 +1,361 @@
+package pie
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/5xxxx/pie/internal/bsonstruct"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// IDGenerator generates the ids of new documents.
+type IDGenerator interface {
+	NewID() (any, error)
+}
+
+// IDGeneratorFunc is a function used as an IDGenerator.
+type IDGeneratorFunc func() (any, error)
+
+// NewID returns f().
+func (f IDGeneratorFunc) NewID() (any, error) {
+	return f()
+}
+
+// IDStrategy is implemented by models generating their _id with a generator
+// of their own. A `pie:"id:<name>"` tag on a field selects a generator of
+// the client by name instead, see IDGenerators.
+//
+// Example usage:
+//
+//	func (Order) IDStrategy() pie.IDGenerator { return pie.UUIDv7 }
+type IDStrategy interface {
+	IDStrategy() IDGenerator
+}
+
+var idStrategyType = reflect.TypeOf((*IDStrategy)(nil)).Elem()
+
+// The built-in generators. Uuids and ULIDs are generated as strings and
+// stored in a [16]byte, []byte or primitive.Binary field as uuid bytes; tag a
+// string field with `pie:"codec:uuid"` to store it as a uuid too.
+var (
+	// ObjectID generates a primitive.ObjectID, as the driver does.
+	ObjectID IDGenerator = IDGeneratorFunc(func() (any, error) {
+		return primitive.NewObjectID(), nil
+	})
+	// UUIDv4 generates a random uuid.
+	UUIDv4 IDGenerator = IDGeneratorFunc(newUUIDv4)
+	// UUIDv7 generates a uuid ordered by its creation time.
+	UUIDv7 IDGenerator = IDGeneratorFunc(newUUIDv7)
+	// ULID generates a ULID, a 26 character string ordered by its creation time.
+	ULID IDGenerator = IDGeneratorFunc(newULID)
+)
+
+// IDGenerators holds the id generators of a client, by the name used in
+// `pie:"id:<name>"` field tags: "objectid", "uuidv4", "uuidv7" and "ulid",
+// and the generators registered with Register. Snowflake ids are only unique
+// with a node number per process, so a Snowflake must be registered under a
+// name before tags use it. Documents inserted with InsertOne, InsertMany and
+// BulkWrite get a generated id when the id field of their model is zero.
+//
+// Example usage:
+//
+//	type Order struct {
+//		ID    int64 `bson:"_id" pie:"id:snowflake"`
+//		Total int64 `bson:"total"`
+//	}
+//
+//	node, err := pie.NewSnowflake(7)
+//	client.RegisterIDGenerator("snowflake", node)
+//	id, err := client.InsertOne(&order) // id is the int64 set on order.ID
+type IDGenerators struct {
+	mu    sync.Mutex
+	named map[string]IDGenerator
+	plans sync.Map // reflect.Type -> *idField
+}
+
+// idField is the id field of a model struct, and the name of the generator
+// selected by its tag.
+type idField struct {
+	name      string
+	index     []int
+	generator string
+}
+
+// defaultIDGenerators assigns ids for a nil *IDGenerators.
+var defaultIDGenerators = NewIDGenerators()
+
+// NewIDGenerators returns a set of id generators holding the built-in ones.
+func NewIDGenerators() *IDGenerators {
+	return &IDGenerators{named: builtinIDGenerators()}
+}
+
+func builtinIDGenerators() map[string]IDGenerator {
+	return map[string]IDGenerator{
+		"objectid": ObjectID,
+		"uuidv4":   UUIDv4,
+		"uuidv7":   UUIDv7,
+		"ulid":     ULID,
+	}
+}
+
+// Register names gen for use in `pie:"id:<name>"` field tags, replacing a
+// generator of the same name.
+func (g *IDGenerators) Register(name string, gen IDGenerator) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.named[name] = gen
+}
+
+func (g *IDGenerators) generator(name string) (IDGenerator, error) {
+	g.mu.Lock()
+	gen := g.named[name]
+	g.mu.Unlock()
+	if gen == nil {
+		return nil, fmt.Errorf("no id generator is named %q", name)
+	}
+	return gen, nil
+}
+
+// Assign sets the id field of doc, a model struct or pointer, to a generated
+// id when it is zero and the model declares a generator, by IDStrategy or
+// by tag. It returns the document to send, a pointer to a copy of doc when
+// doc is a struct, and the id of doc: the value of its id field, or nil when
+// it has none or it is left zero. Other documents are returned as they are.
+func (g *IDGenerators) Assign(doc any) (any, any, error) {
+	if g == nil {
+		g = defaultIDGenerators
+	}
+	v := reflect.ValueOf(doc)
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return doc, nil, nil
+	}
+	return g.assign(v)
+}
+
+func (g *IDGenerators) assign(v reflect.Value) (any, any, error) {
+	doc := v.Interface()
+	for v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return doc, nil, nil
+	}
+	f := g.idField(v.Type())
+	if f == nil {
+		return doc, nil, nil
+	}
+
+	gen, err := g.strategy(v, f)
+	if err != nil {
+		return nil, nil, err
+	}
+	if gen != nil && v.FieldByIndex(f.index).IsZero() {
+		if !v.CanAddr() {
+			cp := reflect.New(v.Type())
+			cp.Elem().Set(v)
+			v, doc = cp.Elem(), cp.Interface()
+		}
+		id, err := gen.NewID()
+		if err != nil {
+			return nil, nil, fmt.Errorf("generate the %s of %s: %w", f.name, v.Type(), err)
+		}
+		if err := setGeneratedID(v.FieldByIndex(f.index), id); err != nil {
+			return nil, nil, fmt.Errorf("generate the %s of %s: %w", f.name, v.Type(), err)
+		}
+	}
+
+	field := v.FieldByIndex(f.index)
+	if field.IsZero() {
+		return doc, nil, nil
+	}
+	return doc, field.Interface(), nil
+}
+
+// strategy returns the generator of the model struct v, or nil when it has none.
+func (g *IDGenerators) strategy(v reflect.Value, f *idField) (IDGenerator, error) {
+	if f.generator != "" {
+		return g.generator(f.generator)
+	}
+	if s, ok := v.Interface().(IDStrategy); ok {
+		return s.IDStrategy(), nil
+	}
+	if v.CanAddr() && v.Addr().Type().Implements(idStrategyType) {
+		return v.Addr().Interface().(IDStrategy).IDStrategy(), nil
+	}
+	if reflect.PtrTo(v.Type()).Implements(idStrategyType) {
+		cp := reflect.New(v.Type())
+		cp.Elem().Set(v)
+		return cp.Interface().(IDStrategy).IDStrategy(), nil
+	}
+	return nil, nil
+}
+
+// idField returns the field tagged with a generator, or else the _id field,
+// of struct type t. Fields of inlined struct pointers are not considered.
+func (g *IDGenerators) idField(t reflect.Type) *idField {
+	if f, ok := g.plans.Load(t); ok {
+		return f.(*idField)
+	}
+	var tagged, id *idField
+	for _, sf := range bsonstruct.Fields(t) {
+		if sf.Indirect {
+			continue
+		}
+		f := &idField{name: sf.Name, index: sf.Index, generator: bsonstruct.Tag(sf.Field)["id"]}
+		if tagged == nil && f.generator != "" {
+			tagged = f
+		}
+		if id == nil && f.name == "_id" {
+			id = f
+		}
+	}
+	if tagged != nil {
+		id = tagged
+	}
+	g.plans.Store(t, id)
+	return id
+}
+
+// setGeneratedID sets the id field v to id, converting uuid strings to
+// bytes and ids to strings as v needs.
+func setGeneratedID(v reflect.Value, id any) error {
+	if v.Kind() == reflect.Ptr {
+		v.Set(reflect.New(v.Type().Elem()))
+		v = v.Elem()
+	}
+	switch id := id.(type) {
+	case string:
+		if v.Kind() == reflect.String {
+			break
+		}
+		b, err := parseUUID(id)
+		if err != nil {
+			break
+		}
+		switch {
+		case v.Type() == reflect.TypeOf(primitive.Binary{}):
+			v.Set(reflect.ValueOf(primitive.Binary{Subtype: 4, Data: b}))
+			return nil
+		case isByteArray(v.Type(), 16):
+			reflect.Copy(v, reflect.ValueOf(b))
+			return nil
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(b)
+			return nil
+		}
+	case primitive.ObjectID:
+		if v.Kind() == reflect.String {
+			v.SetString(id.Hex())
+			return nil
+		}
+	case int64:
+		if v.Kind() == reflect.String {
+			v.SetString(strconv.FormatInt(id, 10))
+			return nil
+		}
+	}
+	return setKey(v, id)
+}
+
+func newUUIDv4() (any, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b[:]), nil
+}
+
+func newUUIDv7() (any, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[6:]); err != nil {
+		return nil, err
+	}
+	putMillis(b[:6], time.Now())
+	b[6] = b[6]&0x0f | 0x70
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b[:]), nil
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func newULID() (any, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[6:]); err != nil {
+		return nil, err
+	}
+	putMillis(b[:6], time.Now())
+	// 128 bits in 26 characters of 5 bits, the first holding 3.
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var s [26]byte
+	for i := len(s) - 1; i >= 0; i-- {
+		s[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(s[:]), nil
+}
+
+// putMillis writes the unix milliseconds of t to the 6 bytes of b, big-endian.
+func putMillis(b []byte, t time.Time) {
+	ms := uint64(t.UnixMilli())
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+}
+
+// snowflakeEpoch is the time Snowflake ids count from.
+var snowflakeEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Snowflake generates int64 ids ordered by their creation time, unique
+// across up to 1024 nodes: 41 bits of milliseconds since 2020, 10 bits of
+// node and 12 bits of sequence within the millisecond.
+type Snowflake struct {
+	mu   sync.Mutex
+	node int64
+	last int64
+	seq  int64
+}
+
+// NewSnowflake returns a Snowflake generating ids for node, which must be
+// unique among the processes inserting into the same collections.
+func NewSnowflake(node int64) (*Snowflake, error) {
+	if node < 0 || node > 1023 {
+		return nil, fmt.Errorf("snowflake node %d is not in [0, 1023]", node)
+	}
+	return &Snowflake{node: node}, nil
+}
+
+// NewID returns the next id as an int64.
+func (s *Snowflake) NewID() (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Since(snowflakeEpoch).Milliseconds()
+	if now < s.last {
+		// The clock went back: keep counting in the last millisecond.
+		now = s.last
+	}
+	if now == s.last {
+		s.seq = (s.seq + 1) & 4095
+		if s.seq == 0 {
+			for now <= s.last {
+				time.Sleep(100 * time.Microsecond)
+				now = time.Since(snowflakeEpoch).Milliseconds()
+			}
+		}
+	} else {
+		s.seq = 0
+	}
+	s.last = now
+	return now<<22 | s.node<<12 | s.seq, nil
+}
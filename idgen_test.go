@@ -0,0 +1,111 @@
+package pie
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type invoice struct {
+	ID   string `bson:"_id" pie:"id:ulid"`
+	Note string `bson:"note"`
+}
+
+type Stamp struct {
+	Key [16]byte `bson:"key" pie:"id:uuidv7"`
+}
+
+type receipt struct {
+	Stamp `bson:",inline"`
+	ID    primitive.ObjectID `bson:"_id,omitempty"`
+}
+
+type voucher struct {
+	ID   int64 `bson:"_id"`
+	Code string
+}
+
+type flake struct {
+	ID int64 `bson:"_id" pie:"id:snowflake"`
+}
+
+func (*voucher) IDStrategy() IDGenerator {
+	return IDGeneratorFunc(func() (any, error) { return 7, nil })
+}
+
+func TestIDGenerators(t *testing.T) {
+	Convey("The built-in generators", t, func() {
+		id, err := UUIDv4.NewID()
+		So(err, ShouldBeNil)
+		So(id, ShouldHaveSameTypeAs, "")
+		So(id.(string)[14], ShouldEqual, '4')
+
+		id, err = UUIDv7.NewID()
+		So(err, ShouldBeNil)
+		So(id.(string)[14], ShouldEqual, '7')
+
+		first, err := ULID.NewID()
+		So(err, ShouldBeNil)
+		So(regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{26}$`).MatchString(first.(string)), ShouldBeTrue)
+
+		node, err := NewSnowflake(5)
+		So(err, ShouldBeNil)
+		a, _ := node.NewID()
+		b, _ := node.NewID()
+		So(b.(int64), ShouldBeGreaterThan, a.(int64))
+		So(a.(int64)>>12&1023, ShouldEqual, 5)
+		_, err = NewSnowflake(1024)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Assign sets zero id fields", t, func() {
+		ids := NewIDGenerators()
+
+		in := &invoice{Note: "a"}
+		doc, id, err := ids.Assign(in)
+		So(err, ShouldBeNil)
+		So(doc, ShouldEqual, in)
+		So(id, ShouldEqual, in.ID)
+		So(len(in.ID), ShouldEqual, 26)
+
+		doc, id, err = ids.Assign(invoice{ID: "kept"})
+		So(err, ShouldBeNil)
+		So(doc, ShouldResemble, invoice{ID: "kept"})
+		So(id, ShouldEqual, "kept")
+
+		doc, id, err = ids.Assign(voucher{Code: "x"})
+		So(err, ShouldBeNil)
+		So(doc, ShouldResemble, &voucher{ID: 7, Code: "x"})
+		So(id, ShouldEqual, int64(7))
+
+		r := &receipt{}
+		_, id, err = ids.Assign(r)
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, r.Key)
+		So(r.Key[6]>>4, ShouldEqual, 7)
+		So(r.ID.IsZero(), ShouldBeTrue)
+
+		_, id, err = ids.Assign(&member{})
+		So(err, ShouldBeNil)
+		So(id, ShouldBeNil)
+
+		// Snowflake nodes are per process, so none is built in.
+		_, _, err = ids.Assign(&flake{})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, `no id generator is named "snowflake"`)
+		node, err := NewSnowflake(9)
+		So(err, ShouldBeNil)
+		ids.Register("snowflake", node)
+		f := &flake{}
+		_, _, err = ids.Assign(f)
+		So(err, ShouldBeNil)
+		So(f.ID>>12&1023, ShouldEqual, 9)
+
+		ids.Register("ulid", IDGeneratorFunc(func() (any, error) { return nil, errors.New("down") }))
+		_, _, err = ids.Assign(&invoice{})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -3,7 +3,9 @@ package pie
 import (
 	"context"
 	"github.com/5xxxx/pie/schemas"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"sort"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -15,6 +17,15 @@ type Indexes interface {
 	DropAll(doc any, ctx ...context.Context) error
 	DropOne(doc any, name string, ctx ...context.Context) error
 	AddIndex(keys any, opt ...*options.IndexOptions) Indexes
+	// AddTextIndex adds a text index on the fields of weights, each weighted
+	// by its value, for Condition.Text. "$**" indexes every string field.
+	AddTextIndex(weights map[string]int32, opt ...*options.IndexOptions) Indexes
+	// AddIndex2dsphere adds a 2dsphere index on key, for GeoJSON geometries
+	// such as geo.Point.
+	AddIndex2dsphere(key string, opt ...*options.IndexOptions) Indexes
+	// AddIndex2d adds a 2d index on key, for legacy coordinate pairs queried
+	// with GeoWithin and a geo.Box, geo.LegacyPolygon or geo.CenterSphere.
+	AddIndex2d(key string, opt ...*options.IndexOptions) Indexes
 	SetMaxTime(d time.Duration) Indexes
 	SetCommitQuorumInt(quorum int32) Indexes
 	SetCommitQuorumString(quorum string) Indexes
@@ -165,6 +176,53 @@ func (i *index) AddIndex(keys any, opt ...*options.IndexOptions) Indexes {
 	return i
 }
 
+// AddTextIndex adds a text index on the fields of weights. A match in a
+// field counts weight times as much towards the relevance score as one in a
+// field of weight 1. A collection has at most one text index. The language
+// used for stemming is set with options.Index().SetDefaultLanguage.
+//
+// Example usage:
+//
+//	client.AddTextIndex(map[string]int32{"title": 10, "body": 1},
+//		options.Index().SetDefaultLanguage("english")).CreateIndexes(&Post{})
+func (i *index) AddTextIndex(weights map[string]int32, opt ...*options.IndexOptions) Indexes {
+	keys, w := textIndexKeys(weights)
+	return i.AddIndex(keys, append(opt, options.Index().SetWeights(w))...)
+}
+
+// textIndexKeys returns the keys and weights of a text index on the fields
+// of weights, in field order so the index name is stable.
+func textIndexKeys(weights map[string]int32) (bson.D, bson.D) {
+	fields := make([]string, 0, len(weights))
+	for f := range weights {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	keys := make(bson.D, len(fields))
+	w := make(bson.D, len(fields))
+	for n, f := range fields {
+		keys[n] = bson.E{Key: f, Value: "text"}
+		w[n] = bson.E{Key: f, Value: weights[f]}
+	}
+	return keys, w
+}
+
+// AddIndex2dsphere adds a 2dsphere index on key.
+func (i *index) AddIndex2dsphere(key string, opt ...*options.IndexOptions) Indexes {
+	return i.AddIndex(bson.D{{Key: key, Value: "2dsphere"}}, opt...)
+}
+
+// AddIndex2d adds a 2d index on key. The bounds and precision can be set
+// with options.Index().SetMin, SetMax and SetBits.
+//
+// The field holds legacy coordinate pairs such as geo.Position, which
+// GeoWithin matches with a geo.Box, geo.LegacyPolygon or geo.CenterSphere.
+// Near, NearSphere and geo.NearStage write GeoJSON points and need a
+// 2dsphere index instead, see AddIndex2dsphere.
+func (i *index) AddIndex2d(key string, opt ...*options.IndexOptions) Indexes {
+	return i.AddIndex(bson.D{{Key: key, Value: "2d"}}, opt...)
+}
+
 // SetMaxTime sets the value for the MaxTime field.
 func (i *index) SetMaxTime(d time.Duration) Indexes {
 	i.createIndexOpts = append(i.createIndexOpts, options.CreateIndexes().SetMaxTime(d))
@@ -0,0 +1,102 @@
+// Package bsonstruct lists the bson fields of model structs the way the
+// driver's default struct codec sees them, and parses their pie tags. It is
+// shared by pie and its internal packages, so that they agree on which Go
+// field holds which key.
+package bsonstruct
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Field is a bson field of a struct type.
+type Field struct {
+	// Name is the key the field is stored under.
+	Name string
+	// Index is the index sequence of the field for reflect.Value.FieldByIndex,
+	// through the ",inline" structs holding it.
+	Index []int
+	// Indirect reports whether Index passes through an inlined struct
+	// pointer, which may be nil; see Value.
+	Indirect bool
+	// Field is the Go struct field.
+	Field reflect.StructField
+}
+
+// Fields lists the fields of struct type t, or of the struct t points to,
+// under their bson names: untagged fields use the lowercased Go name, fields
+// named "-", unexported fields and inlined maps are skipped and ",inline"
+// structs and struct pointers are flattened.
+func Fields(t reflect.Type) []Field {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return appendFields(nil, t, nil, false)
+}
+
+func appendFields(fields []Field, t reflect.Type, index []int, indirect bool) []Field {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		parts := strings.Split(field.Tag.Get("bson"), ",")
+		if parts[0] == "-" {
+			continue
+		}
+		fieldIndex := append(append([]int(nil), index...), i)
+		inline := false
+		for _, opt := range parts[1:] {
+			inline = inline || opt == "inline"
+		}
+		if inline {
+			inner, ptr := field.Type, false
+			for inner.Kind() == reflect.Ptr {
+				inner, ptr = inner.Elem(), true
+			}
+			if inner.Kind() == reflect.Struct {
+				fields = appendFields(fields, inner, fieldIndex, indirect || ptr)
+			}
+			// An inlined map holds the keys of no field.
+			continue
+		}
+		name := parts[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields = append(fields, Field{Name: name, Index: fieldIndex, Indirect: indirect, Field: field})
+	}
+	return fields
+}
+
+// Value returns field f of struct v, or false when a nil inlined pointer
+// holds it.
+func Value(v reflect.Value, f Field) (reflect.Value, bool) {
+	if !f.Indirect {
+		return v.FieldByIndex(f.Index), true
+	}
+	fv, err := v.FieldByIndexErr(f.Index)
+	return fv, err == nil
+}
+
+// Tag parses the pie struct tag of field. Options are separated by commas
+// and are either flags such as "unique" or key:value pairs; flags map to "".
+func Tag(field reflect.StructField) map[string]string {
+	opts := make(map[string]string)
+	tag, ok := field.Tag.Lookup("pie")
+	if !ok {
+		return opts
+	}
+	for _, opt := range strings.Split(tag, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(opt, ":")
+		opts[key] = value
+	}
+	return opts
+}
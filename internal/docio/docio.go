@@ -0,0 +1,517 @@
+// Package docio encodes documents as JSON Lines or CSV and reads them back in
+// batches. It holds what pie's session and the pietest fake share for export
+// and import.
+package docio
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/5xxxx/pie/internal/mql"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Format is an export format.
+type Format int
+
+const (
+	// JSONLines writes one relaxed Extended JSON document per line.
+	JSONLines Format = iota
+	// CanonicalJSONLines writes one canonical Extended JSON document per line.
+	CanonicalJSONLines
+	// CSV writes a header row and one row per document.
+	CSV
+)
+
+// Encoder writes documents in a Format.
+type Encoder struct {
+	w       io.Writer
+	format  Format
+	csv     *csv.Writer
+	columns []string
+	header  bool
+}
+
+// NewEncoder returns an encoder writing to w. For CSV, columns are the dotted
+// paths written, in order; when empty the keys of the first document are used.
+func NewEncoder(w io.Writer, format Format, columns []string) (*Encoder, error) {
+	e := &Encoder{w: w, format: format, columns: columns}
+	switch format {
+	case JSONLines, CanonicalJSONLines:
+	case CSV:
+		e.csv = csv.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown export format %d", format)
+	}
+	return e, nil
+}
+
+// Encode writes doc.
+func (e *Encoder) Encode(doc bson.Raw) error {
+	if e.csv == nil {
+		data, err := bson.MarshalExtJSON(doc, e.format == CanonicalJSONLines, false)
+		if err != nil {
+			return err
+		}
+		_, err = e.w.Write(append(data, '\n'))
+		return err
+	}
+
+	d, err := mql.NormalizeDoc(doc)
+	if err != nil {
+		return err
+	}
+	if !e.header {
+		if len(e.columns) == 0 {
+			for _, el := range d {
+				e.columns = append(e.columns, el.Key)
+			}
+		}
+		if err := e.csv.Write(e.columns); err != nil {
+			return err
+		}
+		e.header = true
+	}
+	row := make([]string, len(e.columns))
+	for i, col := range e.columns {
+		v, ok := pathValue(d, col)
+		if !ok {
+			continue
+		}
+		if row[i], err = csvValue(v); err != nil {
+			return err
+		}
+	}
+	return e.csv.Write(row)
+}
+
+// Close flushes buffered output.
+func (e *Encoder) Close() error {
+	if e.csv == nil {
+		return nil
+	}
+	e.csv.Flush()
+	return e.csv.Error()
+}
+
+// csvValue formats a field for CSV: scalars as text, documents and arrays as relaxed Extended JSON.
+func csvValue(v any) (string, error) {
+	switch x := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return x, nil
+	case primitive.ObjectID:
+		return x.Hex(), nil
+	case primitive.DateTime:
+		return x.Time().UTC().Format(time.RFC3339Nano), nil
+	case bool, int32, int64, float64:
+		return fmt.Sprint(x), nil
+	}
+	data, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: v}}, false, false)
+	if err != nil {
+		return "", err
+	}
+	// Strip the {"v": ...} wrapper.
+	return string(data[5 : len(data)-1]), nil
+}
+
+// Stats counts the documents an import has processed.
+type Stats struct {
+	Read     int64
+	Inserted int64
+	Upserted int64
+	Modified int64
+	Failed   int64
+	// Errors holds the errors of the failed documents.
+	Errors []error
+}
+
+// Add adds the counts and errors of o to s.
+func (s *Stats) Add(o Stats) {
+	s.Inserted += o.Inserted
+	s.Upserted += o.Upserted
+	s.Modified += o.Modified
+	s.Failed += o.Failed
+	s.Errors = append(s.Errors, o.Errors...)
+}
+
+// WriteFunc writes a batch of documents. It reports per-document failures in
+// the returned Stats and returns an error only when the import cannot go on.
+type WriteFunc func(ctx context.Context, docs []bson.D, lines []int) (Stats, error)
+
+// ImportOptions configures Import.
+type ImportOptions struct {
+	Format    Format
+	BatchSize int
+	MaxErrors int
+	Progress  func(Stats)
+}
+
+// ErrTooManyErrors is returned when an import fails on more documents than it tolerates.
+var ErrTooManyErrors = errors.New("too many errors")
+
+// maxLine is the longest line Import reads, a little over the 16MB document limit.
+const maxLine = 17 << 20
+
+// Import reads documents in opts.Format from r and writes them in batches
+// with write. The JSON Lines formats read relaxed or canonical Extended JSON,
+// one document per line or, when the input starts with "[", as an array. CSV
+// reads a header row of dotted paths and one document per row, see csvField.
+// Documents that do not parse count as failed documents. Import stops with
+// ErrTooManyErrors once more than MaxErrors documents failed, or at the first
+// failure when MaxErrors is zero; a negative MaxErrors tolerates any number.
+func Import(ctx context.Context, r io.Reader, opts ImportOptions, write WriteFunc) (Stats, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	var stats Stats
+	var batch []bson.D
+	var lines []int
+
+	tooMany := func() bool {
+		return opts.MaxErrors >= 0 && stats.Failed > int64(opts.MaxErrors)
+	}
+	fail := func() error {
+		return fmt.Errorf("%w: %w", ErrTooManyErrors, errors.Join(stats.Errors...))
+	}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		s, err := write(ctx, batch, lines)
+		stats.Add(s)
+		batch, lines = batch[:0], lines[:0]
+		if opts.Progress != nil {
+			opts.Progress(stats)
+		}
+		if err != nil {
+			return err
+		}
+		if tooMany() {
+			return fail()
+		}
+		return nil
+	}
+
+	src, err := newSource(r, opts.Format)
+	if err != nil {
+		return stats, err
+	}
+	for {
+		d, line, docErr, err := src.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		stats.Read++
+		if docErr != nil {
+			stats.Failed++
+			stats.Errors = append(stats.Errors, fmt.Errorf("line %d: %w", line, docErr))
+			if tooMany() {
+				return stats, fail()
+			}
+			continue
+		}
+		batch = append(batch, d)
+		lines = append(lines, line)
+		if len(batch) >= opts.BatchSize {
+			if err := flush(); err != nil {
+				return stats, err
+			}
+		}
+	}
+	return stats, flush()
+}
+
+// source reads the documents of an import.
+type source interface {
+	// next returns the next document and the line it starts on, or the error
+	// of a document that does not parse, or io.EOF after the last document.
+	// Other errors end the import.
+	next() (doc bson.D, line int, docErr error, err error)
+}
+
+func newSource(r io.Reader, format Format) (source, error) {
+	switch format {
+	case JSONLines, CanonicalJSONLines:
+		br := bufio.NewReader(r)
+		for n := 1; ; n++ {
+			b, err := br.Peek(n)
+			if err != nil || !isSpace(b[n-1]) {
+				if err == nil && b[n-1] == '[' {
+					return newArraySource(br)
+				}
+				break
+			}
+		}
+		scanner := bufio.NewScanner(br)
+		scanner.Buffer(make([]byte, 64<<10), maxLine)
+		return &lineSource{scanner: scanner}, nil
+	case CSV:
+		cr := csv.NewReader(r)
+		cr.ReuseRecord = true
+		return &csvSource{r: cr}, nil
+	}
+	return nil, fmt.Errorf("unknown import format %d", format)
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
+
+// lineSource reads one Extended JSON document per line, skipping blank lines.
+type lineSource struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (s *lineSource) next() (bson.D, int, error, error) {
+	for s.scanner.Scan() {
+		s.line++
+		data := s.scanner.Bytes()
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+		var d bson.D
+		if err := bson.UnmarshalExtJSON(data, false, &d); err != nil {
+			return nil, s.line, err, nil
+		}
+		return d, s.line, nil, nil
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, 0, nil, err
+	}
+	return nil, 0, nil, io.EOF
+}
+
+// arraySource reads the documents of an Extended JSON array.
+type arraySource struct {
+	dec   *json.Decoder
+	lines *lineCounter
+}
+
+func newArraySource(r io.Reader) (*arraySource, error) {
+	lines := &lineCounter{r: r}
+	dec := json.NewDecoder(lines)
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return &arraySource{dec: dec, lines: lines}, nil
+}
+
+func (s *arraySource) next() (bson.D, int, error, error) {
+	if !s.dec.More() {
+		if _, err := s.dec.Token(); err != nil {
+			return nil, 0, nil, err
+		}
+		return nil, 0, nil, io.EOF
+	}
+	var raw json.RawMessage
+	if err := s.dec.Decode(&raw); err != nil {
+		// The array cannot be read past a syntax error.
+		return nil, 0, nil, err
+	}
+	line := s.lines.lineAt(s.dec.InputOffset() - int64(len(raw)))
+	var d bson.D
+	if err := bson.UnmarshalExtJSON(raw, false, &d); err != nil {
+		return nil, line, err, nil
+	}
+	return d, line, nil, nil
+}
+
+// lineCounter records the offsets of the newlines read through it.
+type lineCounter struct {
+	r        io.Reader
+	read     int64
+	newlines []int64
+}
+
+func (c *lineCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	for i, b := range p[:n] {
+		if b == '\n' {
+			c.newlines = append(c.newlines, c.read+int64(i))
+		}
+	}
+	c.read += int64(n)
+	return n, err
+}
+
+// lineAt returns the line of the byte at offset.
+func (c *lineCounter) lineAt(offset int64) int {
+	return 1 + sort.Search(len(c.newlines), func(i int) bool { return c.newlines[i] >= offset })
+}
+
+// csvSource reads a header row of dotted paths and one document per row.
+type csvSource struct {
+	r       *csv.Reader
+	columns []string
+}
+
+func (s *csvSource) next() (bson.D, int, error, error) {
+	if s.columns == nil {
+		header, err := s.r.Read()
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		s.columns = append([]string(nil), header...)
+		s.r.FieldsPerRecord = len(header)
+	}
+	record, err := s.r.Read()
+	if err == io.EOF {
+		return nil, 0, nil, io.EOF
+	}
+	var pe *csv.ParseError
+	if errors.As(err, &pe) {
+		return nil, pe.StartLine, pe.Err, nil
+	}
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	line, _ := s.r.FieldPos(0)
+	var d bson.D
+	for i, col := range s.columns {
+		if record[i] == "" {
+			continue
+		}
+		d = setPath(d, strings.Split(col, "."), csvField(record[i]))
+	}
+	return d, line, nil, nil
+}
+
+// setPath sets the value at path of doc, adding embedded documents as needed.
+func setPath(doc bson.D, path []string, v any) bson.D {
+	for i := range doc {
+		if doc[i].Key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			doc[i].Value = v
+			return doc
+		}
+		sub, _ := doc[i].Value.(bson.D)
+		doc[i].Value = setPath(sub, path[1:], v)
+		return doc
+	}
+	if len(path) == 1 {
+		return append(doc, bson.E{Key: path[0], Value: v})
+	}
+	return append(doc, bson.E{Key: path[0], Value: setPath(nil, path[1:], v)})
+}
+
+// csvField parses a CSV field the way csvValue writes it: documents and
+// arrays as Extended JSON, booleans, integers as int32 or int64, other
+// numbers as doubles, ObjectIDs as hex and dates as RFC 3339; anything else
+// is a string. Strings looking like one of these are read as such, so CSV
+// does not round-trip every document: the JSON Lines formats do.
+func csvField(s string) any {
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if s[0] == '{' || s[0] == '[' {
+		var d bson.D
+		if err := bson.UnmarshalExtJSON([]byte(`{"v":`+s+`}`), false, &d); err == nil {
+			return d[0].Value
+		}
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n >= math.MinInt32 && n <= math.MaxInt32 {
+			return int32(n)
+		}
+		return n
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	if len(s) == 24 {
+		if id, err := primitive.ObjectIDFromHex(s); err == nil {
+			return id
+		}
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return primitive.NewDateTimeFromTime(t)
+	}
+	return s
+}
+
+// pathValue returns the value at a dotted path of doc. Numeric components index arrays.
+func pathValue(doc bson.D, path string) (any, bool) {
+	var v any = doc
+	for _, part := range strings.Split(path, ".") {
+		switch x := v.(type) {
+		case bson.D:
+			var ok bool
+			if v, ok = mql.Get(x, part); !ok {
+				return nil, false
+			}
+		case bson.A:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(x) {
+				return nil, false
+			}
+			v = x[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// UpsertFilter returns the equality filter on fields of doc that an upsert replaces by.
+func UpsertFilter(doc bson.D, fields []string) (bson.D, error) {
+	filter := make(bson.D, 0, len(fields))
+	for _, f := range fields {
+		v, ok := pathValue(doc, f)
+		if !ok {
+			return nil, fmt.Errorf("document has no %q field", f)
+		}
+		filter = append(filter, bson.E{Key: f, Value: v})
+	}
+	return filter, nil
+}
+
+// ProjectionColumns returns the CSV columns of an inclusion projection, or nil
+// for an exclusion projection, where the documents decide. The columns of a
+// map projection are sorted by name, since maps have no order.
+func ProjectionColumns(projection any) ([]string, error) {
+	if projection == nil {
+		return nil, nil
+	}
+	d, err := mql.NormalizeDoc(projection)
+	if err != nil {
+		return nil, err
+	}
+	if reflect.ValueOf(projection).Kind() == reflect.Map {
+		sort.SliceStable(d, func(i, j int) bool { return d[i].Key < d[j].Key })
+	}
+	var columns []string
+	for _, e := range d {
+		// Operator documents such as {$slice: 2} are truthy and keep the field.
+		if mql.Truthy(e.Value) {
+			columns = append(columns, strings.TrimSuffix(e.Key, ".$"))
+		}
+	}
+	return columns, nil
+}
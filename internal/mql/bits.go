@@ -0,0 +1,139 @@
+package mql
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// mod implements $mod: [divisor, remainder]. Numbers are truncated towards
+// zero before the division, like the server does.
+func mod(values []any, arg any) (bool, error) {
+	a, ok := arg.(bson.A)
+	if !ok || len(a) != 2 {
+		return false, errors.New("$mod needs an array of a divisor and a remainder")
+	}
+	d, ok1 := Float(a[0])
+	r, ok2 := Float(a[1])
+	if !ok1 || !ok2 {
+		return false, errors.New("$mod divisor and remainder must be numbers")
+	}
+	divisor, remainder := int64(d), int64(r)
+	if divisor == 0 {
+		return false, errors.New("$mod divisor cannot be 0")
+	}
+	for _, v := range expand(values) {
+		f, ok := Float(v)
+		if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+			continue
+		}
+		if int64(f)%divisor == remainder {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// bits implements the $bitsAllSet, $bitsAnySet, $bitsAllClear and
+// $bitsAnyClear operators on integers and binary data.
+func bits(values []any, op string, arg any) (bool, error) {
+	positions, err := bitPositions(op, arg)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range expand(values) {
+		test, ok := bitTester(v)
+		if !ok {
+			continue
+		}
+		set, clear := 0, 0
+		for _, p := range positions {
+			if test(p) {
+				set++
+			} else {
+				clear++
+			}
+		}
+		var match bool
+		switch op {
+		case "$bitsAllSet":
+			match = clear == 0
+		case "$bitsAnySet":
+			match = set > 0
+		case "$bitsAllClear":
+			match = set == 0
+		case "$bitsAnyClear":
+			match = clear > 0
+		}
+		if match {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// bitPositions returns the bit positions an operand names: a nonnegative
+// integer mask, an array of nonnegative positions or a binary mask.
+func bitPositions(op string, arg any) ([]int, error) {
+	switch x := arg.(type) {
+	case bson.A:
+		out := make([]int, len(x))
+		for i, p := range x {
+			f, ok := Float(p)
+			if !ok || f < 0 || f != math.Trunc(f) {
+				return nil, fmt.Errorf("%s bit positions must be nonnegative whole numbers", op)
+			}
+			out[i] = int(f)
+		}
+		return out, nil
+	case primitive.Binary:
+		var out []int
+		for i, b := range x.Data {
+			for j := 0; j < 8; j++ {
+				if b&(1<<j) != 0 {
+					out = append(out, i*8+j)
+				}
+			}
+		}
+		return out, nil
+	}
+	f, ok := Float(arg)
+	if !ok || f < 0 || f != math.Trunc(f) || f > math.MaxInt64 {
+		return nil, fmt.Errorf("%s needs a nonnegative integer mask, an array of bit positions or a binary mask", op)
+	}
+	mask := uint64(f)
+	var out []int
+	for i := 0; i < 64; i++ {
+		if mask&(1<<i) != 0 {
+			out = append(out, i)
+		}
+	}
+	return out, nil
+}
+
+// bitTester returns a function reporting whether bit p of v is set, for
+// integral numbers, which are sign extended, and binary data.
+func bitTester(v any) (func(p int) bool, bool) {
+	if b, ok := v.(primitive.Binary); ok {
+		return func(p int) bool {
+			return p/8 < len(b.Data) && b.Data[p/8]&(1<<(p%8)) != 0
+		}, true
+	}
+	f, ok := Float(v)
+	if !ok || f != math.Trunc(f) || f < math.MinInt64 || f > math.MaxInt64 {
+		return nil, false
+	}
+	n := int64(f)
+	if i, ok := v.(int64); ok {
+		n = i
+	}
+	return func(p int) bool {
+		if p >= 64 {
+			return n < 0
+		}
+		return uint64(n)&(1<<p) != 0
+	}, true
+}
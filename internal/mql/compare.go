@@ -0,0 +1,220 @@
+package mql
+
+import (
+	"bytes"
+	"math"
+	"math/big"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Canonical BSON type classes in the order MongoDB sorts them.
+// Values from different classes never compare equal, and range
+// operators such as $gt only look at values of the same class.
+const (
+	classMinKey = iota + 1
+	classNull
+	classNumber
+	classString
+	classObject
+	classArray
+	classBinary
+	classObjectID
+	classBool
+	classDate
+	classTimestamp
+	classRegex
+	classMaxKey
+	classOther
+)
+
+func typeClass(v any) int {
+	switch v.(type) {
+	case primitive.MinKey:
+		return classMinKey
+	case nil, primitive.Null, primitive.Undefined:
+		return classNull
+	case int32, int64, float64, primitive.Decimal128:
+		return classNumber
+	case string, primitive.Symbol:
+		return classString
+	case bson.D:
+		return classObject
+	case bson.A:
+		return classArray
+	case primitive.Binary:
+		return classBinary
+	case primitive.ObjectID:
+		return classObjectID
+	case bool:
+		return classBool
+	case primitive.DateTime:
+		return classDate
+	case primitive.Timestamp:
+		return classTimestamp
+	case primitive.Regex:
+		return classRegex
+	case primitive.MaxKey:
+		return classMaxKey
+	}
+	return classOther
+}
+
+// Comparable reports whether a and b belong to the same type class,
+// which is what MongoDB requires before applying $gt, $lt and friends.
+func Comparable(a, b any) bool {
+	return typeClass(a) == typeClass(b)
+}
+
+// Equal reports whether two normalized values are equal under MongoDB rules,
+// where numbers of different BSON types compare by value.
+func Equal(a, b any) bool {
+	return Comparable(a, b) && Compare(a, b) == 0
+}
+
+// Compare orders two normalized values the way MongoDB sorts them.
+// It returns -1, 0 or 1.
+func Compare(a, b any) int {
+	ca, cb := typeClass(a), typeClass(b)
+	if ca != cb {
+		return compareInts(int64(ca), int64(cb))
+	}
+
+	switch ca {
+	case classNumber:
+		return compareNumbers(a, b)
+	case classString:
+		return strings.Compare(stringOf(a), stringOf(b))
+	case classObject:
+		return compareDocs(a.(bson.D), b.(bson.D))
+	case classArray:
+		return compareArrays(a.(bson.A), b.(bson.A))
+	case classBinary:
+		x, y := a.(primitive.Binary), b.(primitive.Binary)
+		if c := compareInts(int64(len(x.Data)), int64(len(y.Data))); c != 0 {
+			return c
+		}
+		if c := compareInts(int64(x.Subtype), int64(y.Subtype)); c != 0 {
+			return c
+		}
+		return bytes.Compare(x.Data, y.Data)
+	case classObjectID:
+		x, y := a.(primitive.ObjectID), b.(primitive.ObjectID)
+		return bytes.Compare(x[:], y[:])
+	case classBool:
+		x, y := a.(bool), b.(bool)
+		switch {
+		case x == y:
+			return 0
+		case !x:
+			return -1
+		}
+		return 1
+	case classDate:
+		return compareInts(int64(a.(primitive.DateTime)), int64(b.(primitive.DateTime)))
+	case classTimestamp:
+		x, y := a.(primitive.Timestamp), b.(primitive.Timestamp)
+		if c := compareInts(int64(x.T), int64(y.T)); c != 0 {
+			return c
+		}
+		return compareInts(int64(x.I), int64(y.I))
+	case classRegex:
+		x, y := a.(primitive.Regex), b.(primitive.Regex)
+		if c := strings.Compare(x.Pattern, y.Pattern); c != 0 {
+			return c
+		}
+		return strings.Compare(x.Options, y.Options)
+	}
+	return 0
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func stringOf(v any) string {
+	if s, ok := v.(primitive.Symbol); ok {
+		return string(s)
+	}
+	return v.(string)
+}
+
+func compareDocs(a, b bson.D) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareInts(int64(typeClass(a[i].Value)), int64(typeClass(b[i].Value))); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a[i].Key, b[i].Key); c != 0 {
+			return c
+		}
+		if c := Compare(a[i].Value, b[i].Value); c != 0 {
+			return c
+		}
+	}
+	return compareInts(int64(len(a)), int64(len(b)))
+}
+
+func compareArrays(a, b bson.A) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := Compare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(int64(len(a)), int64(len(b)))
+}
+
+func compareNumbers(a, b any) int {
+	x, xInt := a.(int64)
+	if v, ok := a.(int32); ok {
+		x, xInt = int64(v), true
+	}
+	y, yInt := b.(int64)
+	if v, ok := b.(int32); ok {
+		y, yInt = int64(v), true
+	}
+	if xInt && yInt {
+		return compareInts(x, y)
+	}
+	return numberOf(a).Cmp(numberOf(b))
+}
+
+// numberOf widens any BSON number to a big.Float so that int64 and
+// Decimal128 values keep their precision when compared with doubles.
+func numberOf(v any) *big.Float {
+	switch n := v.(type) {
+	case int32:
+		return new(big.Float).SetInt64(int64(n))
+	case int64:
+		return new(big.Float).SetInt64(n)
+	case float64:
+		if math.IsNaN(n) {
+			// NaN sorts below every other number.
+			return new(big.Float).SetInf(true)
+		}
+		return new(big.Float).SetFloat64(n)
+	case primitive.Decimal128:
+		f, _, err := big.ParseFloat(n.String(), 10, 128, big.ToNearestEven)
+		if err != nil {
+			return new(big.Float).SetInf(true)
+		}
+		return f
+	}
+	return new(big.Float)
+}
+
+// Float returns v as a float64 if it is a BSON number.
+func Float(v any) (float64, bool) {
+	if typeClass(v) != classNumber {
+		return 0, false
+	}
+	f, _ := numberOf(v).Float64()
+	return f, true
+}
@@ -0,0 +1,427 @@
+package mql
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type missing struct{}
+
+// Missing is what Eval returns for a field path that does not resolve.
+// Stages such as $project drop fields whose expression evaluates to Missing.
+var Missing any = missing{}
+
+// Eval evaluates an aggregation expression against doc. Field paths ("$a.b"),
+// variables ($$ROOT, $$CURRENT, $$REMOVE and those bound by $let, $filter,
+// $map and $reduce), literals, embedded documents and arrays of expressions
+// and a subset of the expression operators are supported.
+func Eval(expr any, doc bson.D) (any, error) {
+	return env{root: doc}.eval(expr)
+}
+
+// env is the scope an expression is evaluated in.
+type env struct {
+	root bson.D
+	vars map[string]any
+}
+
+// with returns a copy of e in which the variable name is bound to v.
+func (e env) with(name string, v any) env {
+	vars := make(map[string]any, len(e.vars)+1)
+	for k, x := range e.vars {
+		vars[k] = x
+	}
+	vars[name] = v
+	return env{root: e.root, vars: vars}
+}
+
+func (e env) eval(expr any) (any, error) {
+	switch x := expr.(type) {
+	case string:
+		if strings.HasPrefix(x, "$$") {
+			return e.variable(x[2:])
+		}
+		if strings.HasPrefix(x, "$") {
+			return fieldPath(e.root, x[1:]), nil
+		}
+		return x, nil
+	case bson.A:
+		out := make(bson.A, len(x))
+		for i, el := range x {
+			v, err := e.eval(el)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = nullIfMissing(v)
+		}
+		return out, nil
+	case bson.D:
+		if len(x) == 1 && strings.HasPrefix(x[0].Key, "$") {
+			return e.operator(x[0].Key, x[0].Value)
+		}
+		out := bson.D{}
+		for _, el := range x {
+			if strings.HasPrefix(el.Key, "$") {
+				return nil, fmt.Errorf("an expression specification must contain exactly one field, found %s among others", el.Key)
+			}
+			v, err := e.eval(el.Value)
+			if err != nil {
+				return nil, err
+			}
+			if v != Missing {
+				out = append(out, bson.E{Key: el.Key, Value: v})
+			}
+		}
+		return out, nil
+	}
+	return expr, nil
+}
+
+func (e env) variable(name string) (any, error) {
+	root, rest, _ := strings.Cut(name, ".")
+	var v any
+	switch root {
+	case "ROOT", "CURRENT":
+		v = e.root
+	case "REMOVE":
+		return Missing, nil
+	default:
+		var ok bool
+		if v, ok = e.vars[root]; !ok {
+			return nil, fmt.Errorf("use of undefined variable: %s", root)
+		}
+	}
+	if rest == "" {
+		return v, nil
+	}
+	return walkPath(v, strings.Split(rest, ".")), nil
+}
+
+// fieldPath resolves a path for an expression: arrays along the way produce
+// arrays of the reached values, unlike query paths which fan out.
+func fieldPath(doc bson.D, path string) any {
+	return walkPath(doc, strings.Split(path, "."))
+}
+
+func walkPath(v any, parts []string) any {
+	if len(parts) == 0 {
+		return v
+	}
+	switch x := v.(type) {
+	case bson.D:
+		next, ok := Get(x, parts[0])
+		if !ok {
+			return Missing
+		}
+		return walkPath(next, parts[1:])
+	case bson.A:
+		out := bson.A{}
+		for _, elem := range x {
+			if r := walkPath(elem, parts); r != Missing {
+				out = append(out, r)
+			}
+		}
+		return out
+	}
+	return Missing
+}
+
+func nullIfMissing(v any) any {
+	if v == Missing {
+		return nil
+	}
+	return v
+}
+
+// args evaluates the operand of an operator, which is either a single expression or an array of them.
+func (e env) args(arg any) ([]any, error) {
+	list, ok := arg.(bson.A)
+	if !ok {
+		list = bson.A{arg}
+	}
+	out := make([]any, len(list))
+	for i, a := range list {
+		v, err := e.eval(a)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = nullIfMissing(v)
+	}
+	return out, nil
+}
+
+// named evaluates the fields of an operator taking a document of named
+// arguments, such as {input: ..., as: ..., cond: ...}. Fields that are not
+// in names are rejected and required ones must be present.
+func (e env) named(op string, arg any, required []string, optional ...string) (map[string]any, error) {
+	spec, ok := arg.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("%s expects an object as its argument", op)
+	}
+	out := map[string]any{}
+	for _, el := range spec {
+		if !contains(required, el.Key) && !contains(optional, el.Key) {
+			return nil, fmt.Errorf("%s found an unknown argument: %s", op, el.Key)
+		}
+		out[el.Key] = el.Value
+	}
+	for _, name := range required {
+		if _, ok := out[name]; !ok {
+			return nil, fmt.Errorf("missing '%s' parameter to %s", name, op)
+		}
+	}
+	return out, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (e env) operator(op string, arg any) (any, error) {
+	switch op {
+	case "$literal":
+		return arg, nil
+	case "$cond":
+		if d, ok := arg.(bson.D); ok {
+			spec, err := e.named(op, d, []string{"if", "then", "else"})
+			if err != nil {
+				return nil, err
+			}
+			arg = bson.A{spec["if"], spec["then"], spec["else"]}
+		}
+		list, ok := arg.(bson.A)
+		if !ok || len(list) != 3 {
+			return nil, errors.New("expression $cond takes exactly 3 arguments")
+		}
+		cond, err := e.eval(list[0])
+		if err != nil {
+			return nil, err
+		}
+		if Truthy(nullIfMissing(cond)) {
+			return e.eval(list[1])
+		}
+		return e.eval(list[2])
+	case "$switch":
+		return e.switchExpr(arg)
+	case "$let":
+		return e.let(arg)
+	case "$filter", "$map", "$reduce":
+		return e.iterate(op, arg)
+	case "$trim", "$ltrim", "$rtrim", "$regexMatch", "$replaceOne", "$replaceAll",
+		"$dateToString", "$dateFromString", "$dateAdd", "$dateSubtract", "$dateDiff":
+		return e.namedOperator(op, arg)
+	case "$year", "$month", "$dayOfMonth", "$dayOfWeek", "$dayOfYear", "$hour", "$minute", "$second", "$millisecond":
+		return e.datePart(op, arg)
+	}
+
+	vals, err := e.args(arg)
+	if err != nil {
+		return nil, err
+	}
+	want := func(n int) error {
+		if len(vals) != n {
+			return fmt.Errorf("expression %s takes exactly %d arguments, %d were passed in", op, n, len(vals))
+		}
+		return nil
+	}
+
+	switch op {
+	case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte", "$cmp":
+		if err := want(2); err != nil {
+			return nil, err
+		}
+		c := Compare(vals[0], vals[1])
+		switch op {
+		case "$eq":
+			return c == 0, nil
+		case "$ne":
+			return c != 0, nil
+		case "$gt":
+			return c > 0, nil
+		case "$gte":
+			return c >= 0, nil
+		case "$lt":
+			return c < 0, nil
+		case "$lte":
+			return c <= 0, nil
+		}
+		return int32(c), nil
+	case "$and":
+		for _, v := range vals {
+			if !Truthy(v) {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "$or":
+		for _, v := range vals {
+			if Truthy(v) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$not":
+		if err := want(1); err != nil {
+			return nil, err
+		}
+		return !Truthy(vals[0]), nil
+	case "$ifNull":
+		for _, v := range vals {
+			if !isNull(v) {
+				return v, nil
+			}
+		}
+		return nil, nil
+	case "$add", "$multiply":
+		return arithmetic(op, vals)
+	case "$subtract", "$divide", "$mod":
+		if err := want(2); err != nil {
+			return nil, err
+		}
+		return arithmetic(op, vals)
+	case "$concat":
+		var b strings.Builder
+		for _, v := range vals {
+			if isNull(v) {
+				return nil, nil
+			}
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("$concat only supports strings, not %T", v)
+			}
+			b.WriteString(s)
+		}
+		return b.String(), nil
+	case "$toLower", "$toUpper":
+		if err := want(1); err != nil {
+			return nil, err
+		}
+		s, _ := vals[0].(string)
+		if op == "$toLower" {
+			return strings.ToLower(s), nil
+		}
+		return strings.ToUpper(s), nil
+	case "$size":
+		if err := want(1); err != nil {
+			return nil, err
+		}
+		a, ok := vals[0].(bson.A)
+		if !ok {
+			return nil, fmt.Errorf("the argument to $size must be an array, but was of type %T", vals[0])
+		}
+		return int32(len(a)), nil
+	case "$in":
+		if err := want(2); err != nil {
+			return nil, err
+		}
+		a, ok := vals[1].(bson.A)
+		if !ok {
+			return nil, errors.New("$in requires an array as a second argument")
+		}
+		for _, el := range a {
+			if Equal(el, vals[0]) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return valueOperator(op, vals)
+}
+
+// Truthy reports how an aggregation expression coerces v to a boolean.
+func Truthy(v any) bool {
+	return truthy(v)
+}
+
+func arithmetic(op string, vals []any) (any, error) {
+	if len(vals) == 0 {
+		return int32(0), nil
+	}
+	for _, v := range vals {
+		if isNull(v) {
+			return nil, nil
+		}
+		if _, ok := Float(v); !ok {
+			return nil, fmt.Errorf("%s only supports numeric types, not %T", op, v)
+		}
+	}
+
+	allInt := true
+	ints := make([]int64, len(vals))
+	for i, v := range vals {
+		switch n := v.(type) {
+		case int32:
+			ints[i] = int64(n)
+		case int64:
+			ints[i] = n
+		default:
+			allInt = false
+		}
+	}
+
+	if allInt && op != "$divide" {
+		acc := ints[0]
+		for _, n := range ints[1:] {
+			switch op {
+			case "$add":
+				acc += n
+			case "$multiply":
+				acc *= n
+			case "$subtract":
+				acc -= n
+			case "$mod":
+				if n == 0 {
+					return nil, errors.New("can't $mod by zero")
+				}
+				acc %= n
+			}
+		}
+		return narrow(acc, vals), nil
+	}
+
+	acc, _ := Float(vals[0])
+	for _, v := range vals[1:] {
+		f, _ := Float(v)
+		switch op {
+		case "$add":
+			acc += f
+		case "$multiply":
+			acc *= f
+		case "$subtract":
+			acc -= f
+		case "$divide":
+			if f == 0 {
+				return nil, errors.New("can't $divide by zero")
+			}
+			acc /= f
+		case "$mod":
+			if f == 0 {
+				return nil, errors.New("can't $mod by zero")
+			}
+			acc = math.Mod(acc, f)
+		}
+	}
+	return acc, nil
+}
+
+// narrow returns n as an int32 when every operand was an int32 and the result fits.
+func narrow(n int64, vals []any) any {
+	for _, v := range vals {
+		if _, ok := v.(int32); !ok {
+			return n
+		}
+	}
+	if n >= math.MinInt32 && n <= math.MaxInt32 {
+		return int32(n)
+	}
+	return n
+}
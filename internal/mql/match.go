@@ -0,0 +1,491 @@
+// Package mql evaluates MongoDB query filters against documents in memory.
+//
+// Filters and documents are handled in their normalized form: the values a
+// bson.D holds after a round trip through the BSON encoder, so that Go ints
+// become int32/int64, time.Time becomes primitive.DateTime, structs become
+// bson.D and slices become bson.A.
+package mql
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Normalize converts an arbitrary Go value into its normalized BSON form.
+func Normalize(v any) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	d, err := NormalizeDoc(bson.D{{Key: "v", Value: v}})
+	if err != nil {
+		return nil, err
+	}
+	return d[0].Value, nil
+}
+
+// NormalizeDoc converts a document (struct, map, bson.D or bson.Raw) into a normalized bson.D.
+func NormalizeDoc(doc any) (bson.D, error) {
+	var raw []byte
+	switch x := doc.(type) {
+	case nil:
+		return nil, errors.New("nil document")
+	case bson.Raw:
+		raw = x
+	case []byte:
+		raw = x
+	default:
+		b, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		raw = b
+	}
+
+	var d bson.D
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Match reports whether the normalized document doc satisfies the normalized filter.
+func Match(filter, doc bson.D) (bool, error) {
+	for _, e := range filter {
+		ok, err := matchElement(e, doc)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchElement(e bson.E, doc bson.D) (bool, error) {
+	switch e.Key {
+	case "$and", "$or", "$nor":
+		clauses, err := clausesOf(e)
+		if err != nil {
+			return false, err
+		}
+		for _, clause := range clauses {
+			ok, err := Match(clause, doc)
+			if err != nil {
+				return false, err
+			}
+			switch {
+			case e.Key == "$and" && !ok:
+				return false, nil
+			case e.Key == "$or" && ok:
+				return true, nil
+			case e.Key == "$nor" && ok:
+				return false, nil
+			}
+		}
+		return e.Key != "$or", nil
+	case "$comment":
+		return true, nil
+	case "$expr":
+		v, err := Eval(e.Value, doc)
+		if err != nil {
+			return false, err
+		}
+		return Truthy(nullIfMissing(v)), nil
+	}
+
+	if strings.HasPrefix(e.Key, "$") {
+		return false, fmt.Errorf("unsupported top-level operator %s", e.Key)
+	}
+	return MatchValues(Lookup(doc, e.Key), e.Value)
+}
+
+func clausesOf(e bson.E) ([]bson.D, error) {
+	arr, ok := e.Value.(bson.A)
+	if !ok || len(arr) == 0 {
+		return nil, fmt.Errorf("%s must be a nonempty array", e.Key)
+	}
+	clauses := make([]bson.D, 0, len(arr))
+	for _, c := range arr {
+		d, ok := c.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("%s argument's entries must be objects", e.Key)
+		}
+		clauses = append(clauses, d)
+	}
+	return clauses, nil
+}
+
+// IsOperatorDoc reports whether v is a document of query operators such as {$gt: 1}.
+func IsOperatorDoc(v any) bool {
+	d, ok := v.(bson.D)
+	return ok && len(d) > 0 && strings.HasPrefix(d[0].Key, "$")
+}
+
+// MatchValues applies cond to the values a path resolved to. cond is either
+// an operator document, a regular expression or a value to compare for equality.
+func MatchValues(values []any, cond any) (bool, error) {
+	if IsOperatorDoc(cond) {
+		return matchOperators(values, cond.(bson.D))
+	}
+	if re, ok := cond.(primitive.Regex); ok {
+		return regexMatch(re, values)
+	}
+	return equals(values, cond), nil
+}
+
+func matchOperators(values []any, ops bson.D) (bool, error) {
+	for _, op := range ops {
+		ok, err := matchOperator(values, op, ops)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchOperator(values []any, op bson.E, siblings bson.D) (bool, error) {
+	switch op.Key {
+	case "$eq":
+		return MatchValues(values, op.Value)
+	case "$ne":
+		ok, err := MatchValues(values, op.Value)
+		return !ok, err
+	case "$gt", "$gte", "$lt", "$lte":
+		return compareOp(values, op.Key, op.Value), nil
+	case "$in":
+		return in(values, op)
+	case "$nin":
+		ok, err := in(values, op)
+		return !ok, err
+	case "$exists":
+		return truthy(op.Value) == (len(values) > 0), nil
+	case "$type":
+		return matchType(values, op.Value)
+	case "$regex":
+		re, err := regexOperand(op.Value, siblings)
+		if err != nil {
+			return false, err
+		}
+		return regexMatch(re, values)
+	case "$options":
+		if _, ok := Get(siblings, "$regex"); !ok {
+			return false, errors.New("$options needs a $regex")
+		}
+		return true, nil
+	case "$not":
+		var ok bool
+		var err error
+		switch arg := op.Value.(type) {
+		case primitive.Regex:
+			ok, err = regexMatch(arg, values)
+		case bson.D:
+			if !IsOperatorDoc(arg) {
+				return false, errors.New("$not needs a regex or an operator document")
+			}
+			ok, err = matchOperators(values, arg)
+		default:
+			return false, errors.New("$not needs a regex or an operator document")
+		}
+		return !ok, err
+	case "$size":
+		n, ok := Float(op.Value)
+		if !ok || n < 0 || n != float64(int(n)) {
+			return false, errors.New("$size needs a nonnegative whole number")
+		}
+		for _, v := range values {
+			if a, ok := v.(bson.A); ok && len(a) == int(n) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$all":
+		return all(values, op.Value)
+	case "$elemMatch":
+		return elemMatch(values, op.Value)
+	case "$mod":
+		return mod(values, op.Value)
+	case "$bitsAllSet", "$bitsAnySet", "$bitsAllClear", "$bitsAnyClear":
+		return bits(values, op.Key, op.Value)
+	}
+	return false, fmt.Errorf("unsupported query operator %s", op.Key)
+}
+
+// all implements $all: every listed value, or {$elemMatch: ...} clause,
+// matches the field. An empty list matches nothing.
+func all(values []any, arg any) (bool, error) {
+	list, ok := arg.(bson.A)
+	if !ok {
+		return false, errors.New("$all needs an array")
+	}
+	if len(list) == 0 {
+		return false, nil
+	}
+	for _, want := range list {
+		var ok bool
+		var err error
+		if d, isDoc := want.(bson.D); isDoc && len(d) == 1 && d[0].Key == "$elemMatch" {
+			ok, err = elemMatch(values, d[0].Value)
+		} else {
+			ok, err = MatchValues(values, want)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// elemMatch implements $elemMatch: some element of an array field satisfies
+// arg, either a document of operators applied to the element itself, such as
+// {$gte: 80}, or a filter applied to an embedded document element.
+func elemMatch(values []any, arg any) (bool, error) {
+	cond, ok := arg.(bson.D)
+	if !ok {
+		return false, errors.New("$elemMatch needs an object")
+	}
+	operators := IsOperatorDoc(cond) && !isLogical(cond[0].Key)
+	for _, v := range values {
+		arr, ok := v.(bson.A)
+		if !ok {
+			continue
+		}
+		for _, elem := range arr {
+			var ok bool
+			var err error
+			if operators {
+				ok, err = matchOperators([]any{elem}, cond)
+			} else if d, isDoc := elem.(bson.D); isDoc {
+				ok, err = Match(cond, d)
+			}
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func isLogical(op string) bool {
+	return op == "$and" || op == "$or" || op == "$nor"
+}
+
+func isNull(v any) bool {
+	return typeClass(v) == classNull
+}
+
+// equals implements {field: value}: a missing field equals null, and an
+// array field matches when the array or any of its elements is equal.
+func equals(values []any, want any) bool {
+	if isNull(want) && len(values) == 0 {
+		return true
+	}
+	for _, v := range expand(values) {
+		if Equal(v, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func compareOp(values []any, op string, arg any) bool {
+	if isNull(arg) {
+		return (op == "$gte" || op == "$lte") && equals(values, nil)
+	}
+	for _, v := range expand(values) {
+		if !Comparable(v, arg) {
+			continue
+		}
+		c := Compare(v, arg)
+		switch op {
+		case "$gt":
+			if c > 0 {
+				return true
+			}
+		case "$gte":
+			if c >= 0 {
+				return true
+			}
+		case "$lt":
+			if c < 0 {
+				return true
+			}
+		case "$lte":
+			if c <= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func in(values []any, op bson.E) (bool, error) {
+	arr, ok := op.Value.(bson.A)
+	if !ok {
+		return false, fmt.Errorf("%s needs an array", op.Key)
+	}
+	for _, want := range arr {
+		if re, ok := want.(primitive.Regex); ok {
+			matched, err := regexMatch(re, values)
+			if err != nil || matched {
+				return matched, err
+			}
+			continue
+		}
+		if IsOperatorDoc(want) {
+			return false, fmt.Errorf("cannot nest operators inside %s", op.Key)
+		}
+		if equals(values, want) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func regexOperand(v any, siblings bson.D) (primitive.Regex, error) {
+	var re primitive.Regex
+	switch p := v.(type) {
+	case string:
+		re.Pattern = p
+	case primitive.Regex:
+		re = p
+	default:
+		return re, errors.New("$regex has to be a string or a regex")
+	}
+	if opts, ok := Get(siblings, "$options"); ok {
+		s, ok := opts.(string)
+		if !ok {
+			return re, errors.New("$options has to be a string")
+		}
+		if re.Options != "" && s != "" {
+			return re, errors.New("options set in both $regex and $options")
+		}
+		re.Options += s
+	}
+	return re, nil
+}
+
+func truthy(v any) bool {
+	switch x := v.(type) {
+	case bool:
+		return x
+	case nil, primitive.Null, primitive.Undefined:
+		return false
+	}
+	if f, ok := Float(v); ok {
+		return f != 0
+	}
+	return true
+}
+
+// typeAliases maps the $type aliases to BSON type numbers.
+var typeAliases = map[string]int32{
+	"double":     1,
+	"string":     2,
+	"object":     3,
+	"array":      4,
+	"binData":    5,
+	"undefined":  6,
+	"objectId":   7,
+	"bool":       8,
+	"date":       9,
+	"null":       10,
+	"regex":      11,
+	"dbPointer":  12,
+	"javascript": 13,
+	"symbol":     14,
+	"int":        16,
+	"timestamp":  17,
+	"long":       18,
+	"decimal":    19,
+	"minKey":     -1,
+	"maxKey":     127,
+}
+
+// TypeNumber returns the BSON type number of a normalized value.
+func TypeNumber(v any) int32 {
+	switch v.(type) {
+	case float64:
+		return 1
+	case string:
+		return 2
+	case bson.D:
+		return 3
+	case bson.A:
+		return 4
+	case primitive.Binary:
+		return 5
+	case primitive.Undefined:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime:
+		return 9
+	case nil, primitive.Null:
+		return 10
+	case primitive.Regex:
+		return 11
+	case primitive.DBPointer:
+		return 12
+	case primitive.JavaScript:
+		return 13
+	case primitive.Symbol:
+		return 14
+	case primitive.CodeWithScope:
+		return 15
+	case int32:
+		return 16
+	case primitive.Timestamp:
+		return 17
+	case int64:
+		return 18
+	case primitive.Decimal128:
+		return 19
+	case primitive.MinKey:
+		return -1
+	case primitive.MaxKey:
+		return 127
+	}
+	return 0
+}
+
+func matchType(values []any, arg any) (bool, error) {
+	wanted := bson.A{arg}
+	if arr, ok := arg.(bson.A); ok {
+		wanted = arr
+	}
+
+	for _, w := range wanted {
+		number := w == "number"
+		code, ok := int32(0), true
+		if !number {
+			code, ok = typeCode(w)
+		}
+		if !ok {
+			return false, fmt.Errorf("unknown type name alias: %v", w)
+		}
+		for _, v := range expand(values) {
+			if number && typeClass(v) == classNumber || !number && TypeNumber(v) == code {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func typeCode(v any) (int32, bool) {
+	if s, ok := v.(string); ok {
+		code, ok := typeAliases[s]
+		return code, ok
+	}
+	if f, ok := Float(v); ok {
+		return int32(f), true
+	}
+	return 0, false
+}
@@ -0,0 +1,1094 @@
+package mql
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// switchExpr evaluates {$switch: {branches: [{case, then}], default}}.
+func (e env) switchExpr(arg any) (any, error) {
+	spec, err := e.named("$switch", arg, []string{"branches"}, "default")
+	if err != nil {
+		return nil, err
+	}
+	branches, ok := spec["branches"].(bson.A)
+	if !ok {
+		return nil, errors.New("$switch expected an array for 'branches'")
+	}
+	for _, b := range branches {
+		branch, err := e.named("$switch branch", b, []string{"case", "then"})
+		if err != nil {
+			return nil, err
+		}
+		c, err := e.eval(branch["case"])
+		if err != nil {
+			return nil, err
+		}
+		if Truthy(nullIfMissing(c)) {
+			return e.eval(branch["then"])
+		}
+	}
+	if def, ok := spec["default"]; ok {
+		return e.eval(def)
+	}
+	return nil, errors.New("$switch could not find a matching branch for an input, and no default was specified")
+}
+
+// let evaluates {$let: {vars: {...}, in: <expression>}}.
+func (e env) let(arg any) (any, error) {
+	spec, err := e.named("$let", arg, []string{"vars", "in"})
+	if err != nil {
+		return nil, err
+	}
+	vars, ok := spec["vars"].(bson.D)
+	if !ok {
+		return nil, errors.New("invalid parameter: expected an object (vars)")
+	}
+	inner := e
+	for _, v := range vars {
+		val, err := e.eval(v.Value)
+		if err != nil {
+			return nil, err
+		}
+		inner = inner.with(v.Key, nullIfMissing(val))
+	}
+	return inner.eval(spec["in"])
+}
+
+// iterate evaluates $filter, $map and $reduce, which bind a variable to each
+// element of their input array in turn.
+func (e env) iterate(op string, arg any) (any, error) {
+	var spec map[string]any
+	var err error
+	switch op {
+	case "$filter":
+		spec, err = e.named(op, arg, []string{"input", "cond"}, "as", "limit")
+	case "$map":
+		spec, err = e.named(op, arg, []string{"input", "in"}, "as")
+	default:
+		spec, err = e.named(op, arg, []string{"input", "initialValue", "in"})
+	}
+	if err != nil {
+		return nil, err
+	}
+	input, err := e.eval(spec["input"])
+	if err != nil {
+		return nil, err
+	}
+	if isNull(nullIfMissing(input)) {
+		return nil, nil
+	}
+	arr, ok := input.(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("input to %s must be an array not %T", op, input)
+	}
+	as := "this"
+	if v, ok := spec["as"]; ok {
+		if as, ok = v.(string); !ok || as == "" {
+			return nil, fmt.Errorf("%s 'as' must be a variable name", op)
+		}
+	}
+
+	switch op {
+	case "$filter":
+		limit := -1
+		if l, ok := spec["limit"]; ok {
+			v, err := e.eval(l)
+			if err != nil {
+				return nil, err
+			}
+			n, ok := Float(v)
+			if !ok || n < 1 || n != math.Trunc(n) {
+				return nil, errors.New("$filter: limit must be a positive integer")
+			}
+			limit = int(n)
+		}
+		out := bson.A{}
+		for _, el := range arr {
+			if len(out) == limit {
+				break
+			}
+			c, err := e.with(as, el).eval(spec["cond"])
+			if err != nil {
+				return nil, err
+			}
+			if Truthy(nullIfMissing(c)) {
+				out = append(out, el)
+			}
+		}
+		return out, nil
+	case "$map":
+		out := make(bson.A, len(arr))
+		for i, el := range arr {
+			v, err := e.with(as, el).eval(spec["in"])
+			if err != nil {
+				return nil, err
+			}
+			out[i] = nullIfMissing(v)
+		}
+		return out, nil
+	}
+
+	acc, err := e.eval(spec["initialValue"])
+	if err != nil {
+		return nil, err
+	}
+	acc = nullIfMissing(acc)
+	for _, el := range arr {
+		if acc, err = e.with("value", acc).with("this", el).eval(spec["in"]); err != nil {
+			return nil, err
+		}
+		acc = nullIfMissing(acc)
+	}
+	return acc, nil
+}
+
+// namedOperator evaluates the string and date operators whose arguments are
+// given as a document of named fields.
+func (e env) namedOperator(op string, arg any) (any, error) {
+	var required, optional []string
+	switch op {
+	case "$trim", "$ltrim", "$rtrim":
+		required, optional = []string{"input"}, []string{"chars"}
+	case "$regexMatch":
+		required, optional = []string{"input", "regex"}, []string{"options"}
+	case "$replaceOne", "$replaceAll":
+		required = []string{"input", "find", "replacement"}
+	case "$dateToString":
+		required, optional = []string{"date"}, []string{"format", "timezone", "onNull"}
+	case "$dateFromString":
+		required, optional = []string{"dateString"}, []string{"format", "timezone", "onError", "onNull"}
+	case "$dateAdd", "$dateSubtract":
+		required, optional = []string{"startDate", "unit", "amount"}, []string{"timezone"}
+	case "$dateDiff":
+		required, optional = []string{"startDate", "endDate", "unit"}, []string{"timezone", "startOfWeek"}
+	}
+	spec, err := e.named(op, arg, required, optional...)
+	if err != nil {
+		return nil, err
+	}
+	vals := map[string]any{}
+	for k, v := range spec {
+		x, err := e.eval(v)
+		if err != nil {
+			return nil, err
+		}
+		vals[k] = nullIfMissing(x)
+	}
+
+	switch op {
+	case "$trim", "$ltrim", "$rtrim":
+		return trim(op, vals)
+	case "$regexMatch":
+		return regexMatchExpr(vals)
+	case "$replaceOne", "$replaceAll":
+		var s [3]string
+		for i, name := range []string{"input", "find", "replacement"} {
+			if isNull(vals[name]) {
+				return nil, nil
+			}
+			str, ok := vals[name].(string)
+			if !ok {
+				return nil, fmt.Errorf("%s requires that '%s' be a string", op, name)
+			}
+			s[i] = str
+		}
+		if op == "$replaceOne" {
+			return strings.Replace(s[0], s[1], s[2], 1), nil
+		}
+		return strings.ReplaceAll(s[0], s[1], s[2]), nil
+	case "$dateToString":
+		return dateToString(vals)
+	case "$dateFromString":
+		return dateFromString(vals)
+	case "$dateAdd", "$dateSubtract":
+		return dateAdd(op, vals)
+	}
+	return dateDiff(vals)
+}
+
+// datePart evaluates $year, $month and the other date part operators, which
+// take a date or {date, timezone}.
+func (e env) datePart(op string, arg any) (any, error) {
+	dateExpr, tz := arg, any(nil)
+	switch x := arg.(type) {
+	case bson.D:
+		if len(x) > 0 && !strings.HasPrefix(x[0].Key, "$") {
+			spec, err := e.named(op, x, []string{"date"}, "timezone")
+			if err != nil {
+				return nil, err
+			}
+			dateExpr = spec["date"]
+			if t, ok := spec["timezone"]; ok {
+				if tz, err = e.eval(t); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case bson.A:
+		if len(x) != 1 {
+			return nil, fmt.Errorf("expression %s takes exactly 1 arguments, %d were passed in", op, len(x))
+		}
+		dateExpr = x[0]
+	}
+	v, err := e.eval(dateExpr)
+	if err != nil {
+		return nil, err
+	}
+	if isNull(nullIfMissing(v)) {
+		return nil, nil
+	}
+	t, err := dateIn(v, tz)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "$year":
+		return int32(t.Year()), nil
+	case "$month":
+		return int32(t.Month()), nil
+	case "$dayOfMonth":
+		return int32(t.Day()), nil
+	case "$dayOfWeek":
+		return int32(t.Weekday()) + 1, nil
+	case "$dayOfYear":
+		return int32(t.YearDay()), nil
+	case "$hour":
+		return int32(t.Hour()), nil
+	case "$minute":
+		return int32(t.Minute()), nil
+	case "$second":
+		return int32(t.Second()), nil
+	}
+	return int32(t.Nanosecond() / int(time.Millisecond)), nil
+}
+
+// valueOperator evaluates the operators that take evaluated arguments and are
+// not handled by operator itself.
+func valueOperator(op string, vals []any) (any, error) {
+	want := func(min, max int) error {
+		if len(vals) < min || len(vals) > max {
+			if min == max {
+				return fmt.Errorf("expression %s takes exactly %d arguments, %d were passed in", op, min, len(vals))
+			}
+			return fmt.Errorf("expression %s takes at least %d arguments, and at most %d, but %d were passed in", op, min, max, len(vals))
+		}
+		return nil
+	}
+	var err error
+	switch op {
+	case "$abs", "$ceil", "$floor", "$sqrt", "$exp", "$ln", "$log10",
+		"$first", "$last", "$isArray", "$strLenCP",
+		"$toString", "$toInt", "$toLong", "$toDouble", "$toDate", "$toBool":
+		err = want(1, 1)
+	case "$pow", "$arrayElemAt", "$split":
+		err = want(2, 2)
+	case "$round", "$trunc":
+		err = want(1, 2)
+	case "$slice":
+		err = want(2, 3)
+	case "$substrCP":
+		err = want(3, 3)
+	case "$indexOfCP":
+		err = want(2, 4)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case "$abs", "$ceil", "$floor", "$sqrt", "$exp", "$ln", "$log10", "$pow", "$round", "$trunc":
+		return mathOperator(op, vals)
+	case "$sum", "$avg", "$min", "$max":
+		list := vals
+		if len(vals) == 1 {
+			if arr, ok := vals[0].(bson.A); ok {
+				list = arr
+			}
+		}
+		return summarize(op, list)
+	case "$isArray":
+		_, ok := vals[0].(bson.A)
+		return ok, nil
+	case "$arrayElemAt", "$first", "$last", "$slice", "$concatArrays":
+		return arrayOperator(op, vals)
+	case "$substrCP", "$strLenCP", "$indexOfCP", "$split":
+		return stringOperator(op, vals)
+	case "$toString", "$toInt", "$toLong", "$toDouble", "$toDate", "$toBool":
+		if isNull(vals[0]) {
+			return nil, nil
+		}
+		return convert(op, vals[0])
+	}
+	return nil, fmt.Errorf("unsupported expression operator %s", op)
+}
+
+func mathOperator(op string, vals []any) (any, error) {
+	for _, v := range vals {
+		if isNull(v) {
+			return nil, nil
+		}
+		if _, ok := Float(v); !ok {
+			return nil, fmt.Errorf("%s only supports numeric types, not %T", op, v)
+		}
+	}
+	x, _ := Float(vals[0])
+	_, isInt := intValue(vals[0])
+	switch op {
+	case "$abs":
+		switch n := vals[0].(type) {
+		case int32:
+			if n < 0 {
+				return narrow(-int64(n), vals), nil
+			}
+			return n, nil
+		case int64:
+			if n < 0 {
+				return -n, nil
+			}
+			return n, nil
+		}
+		return math.Abs(x), nil
+	case "$ceil", "$floor":
+		if isInt {
+			return vals[0], nil
+		}
+		if op == "$ceil" {
+			return math.Ceil(x), nil
+		}
+		return math.Floor(x), nil
+	case "$sqrt":
+		if x < 0 {
+			return nil, errors.New("$sqrt's argument must be greater than or equal to 0")
+		}
+		return math.Sqrt(x), nil
+	case "$exp":
+		return math.Exp(x), nil
+	case "$ln", "$log10":
+		if x <= 0 {
+			return nil, fmt.Errorf("%s's argument must be a positive number, but is %v", op, x)
+		}
+		if op == "$ln" {
+			return math.Log(x), nil
+		}
+		return math.Log10(x), nil
+	case "$pow":
+		y, _ := Float(vals[1])
+		r := math.Pow(x, y)
+		if _, yInt := intValue(vals[1]); isInt && yInt && y >= 0 && math.Abs(r) < 1<<53 {
+			return narrow(int64(r), vals), nil
+		}
+		return r, nil
+	}
+
+	place := 0.0
+	if len(vals) == 2 {
+		p, ok := intValue(vals[1])
+		if !ok || p < -20 || p > 100 {
+			return nil, fmt.Errorf("invalid %s place argument: %v", op, vals[1])
+		}
+		place = float64(p)
+	}
+	if isInt && place >= 0 {
+		return vals[0], nil
+	}
+	scale := math.Pow(10, place)
+	var r float64
+	if op == "$round" {
+		r = math.RoundToEven(x*scale) / scale
+	} else {
+		r = math.Trunc(x*scale) / scale
+	}
+	switch vals[0].(type) {
+	case int32:
+		return int32(r), nil
+	case int64:
+		return int64(r), nil
+	}
+	return r, nil
+}
+
+// intValue returns v as an integer when it is an integral number.
+func intValue(v any) (int64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case float64:
+		if n == math.Trunc(n) && math.Abs(n) < 1<<63 {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+// summarize evaluates $sum, $avg, $min and $max over list, skipping values
+// they ignore.
+func summarize(op string, list []any) (any, error) {
+	switch op {
+	case "$sum", "$avg":
+		var numbers []any
+		total := 0.0
+		for _, v := range list {
+			if f, ok := Float(v); ok {
+				numbers = append(numbers, v)
+				total += f
+			}
+		}
+		if op == "$sum" {
+			if len(numbers) == 0 {
+				return int32(0), nil
+			}
+			return arithmetic("$add", numbers)
+		}
+		if len(numbers) == 0 {
+			return nil, nil
+		}
+		return total / float64(len(numbers)), nil
+	}
+	var best any
+	for _, v := range list {
+		if isNull(v) {
+			continue
+		}
+		if best == nil || op == "$min" && Compare(v, best) < 0 || op == "$max" && Compare(v, best) > 0 {
+			best = v
+		}
+	}
+	return best, nil
+}
+
+func arrayOperator(op string, vals []any) (any, error) {
+	if op == "$concatArrays" {
+		out := bson.A{}
+		for _, v := range vals {
+			if isNull(v) {
+				return nil, nil
+			}
+			arr, ok := v.(bson.A)
+			if !ok {
+				return nil, fmt.Errorf("$concatArrays only supports arrays, not %T", v)
+			}
+			out = append(out, arr...)
+		}
+		return out, nil
+	}
+	if isNull(vals[0]) {
+		return nil, nil
+	}
+	arr, ok := vals[0].(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("%s's argument must be an array, but is %T", op, vals[0])
+	}
+	switch op {
+	case "$first", "$last":
+		if len(arr) == 0 {
+			return Missing, nil
+		}
+		if op == "$first" {
+			return arr[0], nil
+		}
+		return arr[len(arr)-1], nil
+	case "$arrayElemAt":
+		if isNull(vals[1]) {
+			return nil, nil
+		}
+		i, ok := intValue(vals[1])
+		if !ok {
+			return nil, fmt.Errorf("$arrayElemAt's second argument must be a numeric value, but is %T", vals[1])
+		}
+		if i < 0 {
+			i += int64(len(arr))
+		}
+		if i < 0 || i >= int64(len(arr)) {
+			return Missing, nil
+		}
+		return arr[i], nil
+	}
+
+	ints := make([]int64, len(vals)-1)
+	for i, v := range vals[1:] {
+		n, ok := intValue(v)
+		if !ok {
+			return nil, fmt.Errorf("$slice arguments must be integral numbers, not %v", v)
+		}
+		ints[i] = n
+	}
+	size := int64(len(arr))
+	var from, to int64
+	if len(ints) == 1 {
+		if n := ints[0]; n >= 0 {
+			from, to = 0, min(n, size)
+		} else {
+			from, to = max(size+n, 0), size
+		}
+	} else {
+		pos, n := ints[0], ints[1]
+		if n <= 0 {
+			return nil, errors.New("$slice: the third argument must be positive")
+		}
+		if pos < 0 {
+			pos = max(size+pos, 0)
+		}
+		from = min(pos, size)
+		to = min(from+n, size)
+	}
+	return append(bson.A{}, arr[from:to]...), nil
+}
+
+func stringOperator(op string, vals []any) (any, error) {
+	if op == "$substrCP" && isNull(vals[0]) {
+		return "", nil
+	}
+	if isNull(vals[0]) && op != "$strLenCP" {
+		return nil, nil
+	}
+	s, ok := vals[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s requires a string argument, found: %T", op, vals[0])
+	}
+	switch op {
+	case "$strLenCP":
+		return int32(utf8.RuneCountInString(s)), nil
+	case "$split":
+		if isNull(vals[1]) {
+			return nil, nil
+		}
+		delim, ok := vals[1].(string)
+		if !ok || delim == "" {
+			return nil, errors.New("$split requires a non-empty string delimiter")
+		}
+		out := bson.A{}
+		for _, part := range strings.Split(s, delim) {
+			out = append(out, part)
+		}
+		return out, nil
+	}
+
+	runes := []rune(s)
+	ints := make([]int64, len(vals)-1)
+	for i, v := range vals[1:] {
+		if op == "$indexOfCP" && i == 0 {
+			continue
+		}
+		n, ok := intValue(v)
+		if !ok || n < 0 {
+			return nil, fmt.Errorf("%s requires non-negative integral arguments, found: %v", op, v)
+		}
+		ints[i] = n
+	}
+	if op == "$substrCP" {
+		start := min(ints[0], int64(len(runes)))
+		end := min(start+ints[1], int64(len(runes)))
+		return string(runes[start:end]), nil
+	}
+
+	sub, ok := vals[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("$indexOfCP requires a string as the second argument, found: %T", vals[1])
+	}
+	start, end := int64(0), int64(len(runes))
+	if len(ints) > 1 {
+		start = ints[1]
+	}
+	if len(ints) > 2 {
+		end = min(ints[2], end)
+	}
+	subRunes := []rune(sub)
+	for i := start; i+int64(len(subRunes)) <= end; i++ {
+		if string(runes[i:i+int64(len(subRunes))]) == sub {
+			return int32(i), nil
+		}
+	}
+	return int32(-1), nil
+}
+
+func trim(op string, vals map[string]any) (any, error) {
+	if isNull(vals["input"]) {
+		return nil, nil
+	}
+	s, ok := vals["input"].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s requires its input to be a string, got %T", op, vals["input"])
+	}
+	cut := func(r rune) bool { return r == 0 || unicode.IsSpace(r) }
+	if c, ok := vals["chars"]; ok && !isNull(c) {
+		chars, ok := c.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s requires 'chars' to be a string, got %T", op, c)
+		}
+		cut = func(r rune) bool { return strings.ContainsRune(chars, r) }
+	}
+	switch op {
+	case "$ltrim":
+		return strings.TrimLeftFunc(s, cut), nil
+	case "$rtrim":
+		return strings.TrimRightFunc(s, cut), nil
+	}
+	return strings.TrimFunc(s, cut), nil
+}
+
+func regexMatchExpr(vals map[string]any) (any, error) {
+	if isNull(vals["input"]) {
+		return false, nil
+	}
+	s, ok := vals["input"].(string)
+	if !ok {
+		return nil, errors.New("$regexMatch needs 'input' to be of type string")
+	}
+	var re primitive.Regex
+	switch x := vals["regex"].(type) {
+	case string:
+		re.Pattern = x
+	case primitive.Regex:
+		re = x
+	default:
+		return nil, errors.New("$regexMatch needs 'regex' to be of type string or regex")
+	}
+	if o, ok := vals["options"]; ok && !isNull(o) {
+		opts, ok := o.(string)
+		if !ok {
+			return nil, errors.New("$regexMatch needs 'options' to be of type string")
+		}
+		re.Options += opts
+	}
+	compiled, err := Regexp(re)
+	if err != nil {
+		return nil, err
+	}
+	return compiled.MatchString(s), nil
+}
+
+// toTime converts the BSON values $toDate accepts without parsing to a time.
+func toTime(v any) (time.Time, bool) {
+	switch x := v.(type) {
+	case primitive.DateTime:
+		return x.Time().UTC(), true
+	case primitive.Timestamp:
+		return time.Unix(int64(x.T), 0).UTC(), true
+	case primitive.ObjectID:
+		return x.Timestamp().UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// dateIn returns the date v in the timezone tz.
+func dateIn(v any, tz any) (time.Time, error) {
+	t, ok := toTime(v)
+	if !ok {
+		return time.Time{}, fmt.Errorf("can't convert from BSON type %T to Date", v)
+	}
+	loc, err := location(tz)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.In(loc), nil
+}
+
+// location resolves a timezone argument: an Olson name such as
+// "Europe/Berlin" or a UTC offset such as "+02:00".
+func location(tz any) (*time.Location, error) {
+	if isNull(nullIfMissing(tz)) {
+		return time.UTC, nil
+	}
+	name, ok := tz.(string)
+	if !ok {
+		return nil, fmt.Errorf("timezone must be a string, not %T", tz)
+	}
+	if strings.HasPrefix(name, "+") || strings.HasPrefix(name, "-") {
+		digits := strings.ReplaceAll(name[1:], ":", "")
+		if len(digits) == 2 {
+			digits += "00"
+		}
+		h, err1 := strconv.Atoi(digits[:min(2, len(digits))])
+		m, err2 := strconv.Atoi(digits[min(2, len(digits)):])
+		if len(digits) != 4 || err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("unrecognized time zone identifier: %q", name)
+		}
+		offset := (h*60 + m) * 60
+		if name[0] == '-' {
+			offset = -offset
+		}
+		return time.FixedZone(name, offset), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unrecognized time zone identifier: %q", name)
+	}
+	return loc, nil
+}
+
+const defaultDateFormat = "%Y-%m-%dT%H:%M:%S.%LZ"
+
+func dateToString(vals map[string]any) (any, error) {
+	if isNull(vals["date"]) {
+		if v, ok := vals["onNull"]; ok {
+			return v, nil
+		}
+		return nil, nil
+	}
+	t, err := dateIn(vals["date"], vals["timezone"])
+	if err != nil {
+		return nil, err
+	}
+	format := defaultDateFormat
+	if f, ok := vals["format"]; ok && !isNull(f) {
+		if format, ok = f.(string); !ok {
+			return nil, errors.New("$dateToString requires that 'format' be a string")
+		}
+	}
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		if i == len(format) {
+			return nil, errors.New("unmatched '%' at end of format string")
+		}
+		year, week := t.ISOWeek()
+		switch format[i] {
+		case 'Y':
+			fmt.Fprintf(&b, "%04d", t.Year())
+		case 'm':
+			fmt.Fprintf(&b, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 'L':
+			fmt.Fprintf(&b, "%03d", t.Nanosecond()/int(time.Millisecond))
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 'w':
+			fmt.Fprintf(&b, "%d", int(t.Weekday())+1)
+		case 'u':
+			fmt.Fprintf(&b, "%d", (int(t.Weekday())+6)%7+1)
+		case 'V':
+			fmt.Fprintf(&b, "%02d", week)
+		case 'G':
+			fmt.Fprintf(&b, "%04d", year)
+		case 'z':
+			b.WriteString(t.Format("-0700"))
+		case 'Z':
+			_, offset := t.Zone()
+			fmt.Fprintf(&b, "%d", offset/60)
+		case '%':
+			b.WriteByte('%')
+		default:
+			return nil, fmt.Errorf("invalid format character '%%%c' in format string", format[i])
+		}
+	}
+	return b.String(), nil
+}
+
+var dateLayouts = []string{
+	"2006-01-02T15:04:05.999Z07:00",
+	"2006-01-02T15:04:05.999",
+	"2006-01-02 15:04:05.999",
+	"2006-01-02",
+}
+
+func dateFromString(vals map[string]any) (any, error) {
+	if isNull(vals["dateString"]) {
+		if v, ok := vals["onNull"]; ok {
+			return v, nil
+		}
+		return nil, nil
+	}
+	fail := func(err error) (any, error) {
+		if v, ok := vals["onError"]; ok {
+			return v, nil
+		}
+		return nil, err
+	}
+	s, ok := vals["dateString"].(string)
+	if !ok {
+		return fail(fmt.Errorf("$dateFromString requires that 'dateString' be a string, found: %T", vals["dateString"]))
+	}
+	loc, err := location(vals["timezone"])
+	if err != nil {
+		return nil, err
+	}
+	layouts := dateLayouts
+	if f, ok := vals["format"]; ok && !isNull(f) {
+		format, ok := f.(string)
+		if !ok {
+			return nil, errors.New("$dateFromString requires that 'format' be a string")
+		}
+		layout, err := goLayout(format)
+		if err != nil {
+			return nil, err
+		}
+		layouts = []string{layout}
+	}
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return primitive.NewDateTimeFromTime(t), nil
+		}
+	}
+	return fail(fmt.Errorf("error parsing date string '%s'", s))
+}
+
+// goLayout translates a $dateFromString format into a time layout.
+func goLayout(format string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		if i == len(format) {
+			return "", errors.New("unmatched '%' at end of format string")
+		}
+		switch format[i] {
+		case 'Y':
+			b.WriteString("2006")
+		case 'm':
+			b.WriteString("01")
+		case 'd':
+			b.WriteString("02")
+		case 'H':
+			b.WriteString("15")
+		case 'M':
+			b.WriteString("04")
+		case 'S':
+			b.WriteString("05")
+		case 'L':
+			b.WriteString("000")
+		case 'z':
+			b.WriteString("-0700")
+		case '%':
+			b.WriteByte('%')
+		default:
+			return "", fmt.Errorf("invalid format character '%%%c' in format string", format[i])
+		}
+	}
+	return b.String(), nil
+}
+
+var unitMillis = map[string]int64{
+	"day":         24 * 60 * 60 * 1000,
+	"hour":        60 * 60 * 1000,
+	"minute":      60 * 1000,
+	"second":      1000,
+	"millisecond": 1,
+}
+
+func dateAdd(op string, vals map[string]any) (any, error) {
+	if isNull(vals["startDate"]) || isNull(vals["unit"]) || isNull(vals["amount"]) {
+		return nil, nil
+	}
+	t, err := dateIn(vals["startDate"], vals["timezone"])
+	if err != nil {
+		return nil, err
+	}
+	unit, _ := vals["unit"].(string)
+	n, ok := intValue(vals["amount"])
+	if !ok {
+		return nil, fmt.Errorf("%s requires 'amount' to be an integer, found: %v", op, vals["amount"])
+	}
+	if op == "$dateSubtract" {
+		n = -n
+	}
+	months := int64(0)
+	switch unit {
+	case "year":
+		months = 12 * n
+	case "quarter":
+		months = 3 * n
+	case "month":
+		months = n
+	case "week":
+		t = t.AddDate(0, 0, int(7*n))
+	case "day":
+		t = t.AddDate(0, 0, int(n))
+	case "hour", "minute", "second", "millisecond":
+		t = t.Add(time.Duration(n*unitMillis[unit]) * time.Millisecond)
+	default:
+		return nil, fmt.Errorf("%s: unknown time unit value: %v", op, vals["unit"])
+	}
+	if months != 0 {
+		// Like the server, clamp to the last day of a shorter month.
+		total := int64(t.Year())*12 + int64(t.Month()) - 1 + months
+		y, m := int(floorDiv(total, 12)), time.Month(total-floorDiv(total, 12)*12+1)
+		day := min(t.Day(), time.Date(y, m+1, 0, 0, 0, 0, 0, time.UTC).Day())
+		t = time.Date(y, m, day, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	}
+	return primitive.NewDateTimeFromTime(t), nil
+}
+
+var weekdays = map[string]int64{
+	"sunday": 0, "monday": 1, "tuesday": 2, "wednesday": 3, "thursday": 4, "friday": 5, "saturday": 6,
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// dateDiff counts the unit boundaries crossed between startDate and endDate.
+func dateDiff(vals map[string]any) (any, error) {
+	if isNull(vals["startDate"]) || isNull(vals["endDate"]) || isNull(vals["unit"]) {
+		return nil, nil
+	}
+	start, err := dateIn(vals["startDate"], vals["timezone"])
+	if err != nil {
+		return nil, err
+	}
+	end, err := dateIn(vals["endDate"], vals["timezone"])
+	if err != nil {
+		return nil, err
+	}
+	unit, _ := vals["unit"].(string)
+	switch unit {
+	case "year":
+		return int64(end.Year() - start.Year()), nil
+	case "quarter":
+		q := func(t time.Time) int64 { return int64(t.Year())*4 + int64(t.Month()-1)/3 }
+		return q(end) - q(start), nil
+	case "month":
+		m := func(t time.Time) int64 { return int64(t.Year())*12 + int64(t.Month()) }
+		return m(end) - m(start), nil
+	case "week":
+		sow := int64(0)
+		if s, ok := vals["startOfWeek"]; ok && !isNull(s) {
+			name, _ := s.(string)
+			if sow, ok = weekdays[strings.ToLower(name)]; !ok {
+				return nil, fmt.Errorf("$dateDiff: unknown startOfWeek value: %v", s)
+			}
+		}
+		// Day 0 of the Unix epoch is a Thursday.
+		w := func(t time.Time) int64 { return floorDiv(floorDiv(wallMillis(t), unitMillis["day"])+4-sow, 7) }
+		return w(end) - w(start), nil
+	}
+	ms, ok := unitMillis[unit]
+	if !ok {
+		return nil, fmt.Errorf("$dateDiff: unknown time unit value: %v", vals["unit"])
+	}
+	return floorDiv(wallMillis(end), ms) - floorDiv(wallMillis(start), ms), nil
+}
+
+// wallMillis returns the milliseconds since the epoch of t's wall clock reading.
+func wallMillis(t time.Time) int64 {
+	_, offset := t.Zone()
+	return t.UnixMilli() + int64(offset)*1000
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+func convert(op string, v any) (any, error) {
+	switch op {
+	case "$toBool":
+		return Truthy(v), nil
+	case "$toString":
+		switch x := v.(type) {
+		case string:
+			return x, nil
+		case bool:
+			return strconv.FormatBool(x), nil
+		case int32:
+			return strconv.FormatInt(int64(x), 10), nil
+		case int64:
+			return strconv.FormatInt(x, 10), nil
+		case float64:
+			if math.Abs(x) < 1e21 {
+				return strconv.FormatFloat(x, 'f', -1, 64), nil
+			}
+			return strconv.FormatFloat(x, 'g', -1, 64), nil
+		case primitive.Decimal128:
+			return x.String(), nil
+		case primitive.ObjectID:
+			return x.Hex(), nil
+		case primitive.DateTime:
+			return x.Time().UTC().Format("2006-01-02T15:04:05.000Z"), nil
+		}
+	case "$toInt", "$toLong":
+		var n int64
+		switch x := v.(type) {
+		case bool:
+			if x {
+				n = 1
+			}
+		case int32:
+			n = int64(x)
+		case int64:
+			n = x
+		case float64:
+			if math.IsNaN(x) || math.Abs(x) >= 1<<63 {
+				return nil, fmt.Errorf("conversion would overflow target type in %s", op)
+			}
+			n = int64(x)
+		case string:
+			parsed, err := strconv.ParseInt(x, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse number '%s' in %s", x, op)
+			}
+			n = parsed
+		case primitive.DateTime:
+			if op == "$toLong" {
+				return int64(x), nil
+			}
+			return nil, fmt.Errorf("unsupported conversion from date to int in %s", op)
+		default:
+			return nil, fmt.Errorf("unsupported conversion from %T in %s", v, op)
+		}
+		if op == "$toLong" {
+			return n, nil
+		}
+		if n < math.MinInt32 || n > math.MaxInt32 {
+			return nil, fmt.Errorf("conversion would overflow target type in %s", op)
+		}
+		return int32(n), nil
+	case "$toDouble":
+		switch x := v.(type) {
+		case bool:
+			if x {
+				return 1.0, nil
+			}
+			return 0.0, nil
+		case string:
+			f, err := strconv.ParseFloat(x, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse number '%s' in $toDouble", x)
+			}
+			return f, nil
+		case primitive.DateTime:
+			return float64(x), nil
+		}
+		if f, ok := Float(v); ok {
+			return f, nil
+		}
+	case "$toDate":
+		if t, ok := toTime(v); ok {
+			return primitive.NewDateTimeFromTime(t), nil
+		}
+		switch x := v.(type) {
+		case int64:
+			return primitive.DateTime(x), nil
+		case float64:
+			return primitive.DateTime(int64(x)), nil
+		case string:
+			return dateFromString(map[string]any{"dateString": x})
+		}
+	}
+	return nil, fmt.Errorf("unsupported conversion from %T in %s", v, op)
+}
@@ -0,0 +1,67 @@
+package mql
+
+import (
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Get returns the value stored under key in doc.
+func Get(doc bson.D, key string) (any, bool) {
+	for _, e := range doc {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Lookup resolves a dotted path against doc and returns every value it reaches.
+// Arrays met along the way fan out: "items.sku" yields the sku of each
+// embedded document in items, and a numeric component such as "items.0.sku"
+// indexes into the array. A nil result means the path does not exist.
+func Lookup(doc bson.D, path string) []any {
+	return lookup(doc, strings.Split(path, "."))
+}
+
+func lookup(v any, parts []string) []any {
+	if len(parts) == 0 {
+		return []any{v}
+	}
+
+	switch x := v.(type) {
+	case bson.D:
+		next, ok := Get(x, parts[0])
+		if !ok {
+			return nil
+		}
+		return lookup(next, parts[1:])
+	case bson.A:
+		var out []any
+		if i, err := strconv.Atoi(parts[0]); err == nil && i >= 0 && i < len(x) {
+			out = append(out, lookup(x[i], parts[1:])...)
+		}
+		for _, elem := range x {
+			if d, ok := elem.(bson.D); ok {
+				out = append(out, lookup(d, parts)...)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// expand returns values followed by the elements of every array among them.
+// Query operators match a field if either the field itself or one of its
+// elements satisfies the condition.
+func expand(values []any) []any {
+	out := make([]any, 0, len(values))
+	for _, v := range values {
+		out = append(out, v)
+		if a, ok := v.(bson.A); ok {
+			out = append(out, a...)
+		}
+	}
+	return out
+}
@@ -0,0 +1,103 @@
+package mql
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var regexCache sync.Map // map[primitive.Regex]*regexp.Regexp
+
+// Regexp compiles a BSON regular expression into its Go equivalent.
+// The i, m and s options map onto RE2 flags; x strips unescaped
+// whitespace and comments from the pattern, as PCRE does.
+func Regexp(re primitive.Regex) (*regexp.Regexp, error) {
+	if cached, ok := regexCache.Load(re); ok {
+		return cached.(*regexp.Regexp), nil
+	}
+
+	pattern := re.Pattern
+	flags := ""
+	for _, o := range re.Options {
+		switch o {
+		case 'i', 'm', 's':
+			if !strings.ContainsRune(flags, o) {
+				flags += string(o)
+			}
+		case 'x':
+			pattern = stripExtended(pattern)
+		case 'u', 'l':
+			// unicode and locale flags have no RE2 counterpart and do not change matching here
+		default:
+			return nil, fmt.Errorf("invalid regex option %q", o)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexCache.Store(re, compiled)
+	return compiled, nil
+}
+
+func stripExtended(pattern string) string {
+	var b strings.Builder
+	inClass, escaped, comment := false, false, false
+	for _, r := range pattern {
+		switch {
+		case comment:
+			if r == '\n' {
+				comment = false
+			}
+			continue
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case inClass:
+			if r == ']' {
+				inClass = false
+			}
+		case r == '[':
+			inClass = true
+		case r == '#':
+			comment = true
+			continue
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func regexMatch(re primitive.Regex, values []any) (bool, error) {
+	compiled, err := Regexp(re)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range expand(values) {
+		switch x := v.(type) {
+		case string:
+			if compiled.MatchString(x) {
+				return true, nil
+			}
+		case primitive.Symbol:
+			if compiled.MatchString(string(x)) {
+				return true, nil
+			}
+		case primitive.Regex:
+			if x == re {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,349 @@
+// Package populate loads the models referenced by the `pie:"ref:..."` fields
+// of query results, one $in query per relation.
+//
+// A relation field names the field holding the reference, and optionally the
+// bson field of the referenced model it matches, _id by default:
+//
+//	type Post struct {
+//		AuthorID primitive.ObjectID   `bson:"author_id"`
+//		Author   *User                `bson:"-" pie:"ref:AuthorID"`
+//		TagIDs   []primitive.ObjectID `bson:"tag_ids"`
+//		Tags     []Tag                `bson:"-" pie:"ref:TagIDs"`
+//	}
+//
+//	type User struct {
+//		ID    primitive.ObjectID `bson:"_id"`
+//		Posts []Post             `bson:"-" pie:"ref:ID,foreign:author_id"`
+//	}
+package populate
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/5xxxx/pie/internal/bsonstruct"
+	"github.com/5xxxx/pie/internal/mql"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+)
+
+// Loader finds the documents of the collection of model type t that match
+// filter and decodes them into results, a pointer to a slice of t.
+type Loader func(ctx context.Context, t reflect.Type, filter bson.D, results any) error
+
+// Run populates the relations named by paths in result, a pointer to a
+// struct or to a slice of structs or struct pointers. A path is a relation
+// field name, or names joined by dots to populate the loaded models in turn.
+// References are encoded with reg, so that they are queried and matched the
+// way their fields are stored.
+func Run(ctx context.Context, result any, paths []string, reg *bsoncodec.Registry, load Loader) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	return populate(ctx, structs(reflect.ValueOf(result)), tree(paths), reg, load)
+}
+
+type node struct {
+	name     string
+	children []*node
+}
+
+// tree merges paths into a tree of relation names, so that shared prefixes
+// are loaded once.
+func tree(paths []string) []*node {
+	var roots []*node
+	for _, path := range paths {
+		level := &roots
+		for _, name := range strings.Split(path, ".") {
+			var n *node
+			for _, existing := range *level {
+				if existing.name == name {
+					n = existing
+					break
+				}
+			}
+			if n == nil {
+				n = &node{name: name}
+				*level = append(*level, n)
+			}
+			level = &n.children
+		}
+	}
+	return roots
+}
+
+// structs returns the structs held by v, following pointers, interfaces,
+// slices and arrays.
+func structs(v reflect.Value) []reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return structs(v.Elem())
+	case reflect.Slice, reflect.Array:
+		var out []reflect.Value
+		for i := 0; i < v.Len(); i++ {
+			out = append(out, structs(v.Index(i))...)
+		}
+		return out
+	case reflect.Struct:
+		return []reflect.Value{v}
+	}
+	return nil
+}
+
+func populate(ctx context.Context, values []reflect.Value, nodes []*node, reg *bsoncodec.Registry, load Loader) error {
+	if len(values) == 0 {
+		return nil
+	}
+	t := values[0].Type()
+	for _, n := range nodes {
+		rel, err := relationOf(t, n.name)
+		if err != nil {
+			return err
+		}
+
+		keys := make([][]key, len(values))
+		var all bson.A
+		seen := make(map[string]bool)
+		for i, v := range values {
+			if keys[i], err = rel.keys(v, reg); err != nil {
+				return err
+			}
+			for _, k := range keys[i] {
+				if !seen[k.id] {
+					seen[k.id] = true
+					all = append(all, k.value)
+				}
+			}
+		}
+
+		loaded := reflect.New(reflect.SliceOf(rel.model))
+		if len(all) > 0 {
+			filter := bson.D{{Key: rel.foreign.Name, Value: bson.D{{Key: "$in", Value: all}}}}
+			if err := load(ctx, rel.model, filter, loaded.Interface()); err != nil {
+				return fmt.Errorf("populate %s: %w", n.name, err)
+			}
+		}
+		models := loaded.Elem()
+		if err := populate(ctx, structs(models), n.children, reg, load); err != nil {
+			return err
+		}
+
+		// The models are indexed by the keys of their foreign field.
+		byKey := make(map[string][]reflect.Value)
+		for i := 0; i < models.Len(); i++ {
+			m := models.Index(i)
+			fv, ok := bsonstruct.Value(m, rel.foreign)
+			if !ok {
+				continue
+			}
+			foreign, err := encodeKeys(fv, rel.foreign.Field, reg)
+			if err != nil {
+				return err
+			}
+			for _, k := range foreign {
+				byKey[k.id] = append(byKey[k.id], m)
+			}
+		}
+		for i, v := range values {
+			rel.assign(v, keys[i], byKey)
+		}
+	}
+	return nil
+}
+
+// relation is a field populated from the models whose foreign field matches
+// the value of its local field.
+type relation struct {
+	field   reflect.StructField
+	local   reflect.StructField
+	foreign bsonstruct.Field
+	model   reflect.Type
+	many    bool
+}
+
+func relationOf(t reflect.Type, name string) (*relation, error) {
+	f, ok := t.FieldByName(name)
+	if !ok {
+		return nil, fmt.Errorf("populate %s: %s has no field %s", name, t, name)
+	}
+	opts := bsonstruct.Tag(f)
+	ref := opts["ref"]
+	if ref == "" {
+		return nil, fmt.Errorf("populate %s: field %s.%s has no pie:\"ref:...\" tag", name, t, name)
+	}
+	local, ok := t.FieldByName(ref)
+	if !ok {
+		return nil, fmt.Errorf("populate %s: %s has no field %s to reference", name, t, ref)
+	}
+
+	r := &relation{field: f, local: local}
+	foreign := "_id"
+	if fk := opts["foreign"]; fk != "" {
+		foreign = fk
+	}
+	model := f.Type
+	if model.Kind() == reflect.Slice {
+		r.many = true
+		model = model.Elem()
+	}
+	for model.Kind() == reflect.Ptr {
+		model = model.Elem()
+	}
+	if model.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("populate %s: %s is not a model or a slice of models", name, f.Type)
+	}
+	r.model = model
+	for _, field := range bsonstruct.Fields(model) {
+		if field.Name == foreign {
+			r.foreign = field
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("populate %s: %s has no field %q", name, model, foreign)
+}
+
+// key is a normalized reference, and id its string form that equal
+// references share.
+type key struct {
+	value any
+	id    string
+}
+
+// keys returns the distinct non-zero references of the local field of v.
+func (r *relation) keys(v reflect.Value, reg *bsoncodec.Registry) ([]key, error) {
+	all, err := encodeKeys(v.FieldByIndex(r.local.Index), r.local, reg)
+	if err != nil {
+		return nil, err
+	}
+	var out []key
+	seen := make(map[string]bool)
+	for _, k := range all {
+		if !seen[k.id] {
+			seen[k.id] = true
+			out = append(out, k)
+		}
+	}
+	return out, nil
+}
+
+// assign sets the relation field of v to the models matching keys: the
+// first one, or all of them in key order for a slice field.
+func (r *relation) assign(v reflect.Value, keys []key, byKey map[string][]reflect.Value) {
+	target := v.FieldByIndex(r.field.Index)
+	var matched []reflect.Value
+	for _, k := range keys {
+		matched = append(matched, byKey[k.id]...)
+	}
+	if !r.many {
+		if len(matched) == 0 {
+			target.Set(reflect.Zero(target.Type()))
+			return
+		}
+		target.Set(as(matched[0], target.Type()))
+		return
+	}
+	out := reflect.MakeSlice(target.Type(), 0, len(matched))
+	for _, m := range matched {
+		out = reflect.Append(out, as(m, target.Type().Elem()))
+	}
+	target.Set(out)
+}
+
+// as returns the model m, or a pointer to it, as a value of type t.
+func as(m reflect.Value, t reflect.Type) reflect.Value {
+	if t.Kind() == reflect.Ptr {
+		return m.Addr()
+	}
+	return m
+}
+
+// encodeKeys returns the distinct keys of the non-zero values held by v, the
+// value of field, or by the elements of v when it is a slice. Each value is
+// encoded with reg as a field with the pie tag of field, so that field codecs
+// apply.
+func encodeKeys(v reflect.Value, field reflect.StructField, reg *bsoncodec.Registry) ([]key, error) {
+	values := flatten(v)
+	if len(values) == 0 {
+		return nil, nil
+	}
+	var out []key
+	seen := make(map[string]bool)
+	types := make(map[reflect.Type]reflect.Type)
+	for _, x := range values {
+		st := types[x.Type()]
+		if st == nil {
+			st = reflect.StructOf([]reflect.StructField{{
+				Name: "V",
+				Type: x.Type(),
+				Tag:  reflect.StructTag(fmt.Sprintf(`bson:"v" pie:%q`, field.Tag.Get("pie"))),
+			}})
+			types[x.Type()] = st
+		}
+		holder := reflect.New(st).Elem()
+		holder.Field(0).Set(x)
+		raw, err := bson.MarshalWithRegistry(reg, holder.Interface())
+		if err != nil {
+			return nil, fmt.Errorf("reference %s: %w", field.Name, err)
+		}
+		d, err := mql.NormalizeDoc(bson.Raw(raw))
+		if err != nil {
+			return nil, err
+		}
+		id, err := keyID(d[0].Value)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, key{value: d[0].Value, id: id})
+		}
+	}
+	return out, nil
+}
+
+// keyID returns the canonical Extended JSON of the normalized value v, with
+// integral numbers written alike whatever their type, as the server matches
+// them.
+func keyID(v any) (string, error) {
+	switch n := v.(type) {
+	case int32:
+		return strconv.FormatInt(int64(n), 10), nil
+	case int64:
+		return strconv.FormatInt(n, 10), nil
+	case float64:
+		if n == math.Trunc(n) && math.Abs(n) < 1<<63 {
+			return strconv.FormatInt(int64(n), 10), nil
+		}
+	}
+	b, err := bson.MarshalExtJSON(bson.D{{Key: "k", Value: v}}, true, false)
+	return string(b), err
+}
+
+// flatten returns the non-zero values held by v, or by the elements of v
+// when it is a slice.
+func flatten(v reflect.Value) []reflect.Value {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if (v.Kind() == reflect.Slice || v.Kind() == reflect.Array) && v.Type().Elem().Kind() != reflect.Uint8 {
+		var out []reflect.Value
+		for i := 0; i < v.Len(); i++ {
+			out = append(out, flatten(v.Index(i))...)
+		}
+		return out
+	}
+	if v.IsZero() {
+		return nil
+	}
+	return []reflect.Value{v}
+}
@@ -0,0 +1,397 @@
+// Package shell renders queries as mongosh commands.
+//
+// Values are rendered in their normalized BSON form (see package mql), on a
+// single line, with the shell's constructors for the types JSON lacks:
+//
+//	db.getCollection("users").find({ age: { $gte: 18 }, _id: ObjectId("5f1d...") }).sort({ name: 1 }).limit(10)
+package shell
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/5xxxx/pie/internal/mql"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Target returns the shell expression for collection coll of database db,
+// or of the shell's current database when db is empty.
+func Target(db, coll string) string {
+	if db == "" {
+		return "db.getCollection(" + quote(coll) + ")"
+	}
+	return "db.getSiblingDB(" + quote(db) + ").getCollection(" + quote(coll) + ")"
+}
+
+// Find renders target.find(filter, projection) followed by the cursor
+// methods for the options that are set.
+func Find(target string, filter bson.D, opts *options.FindOptions) (string, error) {
+	var b strings.Builder
+	f, err := Value(filter)
+	if err != nil {
+		return "", err
+	}
+	b.WriteString(target + ".find(" + f)
+	if opts.Projection != nil {
+		p, err := Value(opts.Projection)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(", " + p)
+	}
+	b.WriteString(")")
+
+	cursor := []struct {
+		name  string
+		value any
+	}{
+		{"sort", opts.Sort},
+		{"skip", opts.Skip},
+		{"limit", opts.Limit},
+		{"hint", opts.Hint},
+		{"collation", opts.Collation},
+		{"comment", opts.Comment},
+		{"maxTimeMS", opts.MaxTime},
+	}
+	for _, m := range cursor {
+		v, ok, err := option(m.value)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			b.WriteString("." + m.name + "(" + v + ")")
+		}
+	}
+	return b.String(), nil
+}
+
+// Update renders target.updateOne or target.updateMany with filter, update
+// and the options that are set.
+func Update(target string, filter bson.D, update any, many bool, opts *options.UpdateOptions) (string, error) {
+	method := "updateOne"
+	if many {
+		method = "updateMany"
+	}
+	f, err := Value(filter)
+	if err != nil {
+		return "", err
+	}
+	u, err := Value(update)
+	if err != nil {
+		return "", err
+	}
+	var arrayFilters any
+	if opts.ArrayFilters != nil {
+		arrayFilters = bson.A(opts.ArrayFilters.Filters)
+	}
+	o, err := document(
+		bson.E{Key: "upsert", Value: opts.Upsert},
+		bson.E{Key: "arrayFilters", Value: arrayFilters},
+		bson.E{Key: "hint", Value: opts.Hint},
+		bson.E{Key: "collation", Value: opts.Collation},
+		bson.E{Key: "bypassDocumentValidation", Value: opts.BypassDocumentValidation},
+	)
+	if err != nil {
+		return "", err
+	}
+	return call(target, method, f, u, o), nil
+}
+
+// Aggregate renders target.aggregate(pipeline, options) with the options
+// that are set.
+func Aggregate(target string, pipeline bson.A, opts *options.AggregateOptions) (string, error) {
+	p, err := Value(pipeline)
+	if err != nil {
+		return "", err
+	}
+	var cursor any
+	if opts.BatchSize != nil {
+		cursor = bson.D{{Key: "batchSize", Value: *opts.BatchSize}}
+	}
+	o, err := document(
+		bson.E{Key: "allowDiskUse", Value: opts.AllowDiskUse},
+		bson.E{Key: "cursor", Value: cursor},
+		bson.E{Key: "bypassDocumentValidation", Value: opts.BypassDocumentValidation},
+		bson.E{Key: "collation", Value: opts.Collation},
+		bson.E{Key: "maxTimeMS", Value: opts.MaxTime},
+		bson.E{Key: "comment", Value: opts.Comment},
+		bson.E{Key: "hint", Value: opts.Hint},
+	)
+	if err != nil {
+		return "", err
+	}
+	return call(target, "aggregate", p, o), nil
+}
+
+func call(target, method string, args ...string) string {
+	for len(args) > 0 && args[len(args)-1] == "" {
+		args = args[:len(args)-1]
+	}
+	return target + "." + method + "(" + strings.Join(args, ", ") + ")"
+}
+
+// document renders the options among fields that are set, or "" when none is.
+func document(fields ...bson.E) (string, error) {
+	var parts []string
+	for _, e := range fields {
+		v, ok, err := option(e.Value)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			parts = append(parts, key(e.Key)+": "+v)
+		}
+	}
+	if len(parts) == 0 {
+		return "", nil
+	}
+	return "{ " + strings.Join(parts, ", ") + " }", nil
+}
+
+// option renders an option value, reporting false when it is not set.
+func option(v any) (string, bool, error) {
+	switch x := v.(type) {
+	case nil:
+		return "", false, nil
+	case *bool:
+		if x == nil {
+			return "", false, nil
+		}
+		return strconv.FormatBool(*x), true, nil
+	case *int64:
+		if x == nil {
+			return "", false, nil
+		}
+		return strconv.FormatInt(*x, 10), true, nil
+	case *string:
+		if x == nil {
+			return "", false, nil
+		}
+		return quote(*x), true, nil
+	case *time.Duration:
+		if x == nil {
+			return "", false, nil
+		}
+		return strconv.FormatInt(x.Milliseconds(), 10), true, nil
+	case *options.Collation:
+		if x == nil {
+			return "", false, nil
+		}
+		var d bson.D
+		if err := bson.Unmarshal(x.ToDocument(), &d); err != nil {
+			return "", false, err
+		}
+		s, err := Value(d)
+		return s, true, err
+	}
+	s, err := Value(v)
+	return s, true, err
+}
+
+// Value normalizes v and renders it. Maps are rendered with their keys
+// sorted, so the output of a query built from maps is stable.
+func Value(v any) (string, error) {
+	if v == nil {
+		return Format(nil), nil
+	}
+	raw, err := bson.MarshalWithRegistry(registry, bson.D{{Key: "v", Value: v}})
+	if err != nil {
+		return "", err
+	}
+	d, err := mql.NormalizeDoc(bson.Raw(raw))
+	if err != nil {
+		return "", err
+	}
+	return Format(d[0].Value), nil
+}
+
+// registry is the default registry with maps encoded in key order.
+var registry = func() *bsoncodec.Registry {
+	rb := bson.NewRegistryBuilder()
+	rb.RegisterDefaultEncoder(reflect.Map, bsoncodec.ValueEncoderFunc(encodeSortedMap))
+	return rb.Build()
+}()
+
+// encodeSortedMap encodes a map with string keys as a document sorted by key,
+// and other maps as the driver does.
+func encodeSortedMap(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if val.Type().Key().Kind() != reflect.String {
+		return bsoncodec.NewMapCodec().EncodeValue(ec, vw, val)
+	}
+	if val.IsNil() {
+		return vw.WriteNull()
+	}
+	keys := val.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	d := make(bson.D, len(keys))
+	for i, k := range keys {
+		d[i] = bson.E{Key: k.String(), Value: val.MapIndex(k).Interface()}
+	}
+	enc, err := ec.LookupEncoder(reflect.TypeOf(d))
+	if err != nil {
+		return err
+	}
+	return enc.EncodeValue(ec, vw, reflect.ValueOf(d))
+}
+
+// Format renders a normalized value.
+func Format(v any) string {
+	var b strings.Builder
+	format(&b, v)
+	return b.String()
+}
+
+func format(b *strings.Builder, v any) {
+	switch x := v.(type) {
+	case nil:
+		b.WriteString("null")
+	case bson.D:
+		if len(x) == 0 {
+			b.WriteString("{}")
+			return
+		}
+		b.WriteString("{ ")
+		for i, e := range x {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(key(e.Key) + ": ")
+			format(b, e.Value)
+		}
+		b.WriteString(" }")
+	case bson.A:
+		if len(x) == 0 {
+			b.WriteString("[]")
+			return
+		}
+		b.WriteString("[ ")
+		for i, e := range x {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			format(b, e)
+		}
+		b.WriteString(" ]")
+	case string:
+		b.WriteString(quote(x))
+	case bool:
+		b.WriteString(strconv.FormatBool(x))
+	case int32:
+		b.WriteString(strconv.FormatInt(int64(x), 10))
+	case int64:
+		b.WriteString("NumberLong(" + strconv.FormatInt(x, 10) + ")")
+	case float64:
+		b.WriteString(number(x))
+	case primitive.Decimal128:
+		b.WriteString("NumberDecimal(" + quote(x.String()) + ")")
+	case primitive.ObjectID:
+		b.WriteString("ObjectId(" + quote(x.Hex()) + ")")
+	case primitive.DateTime:
+		b.WriteString("ISODate(" + quote(x.Time().UTC().Format("2006-01-02T15:04:05.000Z")) + ")")
+	case primitive.Regex:
+		b.WriteString(regex(x))
+	case primitive.Binary:
+		b.WriteString(binary(x))
+	case []byte:
+		b.WriteString(binary(primitive.Binary{Data: x}))
+	case primitive.Timestamp:
+		fmt.Fprintf(b, "Timestamp({ t: %d, i: %d })", x.T, x.I)
+	case primitive.Null:
+		b.WriteString("null")
+	case primitive.Undefined:
+		b.WriteString("undefined")
+	case primitive.MinKey:
+		b.WriteString("MinKey()")
+	case primitive.MaxKey:
+		b.WriteString("MaxKey()")
+	case primitive.JavaScript:
+		b.WriteString("Code(" + quote(string(x)) + ")")
+	case primitive.CodeWithScope:
+		b.WriteString("Code(" + quote(string(x.Code)) + ", ")
+		format(b, x.Scope)
+		b.WriteString(")")
+	case primitive.Symbol:
+		b.WriteString(quote(string(x)))
+	case primitive.DBPointer:
+		b.WriteString("DBPointer(" + quote(x.DB) + ", ObjectId(" + quote(x.Pointer.Hex()) + "))")
+	default:
+		fmt.Fprintf(b, "%v", x)
+	}
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// key renders a field name, quoted unless it is a plain identifier.
+func key(k string) string {
+	if identifier.MatchString(k) {
+		return k
+	}
+	return quote(k)
+}
+
+// quote renders s as a JSON string, which is also a valid JavaScript string.
+func quote(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func number(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// regex renders a regular expression literal, or BSONRegExp when the options
+// or the pattern have no literal form.
+func regex(re primitive.Regex) string {
+	if strings.ContainsAny(re.Pattern, "\n\r") || strings.Trim(re.Options, "imsu") != "" {
+		return "BSONRegExp(" + quote(re.Pattern) + ", " + quote(re.Options) + ")"
+	}
+	if re.Pattern == "" {
+		return "/(?:)/" + re.Options
+	}
+	var b strings.Builder
+	b.WriteByte('/')
+	escaped := false
+	for _, r := range re.Pattern {
+		if r == '/' && !escaped {
+			b.WriteByte('\\')
+		}
+		escaped = r == '\\' && !escaped
+		b.WriteRune(r)
+	}
+	b.WriteByte('/')
+	b.WriteString(re.Options)
+	return b.String()
+}
+
+func binary(bin primitive.Binary) string {
+	if bin.Subtype == 4 && len(bin.Data) == 16 {
+		h := hex.EncodeToString(bin.Data)
+		return "UUID(" + quote(h[:8]+"-"+h[8:12]+"-"+h[12:16]+"-"+h[16:20]+"-"+h[20:]) + ")"
+	}
+	return fmt.Sprintf("BinData(%d, %s)", bin.Subtype, quote(base64.StdEncoding.EncodeToString(bin.Data)))
+}
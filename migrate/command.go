@@ -0,0 +1,85 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// errNoMigrations is returned by Command for up when no migrations are known.
+var errNoMigrations = errors.New("migrate: no migrations are registered; import the package that registers them, see Main")
+
+// Command runs the migrate subcommand with args, writing its report to out:
+//
+//	up [-to VERSION]      apply pending migrations, up to VERSION if given
+//	down [-to VERSION]    roll back the latest migration, or every one newer than VERSION
+//	status                list migrations and when they were applied
+//
+// It is what `pie migrate` runs, and can be called from a program's own main
+// so that the migrations it registers are known. up fails when m knows no
+// migrations, which usually means the migrations package was not linked in.
+func Command(ctx context.Context, m *Migrator, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("migrate: expected up, down or status")
+	}
+	fs := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	fs.SetOutput(out)
+	to := fs.Int64("to", -1, "target version")
+
+	switch args[0] {
+	case "up", "down":
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if args[0] == "up" && len(m.migrations) == 0 {
+			return errNoMigrations
+		}
+	case "status":
+		return printStatus(ctx, m, out)
+	default:
+		return fmt.Errorf("migrate: unknown command %q, expected up, down or status", args[0])
+	}
+
+	var done []Migration
+	var err error
+	switch {
+	case args[0] == "up":
+		done, err = m.UpTo(ctx, *to)
+	case *to >= 0:
+		done, err = m.DownTo(ctx, *to)
+	default:
+		done, err = m.Down(ctx)
+	}
+	for _, mg := range done {
+		fmt.Fprintf(out, "%s %d %s\n", args[0], mg.Version, mg.Description)
+	}
+	if err == nil && len(done) == 0 {
+		fmt.Fprintln(out, "nothing to do")
+	}
+	return err
+}
+
+func printStatus(ctx context.Context, m *Migrator, out io.Writer) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tAPPLIED\tDESCRIPTION")
+	for _, st := range statuses {
+		applied := "pending"
+		if st.Applied {
+			applied = st.AppliedAt.Format(time.RFC3339)
+		}
+		desc := st.Description
+		if st.Missing {
+			desc += " (not known to this program)"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", st.Version, applied, desc)
+	}
+	return w.Flush()
+}
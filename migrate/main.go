@@ -0,0 +1,65 @@
+package migrate
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/5xxxx/pie"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Main is the main function of the pie command:
+//
+//	pie [-uri URI] [-db NAME] migrate up|down|status [-to VERSION]
+//
+// The connection defaults to the PIE_URI and PIE_DB environment variables.
+// Migrations are Go code, so an application builds its own pie command
+// around Main, importing its migrations package for the Register calls in
+// its init functions:
+//
+//	package main
+//
+//	import (
+//		"github.com/5xxxx/pie/migrate"
+//
+//		_ "example.com/app/migrations"
+//	)
+//
+//	func main() {
+//		migrate.Main()
+//	}
+func Main() {
+	uri := flag.String("uri", os.Getenv("PIE_URI"), "MongoDB connection string")
+	db := flag.String("db", os.Getenv("PIE_DB"), "database name")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] migrate up|down|status [-to VERSION]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 || args[0] != "migrate" || *uri == "" || *db == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := run(ctx, *uri, *db, args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		stop()
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, uri, db string, args []string) error {
+	client, err := pie.NewClient(db, options.Client().ApplyURI(uri))
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+	return Command(ctx, New(client), args, os.Stdout)
+}
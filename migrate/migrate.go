@@ -0,0 +1,386 @@
+// Package migrate runs versioned schema and data migrations against a pie.Client.
+//
+// Migrations are Go functions registered with a version, usually from the
+// init functions of a migrations package:
+//
+//	func init() {
+//		migrate.Register(20240301120000, "index users by email",
+//			func(ctx context.Context, client pie.Client) error {
+//				_, err := client.AddIndex(bson.M{"email": 1}, options.Index().SetUnique(true)).CreateIndexes(&User{}, ctx)
+//				return err
+//			},
+//			func(ctx context.Context, client pie.Client) error {
+//				return client.NewIndexes().DropOne(&User{}, "email_1", ctx)
+//			})
+//	}
+//
+// Applied versions are recorded in the pie_migrations collection. A lock
+// document in the same collection keeps two processes from migrating at once;
+// it is renewed while migrations run, and a run that loses it stops before
+// recording another version.
+//
+// The pie command only knows the migrations of the packages linked into it,
+// so each application builds its own, see Main.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/5xxxx/pie"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CollectionName is the collection applied versions and the lock are kept in.
+const CollectionName = "pie_migrations"
+
+// DefaultLockTTL is how long a lock is honoured before another process may take it over.
+const DefaultLockTTL = 15 * time.Minute
+
+var (
+	// ErrLocked is returned when another process holds the migration lock.
+	ErrLocked = errors.New("migrate: another migration is running")
+	// ErrIrreversible is returned when rolling back a migration without a down step.
+	ErrIrreversible = errors.New("migrate: migration has no down step")
+	// ErrLockLost is returned when the lock expired and was taken over, or
+	// removed, while migrations ran.
+	ErrLockLost = errors.New("migrate: the migration lock was lost")
+)
+
+// Func is an up or down step of a migration.
+type Func func(ctx context.Context, client pie.Client) error
+
+// Migration is a versioned change. Versions order the migrations; a timestamp
+// such as 20240301120000 keeps them unique across branches.
+type Migration struct {
+	Version     int64
+	Description string
+	Up          Func
+	Down        Func
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[int64]Migration{}
+)
+
+// Register adds a migration to the ones New uses by default. It panics if
+// up is nil or the version is registered twice.
+func Register(version int64, description string, up, down Func) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if up == nil {
+		panic(fmt.Sprintf("migrate: migration %d has no up step", version))
+	}
+	if _, dup := registry[version]; dup {
+		panic(fmt.Sprintf("migrate: migration %d registered twice", version))
+	}
+	registry[version] = Migration{Version: version, Description: description, Up: up, Down: down}
+}
+
+// Registered returns the registered migrations in version order.
+func Registered() []Migration {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	out := make([]Migration, 0, len(registry))
+	for _, m := range registry {
+		out = append(out, m)
+	}
+	sortMigrations(out)
+	return out
+}
+
+func sortMigrations(ms []Migration) {
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+}
+
+// record is the document kept for an applied migration.
+type record struct {
+	Version     int64     `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"applied_at"`
+}
+
+func (record) CollectionName() string { return CollectionName }
+
+// lock is the document held by the process running migrations.
+type lock struct {
+	ID        string    `bson:"_id"`
+	Owner     string    `bson:"owner"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+func (lock) CollectionName() string { return CollectionName }
+
+const lockID = "lock"
+
+// Status is the state of a migration.
+type Status struct {
+	Version     int64
+	Description string
+	Applied     bool
+	AppliedAt   time.Time
+	// Missing is set for applied versions that are not among the known migrations.
+	Missing bool
+}
+
+// Migrator applies and rolls back migrations.
+type Migrator struct {
+	client     pie.Client
+	migrations []Migration
+	lockTTL    time.Duration
+	owner      string
+	now        func() time.Time
+}
+
+// New returns a Migrator for client over migrations, or over the registered
+// migrations when none are given.
+func New(client pie.Client, migrations ...Migration) *Migrator {
+	if len(migrations) == 0 {
+		migrations = Registered()
+	} else {
+		migrations = append([]Migration(nil), migrations...)
+		sortMigrations(migrations)
+	}
+	host, _ := os.Hostname()
+	return &Migrator{
+		client:     client,
+		migrations: migrations,
+		lockTTL:    DefaultLockTTL,
+		owner:      fmt.Sprintf("%s/%d/%s", host, os.Getpid(), primitive.NewObjectID().Hex()),
+		now:        time.Now,
+	}
+}
+
+// SetLockTTL sets how long the lock is held before other processes may take
+// it over. The lock is renewed every third of ttl while migrations run, so
+// ttl only needs to exceed the time a stalled process should keep it.
+func (m *Migrator) SetLockTTL(ttl time.Duration) *Migrator {
+	m.lockTTL = ttl
+	return m
+}
+
+// Up applies every pending migration in version order and returns the ones it applied.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	return m.UpTo(ctx, -1)
+}
+
+// UpTo applies the pending migrations up to and including version, or all of
+// them when version is negative.
+func (m *Migrator) UpTo(ctx context.Context, version int64) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(ctx context.Context, applied map[int64]record) error {
+		for _, mg := range m.migrations {
+			if version >= 0 && mg.Version > version {
+				break
+			}
+			if _, ok := applied[mg.Version]; ok {
+				continue
+			}
+			if err := mg.Up(ctx, m.client); err != nil {
+				return fmt.Errorf("migrate: up %d (%s): %w", mg.Version, mg.Description, err)
+			}
+			if err := m.hold(ctx); err != nil {
+				return fmt.Errorf("migrate: recording %d: %w", mg.Version, err)
+			}
+			r := record{Version: mg.Version, Description: mg.Description, AppliedAt: m.now().UTC()}
+			if _, err := m.client.NewSession().InsertOne(&r, ctx); err != nil {
+				return fmt.Errorf("migrate: recording %d: %w", mg.Version, err)
+			}
+			done = append(done, mg)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down rolls back the most recently applied migration and returns it, or
+// returns nil when nothing is applied.
+func (m *Migrator) Down(ctx context.Context) ([]Migration, error) {
+	return m.down(ctx, math.MinInt64, 1)
+}
+
+// DownTo rolls back every applied migration newer than version, newest first.
+func (m *Migrator) DownTo(ctx context.Context, version int64) ([]Migration, error) {
+	return m.down(ctx, version, -1)
+}
+
+// down rolls back at most limit applied migrations newer than version, or all of them when limit is negative.
+func (m *Migrator) down(ctx context.Context, version int64, limit int) ([]Migration, error) {
+	known := make(map[int64]Migration, len(m.migrations))
+	for _, mg := range m.migrations {
+		known[mg.Version] = mg
+	}
+	var done []Migration
+	err := m.locked(ctx, func(ctx context.Context, applied map[int64]record) error {
+		versions := make([]int64, 0, len(applied))
+		for v := range applied {
+			versions = append(versions, v)
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+		for i, v := range versions {
+			if (limit >= 0 && i >= limit) || v <= version {
+				break
+			}
+			mg, ok := known[v]
+			if !ok {
+				return fmt.Errorf("migrate: down %d: migration is not known to this program", v)
+			}
+			if mg.Down == nil {
+				return fmt.Errorf("migrate: down %d (%s): %w", v, mg.Description, ErrIrreversible)
+			}
+			if err := mg.Down(ctx, m.client); err != nil {
+				return fmt.Errorf("migrate: down %d (%s): %w", v, mg.Description, err)
+			}
+			if err := m.hold(ctx); err != nil {
+				return fmt.Errorf("migrate: unrecording %d: %w", v, err)
+			}
+			if _, err := m.client.NewSession().Eq("_id", v).DeleteOne(&record{}, ctx); err != nil {
+				return fmt.Errorf("migrate: unrecording %d: %w", v, err)
+			}
+			done = append(done, mg)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Status returns the state of every known migration and of applied versions
+// that are not known, in version order.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []Status
+	for _, mg := range m.migrations {
+		st := Status{Version: mg.Version, Description: mg.Description}
+		if r, ok := applied[mg.Version]; ok {
+			st.Applied, st.AppliedAt = true, r.AppliedAt
+			delete(applied, mg.Version)
+		}
+		out = append(out, st)
+	}
+	for _, r := range applied {
+		out = append(out, Status{Version: r.Version, Description: r.Description, Applied: true, AppliedAt: r.AppliedAt, Missing: true})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int64]record, error) {
+	var records []record
+	if err := m.client.NewSession().Exists("applied_at", true).FindAll(&records, ctx); err != nil {
+		return nil, err
+	}
+	applied := make(map[int64]record, len(records))
+	for _, r := range records {
+		applied[r.Version] = r
+	}
+	return applied, nil
+}
+
+// locked runs fn with the applied migrations while holding the lock. The
+// context fn gets is cancelled with ErrLockLost if the lock is lost.
+func (m *Migrator) locked(ctx context.Context, fn func(ctx context.Context, applied map[int64]record) error) error {
+	if err := m.acquire(ctx); err != nil {
+		return err
+	}
+	defer m.release()
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	defer m.heartbeat(ctx, cancel)()
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	return fn(ctx, applied)
+}
+
+// heartbeat renews the lock every third of its TTL until the returned
+// function is called, and cancels ctx with ErrLockLost when it is lost.
+// Other renewal errors are retried on the next beat.
+func (m *Migrator) heartbeat(ctx context.Context, lost context.CancelCauseFunc) (stop func()) {
+	interval := m.lockTTL / 3
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := m.renew(ctx); errors.Is(err, ErrLockLost) {
+					lost(err)
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// hold renews the lock, returning ErrLockLost if m no longer holds it.
+func (m *Migrator) hold(ctx context.Context) error {
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+	return m.renew(ctx)
+}
+
+// renew extends the lock held by m by its TTL.
+func (m *Migrator) renew(ctx context.Context) error {
+	res, err := m.client.NewSession().
+		FilterBson(bson.D{{Key: "_id", Value: lockID}, {Key: "owner", Value: m.owner}}).
+		UpdateOneBson(&lock{}, bson.M{"$set": bson.M{"expires_at": m.now().UTC().Add(m.lockTTL)}}, ctx)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// acquire takes the lock unless another owner holds an unexpired one. The
+// upsert only matches an expired lock; against a live one it tries to insert
+// a second lock document and fails on the duplicate _id.
+func (m *Migrator) acquire(ctx context.Context) error {
+	now := m.now().UTC()
+	_, err := m.client.NewSession().
+		FilterBson(bson.D{{Key: "_id", Value: lockID}, {Key: "expires_at", Value: bson.M{"$lt": now}}}).
+		SetUpsert(true).
+		UpdateOneBson(&lock{}, bson.M{"$set": bson.M{"owner": m.owner, "expires_at": now.Add(m.lockTTL)}}, ctx)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrLocked
+	}
+	return err
+}
+
+// release drops the lock if it is still held by m. It does not use the
+// caller's context, so that a cancelled run still releases it.
+func (m *Migrator) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, _ = m.client.NewSession().Eq("_id", lockID).Eq("owner", m.owner).DeleteOne(&lock{}, ctx)
+}
@@ -0,0 +1,146 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/5xxxx/pie"
+	"github.com/5xxxx/pie/pietest"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMigrator(t *testing.T) {
+	Convey("Given a fake client and three migrations", t, func() {
+		ctx := context.Background()
+		client := pietest.NewClient("test")
+		var log []string
+		step := func(name string) Func {
+			return func(ctx context.Context, client pie.Client) error {
+				log = append(log, name)
+				return nil
+			}
+		}
+		migrations := []Migration{
+			{Version: 3, Description: "third", Up: step("up 3")},
+			{Version: 1, Description: "first", Up: step("up 1"), Down: step("down 1")},
+			{Version: 2, Description: "second", Up: step("up 2"), Down: step("down 2")},
+		}
+		m := New(client, migrations...)
+
+		Convey("Up applies pending migrations in version order, once", func() {
+			done, err := m.Up(ctx)
+			So(err, ShouldBeNil)
+			So(done, ShouldHaveLength, 3)
+			So(log, ShouldResemble, []string{"up 1", "up 2", "up 3"})
+
+			done, err = m.Up(ctx)
+			So(err, ShouldBeNil)
+			So(done, ShouldBeEmpty)
+
+			statuses, err := m.Status(ctx)
+			So(err, ShouldBeNil)
+			So(statuses, ShouldHaveLength, 3)
+			So(statuses[0].Applied, ShouldBeTrue)
+			So(statuses[2].Description, ShouldEqual, "third")
+		})
+
+		Convey("UpTo stops at the target and Down rolls back the latest", func() {
+			_, err := m.UpTo(ctx, 2)
+			So(err, ShouldBeNil)
+			done, err := m.Down(ctx)
+			So(err, ShouldBeNil)
+			So(done, ShouldHaveLength, 1)
+			So(done[0].Version, ShouldEqual, 2)
+			So(log, ShouldResemble, []string{"up 1", "up 2", "down 2"})
+
+			statuses, err := m.Status(ctx)
+			So(err, ShouldBeNil)
+			So(statuses[0].Applied, ShouldBeTrue)
+			So(statuses[1].Applied, ShouldBeFalse)
+		})
+
+		Convey("DownTo stops at a migration without a down step", func() {
+			_, err := m.Up(ctx)
+			So(err, ShouldBeNil)
+			_, err = m.DownTo(ctx, 0)
+			So(errors.Is(err, ErrIrreversible), ShouldBeTrue)
+		})
+
+		Convey("A failing step stops the run after recording the earlier ones", func() {
+			m := New(client, Migration{Version: 1, Up: step("up 1")}, Migration{Version: 2, Up: func(context.Context, pie.Client) error {
+				return errors.New("boom")
+			}})
+			done, err := m.Up(ctx)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "boom")
+			So(done, ShouldHaveLength, 1)
+
+			statuses, err := New(client).Status(ctx)
+			So(err, ShouldBeNil)
+			So(statuses, ShouldHaveLength, 1)
+			So(statuses[0].Missing, ShouldBeTrue)
+		})
+
+		Convey("The lock keeps a second migrator out until it expires", func() {
+			So(m.acquire(ctx), ShouldBeNil)
+			other := New(client, migrations...)
+			_, err := other.Up(ctx)
+			So(err, ShouldEqual, ErrLocked)
+
+			other.now = func() time.Time { return time.Now().Add(DefaultLockTTL + time.Minute) }
+			_, err = other.Up(ctx)
+			So(err, ShouldBeNil)
+			So(log, ShouldHaveLength, 3)
+
+			_, err = m.Up(ctx)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("A long migration renews the lock", func() {
+			var otherErr error
+			m := New(client, Migration{Version: 1, Up: func(ctx context.Context, client pie.Client) error {
+				time.Sleep(150 * time.Millisecond)
+				_, otherErr = New(client, migrations...).Up(ctx)
+				return nil
+			}}).SetLockTTL(60 * time.Millisecond)
+			done, err := m.Up(ctx)
+			So(err, ShouldBeNil)
+			So(done, ShouldHaveLength, 1)
+			So(otherErr, ShouldEqual, ErrLocked)
+		})
+
+		Convey("A run that lost the lock records nothing more", func() {
+			m := New(client, Migration{Version: 1, Up: func(ctx context.Context, client pie.Client) error {
+				_, err := client.NewSession().Eq("_id", lockID).DeleteOne(&lock{}, ctx)
+				return err
+			}})
+			done, err := m.Up(ctx)
+			So(errors.Is(err, ErrLockLost), ShouldBeTrue)
+			So(done, ShouldBeEmpty)
+
+			statuses, err := New(client).Status(ctx)
+			So(err, ShouldBeNil)
+			So(statuses, ShouldBeEmpty)
+		})
+
+		Convey("Command reports what it did", func() {
+			var out bytes.Buffer
+			So(Command(ctx, m, []string{"up", "-to", "1"}, &out), ShouldBeNil)
+			So(out.String(), ShouldEqual, "up 1 first\n")
+
+			out.Reset()
+			So(Command(ctx, m, []string{"status"}, &out), ShouldBeNil)
+			So(out.String(), ShouldContainSubstring, "2        pending")
+
+			out.Reset()
+			So(Command(ctx, m, []string{"down"}, &out), ShouldBeNil)
+			So(out.String(), ShouldEqual, "down 1 first\n")
+
+			So(Command(ctx, m, []string{"sideways"}, &out), ShouldNotBeNil)
+			So(Command(ctx, New(client), []string{"up"}, &out), ShouldEqual, errNoMigrations)
+		})
+	})
+}
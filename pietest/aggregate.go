@@ -0,0 +1,649 @@
+package pietest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/5xxxx/pie"
+	"github.com/5xxxx/pie/geo"
+	"github.com/5xxxx/pie/internal/mql"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// aggregate runs pipelines in memory. The supported stages are $match,
+// $sort, $skip, $limit, $project, $addFields, $set, $unset, $unwind,
+// $count, $group, $replaceRoot, $replaceWith and equality $lookup.
+type aggregate struct {
+	db       string
+	doc      any
+	engine   *Client
+	pipeline bson.A
+	opts     []*options.AggregateOptions
+	collOpts []*options.CollectionOptions
+}
+
+var _ pie.Aggregate = (*aggregate)(nil)
+
+func newAggregate(engine *Client) *aggregate {
+	return &aggregate{engine: engine}
+}
+
+func (a *aggregate) One(result any, ctx ...context.Context) error {
+	target := result
+	if a.doc != nil {
+		target = a.doc
+	}
+	coll, err := a.engine.CollectionNameForStruct(target)
+	if err != nil {
+		return err
+	}
+	docs, err := a.run(coll.Name)
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return a.session().decode(docs[0], result)
+}
+
+func (a *aggregate) All(result any, ctx ...context.Context) error {
+	var name string
+	if a.doc != nil {
+		coll, err := a.engine.CollectionNameForStruct(a.doc)
+		if err != nil {
+			return err
+		}
+		name = coll.Name
+	} else {
+		coll, err := a.engine.CollectionNameForSlice(result)
+		if err != nil {
+			return err
+		}
+		name = coll.Name
+	}
+	docs, err := a.run(name)
+	if err != nil {
+		return err
+	}
+	return a.session().decodeAll(docs, result)
+}
+
+func (a *aggregate) session() *session {
+	return &session{engine: a.engine, db: a.db, collOpts: a.collOpts}
+}
+
+func (a *aggregate) SetAllowDiskUse(b bool) pie.Aggregate {
+	a.opts = append(a.opts, options.Aggregate().SetAllowDiskUse(b))
+	return a
+}
+
+func (a *aggregate) SetBatchSize(i int32) pie.Aggregate {
+	a.opts = append(a.opts, options.Aggregate().SetBatchSize(i))
+	return a
+}
+
+func (a *aggregate) SetBypassDocumentValidation(b bool) pie.Aggregate {
+	a.opts = append(a.opts, options.Aggregate().SetBypassDocumentValidation(b))
+	return a
+}
+
+func (a *aggregate) SetCollation(c *options.Collation) pie.Aggregate {
+	a.opts = append(a.opts, options.Aggregate().SetCollation(c))
+	return a
+}
+
+func (a *aggregate) SetMaxTime(d time.Duration) pie.Aggregate {
+	a.opts = append(a.opts, options.Aggregate().SetMaxTime(d))
+	return a
+}
+
+func (a *aggregate) SetMaxAwaitTime(d time.Duration) pie.Aggregate {
+	a.opts = append(a.opts, options.Aggregate().SetMaxAwaitTime(d))
+	return a
+}
+
+func (a *aggregate) SetComment(s string) pie.Aggregate {
+	a.opts = append(a.opts, options.Aggregate().SetComment(s))
+	return a
+}
+
+func (a *aggregate) SetHint(h any) pie.Aggregate {
+	a.opts = append(a.opts, options.Aggregate().SetHint(h))
+	return a
+}
+
+func (a *aggregate) Pipeline(pipeline bson.A) pie.Aggregate {
+	a.pipeline = append(a.pipeline, pipeline...)
+	return a
+}
+
+func (a *aggregate) Match(c pie.Condition) pie.Aggregate {
+	filters, err := c.Filters()
+	if err != nil {
+		panic(err)
+	}
+	a.pipeline = append(a.pipeline, bson.M{
+		"$match": filters,
+	})
+	return a
+}
+
+func (a *aggregate) GeoNear(stage *geo.NearStage) pie.Aggregate {
+	a.pipeline = append(a.pipeline, stage.Stage())
+	return a
+}
+
+func (a *aggregate) Project(spec any) pie.Aggregate {
+	a.pipeline = append(a.pipeline, bson.D{{Key: "$project", Value: spec}})
+	return a
+}
+
+func (a *aggregate) AddFields(fields any) pie.Aggregate {
+	a.pipeline = append(a.pipeline, bson.D{{Key: "$addFields", Value: fields}})
+	return a
+}
+
+func (a *aggregate) Group(id any, fields any) pie.Aggregate {
+	spec := bson.D{{Key: "_id", Value: id}}
+	switch f := fields.(type) {
+	case bson.D:
+		spec = append(spec, f...)
+	case bson.M:
+		spec = append(spec, sortedEntries(f)...)
+	case map[string]any:
+		spec = append(spec, sortedEntries(f)...)
+	}
+	a.pipeline = append(a.pipeline, bson.D{{Key: "$group", Value: spec}})
+	return a
+}
+
+// sortedEntries returns the entries of m in key order, as pie's Group adds them.
+func sortedEntries(m map[string]any) bson.D {
+	out := make(bson.D, 0, len(m))
+	for k, v := range m {
+		out = append(out, bson.E{Key: k, Value: v})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+func (a *aggregate) SetDatabase(db string) pie.Aggregate {
+	a.db = db
+	return a
+}
+
+func (a *aggregate) Collection(doc any) pie.Aggregate {
+	a.doc = doc
+	return a
+}
+
+func (a *aggregate) SetCollReadPreference(rp *readpref.ReadPref) pie.Aggregate {
+	a.collOpts = append(a.collOpts, options.Collection().SetReadPreference(rp))
+	return a
+}
+
+func (a *aggregate) SetCollRegistry(r *bsoncodec.Registry) pie.Aggregate {
+	a.collOpts = append(a.collOpts, options.Collection().SetRegistry(r))
+	return a
+}
+
+func (a *aggregate) SetCollWriteConcern(wc *writeconcern.WriteConcern) pie.Aggregate {
+	a.collOpts = append(a.collOpts, options.Collection().SetWriteConcern(wc))
+	return a
+}
+
+func (a *aggregate) SetReadConcern(rc *readconcern.ReadConcern) pie.Aggregate {
+	a.collOpts = append(a.collOpts, options.Collection().SetReadConcern(rc))
+	return a
+}
+
+// run executes the pipeline against the named collection.
+func (a *aggregate) run(name string) ([]bson.D, error) {
+	normalized, err := mql.Normalize(a.pipeline)
+	if err != nil {
+		return nil, err
+	}
+	stages, _ := normalized.(bson.A)
+
+	var docs []bson.D
+	err = a.engine.withCollection(a.db, name, func(c *collection) error {
+		for _, raw := range c.docs {
+			docs = append(docs, decode(raw))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range stages {
+		stage, ok := s.(bson.D)
+		if !ok || len(stage) != 1 {
+			return nil, fmt.Errorf("a pipeline stage specification object must contain exactly one field")
+		}
+		if docs, err = a.stage(stage[0].Key, stage[0].Value, docs); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+func (a *aggregate) stage(name string, arg any, docs []bson.D) ([]bson.D, error) {
+	switch name {
+	case "$match":
+		filter, ok := arg.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("the match filter must be an expression in an object")
+		}
+		var out []bson.D
+		for _, d := range docs {
+			ok, err := mql.Match(filter, d)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				out = append(out, d)
+			}
+		}
+		return out, nil
+	case "$sort":
+		positions := make([]int, len(docs))
+		return docs, sortDocs(positions, docs, nil, arg)
+	case "$skip", "$limit":
+		n, ok := mql.Float(arg)
+		if !ok || n < 0 {
+			return nil, fmt.Errorf("invalid argument to %s stage: %v", name, arg)
+		}
+		if name == "$skip" {
+			if int(n) >= len(docs) {
+				return nil, nil
+			}
+			return docs[int(n):], nil
+		}
+		if int(n) < len(docs) {
+			return docs[:int(n)], nil
+		}
+		return docs, nil
+	case "$project":
+		spec, ok := arg.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("$project specification must be an object")
+		}
+		return mapDocs(docs, func(d bson.D) (bson.D, error) { return projectStage(d, spec) })
+	case "$addFields", "$set":
+		spec, ok := arg.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("%s specification stage must be an object", name)
+		}
+		return mapDocs(docs, func(d bson.D) (bson.D, error) { return addFields(d, spec) })
+	case "$unset":
+		fields := bson.A{arg}
+		if arr, ok := arg.(bson.A); ok {
+			fields = arr
+		}
+		spec := bson.D{}
+		for _, f := range fields {
+			s, ok := f.(string)
+			if !ok {
+				return nil, fmt.Errorf("$unset specification must be a string or an array of strings")
+			}
+			spec = append(spec, bson.E{Key: s, Value: int32(0)})
+		}
+		return mapDocs(docs, func(d bson.D) (bson.D, error) { return project(d, spec, nil) })
+	case "$unwind":
+		return unwind(docs, arg)
+	case "$count":
+		field, ok := arg.(string)
+		if !ok || field == "" || strings.HasPrefix(field, "$") || strings.Contains(field, ".") {
+			return nil, fmt.Errorf("the count field must be a non-empty string without '$' or '.'")
+		}
+		if len(docs) == 0 {
+			return nil, nil
+		}
+		return []bson.D{{{Key: field, Value: int32(len(docs))}}}, nil
+	case "$group":
+		spec, ok := arg.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("a group's fields must be specified in an object")
+		}
+		return group(docs, spec)
+	case "$replaceRoot", "$replaceWith":
+		expr := arg
+		if name == "$replaceRoot" {
+			spec, _ := arg.(bson.D)
+			expr, _ = mql.Get(spec, "newRoot")
+		}
+		return mapDocs(docs, func(d bson.D) (bson.D, error) {
+			v, err := mql.Eval(expr, d)
+			if err != nil {
+				return nil, err
+			}
+			root, ok := v.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("'newRoot' expression must evaluate to an object, but resulting value was %v", v)
+			}
+			return root, nil
+		})
+	case "$lookup":
+		return a.lookup(docs, arg)
+	}
+	return nil, fmt.Errorf("unsupported pipeline stage %s", name)
+}
+
+func mapDocs(docs []bson.D, fn func(bson.D) (bson.D, error)) ([]bson.D, error) {
+	out := make([]bson.D, 0, len(docs))
+	for _, d := range docs {
+		r, err := fn(d)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// projectStage handles $project, which accepts computed fields on top of the
+// inclusion and exclusion flags a find projection understands.
+func projectStage(doc bson.D, spec bson.D) (bson.D, error) {
+	var flags, computed bson.D
+	for _, e := range spec {
+		switch e.Value.(type) {
+		case bool, int32, int64, float64:
+			flags = append(flags, e)
+		default:
+			computed = append(computed, e)
+		}
+	}
+	if len(computed) == 0 {
+		return project(doc, flags, nil)
+	}
+
+	inclusion := false
+	for _, f := range flags {
+		if f.Key == "_id" {
+			continue
+		}
+		if !projectionFlag(f.Value) {
+			return nil, fmt.Errorf("cannot do exclusion on field %s in inclusion projection", f.Key)
+		}
+		inclusion = true
+	}
+
+	out := includeFields(doc, [][]string{{"_id"}})
+	if inclusion {
+		var err error
+		if out, err = project(doc, flags, nil); err != nil {
+			return nil, err
+		}
+	} else if v, ok := mql.Get(flags, "_id"); ok && !projectionFlag(v) {
+		out = bson.D{}
+	}
+	return setFields(out, doc, computed)
+}
+
+func addFields(doc bson.D, spec bson.D) (bson.D, error) {
+	return setFields(doc, doc, spec)
+}
+
+// setFields evaluates the expressions of spec against source and stores the results in target.
+func setFields(target, source bson.D, spec bson.D) (bson.D, error) {
+	out := target
+	for _, e := range spec {
+		v, err := mql.Eval(e.Value, source)
+		if err != nil {
+			return nil, err
+		}
+		if v == mql.Missing {
+			continue
+		}
+		if out, err = modifyDoc(out, e.Key, true, func(any, bool) (any, bool, error) { return v, true, nil }); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func unwind(docs []bson.D, arg any) ([]bson.D, error) {
+	path, _ := arg.(string)
+	preserve := false
+	if spec, ok := arg.(bson.D); ok {
+		p, _ := mql.Get(spec, "path")
+		path, _ = p.(string)
+		if v, ok := mql.Get(spec, "preserveNullAndEmptyArrays"); ok {
+			preserve = mql.Truthy(v)
+		}
+		if _, ok := mql.Get(spec, "includeArrayIndex"); ok {
+			return nil, fmt.Errorf("pietest: $unwind includeArrayIndex is not supported")
+		}
+	}
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("path option to $unwind stage should be prefixed with a '$': %s", path)
+	}
+	path = path[1:]
+
+	var out []bson.D
+	for _, d := range docs {
+		values := mql.Lookup(d, path)
+		if len(values) == 0 {
+			if preserve {
+				out = append(out, d)
+			}
+			continue
+		}
+		arr, ok := values[0].(bson.A)
+		if !ok {
+			if values[0] != nil || preserve {
+				out = append(out, d)
+			}
+			continue
+		}
+		if len(arr) == 0 && preserve {
+			unset, _ := modifyDoc(d, path, false, func(any, bool) (any, bool, error) { return nil, false, nil })
+			out = append(out, unset)
+		}
+		for _, elem := range arr {
+			elem := elem
+			r, err := modifyDoc(d, path, true, func(any, bool) (any, bool, error) { return elem, true, nil })
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+func group(docs []bson.D, spec bson.D) ([]bson.D, error) {
+	idExpr, ok := mql.Get(spec, "_id")
+	if !ok {
+		return nil, fmt.Errorf("a group specification must include an _id")
+	}
+
+	type bucket struct {
+		id   any
+		docs []bson.D
+	}
+	var buckets []*bucket
+	for _, d := range docs {
+		id, err := mql.Eval(idExpr, d)
+		if err != nil {
+			return nil, err
+		}
+		if id == mql.Missing {
+			id = nil
+		}
+		var b *bucket
+		for _, existing := range buckets {
+			if mql.Equal(existing.id, id) {
+				b = existing
+				break
+			}
+		}
+		if b == nil {
+			b = &bucket{id: id}
+			buckets = append(buckets, b)
+		}
+		b.docs = append(b.docs, d)
+	}
+
+	out := make([]bson.D, 0, len(buckets))
+	for _, b := range buckets {
+		row := bson.D{{Key: "_id", Value: b.id}}
+		for _, e := range spec {
+			if e.Key == "_id" {
+				continue
+			}
+			acc, ok := e.Value.(bson.D)
+			if !ok || len(acc) != 1 {
+				return nil, fmt.Errorf("the field '%s' must be an accumulator object", e.Key)
+			}
+			v, err := accumulate(acc[0].Key, acc[0].Value, b.docs)
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, bson.E{Key: e.Key, Value: v})
+		}
+		out = append(out, row)
+	}
+	return out, nil
+}
+
+func accumulate(op string, expr any, docs []bson.D) (any, error) {
+	values := make([]any, 0, len(docs))
+	for _, d := range docs {
+		v, err := mql.Eval(expr, d)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+
+	switch op {
+	case "$sum", "$avg":
+		var numbers []any
+		for _, v := range values {
+			if _, ok := mql.Float(v); ok {
+				numbers = append(numbers, v)
+			}
+		}
+		if op == "$avg" {
+			if len(numbers) == 0 {
+				return nil, nil
+			}
+			total := 0.0
+			for _, n := range numbers {
+				f, _ := mql.Float(n)
+				total += f
+			}
+			return total / float64(len(numbers)), nil
+		}
+		return mql.Eval(bson.D{{Key: "$add", Value: bson.A(numbers)}}, nil)
+	case "$min", "$max":
+		var best any
+		found := false
+		for _, v := range values {
+			if v == mql.Missing || v == nil {
+				continue
+			}
+			c := 0
+			if found {
+				c = mql.Compare(v, best)
+			}
+			if !found || op == "$min" && c < 0 || op == "$max" && c > 0 {
+				best, found = v, true
+			}
+		}
+		return best, nil
+	case "$first", "$last":
+		if len(values) == 0 {
+			return nil, nil
+		}
+		v := values[0]
+		if op == "$last" {
+			v = values[len(values)-1]
+		}
+		if v == mql.Missing {
+			return nil, nil
+		}
+		return v, nil
+	case "$push", "$addToSet":
+		out := bson.A{}
+		for _, v := range values {
+			if v == mql.Missing || op == "$addToSet" && containsValue(out, v) {
+				continue
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	case "$count":
+		return int32(len(values)), nil
+	}
+	return nil, fmt.Errorf("unknown group operator '%s'", op)
+}
+
+// lookup implements the localField/foreignField form of $lookup.
+func (a *aggregate) lookup(docs []bson.D, arg any) ([]bson.D, error) {
+	spec, ok := arg.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("the $lookup stage specification must be an object")
+	}
+	str := func(key string) string {
+		v, _ := mql.Get(spec, key)
+		s, _ := v.(string)
+		return s
+	}
+	from, local, foreign, as := str("from"), str("localField"), str("foreignField"), str("as")
+	if from == "" || local == "" || foreign == "" || as == "" {
+		return nil, fmt.Errorf("pietest: $lookup needs from, localField, foreignField and as")
+	}
+
+	var foreignDocs []bson.D
+	err := a.engine.withCollection(a.db, from, func(c *collection) error {
+		for _, raw := range c.docs {
+			foreignDocs = append(foreignDocs, decode(raw))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return mapDocs(docs, func(d bson.D) (bson.D, error) {
+		localValues := mql.Lookup(d, local)
+		matched := bson.A{}
+		for _, f := range foreignDocs {
+			if lookupMatches(localValues, mql.Lookup(f, foreign)) {
+				matched = append(matched, f)
+			}
+		}
+		return modifyDoc(d, as, true, func(any, bool) (any, bool, error) { return matched, true, nil })
+	})
+}
+
+func lookupMatches(local, foreign []any) bool {
+	if len(local) == 0 {
+		local = []any{nil}
+	}
+	for _, l := range local {
+		items := []any{l}
+		if arr, ok := l.(bson.A); ok {
+			items = arr
+		}
+		for _, item := range items {
+			if ok, _ := mql.MatchValues(foreign, bson.D{{Key: "$eq", Value: item}}); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
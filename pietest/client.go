@@ -0,0 +1,530 @@
+package pietest
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"reflect"
+
+	"github.com/5xxxx/pie"
+	"github.com/5xxxx/pie/geo"
+	"github.com/5xxxx/pie/names"
+	"github.com/5xxxx/pie/schemas"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Client is an in-memory implementation of pie.Client. Documents are stored
+// as BSON per database and collection, so code written against pie.Client
+// can be unit tested without a running MongoDB.
+//
+// Collections are resolved from Go types exactly as pie does it. DataBase and
+// Collection return handles of a driver client that never connects, because
+// there is no server behind the fake: operations on them return an error,
+// and code that reaches for the raw driver needs a real database.
+type Client struct {
+	db       string
+	parser   *pie.Parser
+	store    *store
+	registry *bsoncodec.Registry
+	cache    pie.Cache
+	codecs   *pie.Codecs
+	ids      *pie.IDGenerators
+	fixtures *pie.Fixtures
+	driver   *mongo.Client
+}
+
+var _ pie.Client = (*Client)(nil)
+
+// NewClient creates an empty in-memory client using db as its default database.
+func NewClient(db string) *Client {
+	mapper := names.NewCacheMapper(new(names.SnakeMapper))
+	// A driver client only connects in Connect, which is never called.
+	driver, err := mongo.NewClient(options.Client())
+	if err != nil {
+		panic(err)
+	}
+	return &Client{
+		db:       db,
+		parser:   pie.NewParser(mapper, mapper),
+		store:    newStore(),
+		registry: bson.DefaultRegistry,
+		codecs:   pie.NewCodecs(),
+		ids:      pie.NewIDGenerators(),
+		fixtures: pie.NewFixtures(),
+		driver:   driver,
+	}
+}
+
+// Reset drops every database, collection and index held by the client.
+func (c *Client) Reset() {
+	c.store.restore(map[string]map[string]*collection{})
+}
+
+// Documents returns a copy of the documents stored in the named collection,
+// in insertion order. It is meant for assertions in tests.
+func (c *Client) Documents(name string, db ...string) []bson.Raw {
+	var docs []bson.Raw
+	_ = c.withCollection(c.database(db...), name, func(coll *collection) error {
+		docs = append(docs, coll.docs...)
+		return nil
+	})
+	return docs
+}
+
+func (c *Client) database(db ...string) string {
+	if len(db) > 0 && len(db[0]) > 0 {
+		return db[0]
+	}
+	return c.db
+}
+
+// withCollection runs fn with exclusive access to the named collection.
+func (c *Client) withCollection(db, name string, fn func(*collection) error) error {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	return fn(c.store.collection(c.database(db), name))
+}
+
+func (c *Client) FindPagination(needCount bool, doc any, ctx ...context.Context) (int64, error) {
+	return c.NewSession().FindPagination(needCount, doc, ctx...)
+}
+
+func (c *Client) FindOneAndReplace(doc any, ctx ...context.Context) error {
+	return c.NewSession().FindOneAndReplace(doc, ctx...)
+}
+
+func (c *Client) FindOneAndUpdate(doc any, ctx ...context.Context) (*mongo.SingleResult, error) {
+	return c.NewSession().FindOneAndUpdate(doc, ctx...)
+}
+
+func (c *Client) FindAndDelete(doc any, ctx ...context.Context) error {
+	return c.NewSession().FindAndDelete(doc, ctx...)
+}
+
+func (c *Client) FindOne(doc any, ctx ...context.Context) error {
+	return c.NewSession().FindOne(doc, ctx...)
+}
+
+func (c *Client) FindAll(docs any, ctx ...context.Context) error {
+	return c.NewSession().FindAll(docs, ctx...)
+}
+
+func (c *Client) RegexFilter(key, pattern string) pie.Session {
+	return c.NewSession().RegexFilter(key, pattern)
+}
+
+func (c *Client) Distinct(doc any, columns string, ctx ...context.Context) ([]any, error) {
+	return c.NewSession().Distinct(doc, columns, ctx...)
+}
+
+func (c *Client) FindOneAndUpdateBson(coll any, bson any, ctx ...context.Context) (*mongo.SingleResult, error) {
+	return c.NewSession().FindOneAndUpdateBson(coll, bson, ctx...)
+}
+
+func (c *Client) InsertOne(v any, ctx ...context.Context) (any, error) {
+	return c.NewSession().InsertOne(v, ctx...)
+}
+
+func (c *Client) InsertMany(v any, ctx ...context.Context) (*mongo.InsertManyResult, error) {
+	return c.NewSession().InsertMany(v, ctx...)
+}
+
+func (c *Client) BulkWrite(docs any, ctx ...context.Context) (*mongo.BulkWriteResult, error) {
+	return c.NewSession().BulkWrite(docs, ctx...)
+}
+
+func (c *Client) ReplaceOne(doc any, ctx ...context.Context) (*mongo.UpdateResult, error) {
+	return c.NewSession().ReplaceOne(doc, ctx...)
+}
+
+func (c *Client) Update(bean any, ctx ...context.Context) (*mongo.UpdateResult, error) {
+	return c.NewSession().UpdateOne(bean, ctx...)
+}
+
+func (c *Client) UpdateMany(bean any, ctx ...context.Context) (*mongo.UpdateResult, error) {
+	return c.NewSession().UpdateMany(bean, ctx...)
+}
+
+func (c *Client) UpdateOneBson(coll any, bson any, ctx ...context.Context) (*mongo.UpdateResult, error) {
+	return c.NewSession().UpdateOneBson(coll, bson, ctx...)
+}
+
+func (c *Client) UpdateManyBson(coll any, bson any, ctx ...context.Context) (*mongo.UpdateResult, error) {
+	return c.NewSession().UpdateManyBson(coll, bson, ctx...)
+}
+
+func (c *Client) SoftDeleteOne(filter any, ctx ...context.Context) error {
+	return c.NewSession().SoftDeleteOne(filter, ctx...)
+}
+
+func (c *Client) SoftDeleteMany(filter any, ctx ...context.Context) error {
+	return c.NewSession().SoftDeleteMany(filter, ctx...)
+}
+
+func (c *Client) DeleteOne(filter any, ctx ...context.Context) (*mongo.DeleteResult, error) {
+	return c.NewSession().DeleteOne(filter, ctx...)
+}
+
+func (c *Client) DeleteMany(filter any, ctx ...context.Context) (*mongo.DeleteResult, error) {
+	return c.NewSession().DeleteMany(filter, ctx...)
+}
+
+// DataBase returns a database of a driver client that is never connected:
+// the fake has no driver database to expose, so every operation on it fails
+// with an error.
+func (c *Client) DataBase() *mongo.Database {
+	return c.driver.Database(c.db)
+}
+
+// Collection returns a collection of a driver client that is never
+// connected, see DataBase.
+func (c *Client) Collection(name string, collOpts []*options.CollectionOptions, db ...string) *mongo.Collection {
+	return c.driver.Database(c.database(db...)).Collection(name, collOpts...)
+}
+
+func (c *Client) Ping() error {
+	return nil
+}
+
+func (c *Client) Connect(ctx ...context.Context) error {
+	return nil
+}
+
+func (c *Client) Disconnect(ctx ...context.Context) error {
+	return nil
+}
+
+func (c *Client) Soft(s bool) pie.Session {
+	return c.NewSession().Soft(s)
+}
+
+func (c *Client) FilterBy(object any) pie.Session {
+	return c.NewSession().FilterBy(object)
+}
+
+func (c *Client) Filter(key string, value any) pie.Session {
+	return c.NewSession().Filter(key, value)
+}
+
+func (c *Client) Asc(colNames ...string) pie.Session {
+	return c.NewSession().Asc(colNames...)
+}
+
+func (c *Client) Eq(key string, value any) pie.Session {
+	return c.NewSession().Eq(key, value)
+}
+
+func (c *Client) Ne(key string, ne any) pie.Session {
+	return c.NewSession().Ne(key, ne)
+}
+
+func (c *Client) Nin(key string, nin any) pie.Session {
+	return c.NewSession().Nin(key, nin)
+}
+
+func (c *Client) Nor(filter ...pie.Condition) pie.Session {
+	return c.NewSession().Nor(filter...)
+}
+
+func (c *Client) Exists(key string, exists bool, filter ...pie.Condition) pie.Session {
+	return c.NewSession().Exists(key, exists, filter...)
+}
+
+func (c *Client) ElemMatch(key string, cond pie.Condition) pie.Session {
+	return c.NewSession().ElemMatch(key, cond)
+}
+
+func (c *Client) All(key string, values any) pie.Session {
+	return c.NewSession().All(key, values)
+}
+
+func (c *Client) Size(key string, n int) pie.Session {
+	return c.NewSession().Size(key, n)
+}
+
+func (c *Client) Mod(key string, divisor, remainder int64) pie.Session {
+	return c.NewSession().Mod(key, divisor, remainder)
+}
+
+func (c *Client) BitsAllSet(key string, bits any) pie.Session {
+	return c.NewSession().BitsAllSet(key, bits)
+}
+
+func (c *Client) BitsAnySet(key string, bits any) pie.Session {
+	return c.NewSession().BitsAnySet(key, bits)
+}
+
+func (c *Client) BitsAllClear(key string, bits any) pie.Session {
+	return c.NewSession().BitsAllClear(key, bits)
+}
+
+func (c *Client) BitsAnyClear(key string, bits any) pie.Session {
+	return c.NewSession().BitsAnyClear(key, bits)
+}
+
+func (c *Client) JSONSchema(schema any) pie.Session {
+	return c.NewSession().JSONSchema(schema)
+}
+
+func (c *Client) Comment(comment string) pie.Session {
+	return c.NewSession().Comment(comment)
+}
+
+func (c *Client) Type(key string, t any) pie.Session {
+	return c.NewSession().Type(key, t)
+}
+
+func (c *Client) Expr(expression any) pie.Session {
+	return c.NewSession().Expr(expression)
+}
+
+func (c *Client) Regex(key string, pattern string, opts string) pie.Session {
+	return c.NewSession().Regex(key, pattern, opts)
+}
+
+func (c *Client) StartsWith(key string, prefix string) pie.Session {
+	return c.NewSession().StartsWith(key, prefix)
+}
+
+func (c *Client) EndsWith(key string, suffix string) pie.Session {
+	return c.NewSession().EndsWith(key, suffix)
+}
+
+func (c *Client) Contains(key string, substr string) pie.Session {
+	return c.NewSession().Contains(key, substr)
+}
+
+func (c *Client) EqualFold(key string, s string) pie.Session {
+	return c.NewSession().EqualFold(key, s)
+}
+
+func (c *Client) Text(search, language string, caseSensitive, diacriticSensitive bool) pie.Session {
+	return c.NewSession().Text(search, language, caseSensitive, diacriticSensitive)
+}
+
+func (c *Client) Near(key string, point geo.Point, maxDistance, minDistance float64) pie.Session {
+	return c.NewSession().Near(key, point, maxDistance, minDistance)
+}
+
+func (c *Client) NearSphere(key string, point geo.Point, maxDistance, minDistance float64) pie.Session {
+	return c.NewSession().NearSphere(key, point, maxDistance, minDistance)
+}
+
+func (c *Client) GeoWithin(key string, shape geo.Shape) pie.Session {
+	return c.NewSession().GeoWithin(key, shape)
+}
+
+func (c *Client) GeoIntersects(key string, geometry geo.Geometry) pie.Session {
+	return c.NewSession().GeoIntersects(key, geometry)
+}
+
+func (c *Client) ID(id any) pie.Session {
+	return c.NewSession().ID(id)
+}
+
+func (c *Client) Gt(key string, value any) pie.Session {
+	return c.NewSession().Gt(key, value)
+}
+
+func (c *Client) Gte(key string, value any) pie.Session {
+	return c.NewSession().Gte(key, value)
+}
+
+func (c *Client) Lt(key string, value any) pie.Session {
+	return c.NewSession().Lt(key, value)
+}
+
+func (c *Client) Lte(key string, value any) pie.Session {
+	return c.NewSession().Lte(key, value)
+}
+
+func (c *Client) In(key string, value any) pie.Session {
+	return c.NewSession().In(key, value)
+}
+
+func (c *Client) And(filter ...pie.Condition) pie.Session {
+	return c.NewSession().And(filter...)
+}
+
+func (c *Client) Not(key string, value any) pie.Session {
+	return c.NewSession().Not(key, value)
+}
+
+func (c *Client) Or(filter ...pie.Condition) pie.Session {
+	return c.NewSession().Or(filter...)
+}
+
+func (c *Client) Limit(limit int64) pie.Session {
+	return c.NewSession().Limit(limit)
+}
+
+func (c *Client) Skip(skip int64) pie.Session {
+	return c.NewSession().Skip(skip)
+}
+
+func (c *Client) Count(i any, ctx ...context.Context) (int64, error) {
+	return c.NewSession().Count(i, ctx...)
+}
+
+func (c *Client) Desc(colNames ...string) pie.Session {
+	return c.NewSession().Desc(colNames...)
+}
+
+func (c *Client) FilterBson(d bson.D) pie.Session {
+	return c.NewSession().FilterBson(d)
+}
+
+func (c *Client) Project(p any) pie.Session {
+	return c.NewSession().Project(p)
+}
+
+func (c *Client) Select(dto any) pie.Session {
+	return c.NewSession().Select(dto)
+}
+
+func (c *Client) Populate(paths ...string) pie.Session {
+	return c.NewSession().Populate(paths...)
+}
+
+func (c *Client) NewIndexes() pie.Indexes {
+	return newIndexes(c)
+}
+
+func (c *Client) DropAll(doc any, ctx ...context.Context) error {
+	return c.NewIndexes().DropAll(doc, ctx...)
+}
+
+func (c *Client) DropOne(doc any, name string, ctx ...context.Context) error {
+	return c.NewIndexes().DropOne(doc, name, ctx...)
+}
+
+func (c *Client) AddIndex(keys any, opt ...*options.IndexOptions) pie.Indexes {
+	return c.NewIndexes().AddIndex(keys, opt...)
+}
+
+func (c *Client) AddTextIndex(weights map[string]int32, opt ...*options.IndexOptions) pie.Indexes {
+	return c.NewIndexes().AddTextIndex(weights, opt...)
+}
+
+func (c *Client) AddIndex2dsphere(key string, opt ...*options.IndexOptions) pie.Indexes {
+	return c.NewIndexes().AddIndex2dsphere(key, opt...)
+}
+
+func (c *Client) AddIndex2d(key string, opt ...*options.IndexOptions) pie.Indexes {
+	return c.NewIndexes().AddIndex2d(key, opt...)
+}
+
+func (c *Client) NewSession() pie.Session {
+	return newSession(c)
+}
+
+func (c *Client) Aggregate() pie.Aggregate {
+	return newAggregate(c)
+}
+
+// SetCache records cache so Cache returns it. The fake reads its store
+// directly and never consults the cache.
+func (c *Client) SetCache(cache pie.Cache) {
+	c.cache = cache
+}
+
+func (c *Client) Cache() pie.Cache {
+	return c.cache
+}
+
+func (c *Client) Codecs() *pie.Codecs {
+	return c.codecs
+}
+
+func (c *Client) RegisterCodec(t reflect.Type, enc bsoncodec.ValueEncoder, dec bsoncodec.ValueDecoder) {
+	c.codecs.Register(t, enc, dec)
+}
+
+func (c *Client) IDGenerators() *pie.IDGenerators {
+	return c.ids
+}
+
+func (c *Client) RegisterIDGenerator(name string, gen pie.IDGenerator) {
+	c.ids.Register(name, gen)
+}
+
+func (c *Client) Fixtures() *pie.Fixtures {
+	return c.fixtures
+}
+
+func (c *Client) RegisterFixtureModels(models ...any) {
+	c.fixtures.Register(models...)
+}
+
+// LoadFixtures loads fixture files into the fake with pie.Fixtures.Load.
+func (c *Client) LoadFixtures(ctx context.Context, fsys fs.FS, patterns ...string) (pie.FixtureIDs, error) {
+	return c.fixtures.Load(ctx, c, fsys, patterns...)
+}
+
+// CollectionNameForStruct validates doc the same way pie does and returns its collection.
+func (c *Client) CollectionNameForStruct(doc any) (*schemas.Collection, error) {
+	beanValue := reflect.ValueOf(doc)
+	if beanValue.Kind() != reflect.Ptr {
+		return nil, errors.New("needs a pointer to a value")
+	} else if beanValue.Elem().Kind() == reflect.Ptr {
+		return nil, errors.New("a pointer to a pointer is not allowed")
+	}
+
+	if beanValue.Elem().Kind() == reflect.Interface {
+		return c.prepare(c.codecs.CollectionOf(c.parser, beanValue.Elem().Type()))
+	}
+	if beanValue.Elem().Kind() != reflect.Struct {
+		return nil, errors.New("needs a struct pointer")
+	}
+	return c.prepare(c.parser.Parse(beanValue))
+}
+
+// prepare readies the codecs for the model of coll, as pie's client does.
+func (c *Client) prepare(coll *schemas.Collection, err error) (*schemas.Collection, error) {
+	if err != nil {
+		return nil, err
+	}
+	if err := c.codecs.Prepare(coll.Type); err != nil {
+		return nil, err
+	}
+	return coll, nil
+}
+
+// CollectionNameForSlice validates doc the same way pie does and returns its collection.
+func (c *Client) CollectionNameForSlice(doc any) (*schemas.Collection, error) {
+	savedValue := reflect.Indirect(reflect.ValueOf(doc))
+	if savedValue.Kind() != reflect.Slice && reflect.Map != savedValue.Kind() {
+		return nil, errors.New("needs a pointer to a slice or a map")
+	}
+
+	if savedValue.Kind() == reflect.Map {
+		return c.parser.Parse(savedValue)
+	}
+	elemType := savedValue.Type().Elem()
+	if elemType.Kind() == reflect.Interface {
+		return c.prepare(c.codecs.CollectionOf(c.parser, elemType))
+	}
+	if elemType.Kind() != reflect.Struct {
+		return nil, pie.ErrUnsupportedType
+	}
+	return c.prepare(c.parser.Parse(reflect.New(elemType)))
+}
+
+// Transaction runs f and rolls every collection back to its previous state
+// when f returns an error. Transactions are not isolated from concurrent writers.
+func (c *Client) Transaction(ctx context.Context, f schemas.TransFunc) error {
+	return c.TransactionWithOptions(ctx, f)
+}
+
+// TransactionWithOptions behaves like Transaction; the session options are ignored.
+func (c *Client) TransactionWithOptions(ctx context.Context, f schemas.TransFunc, opt ...*options.SessionOptions) error {
+	saved := c.store.snapshot()
+	if err := f(ctx); err != nil {
+		c.store.restore(saved)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,945 @@
+package pietest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/5xxxx/pie"
+	"github.com/5xxxx/pie/expr"
+	"github.com/5xxxx/pie/schemas"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type user struct {
+	ID    primitive.ObjectID `bson:"_id,omitempty"`
+	Name  string             `bson:"name,omitempty"`
+	Age   int                `bson:"age,omitempty"`
+	Email string             `bson:"email,omitempty"`
+	Tags  []string           `bson:"tags,omitempty"`
+}
+
+func seed(c *Client) {
+	_, err := c.InsertMany([]user{
+		{Name: "alice", Age: 30, Email: "alice@example.com", Tags: []string{"admin", "dev"}},
+		{Name: "bob", Age: 25, Email: "bob@example.com", Tags: []string{"dev"}},
+		{Name: "carol", Age: 35, Email: "carol@example.com"},
+	})
+	So(err, ShouldBeNil)
+}
+
+func userNames(users []user) []string {
+	out := make([]string, len(users))
+	for i, u := range users {
+		out[i] = u.Name
+	}
+	return out
+}
+
+func TestFind(t *testing.T) {
+	Convey("Given a fake client with a few users", t, func() {
+		c := NewClient("test")
+		seed(c)
+
+		Convey("FindOne applies the condition filters", func() {
+			var u user
+			So(c.Eq("name", "bob").FindOne(&u), ShouldBeNil)
+			So(u.Age, ShouldEqual, 25)
+			So(u.ID.IsZero(), ShouldBeFalse)
+		})
+
+		Convey("FindOne reports ErrNoDocuments when nothing matches", func() {
+			var u user
+			So(c.Eq("name", "dave").FindOne(&u), ShouldEqual, mongo.ErrNoDocuments)
+		})
+
+		Convey("Strict sessions reject unknown fields", func() {
+			var users []user
+			err := c.NewSession().Strict(true).Eq("nmae", "bob").FindAll(&users)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `did you mean "name"?`)
+			So(c.NewSession().Strict(true).Eq("name", "bob").Sort("-age").FindAll(&users), ShouldBeNil)
+			So(users, ShouldHaveLength, 1)
+		})
+
+		Convey("FindAll supports comparison, array and regex operators", func() {
+			var users []user
+			So(c.Gte("age", 30).Asc("age").FindAll(&users), ShouldBeNil)
+			So(userNames(users), ShouldResemble, []string{"alice", "carol"})
+
+			So(c.Eq("tags", "dev").Sort("-age").FindAll(&users), ShouldBeNil)
+			So(userNames(users), ShouldResemble, []string{"alice", "bob"})
+
+			So(c.In("name", []string{"bob", "carol"}).Ne("age", 35).FindAll(&users), ShouldBeNil)
+			So(userNames(users), ShouldResemble, []string{"bob"})
+
+			So(c.RegexFilter("email", "^CAR").FindAll(&users), ShouldBeNil)
+			So(userNames(users), ShouldResemble, []string{"carol"})
+
+			So(c.StartsWith("email", "CAR").FindAll(&users), ShouldBeNil)
+			So(users, ShouldBeEmpty)
+			So(c.EqualFold("name", "BOB").FindAll(&users), ShouldBeNil)
+			So(userNames(users), ShouldResemble, []string{"bob"})
+			So(c.Regex("name", "^ B # first letter", "xi").FindAll(&users), ShouldBeNil)
+			So(userNames(users), ShouldResemble, []string{"bob"})
+			So(c.Regex("name", "^B", "q").FindAll(&users), ShouldNotBeNil)
+
+			So(c.Exists("tags", false).FindAll(&users), ShouldBeNil)
+			So(userNames(users), ShouldResemble, []string{"carol"})
+
+			So(c.All("tags", []string{"dev", "admin"}).FindAll(&users), ShouldBeNil)
+			So(userNames(users), ShouldResemble, []string{"alice"})
+
+			So(c.Size("tags", 1).FindAll(&users), ShouldBeNil)
+			So(userNames(users), ShouldResemble, []string{"bob"})
+
+			So(c.ElemMatch("tags", pie.DefaultCondition().Regex("", "^ad", "")).FindAll(&users), ShouldBeNil)
+			So(userNames(users), ShouldResemble, []string{"alice"})
+		})
+
+		Convey("FindPagination sorts, skips, limits and counts", func() {
+			var users []user
+			count, err := c.Desc("age").Skip(1).Limit(1).FindPagination(true, &users)
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 3)
+			So(userNames(users), ShouldResemble, []string{"alice"})
+		})
+
+		Convey("Project keeps only the requested fields", func() {
+			var u user
+			So(c.Eq("name", "alice").Project(bson.M{"name": 1, "_id": 0}).FindOne(&u), ShouldBeNil)
+			So(u, ShouldResemble, user{Name: "alice"})
+		})
+
+		Convey("Projection builders slice arrays and select DTO fields", func() {
+			var u user
+			So(c.Eq("name", "alice").Project(pie.NewProjection().Include("name").Slice("tags", -1)).FindOne(&u), ShouldBeNil)
+			So(u.Email, ShouldBeEmpty)
+			So(u.Tags, ShouldResemble, []string{"dev"})
+
+			u = user{}
+			So(c.Eq("name", "alice").Project(pie.NewProjection().ElemMatch("tags", pie.DefaultCondition().Eq("", "dev"))).FindOne(&u), ShouldBeNil)
+			So(u.Name, ShouldBeEmpty)
+			So(u.Tags, ShouldResemble, []string{"dev"})
+
+			type card struct {
+				Name string `bson:"name"`
+				Age  int    `bson:"age"`
+			}
+			var cards []card
+			So(c.NewSession().SetCollection("user").Select(&cards).Desc("age").FindAll(&cards), ShouldBeNil)
+			So(cards, ShouldResemble, []card{{"carol", 35}, {"alice", 30}, {"bob", 25}})
+			err := c.Select(&cards).FindAll(&cards)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "SetCollection")
+
+			So(c.Project(pie.NewProjection().Include("name").Exclude("age")).FindOne(&u), ShouldNotBeNil)
+		})
+
+		Convey("Count and Distinct see the same documents as Find", func() {
+			n, err := c.Lt("age", 31).Count(&user{})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+
+			tags, err := c.NewSession().Distinct(&[]user{}, "tags")
+			So(err, ShouldBeNil)
+			So(tags, ShouldResemble, []any{"admin", "dev"})
+		})
+
+		Convey("ID filters by ObjectID", func() {
+			var bob user
+			So(c.Eq("name", "bob").FindOne(&bob), ShouldBeNil)
+			var u user
+			So(c.ID(bob.ID.Hex()).FindOne(&u), ShouldBeNil)
+			So(u.Name, ShouldEqual, "bob")
+		})
+	})
+}
+
+func TestWrite(t *testing.T) {
+	Convey("Given a fake client with a few users", t, func() {
+		c := NewClient("test")
+		seed(c)
+
+		Convey("Update sets the fields of the bean", func() {
+			res, err := c.Eq("name", "bob").UpdateOne(&user{Age: 26})
+			So(err, ShouldBeNil)
+			So(res.MatchedCount, ShouldEqual, 1)
+			So(res.ModifiedCount, ShouldEqual, 1)
+
+			var u user
+			So(c.Eq("name", "bob").FindOne(&u), ShouldBeNil)
+			So(u.Age, ShouldEqual, 26)
+			So(u.Email, ShouldEqual, "bob@example.com")
+		})
+
+		Convey("UpdateManyBson applies update operators", func() {
+			res, err := c.Exists("tags", true).UpdateManyBson(&user{}, bson.M{
+				"$inc":  bson.M{"age": 1},
+				"$push": bson.M{"tags": "go"},
+			})
+			So(err, ShouldBeNil)
+			So(res.ModifiedCount, ShouldEqual, 2)
+
+			var u user
+			So(c.Eq("name", "alice").FindOne(&u), ShouldBeNil)
+			So(u.Age, ShouldEqual, 31)
+			So(u.Tags, ShouldResemble, []string{"admin", "dev", "go"})
+
+			_, err = c.Eq("name", "alice").UpdateOneBson(&user{}, bson.M{"$pull": bson.M{"tags": "dev"}, "$unset": bson.M{"email": ""}})
+			So(err, ShouldBeNil)
+			var updated user
+			So(c.Eq("name", "alice").FindOne(&updated), ShouldBeNil)
+			So(updated.Tags, ShouldResemble, []string{"admin", "go"})
+			So(updated.Email, ShouldBeEmpty)
+		})
+
+		Convey("Upserts insert the filter equality fields", func() {
+			res, err := c.Eq("name", "dave").SetUpsert(true).UpdateOneBson(&user{}, bson.M{"$set": bson.M{"age": 40}})
+			So(err, ShouldBeNil)
+			So(res.UpsertedCount, ShouldEqual, 1)
+
+			var u user
+			So(c.Eq("name", "dave").FindOne(&u), ShouldBeNil)
+			So(u.Age, ShouldEqual, 40)
+		})
+
+		Convey("FindOneAndUpdate returns the requested version of the document", func() {
+			res, err := c.Eq("name", "carol").SetReturnDocument(options.After).FindOneAndUpdate(&user{Age: 36})
+			So(err, ShouldBeNil)
+			var u user
+			So(res.Decode(&u), ShouldBeNil)
+			So(u.Age, ShouldEqual, 36)
+
+			res, err = c.Eq("name", "nobody").FindOneAndUpdate(&user{Age: 1})
+			So(err, ShouldBeNil)
+			So(res.Err(), ShouldEqual, mongo.ErrNoDocuments)
+		})
+
+		Convey("FindAndDelete removes and decodes the document", func() {
+			u := user{}
+			So(c.Eq("name", "bob").FindAndDelete(&u), ShouldBeNil)
+			So(u.Name, ShouldEqual, "bob")
+			n, err := c.Count(&user{})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+		})
+
+		Convey("Replacing a document keeps its _id", func() {
+			var bob user
+			So(c.Eq("name", "bob").FindOne(&bob), ShouldBeNil)
+			_, err := c.ID(bob.ID).ReplaceOne(&user{Name: "robert"})
+			So(err, ShouldBeNil)
+
+			var u user
+			So(c.ID(bob.ID).FindOne(&u), ShouldBeNil)
+			So(u, ShouldResemble, user{ID: bob.ID, Name: "robert"})
+		})
+
+		Convey("Soft deletes are hidden by Soft(false)", func() {
+			So(c.Eq("name", "alice").SoftDeleteOne(&user{}), ShouldBeNil)
+			n, err := c.Soft(false).Count(&user{})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+		})
+
+		Convey("Driver handles report errors instead of panicking", func() {
+			So(c.DataBase(), ShouldNotBeNil)
+			_, err := c.Collection("user", nil).InsertOne(context.Background(), bson.D{})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("DeleteMany removes every matching document", func() {
+			res, err := c.Gt("age", 26).DeleteMany(&user{})
+			So(err, ShouldBeNil)
+			So(res.DeletedCount, ShouldEqual, 2)
+			So(c.Documents("user"), ShouldHaveLength, 1)
+		})
+	})
+}
+
+func TestIndexes(t *testing.T) {
+	Convey("Unique indexes reject duplicates", t, func() {
+		c := NewClient("test")
+		seed(c)
+
+		created, err := c.AddIndex(bson.D{{Key: "email", Value: 1}}, options.Index().SetUnique(true)).CreateIndexes(&user{})
+		So(err, ShouldBeNil)
+		So(created, ShouldResemble, []string{"email_1"})
+
+		_, err = c.InsertOne(&user{Name: "alice2", Email: "alice@example.com"})
+		So(mongo.IsDuplicateKeyError(err), ShouldBeTrue)
+
+		_, err = c.Eq("name", "bob").UpdateOne(&user{Email: "carol@example.com"})
+		So(mongo.IsDuplicateKeyError(err), ShouldBeTrue)
+
+		So(c.DropOne(&user{}, "email_1"), ShouldBeNil)
+		_, err = c.InsertOne(&user{Name: "alice2", Email: "alice@example.com"})
+		So(err, ShouldBeNil)
+
+		_, err = c.AddIndex(bson.D{{Key: "email", Value: 1}}, options.Index().SetUnique(true)).CreateIndexes(&user{})
+		So(mongo.IsDuplicateKeyError(err), ShouldBeTrue)
+	})
+}
+
+func TestAggregate(t *testing.T) {
+	Convey("Pipelines run in memory", t, func() {
+		c := NewClient("test")
+		seed(c)
+
+		var rows []struct {
+			Tag   string `bson:"_id"`
+			Count int    `bson:"count"`
+			Age   int    `bson:"age"`
+		}
+		err := c.Aggregate().
+			Collection(&user{}).
+			Match(pie.DefaultCondition().Gte("age", 25)).
+			Pipeline(bson.A{
+				bson.M{"$unwind": "$tags"},
+				bson.M{"$group": bson.M{"_id": "$tags", "count": bson.M{"$sum": 1}, "age": bson.M{"$max": "$age"}}},
+				bson.M{"$sort": bson.M{"_id": 1}},
+			}).
+			All(&rows)
+		So(err, ShouldBeNil)
+		So(rows, ShouldHaveLength, 2)
+		So(rows[0].Tag, ShouldEqual, "admin")
+		So(rows[1].Tag, ShouldEqual, "dev")
+		So(rows[1].Count, ShouldEqual, 2)
+		So(rows[1].Age, ShouldEqual, 30)
+	})
+}
+
+func TestAggregateExpressions(t *testing.T) {
+	Convey("Project, AddFields and Group evaluate expressions", t, func() {
+		c := NewClient("test")
+		seed(c)
+
+		var rows []struct {
+			Bracket string   `bson:"_id"`
+			Users   int      `bson:"users"`
+			Names   []string `bson:"names"`
+			Tags    int      `bson:"tags"`
+		}
+		err := c.Aggregate().
+			Collection(&user{}).
+			AddFields(bson.M{
+				"bracket": expr.Switch(
+					expr.Case(expr.Lt(expr.Field("age"), 30), "young"),
+					expr.Default("senior"),
+				),
+				"tagCount": expr.Size(expr.IfNull(expr.Field("tags"), bson.A{})),
+			}).
+			Project(bson.D{
+				{Key: "bracket", Value: 1},
+				{Key: "tagCount", Value: 1},
+				{Key: "name", Value: expr.ToUpper(expr.Substr(expr.Field("name"), 0, 1))},
+			}).
+			Group(expr.Field("bracket"), bson.D{
+				{Key: "users", Value: expr.Count()},
+				{Key: "names", Value: expr.Push(expr.Field("name"))},
+				{Key: "tags", Value: expr.Sum(expr.Field("tagCount"))},
+			}).
+			Pipeline(bson.A{bson.M{"$sort": bson.M{"_id": 1}}}).
+			All(&rows)
+		So(err, ShouldBeNil)
+		So(rows, ShouldHaveLength, 2)
+		So(rows[0].Bracket, ShouldEqual, "senior")
+		So(rows[0].Users, ShouldEqual, 2)
+		So(rows[0].Names, ShouldResemble, []string{"A", "C"})
+		So(rows[0].Tags, ShouldEqual, 2)
+		So(rows[1].Bracket, ShouldEqual, "young")
+		So(rows[1].Names, ShouldResemble, []string{"B"})
+
+		var devs []user
+		So(c.Expr(expr.Eq(expr.Size(expr.Filter(expr.IfNull(expr.Field("tags"), bson.A{}), "", expr.Eq(expr.This, "dev"))), 1)).
+			Asc("name").FindAll(&devs), ShouldBeNil)
+		So(userNames(devs), ShouldResemble, []string{"alice", "bob"})
+	})
+}
+
+type company struct {
+	ID   primitive.ObjectID `bson:"_id,omitempty"`
+	Name string             `bson:"name"`
+}
+
+type author struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Name      string             `bson:"name"`
+	CompanyID primitive.ObjectID `bson:"company_id"`
+	Company   *company           `bson:"-" pie:"ref:CompanyID"`
+	Stories   []story            `bson:"-" pie:"ref:ID,foreign:author_id"`
+}
+
+type story struct {
+	ID         primitive.ObjectID   `bson:"_id,omitempty"`
+	Title      string               `bson:"title"`
+	AuthorID   primitive.ObjectID   `bson:"author_id"`
+	Author     *author              `bson:"-" pie:"ref:AuthorID"`
+	SponsorIDs []primitive.ObjectID `bson:"sponsor_ids"`
+	Sponsors   []company            `bson:"-" pie:"ref:SponsorIDs"`
+}
+
+type label struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty"`
+	ParcelID string             `bson:"parcel_id" pie:"codec:uuid"`
+	Parcel   *parcel            `bson:"-" pie:"ref:ParcelID"`
+}
+
+func TestPopulate(t *testing.T) {
+	Convey("Populate loads referenced models", t, func() {
+		c := NewClient("test")
+		insert := func(doc any) primitive.ObjectID {
+			id, err := c.InsertOne(doc)
+			So(err, ShouldBeNil)
+			return id.(primitive.ObjectID)
+		}
+		acme := insert(&company{Name: "acme"})
+		initech := insert(&company{Name: "initech"})
+		ann := insert(&author{Name: "ann", CompanyID: acme})
+		bo := insert(&author{Name: "bo", CompanyID: initech})
+		_, err := c.InsertMany([]story{
+			{Title: "a1", AuthorID: ann, SponsorIDs: []primitive.ObjectID{initech, acme}},
+			{Title: "b1", AuthorID: bo},
+			{Title: "a2", AuthorID: ann, SponsorIDs: []primitive.ObjectID{acme}},
+		})
+		So(err, ShouldBeNil)
+
+		Convey("One-to-one, one-to-many and nested paths", func() {
+			var stories []story
+			So(c.Populate("Author.Company", "Sponsors").Asc("title").FindAll(&stories), ShouldBeNil)
+			So(stories, ShouldHaveLength, 3)
+			So(stories[0].Author.Name, ShouldEqual, "ann")
+			So(stories[0].Author.Company.Name, ShouldEqual, "acme")
+			So(stories[1].Author.Company.Name, ShouldEqual, "acme")
+			So(stories[2].Author.Name, ShouldEqual, "bo")
+			So(stories[2].Author.Company.Name, ShouldEqual, "initech")
+			So(stories[0].Author, ShouldPointTo, stories[1].Author)
+			So(stories[0].Sponsors, ShouldResemble, []company{{ID: initech, Name: "initech"}, {ID: acme, Name: "acme"}})
+			So(stories[2].Sponsors, ShouldBeEmpty)
+		})
+
+		Convey("Reverse relations match a foreign field", func() {
+			var a author
+			So(c.Eq("name", "ann").Populate("Stories").FindOne(&a), ShouldBeNil)
+			So(a.Company, ShouldBeNil)
+			So(a.Stories, ShouldHaveLength, 2)
+			So(a.Stories[0].Title, ShouldEqual, "a1")
+			So(a.Stories[1].Title, ShouldEqual, "a2")
+		})
+
+		Convey("References are encoded with their field codecs", func() {
+			p := &parcel{Weight: 3}
+			_, err := c.InsertOne(p)
+			So(err, ShouldBeNil)
+			_, err = c.InsertOne(&label{ParcelID: p.ID})
+			So(err, ShouldBeNil)
+
+			var l label
+			So(c.Populate("Parcel").FindOne(&l), ShouldBeNil)
+			So(l.Parcel, ShouldNotBeNil)
+			So(l.Parcel.Weight, ShouldEqual, 3)
+		})
+
+		Convey("Unknown or untagged fields are errors", func() {
+			var stories []story
+			So(c.Populate("Editor").FindAll(&stories), ShouldNotBeNil)
+			So(c.Populate("Title").FindAll(&stories), ShouldNotBeNil)
+		})
+	})
+}
+
+type event interface {
+	Page() string
+}
+
+type clickEvent struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty"`
+	URL    string             `bson:"url"`
+	Button int                `bson:"button"`
+}
+
+func (e clickEvent) Page() string         { return e.URL }
+func (clickEvent) CollectionName() string { return "events" }
+
+type viewEvent struct {
+	ID  primitive.ObjectID `bson:"_id,omitempty"`
+	URL string             `bson:"url"`
+	Ms  int                `bson:"ms"`
+}
+
+func (e *viewEvent) Page() string        { return e.URL }
+func (viewEvent) CollectionName() string { return "events" }
+
+type visit struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty"`
+	Events []event            `bson:"events"`
+	Last   event              `bson:"last"`
+}
+
+func TestVariants(t *testing.T) {
+	Convey("Variants are stored with their discriminator", t, func() {
+		c := NewClient("test")
+		So(pie.RegisterVariant[event](c, "kind", "click", clickEvent{}), ShouldBeNil)
+		So(pie.RegisterVariant[event](c, "kind", "view", &viewEvent{}), ShouldBeNil)
+
+		_, err := c.InsertMany([]event{
+			clickEvent{URL: "/a", Button: 1},
+			&viewEvent{URL: "/b", Ms: 30},
+		})
+		So(err, ShouldBeNil)
+		docs := c.Documents("events")
+		So(docs, ShouldHaveLength, 2)
+		So(docs[0].Lookup("kind").StringValue(), ShouldEqual, "click")
+		So(docs[1].Lookup("kind").StringValue(), ShouldEqual, "view")
+
+		Convey("Results typed by the interface get the concrete types", func() {
+			var events []event
+			So(c.Asc("url").FindAll(&events), ShouldBeNil)
+			So(events, ShouldHaveLength, 2)
+			So(events[0], ShouldHaveSameTypeAs, clickEvent{})
+			So(events[0].(clickEvent).Button, ShouldEqual, 1)
+			So(events[1].(*viewEvent).Ms, ShouldEqual, 30)
+
+			var e event
+			So(c.Eq("kind", "view").FindOne(&e), ShouldBeNil)
+			So(e.Page(), ShouldEqual, "/b")
+
+			var grouped []event
+			So(c.Aggregate().Match(pie.DefaultCondition().Eq("kind", "click")).All(&grouped), ShouldBeNil)
+			So(grouped, ShouldResemble, []event{events[0]})
+		})
+
+		Convey("Interface fields and slices are decoded too", func() {
+			_, err := c.InsertOne(&visit{
+				Events: []event{clickEvent{URL: "/a"}, &viewEvent{URL: "/b"}},
+				Last:   &viewEvent{URL: "/b", Ms: 5},
+			})
+			So(err, ShouldBeNil)
+			var s visit
+			So(c.FindOne(&s), ShouldBeNil)
+			So(s.Events, ShouldHaveLength, 2)
+			So(s.Events[0], ShouldHaveSameTypeAs, clickEvent{})
+			So(s.Events[1], ShouldHaveSameTypeAs, &viewEvent{})
+			So(s.Last.(*viewEvent).Ms, ShouldEqual, 5)
+		})
+
+		Convey("Unknown discriminators and conflicting registrations are errors", func() {
+			_, err := c.NewSession().SetCollection("events").InsertOne(bson.D{{Key: "kind", Value: "scroll"}})
+			So(err, ShouldBeNil)
+			var events []event
+			So(c.FindAll(&events), ShouldNotBeNil)
+
+			So(pie.RegisterVariant[event](c, "type", "click", clickEvent{}), ShouldNotBeNil)
+			So(pie.RegisterVariant[event](c, "kind", "click", &viewEvent{}), ShouldNotBeNil)
+			So(pie.RegisterVariant[event](c, "kind", "tap", clickEvent{}), ShouldNotBeNil)
+			So(pie.RegisterVariant[any](c, "kind", "click", clickEvent{}), ShouldNotBeNil)
+		})
+	})
+}
+
+type job struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty"`
+	Timeout time.Duration      `bson:"timeout" pie:"codec:millis"`
+	Budget  string             `bson:"budget" pie:"codec:decimal"`
+}
+
+func TestCodecs(t *testing.T) {
+	Convey("Field codecs apply to stored documents", t, func() {
+		c := NewClient("test")
+		_, err := c.InsertOne(&job{Timeout: 2 * time.Second, Budget: "10.50"})
+		So(err, ShouldBeNil)
+		docs := c.Documents("job")
+		So(docs, ShouldHaveLength, 1)
+		So(docs[0].Lookup("timeout").Int64(), ShouldEqual, 2000)
+		So(docs[0].Lookup("budget").Decimal128().String(), ShouldEqual, "10.50")
+
+		var j job
+		So(c.Eq("timeout", 2000).FindOne(&j), ShouldBeNil)
+		So(j.Timeout, ShouldEqual, 2*time.Second)
+		So(j.Budget, ShouldEqual, "10.50")
+	})
+}
+
+type sku struct {
+	Code  string `bson:"_id"`
+	Stock int    `bson:"stock"`
+}
+
+type seat struct {
+	Flight string `bson:"flight" pie:"pk"`
+	Row    int64  `bson:"row" pie:"pk"`
+	Holder string `bson:"holder"`
+}
+
+func TestPrimaryKeys(t *testing.T) {
+	Convey("IDs follow the declared primary key", t, func() {
+		c := NewClient("test")
+		hexCode := primitive.NewObjectID().Hex()
+		_, err := c.InsertMany([]sku{{Code: hexCode, Stock: 1}, {Code: "sku-2", Stock: 2}})
+		So(err, ShouldBeNil)
+		_, err = c.InsertMany([]seat{{Flight: "LH1", Row: 1, Holder: "ann"}, {Flight: "LH1", Row: 2, Holder: "bo"}})
+		So(err, ShouldBeNil)
+
+		var s sku
+		So(c.ID(hexCode).FindOne(&s), ShouldBeNil)
+		So(s.Stock, ShouldEqual, 1)
+		So(c.ID("sku-2").FindOne(&s), ShouldBeNil)
+		So(s.Stock, ShouldEqual, 2)
+
+		var st seat
+		So(c.ID(schemas.NewPK("LH1", 2)).FindOne(&st), ShouldBeNil)
+		So(st.Holder, ShouldEqual, "bo")
+		So(c.ID("LH1").FindOne(&st), ShouldNotBeNil)
+
+		shell, err := c.ID(schemas.NewPK("LH1", 2)).Shell(&seat{})
+		So(err, ShouldBeNil)
+		So(shell, ShouldEqual, `db.getCollection("seat").find({ flight: "LH1", row: NumberLong(2) })`)
+
+		Convey("Replacing without a filter matches the document's key", func() {
+			_, err := c.ReplaceOne(&seat{Flight: "LH1", Row: 1, Holder: "cy"})
+			So(err, ShouldBeNil)
+			So(c.ID(schemas.NewPK("LH1", 1)).FindOne(&st), ShouldBeNil)
+			So(st.Holder, ShouldEqual, "cy")
+
+			res, err := c.NewSession().SetUpsert(true).ReplaceOne(&seat{Flight: "LH2", Row: 9, Holder: "di"})
+			So(err, ShouldBeNil)
+			So(res.UpsertedCount, ShouldEqual, 1)
+			n, err := c.Count(&seat{})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 3)
+		})
+	})
+}
+
+type parcel struct {
+	ID     string `bson:"_id" pie:"id:uuidv7,codec:uuid"`
+	Weight int    `bson:"weight"`
+}
+
+type shipment struct {
+	ID   int64  `bson:"_id" pie:"id:snowflake"`
+	Dest string `bson:"dest"`
+}
+
+func TestIDGenerators(t *testing.T) {
+	Convey("Inserts generate the ids their models declare", t, func() {
+		c := NewClient("test")
+		node, err := pie.NewSnowflake(3)
+		So(err, ShouldBeNil)
+		c.RegisterIDGenerator("snowflake", node)
+
+		p := &parcel{Weight: 2}
+		id, err := c.InsertOne(p)
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, p.ID)
+		subtype, _ := c.Documents("parcel")[0].Lookup("_id").Binary()
+		So(subtype, ShouldEqual, 4)
+
+		var found parcel
+		So(c.ID(p.ID).FindOne(&found), ShouldBeNil)
+		So(found.Weight, ShouldEqual, 2)
+
+		shipments := []shipment{{Dest: "a"}, {Dest: "b"}}
+		res, err := c.InsertMany(shipments)
+		So(err, ShouldBeNil)
+		So(res.InsertedIDs, ShouldResemble, []any{shipments[0].ID, shipments[1].ID})
+		So(shipments[1].ID, ShouldBeGreaterThan, shipments[0].ID)
+		So(shipments[0].ID>>12&1023, ShouldEqual, 3)
+
+		_, err = c.BulkWrite([]shipment{{Dest: "c"}})
+		So(err, ShouldBeNil)
+		n, err := c.Count(&shipment{})
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 3)
+
+		id, err = c.InsertOne(&company{Name: "acme"})
+		So(err, ShouldBeNil)
+		So(id, ShouldHaveSameTypeAs, primitive.ObjectID{})
+	})
+}
+
+func TestShell(t *testing.T) {
+	Convey("Sessions and aggregates render like pie's", t, func() {
+		c := NewClient("test")
+		out, err := c.Gte("age", 30).Asc("name").Limit(5).SetHint("age_1").Shell(&[]user{})
+		So(err, ShouldBeNil)
+		So(out, ShouldEqual, `db.getCollection("user").find({ age: { $gte: 30 } }).sort({ name: 1 }).limit(5).hint("age_1")`)
+
+		a := c.Aggregate().Collection(&user{}).Match(pie.DefaultCondition().Eq("name", "bob")).SetComment("report")
+		So(a.String(), ShouldEqual, `db.getCollection("user").aggregate([ { $match: { name: "bob" } } ], { comment: "report" })`)
+	})
+}
+
+func TestTransaction(t *testing.T) {
+	Convey("A failed transaction rolls back its writes", t, func() {
+		c := NewClient("test")
+		seed(c)
+
+		failure := errors.New("boom")
+		err := c.Transaction(context.Background(), func(ctx context.Context) error {
+			if _, err := c.DeleteMany(&user{}, ctx); err != nil {
+				return err
+			}
+			return failure
+		})
+		So(err, ShouldEqual, failure)
+		So(c.Documents("user"), ShouldHaveLength, 3)
+	})
+}
+
+type post struct {
+	ID     primitive.ObjectID `bson:"_id"`
+	Title  string             `bson:"title"`
+	Author primitive.ObjectID `bson:"author"`
+	At     time.Time          `bson:"at"`
+}
+
+type ticket struct {
+	ID    string `bson:"_id" pie:"id:uuidv4"`
+	Title string `bson:"title"`
+}
+
+func TestLoadFixtures(t *testing.T) {
+	Convey("Given fixture files referring to each other", t, func() {
+		c := NewClient("test")
+		seed(c)
+		c.RegisterFixtureModels(user{}, &post{}, ticket{})
+		fsys := fstest.MapFS{
+			"fixtures/user.yaml": {Data: []byte("- {_id: $oid:alice, name: alice, age: 30}\n- {_id: $oid:bob, name: bob, age: 25}\n")},
+			"fixtures/post.json": {Data: []byte(`{"truncate": false, "documents": [{"_id": "$oid:hello", "title": "hello", "author": "$oid:alice", "at": "$now-24h"}]}`)},
+		}
+
+		ids, err := c.LoadFixtures(context.Background(), fsys, "fixtures/*")
+		So(err, ShouldBeNil)
+		So(ids, ShouldHaveLength, 3)
+
+		Convey("Collections are truncated and loaded", func() {
+			var users []user
+			So(c.NewSession().FindAll(&users), ShouldBeNil)
+			So(userNames(users), ShouldResemble, []string{"alice", "bob"})
+			So(users[0].ID, ShouldEqual, ids["alice"])
+		})
+
+		Convey("References resolve to the generated IDs", func() {
+			var p post
+			So(c.ID(ids["hello"]).FindOne(&p), ShouldBeNil)
+			So(p.Author, ShouldEqual, ids["alice"])
+			So(p.At, ShouldHappenBefore, time.Now().Add(-23*time.Hour))
+		})
+
+		Convey("Loading again replaces truncated collections only", func() {
+			_, err := c.LoadFixtures(context.Background(), fsys, "fixtures/*")
+			So(err, ShouldBeNil)
+			n, err := c.NewSession().Count(&user{})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+			_, err = c.LoadFixtures(context.Background(), fsys, "fixtures/post.json")
+			So(err, ShouldBeNil)
+			n, err = c.NewSession().Count(&post{})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 3)
+		})
+
+		Convey("Documents are inserted as their models", func() {
+			fsys := fstest.MapFS{"ticket.json": {Data: []byte(`[{"title": "first"}]`)}}
+			_, err := c.LoadFixtures(context.Background(), fsys)
+			So(err, ShouldBeNil)
+			var tk ticket
+			So(c.NewSession().FindOne(&tk), ShouldBeNil)
+			So(tk.ID, ShouldHaveLength, 36)
+		})
+
+		Convey("Keys that are no field and collections without a model are refused", func() {
+			_, err := c.LoadFixtures(context.Background(), fstest.MapFS{"ticket.json": {Data: []byte(`[{"titel": "first"}]`)}})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `"titel" is not a field`)
+			_, err = c.LoadFixtures(context.Background(), fstest.MapFS{"comment.json": {Data: []byte(`[]`)}})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `no model is registered for collection "comment"`)
+		})
+	})
+}
+
+func TestExportImport(t *testing.T) {
+	Convey("Given a fake client with a few users", t, func() {
+		c := NewClient("test")
+		seed(c)
+		ctx := context.Background()
+
+		Convey("Export writes the filtered documents as CSV", func() {
+			var buf bytes.Buffer
+			err := c.NewSession().SetCollection("user").Gte("age", 30).Asc("age").
+				Project(bson.D{{Key: "name", Value: 1}, {Key: "tags", Value: 1}, {Key: "_id", Value: 0}}).Export(ctx, &buf, pie.ExportCSV)
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldEqual, "name,tags\nalice,\"[\"\"admin\"\",\"\"dev\"\"]\"\ncarol,\n")
+		})
+
+		Convey("CSV columns of a map projection are sorted", func() {
+			var buf bytes.Buffer
+			err := c.NewSession().SetCollection("user").Eq("name", "bob").
+				Project(bson.M{"name": 1, "email": 1, "age": 1, "_id": 0}).Export(ctx, &buf, pie.ExportCSV)
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldEqual, "age,email,name\n25,bob@example.com,bob\n")
+		})
+
+		Convey("CSV exports import back", func() {
+			var buf bytes.Buffer
+			So(c.NewSession().SetCollection("user").Asc("name").Export(ctx, &buf, pie.ExportCSV), ShouldBeNil)
+			buf.WriteString("\"unterminated\n")
+
+			res, err := c.NewSession().SetCollection("backup").Import(ctx, &buf, &pie.ImportOptions{
+				Format:    pie.ExportCSV,
+				MaxErrors: 1,
+			})
+			So(err, ShouldBeNil)
+			So(res.Inserted, ShouldEqual, 3)
+			So(res.Failed, ShouldEqual, 1)
+			So(res.Errors[0].Error(), ShouldStartWith, "line 5:")
+
+			var users, backup []user
+			So(c.NewSession().SetCollection("user").Asc("name").FindAll(&users), ShouldBeNil)
+			So(c.NewSession().SetCollection("backup").Asc("name").FindAll(&backup), ShouldBeNil)
+			So(backup, ShouldResemble, users)
+
+			in := strings.NewReader("name,address.city\neve,Oslo\n")
+			_, err = c.NewSession().SetCollection("other").Import(ctx, in, &pie.ImportOptions{Format: pie.ExportCSV})
+			So(err, ShouldBeNil)
+			var doc bson.M
+			So(c.NewSession().SetCollection("other").FindOne(&doc), ShouldBeNil)
+			So(doc["address"], ShouldResemble, bson.M{"city": "Oslo"})
+		})
+
+		Convey("Extended JSON arrays import", func() {
+			in := strings.NewReader(" [\n" +
+				`  {"name": "dave", "age": {"$numberInt": "40"}},` + "\n" +
+				`  {"age": {"$numberInt": "forty"}}` + "\n" +
+				"]\n")
+			res, err := c.NewSession().SetCollection("other").Import(ctx, in, &pie.ImportOptions{MaxErrors: -1})
+			So(err, ShouldBeNil)
+			So(res.Read, ShouldEqual, 2)
+			So(res.Inserted, ShouldEqual, 1)
+			So(res.Errors[0].Error(), ShouldStartWith, "line 3:")
+
+			var u user
+			So(c.NewSession().SetCollection("other").FindOne(&u), ShouldBeNil)
+			So(u.Age, ShouldEqual, 40)
+		})
+
+		Convey("Exported documents import into another collection", func() {
+			var buf bytes.Buffer
+			So(c.NewSession().SetCollection("user").Export(ctx, &buf, pie.ExportCanonicalJSONLines), ShouldBeNil)
+
+			var progress []int64
+			res, err := c.NewSession().SetCollection("backup").Import(ctx, &buf, &pie.ImportOptions{
+				BatchSize: 2,
+				Progress:  func(r pie.ImportResult) { progress = append(progress, r.Inserted) },
+			})
+			So(err, ShouldBeNil)
+			So(res.Read, ShouldEqual, 3)
+			So(res.Inserted, ShouldEqual, 3)
+			So(progress, ShouldResemble, []int64{2, 3})
+
+			var users []user
+			So(c.NewSession().SetCollection("backup").Asc("name").FindAll(&users), ShouldBeNil)
+			So(userNames(users), ShouldResemble, []string{"alice", "bob", "carol"})
+		})
+
+		Convey("Upserts replace documents matching the upsert fields", func() {
+			in := strings.NewReader(`{"name": "alice", "age": 31}` + "\n" + `{"name": "dave", "age": 40}` + "\n")
+			res, err := c.NewSession().SetCollection("user").Import(ctx, in, &pie.ImportOptions{
+				Upsert:       true,
+				UpsertFields: []string{"name"},
+			})
+			So(err, ShouldBeNil)
+			So(res.Modified, ShouldEqual, 1)
+			So(res.Upserted, ShouldEqual, 1)
+
+			var u user
+			So(c.NewSession().Eq("name", "alice").FindOne(&u), ShouldBeNil)
+			So(u.Age, ShouldEqual, 31)
+			So(u.Email, ShouldBeEmpty)
+		})
+
+		Convey("Failed documents are reported up to MaxErrors", func() {
+			in := strings.NewReader("{\"name\": \"x\"}\nnot json\n\n{\"_id\": 1}\n{\"_id\": 1}\n")
+			res, err := c.NewSession().SetCollection("other").Import(ctx, in, &pie.ImportOptions{MaxErrors: 2})
+			So(err, ShouldBeNil)
+			So(res.Inserted, ShouldEqual, 2)
+			So(res.Failed, ShouldEqual, 2)
+			So(res.Errors[0].Error(), ShouldStartWith, "line 2:")
+			So(res.Errors[1].Error(), ShouldStartWith, "line 5:")
+
+			in = strings.NewReader("not json\n{}\n")
+			res, err = c.NewSession().SetCollection("other").Import(ctx, in)
+			So(errors.Is(err, pie.ErrTooManyImportErrors), ShouldBeTrue)
+			So(res.Inserted, ShouldEqual, 0)
+		})
+
+		Convey("Export and Import need a collection", func() {
+			So(c.NewSession().Export(ctx, &bytes.Buffer{}, pie.ExportJSONLines), ShouldNotBeNil)
+		})
+	})
+}
+
+type article struct {
+	ID    primitive.ObjectID `bson:"_id,omitempty"`
+	Title string             `bson:"title"`
+	Body  string             `bson:"body"`
+	Score float64            `bson:"score,omitempty"`
+}
+
+func TestTextSearch(t *testing.T) {
+	Convey("Given articles with a weighted text index", t, func() {
+		c := NewClient("test")
+		_, err := c.InsertMany([]article{
+			{Title: "Coffee brewing", Body: "How to brew coffee at home"},
+			{Title: "Tea", Body: "Green tea and a little coffee"},
+			{Title: "Decaf coffee", Body: "Coffee without caffeine"},
+			{Title: "Café culture", Body: "Fair trade beans"},
+		})
+		So(err, ShouldBeNil)
+		_, err = c.AddTextIndex(map[string]int32{"title": 10, "body": 1}).CreateIndexes(&article{})
+		So(err, ShouldBeNil)
+
+		Convey("Results sort by relevance with the score projected", func() {
+			var found []article
+			err := c.Text("coffee -decaf", "", false, false).SortByScore().ProjectScore("score").FindAll(&found)
+			So(err, ShouldBeNil)
+			So(found, ShouldHaveLength, 2)
+			So(found[0].Title, ShouldEqual, "Coffee brewing")
+			So(found[0].Score, ShouldEqual, 11)
+			So(found[1].Title, ShouldEqual, "Tea")
+			So(found[1].Score, ShouldEqual, 1)
+		})
+
+		Convey("Phrases must appear and diacritics fold unless asked not to", func() {
+			n, err := c.Text(`"fair trade" cafe`, "", false, false).Count(&article{})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			n, err = c.Text("cafe", "", false, true).Count(&article{})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 0)
+		})
+
+		Convey("Strict sessions accept the score keys", func() {
+			var found []article
+			err := c.NewSession().Strict(true).Text("tea", "", false, false).SortByScore("-title").FindAll(&found)
+			So(err, ShouldBeNil)
+			So(found, ShouldHaveLength, 1)
+		})
+
+		Convey("Sorting by score needs a text search", func() {
+			var found []article
+			So(c.NewSession().SortByScore().FindAll(&found), ShouldNotBeNil)
+		})
+	})
+}
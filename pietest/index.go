@@ -0,0 +1,241 @@
+package pietest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/5xxxx/pie"
+	"github.com/5xxxx/pie/internal/mql"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// indexes records index definitions on the fake. Only the options that
+// change what a write accepts are honoured: unique, sparse and partial
+// filters, plus the fields and weights of text indexes, which $text searches.
+type indexes struct {
+	db      string
+	doc     any
+	engine  *Client
+	indexes []mongo.IndexModel
+}
+
+var _ pie.Indexes = (*indexes)(nil)
+
+func newIndexes(engine *Client) *indexes {
+	return &indexes{engine: engine}
+}
+
+func (i *indexes) CreateIndexes(doc any, ctx ...context.Context) ([]string, error) {
+	name, err := i.collectionName(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	specs := make([]indexSpec, 0, len(i.indexes))
+	for _, m := range i.indexes {
+		spec, err := indexSpecOf(m)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+
+	var created []string
+	err = i.engine.withCollection(i.db, name, func(c *collection) error {
+		for _, spec := range specs {
+			if err := c.addIndex(spec); err != nil {
+				return err
+			}
+			created = append(created, spec.name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (i *indexes) DropAll(doc any, ctx ...context.Context) error {
+	name, err := i.collectionName(doc)
+	if err != nil {
+		return err
+	}
+	return i.engine.withCollection(i.db, name, func(c *collection) error {
+		c.indexes = nil
+		return nil
+	})
+}
+
+func (i *indexes) DropOne(doc any, name string, ctx ...context.Context) error {
+	coll, err := i.collectionName(doc)
+	if err != nil {
+		return err
+	}
+	return i.engine.withCollection(i.db, coll, func(c *collection) error {
+		if name == idIndex.name {
+			return fmt.Errorf("cannot drop _id index")
+		}
+		for n, idx := range c.indexes {
+			if idx.name == name {
+				c.indexes = append(c.indexes[:n], c.indexes[n+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("index not found with name [%s]", name)
+	})
+}
+
+func (i *indexes) AddIndex(keys any, opt ...*options.IndexOptions) pie.Indexes {
+	i.indexes = append(i.indexes, mongo.IndexModel{
+		Keys:    keys,
+		Options: options.MergeIndexOptions(opt...),
+	})
+	return i
+}
+
+func (i *indexes) AddTextIndex(weights map[string]int32, opt ...*options.IndexOptions) pie.Indexes {
+	fields := make([]string, 0, len(weights))
+	for f := range weights {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	keys := make(bson.D, len(fields))
+	w := make(bson.D, len(fields))
+	for n, f := range fields {
+		keys[n] = bson.E{Key: f, Value: "text"}
+		w[n] = bson.E{Key: f, Value: weights[f]}
+	}
+	return i.AddIndex(keys, append(opt, options.Index().SetWeights(w))...)
+}
+
+func (i *indexes) AddIndex2dsphere(key string, opt ...*options.IndexOptions) pie.Indexes {
+	return i.AddIndex(bson.D{{Key: key, Value: "2dsphere"}}, opt...)
+}
+
+func (i *indexes) AddIndex2d(key string, opt ...*options.IndexOptions) pie.Indexes {
+	return i.AddIndex(bson.D{{Key: key, Value: "2d"}}, opt...)
+}
+
+func (i *indexes) SetMaxTime(d time.Duration) pie.Indexes {
+	return i
+}
+
+func (i *indexes) SetCommitQuorumInt(quorum int32) pie.Indexes {
+	return i
+}
+
+func (i *indexes) SetCommitQuorumString(quorum string) pie.Indexes {
+	return i
+}
+
+func (i *indexes) SetCommitQuorumMajority() pie.Indexes {
+	return i
+}
+
+func (i *indexes) SetCommitQuorumVotingMembers() pie.Indexes {
+	return i
+}
+
+func (i *indexes) SetDatabase(db string) pie.Indexes {
+	i.db = db
+	return i
+}
+
+func (i *indexes) Collection(doc any) pie.Indexes {
+	i.doc = doc
+	return i
+}
+
+func (i *indexes) collectionName(doc any) (string, error) {
+	if i.doc != nil {
+		doc = i.doc
+	}
+	coll, err := i.engine.CollectionNameForStruct(doc)
+	if err != nil {
+		return "", err
+	}
+	return coll.Name, nil
+}
+
+func indexSpecOf(m mongo.IndexModel) (indexSpec, error) {
+	keys, err := mql.NormalizeDoc(m.Keys)
+	if err != nil {
+		return indexSpec{}, fmt.Errorf("invalid index keys: %w", err)
+	}
+	if len(keys) == 0 {
+		return indexSpec{}, fmt.Errorf("index keys cannot be empty")
+	}
+
+	spec := indexSpec{keys: keys}
+	if m.Options != nil {
+		if m.Options.Name != nil {
+			spec.name = *m.Options.Name
+		}
+		spec.unique = isTrue(m.Options.Unique)
+		spec.sparse = isTrue(m.Options.Sparse)
+		if m.Options.Weights != nil {
+			if spec.weights, err = mql.NormalizeDoc(m.Options.Weights); err != nil {
+				return indexSpec{}, fmt.Errorf("invalid weights: %w", err)
+			}
+		}
+		if m.Options.PartialFilterExpression != nil {
+			if spec.partial, err = mql.NormalizeDoc(m.Options.PartialFilterExpression); err != nil {
+				return indexSpec{}, fmt.Errorf("invalid partial filter expression: %w", err)
+			}
+		}
+	}
+	if spec.name == "" {
+		parts := make([]string, 0, len(keys)*2)
+		for _, k := range keys {
+			parts = append(parts, k.Key, fmt.Sprint(k.Value))
+		}
+		spec.name = strings.Join(parts, "_")
+	}
+	return spec, nil
+}
+
+// addIndex registers spec, refusing it when the existing documents already
+// violate it or when an index of the same name has a different definition.
+func (c *collection) addIndex(spec indexSpec) error {
+	for _, idx := range c.allIndexes() {
+		if idx.name != spec.name {
+			continue
+		}
+		if sameIndex(idx, spec) {
+			return nil
+		}
+		return fmt.Errorf("index with name: %s already exists with different options", spec.name)
+	}
+
+	if spec.unique {
+		var seen []bson.A
+		for _, raw := range c.docs {
+			key, ok, err := spec.key(decode(raw))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			for _, other := range seen {
+				if mql.Equal(key, other) {
+					return duplicateKeyError(spec, key)
+				}
+			}
+			seen = append(seen, key)
+		}
+	}
+	c.indexes = append(c.indexes, spec)
+	return nil
+}
+
+func sameIndex(a, b indexSpec) bool {
+	return a.unique == b.unique && a.sparse == b.sparse &&
+		mql.Equal(a.keys, b.keys) && mql.Equal(a.partial, b.partial) && mql.Equal(a.weights, b.weights)
+}
@@ -0,0 +1,387 @@
+package pietest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/5xxxx/pie/internal/mql"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// findSpec is the part of a find command the fake understands once the
+// driver options of a session have been merged.
+type findSpec struct {
+	sort       any
+	skip       int64
+	limit      int64
+	projection any
+}
+
+// find runs filter against the collection and applies sort, skip, limit and projection.
+func (c *collection) find(filter bson.D, spec findSpec) ([]int, []bson.D, error) {
+	positions, docs, scores, err := c.matchScored(filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = sortDocs(positions, docs, scores, spec.sort); err != nil {
+		return nil, nil, err
+	}
+
+	skip, limit := spec.skip, spec.limit
+	if limit < 0 {
+		limit = -limit
+	}
+	if skip >= int64(len(docs)) {
+		return nil, nil, nil
+	}
+	if skip > 0 {
+		positions, docs = positions[skip:], docs[skip:]
+		if scores != nil {
+			scores = scores[skip:]
+		}
+	}
+	if limit > 0 && limit < int64(len(docs)) {
+		positions, docs = positions[:limit], docs[:limit]
+	}
+
+	if spec.projection != nil {
+		for i, d := range docs {
+			var score any
+			if scores != nil {
+				score = scores[i]
+			}
+			if docs[i], err = project(d, spec.projection, score); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return positions, docs, nil
+}
+
+// sortDocs orders docs, and positions and scores alongside them, by the sort
+// specification. scores are the text scores of a $text search, or nil.
+func sortDocs(positions []int, docs []bson.D, scores []float64, spec any) error {
+	if spec == nil {
+		return nil
+	}
+	keys, err := mql.NormalizeDoc(spec)
+	if err != nil {
+		return fmt.Errorf("invalid sort specification: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	dirs := make([]int, len(keys))
+	for i, k := range keys {
+		if isTextScore(k.Value) {
+			if scores == nil {
+				return errNoTextScore
+			}
+			// Scores sort best first.
+			dirs[i] = -1
+			continue
+		}
+		f, ok := mql.Float(k.Value)
+		if !ok || (f != 1 && f != -1) {
+			return fmt.Errorf("invalid sort order %v for %s", k.Value, k.Key)
+		}
+		dirs[i] = int(f)
+	}
+
+	idx := make([]int, len(docs))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		for i, k := range keys {
+			var x, y any
+			if isTextScore(k.Value) {
+				x, y = scores[idx[a]], scores[idx[b]]
+			} else {
+				x = sortKey(docs[idx[a]], k.Key, dirs[i])
+				y = sortKey(docs[idx[b]], k.Key, dirs[i])
+			}
+			if c := mql.Compare(x, y) * dirs[i]; c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+
+	sortedPos := make([]int, len(idx))
+	sortedDocs := make([]bson.D, len(idx))
+	var sortedScores []float64
+	if scores != nil {
+		sortedScores = make([]float64, len(idx))
+	}
+	for i, j := range idx {
+		sortedPos[i], sortedDocs[i] = positions[j], docs[j]
+		if scores != nil {
+			sortedScores[i] = scores[j]
+		}
+	}
+	copy(positions, sortedPos)
+	copy(docs, sortedDocs)
+	copy(scores, sortedScores)
+	return nil
+}
+
+// sortKey picks the value a document sorts by: arrays sort by their smallest
+// element in ascending order and by their largest in descending order.
+func sortKey(doc bson.D, path string, dir int) any {
+	var values []any
+	for _, v := range mql.Lookup(doc, path) {
+		if a, ok := v.(bson.A); ok && len(a) > 0 {
+			values = append(values, a...)
+			continue
+		}
+		values = append(values, v)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	best := values[0]
+	for _, v := range values[1:] {
+		if mql.Compare(v, best)*dir < 0 {
+			best = v
+		}
+	}
+	return best
+}
+
+var errNoTextScore = errors.New("query requires text score metadata, but it is not available")
+
+// project applies an inclusion or exclusion projection to doc. score is the
+// text score {$meta: "textScore"} fields are set to, or nil without a $text search.
+func project(doc bson.D, projection any, score any) (bson.D, error) {
+	spec, err := mql.NormalizeDoc(projection)
+	if err != nil {
+		return nil, fmt.Errorf("invalid projection: %w", err)
+	}
+	var meta bson.D
+	for i := 0; i < len(spec); i++ {
+		if isTextScore(spec[i].Value) {
+			if score == nil {
+				return nil, errNoTextScore
+			}
+			meta = append(meta, bson.E{Key: spec[i].Key, Value: score})
+			spec = append(spec[:i:i], spec[i+1:]...)
+			i--
+		}
+	}
+	if len(spec) == 0 {
+		return append(append(bson.D{}, doc...), meta...), nil
+	}
+	out, err := projectFields(doc, spec)
+	if err != nil {
+		return nil, err
+	}
+	return append(out, meta...), nil
+}
+
+func projectFields(doc bson.D, spec bson.D) (bson.D, error) {
+	keepID := true
+	var include, exclude []string
+	var slices, matches bson.D
+	for _, e := range spec {
+		if strings.HasPrefix(e.Key, "$") {
+			return nil, fmt.Errorf("unsupported projection operator %s", e.Key)
+		}
+		if mql.IsOperatorDoc(e.Value) {
+			op := e.Value.(bson.D)[0]
+			switch {
+			case op.Key == "$slice":
+				slices = append(slices, bson.E{Key: e.Key, Value: op.Value})
+			case op.Key == "$elemMatch" && !strings.Contains(e.Key, "."):
+				matches = append(matches, bson.E{Key: e.Key, Value: op.Value})
+				include = append(include, e.Key)
+			default:
+				return nil, fmt.Errorf("unsupported projection operator for %s", e.Key)
+			}
+			continue
+		}
+		on := projectionFlag(e.Value)
+		if e.Key == "_id" {
+			keepID = on
+			continue
+		}
+		if on {
+			include = append(include, e.Key)
+		} else {
+			exclude = append(exclude, e.Key)
+		}
+	}
+	if len(include) > 0 && len(exclude) > 0 {
+		return nil, errors.New("cannot mix inclusion and exclusion in a projection")
+	}
+
+	var out bson.D
+	if len(include) > 0 {
+		for _, e := range slices {
+			include = append(include, e.Key)
+		}
+		out = includeFields(doc, splitPaths(include))
+	} else {
+		out = excludeFields(doc, splitPaths(exclude))
+	}
+	out, err := projectArrays(out, slices, matches)
+	if err != nil {
+		return nil, err
+	}
+
+	if !keepID {
+		return excludeFields(out, [][]string{{"_id"}}), nil
+	}
+	if len(include) > 0 {
+		if id, ok := mql.Get(doc, "_id"); ok {
+			if _, has := mql.Get(out, "_id"); !has {
+				out = append(bson.D{{Key: "_id", Value: id}}, out...)
+			}
+		}
+	}
+	return out, nil
+}
+
+// projectArrays applies the $slice and $elemMatch projections to doc.
+func projectArrays(doc bson.D, slices, matches bson.D) (bson.D, error) {
+	var err error
+	for _, e := range matches {
+		cond := bson.D{{Key: "$elemMatch", Value: e.Value}}
+		doc, err = modifyDoc(doc, e.Key, false, func(old any, exists bool) (any, bool, error) {
+			arr, ok := old.(bson.A)
+			if !ok {
+				return old, true, nil
+			}
+			for _, el := range arr {
+				ok, err := mql.MatchValues([]any{bson.A{el}}, cond)
+				if err != nil || ok {
+					return bson.A{el}, true, err
+				}
+			}
+			return nil, false, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range slices {
+		arg := e.Value
+		doc, err = modifyDoc(doc, e.Key, false, func(old any, exists bool) (any, bool, error) {
+			arr, ok := old.(bson.A)
+			if !ok {
+				return old, true, nil
+			}
+			args := bson.A{bson.D{{Key: "$literal", Value: arr}}}
+			if a, ok := arg.(bson.A); ok {
+				args = append(args, a...)
+			} else {
+				args = append(args, arg)
+			}
+			v, err := mql.Eval(bson.D{{Key: "$slice", Value: args}}, nil)
+			return v, true, err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+func projectionFlag(v any) bool {
+	switch x := v.(type) {
+	case bool:
+		return x
+	}
+	if f, ok := mql.Float(v); ok {
+		return f != 0
+	}
+	return true
+}
+
+func splitPaths(paths []string) [][]string {
+	out := make([][]string, len(paths))
+	for i, p := range paths {
+		out[i] = strings.Split(p, ".")
+	}
+	return out
+}
+
+// childPaths returns the remainders of the paths whose first component is key.
+// whole is true when one of them ends at key.
+func childPaths(paths [][]string, key string) (rest [][]string, whole bool) {
+	for _, p := range paths {
+		if p[0] != key {
+			continue
+		}
+		if len(p) == 1 {
+			whole = true
+			continue
+		}
+		rest = append(rest, p[1:])
+	}
+	return rest, whole
+}
+
+func includeFields(doc bson.D, paths [][]string) bson.D {
+	out := bson.D{}
+	for _, e := range doc {
+		rest, whole := childPaths(paths, e.Key)
+		switch {
+		case whole:
+			out = append(out, e)
+		case len(rest) > 0:
+			if v, ok := includeValue(e.Value, rest); ok {
+				out = append(out, bson.E{Key: e.Key, Value: v})
+			}
+		}
+	}
+	return out
+}
+
+func includeValue(v any, paths [][]string) (any, bool) {
+	switch x := v.(type) {
+	case bson.D:
+		return includeFields(x, paths), true
+	case bson.A:
+		out := bson.A{}
+		for _, elem := range x {
+			if sub, ok := elem.(bson.D); ok {
+				out = append(out, includeFields(sub, paths))
+			}
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+func excludeFields(doc bson.D, paths [][]string) bson.D {
+	out := bson.D{}
+	for _, e := range doc {
+		rest, whole := childPaths(paths, e.Key)
+		switch {
+		case whole:
+		case len(rest) > 0:
+			out = append(out, bson.E{Key: e.Key, Value: excludeValue(e.Value, rest)})
+		default:
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func excludeValue(v any, paths [][]string) any {
+	switch x := v.(type) {
+	case bson.D:
+		return excludeFields(x, paths)
+	case bson.A:
+		out := make(bson.A, len(x))
+		for i, elem := range x {
+			out[i] = excludeValue(elem, paths)
+		}
+		return out
+	}
+	return v
+}
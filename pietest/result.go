@@ -0,0 +1,38 @@
+package pietest
+
+import (
+	"reflect"
+	"unsafe"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The driver has no public constructor for SingleResult, so the fake fills
+// the unexported fields the same way a real collection would.
+
+func singleResult(doc bson.D, reg *bsoncodec.Registry) *mongo.SingleResult {
+	if doc == nil {
+		return &mongo.SingleResult{}
+	}
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return singleError(err)
+	}
+	sr := &mongo.SingleResult{}
+	setField(sr, "rdr", bson.Raw(raw))
+	setField(sr, "reg", reg)
+	return sr
+}
+
+func singleError(err error) *mongo.SingleResult {
+	sr := &mongo.SingleResult{}
+	setField(sr, "err", err)
+	return sr
+}
+
+func setField(sr *mongo.SingleResult, name string, value any) {
+	field := reflect.ValueOf(sr).Elem().FieldByName(name)
+	reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().Set(reflect.ValueOf(value))
+}
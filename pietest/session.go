@@ -0,0 +1,1460 @@
+package pietest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/5xxxx/pie"
+	"github.com/5xxxx/pie/geo"
+	"github.com/5xxxx/pie/internal/docio"
+	"github.com/5xxxx/pie/internal/mql"
+	"github.com/5xxxx/pie/internal/populate"
+	"github.com/5xxxx/pie/schemas"
+	"github.com/5xxxx/pie/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// session is the in-memory counterpart of pie's session. It collects the
+// same driver options and interprets them when an operation runs.
+type session struct {
+	db                    string
+	engine                *Client
+	filter                pie.Condition
+	findOneOptions        []*options.FindOneOptions
+	findOptions           []*options.FindOptions
+	insertManyOpts        []*options.InsertManyOptions
+	insertOneOpts         []*options.InsertOneOptions
+	deleteOpts            []*options.DeleteOptions
+	updateOpts            []*options.UpdateOptions
+	countOpts             []*options.CountOptions
+	distinctOpts          []*options.DistinctOptions
+	findOneAndDeleteOpts  []*options.FindOneAndDeleteOptions
+	findOneAndReplaceOpts []*options.FindOneAndReplaceOptions
+	findOneAndUpdateOpts  []*options.FindOneAndUpdateOptions
+	replaceOpts           []*options.ReplaceOptions
+	bulkWriteOptions      []*options.BulkWriteOptions
+	collOpts              []*options.CollectionOptions
+	strict                bool
+	collection            string
+	populates             []string
+	ids                   []any
+	selected              bool
+}
+
+var _ pie.Session = (*session)(nil)
+
+func newSession(engine *Client) *session {
+	return &session{engine: engine, filter: pie.DefaultCondition()}
+}
+
+func (s *session) FindPagination(needCount bool, rowsSlicePtr any, ctx ...context.Context) (int64, error) {
+	name, err := s.collectionForSlice(rowsSlicePtr)
+	if err != nil {
+		return 0, err
+	}
+	filter, err := s.filters()
+	if err != nil {
+		return 0, err
+	}
+	opts := options.MergeFindOptions(s.findOptions...)
+
+	var docs []bson.D
+	var rowCount int64
+	err = s.with(name, func(c *collection) error {
+		_, docs, err = c.find(filter, findSpecOf(opts))
+		if err != nil || !needCount {
+			return err
+		}
+		rowCount, err = c.count(filter, options.MergeCountOptions(s.countOpts...))
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err = s.decodeAll(docs, rowsSlicePtr); err != nil {
+		return 0, err
+	}
+	return rowCount, s.populate(rowsSlicePtr)
+}
+
+func (s *session) BulkWrite(docs any, ctx ...context.Context) (*mongo.BulkWriteResult, error) {
+	name, err := s.collectionForSlice(docs)
+	if err != nil {
+		return nil, err
+	}
+	ordered := true
+	if o := options.MergeBulkWriteOptions(s.bulkWriteOptions...); o.Ordered != nil {
+		ordered = *o.Ordered
+	}
+
+	result := &mongo.BulkWriteResult{UpsertedIDs: map[int64]any{}}
+	_, err = s.insert(name, docs, ordered, func(int, any) { result.InsertedCount++ })
+	return result, err
+}
+
+func (s *session) FilterBy(object any) pie.Session {
+	s.filter.FilterBy(object)
+	return s
+}
+
+func (s *session) Distinct(doc any, columns string, ctx ...context.Context) ([]any, error) {
+	name, err := s.collectionForSlice(doc)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := s.filters()
+	if err != nil {
+		return nil, err
+	}
+
+	values := []any{}
+	err = s.with(name, func(c *collection) error {
+		_, docs, err := c.match(filter)
+		for _, d := range docs {
+			for _, v := range mql.Lookup(d, columns) {
+				items := []any{v}
+				if a, ok := v.(bson.A); ok {
+					items = a
+				}
+				for _, item := range items {
+					if !containsValue(values, item) {
+						values = append(values, item)
+					}
+				}
+			}
+		}
+		return err
+	})
+	return values, err
+}
+
+func (s *session) ReplaceOne(doc any, ctx ...context.Context) (*mongo.UpdateResult, error) {
+	name, err := s.collectionForStruct(doc)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := s.replaceFilters(doc)
+	if err != nil {
+		return nil, err
+	}
+	replacement, err := s.encode(doc)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.MergeReplaceOptions(s.replaceOpts...)
+
+	return s.update(name, filter, false, isTrue(opts.Upsert), func(old bson.D, _ bool) (bson.D, error) {
+		return applyReplacement(old, replacement)
+	})
+}
+
+func (s *session) FindOneAndReplace(doc any, ctx ...context.Context) error {
+	name, err := s.collectionForStruct(doc)
+	if err != nil {
+		return err
+	}
+	filter, err := s.replaceFilters(doc)
+	if err != nil {
+		return err
+	}
+	replacement, err := s.encode(doc)
+	if err != nil {
+		return err
+	}
+	opts := options.MergeFindOneAndReplaceOptions(s.findOneAndReplaceOpts...)
+
+	found, err := s.findAndModify(name, filter, modifySpec{
+		sort:       opts.Sort,
+		projection: opts.Projection,
+		upsert:     isTrue(opts.Upsert),
+		returnNew:  opts.ReturnDocument != nil && *opts.ReturnDocument == options.After,
+		apply: func(old bson.D, _ bool) (bson.D, error) {
+			return applyReplacement(old, replacement)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return singleResult(found, s.registry()).Decode(doc)
+}
+
+func (s *session) FindOneAndUpdate(doc any, ctx ...context.Context) (*mongo.SingleResult, error) {
+	name, err := s.collectionForStruct(doc)
+	if err != nil {
+		return nil, err
+	}
+	return s.findOneAndUpdate(name, bson.M{"$set": doc})
+}
+
+func (s *session) FindOneAndUpdateBson(coll any, bson any, ctx ...context.Context) (*mongo.SingleResult, error) {
+	name, err := s.collectionForStruct(coll)
+	if err != nil {
+		return nil, err
+	}
+	return s.findOneAndUpdate(name, bson)
+}
+
+func (s *session) findOneAndUpdate(name string, update any) (*mongo.SingleResult, error) {
+	filter, err := s.filters()
+	if err != nil {
+		return nil, err
+	}
+	opts := options.MergeFindOneAndUpdateOptions(s.findOneAndUpdateOpts...)
+	if opts.ArrayFilters != nil {
+		return nil, errArrayFilters
+	}
+	u, err := s.encode(update)
+	if err != nil {
+		return singleError(err), nil
+	}
+
+	found, err := s.findAndModify(name, filter, modifySpec{
+		sort:       opts.Sort,
+		projection: opts.Projection,
+		upsert:     isTrue(opts.Upsert),
+		returnNew:  opts.ReturnDocument != nil && *opts.ReturnDocument == options.After,
+		apply: func(old bson.D, inserting bool) (bson.D, error) {
+			return applyUpdate(old, u, inserting)
+		},
+	})
+	if err != nil {
+		return singleError(err), nil
+	}
+	return singleResult(found, s.registry()), nil
+}
+
+func (s *session) FindAndDelete(doc any, ctx ...context.Context) error {
+	name, err := s.collectionForStruct(doc)
+	if err != nil {
+		return err
+	}
+	filter, err := s.filters()
+	if err != nil {
+		return err
+	}
+	opts := options.MergeFindOneAndDeleteOptions(s.findOneAndDeleteOpts...)
+
+	found, err := s.findAndModify(name, filter, modifySpec{
+		sort:       opts.Sort,
+		projection: opts.Projection,
+		remove:     true,
+	})
+	if err != nil {
+		return err
+	}
+	return singleResult(found, s.registry()).Decode(doc)
+}
+
+func (s *session) FindOne(doc any, ctx ...context.Context) error {
+	name, err := s.collectionForStruct(doc)
+	if err != nil {
+		return err
+	}
+	filter, err := s.filters()
+	if err != nil {
+		return err
+	}
+	opts := options.MergeFindOneOptions(s.findOneOptions...)
+	spec := findSpec{sort: opts.Sort, projection: opts.Projection, limit: 1}
+	if opts.Skip != nil {
+		spec.skip = *opts.Skip
+	}
+
+	var docs []bson.D
+	err = s.with(name, func(c *collection) error {
+		_, docs, err = c.find(filter, spec)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return mongo.ErrNoDocuments
+	}
+	if err = s.decode(docs[0], doc); err != nil {
+		return err
+	}
+	return s.populate(doc)
+}
+
+func (s *session) FindAll(rowsSlicePtr any, ctx ...context.Context) error {
+	name, err := s.collectionForSlice(rowsSlicePtr)
+	if err != nil {
+		return err
+	}
+	filter, err := s.filters()
+	if err != nil {
+		return err
+	}
+	opts := options.MergeFindOptions(s.findOptions...)
+
+	var docs []bson.D
+	err = s.with(name, func(c *collection) error {
+		_, docs, err = c.find(filter, findSpecOf(opts))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err = s.decodeAll(docs, rowsSlicePtr); err != nil {
+		return err
+	}
+	return s.populate(rowsSlicePtr)
+}
+
+func (s *session) InsertOne(doc any, ctx ...context.Context) (any, error) {
+	name, err := s.collectionForStruct(doc)
+	if err != nil {
+		return nil, err
+	}
+	doc, typed, err := s.engine.ids.Assign(doc)
+	if err != nil {
+		return nil, err
+	}
+	d, err := s.encode(doc)
+	if err != nil {
+		return nil, err
+	}
+	d, id := ensureID(d)
+	if err = s.with(name, func(c *collection) error { return c.insert(d) }); err != nil {
+		return nil, err
+	}
+	if typed != nil {
+		return typed, nil
+	}
+	return id, nil
+}
+
+func (s *session) InsertMany(docs any, ctx ...context.Context) (*mongo.InsertManyResult, error) {
+	name, err := s.collectionForSlice(docs)
+	if err != nil {
+		return nil, err
+	}
+	ordered := true
+	if o := options.MergeInsertManyOptions(s.insertManyOpts...); o.Ordered != nil {
+		ordered = *o.Ordered
+	}
+
+	result := &mongo.InsertManyResult{}
+	_, err = s.insert(name, docs, ordered, func(_ int, id any) {
+		result.InsertedIDs = append(result.InsertedIDs, id)
+	})
+	return result, err
+}
+
+// insert stores every element of the slice docs. inserted is called for each
+// document that made it into the collection.
+func (s *session) insert(name string, docs any, ordered bool, inserted func(int, any)) (int, error) {
+	values := reflect.ValueOf(docs)
+	if values.Kind() == reflect.Ptr {
+		values = values.Elem()
+	}
+	prepared := make([]bson.D, 0, values.Len())
+	for i := 0; i < values.Len(); i++ {
+		value := values.Index(i)
+		if value.Kind() == reflect.Struct && value.CanAddr() {
+			value = value.Addr()
+		}
+		doc, _, err := s.engine.ids.Assign(value.Interface())
+		if err != nil {
+			return 0, err
+		}
+		d, err := s.encode(doc)
+		if err != nil {
+			return 0, err
+		}
+		d, _ = ensureID(d)
+		prepared = append(prepared, d)
+	}
+
+	count := 0
+	var firstErr error
+	err := s.with(name, func(c *collection) error {
+		for i, d := range prepared {
+			if err := c.insert(d); err != nil {
+				if ordered {
+					return err
+				}
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			id, _ := mql.Get(d, "_id")
+			inserted(i, id)
+			count++
+		}
+		return nil
+	})
+	if err == nil {
+		err = firstErr
+	}
+	return count, err
+}
+
+func (s *session) DeleteOne(doc any, ctx ...context.Context) (*mongo.DeleteResult, error) {
+	return s.delete(doc, true)
+}
+
+func (s *session) DeleteMany(doc any, ctx ...context.Context) (*mongo.DeleteResult, error) {
+	return s.delete(doc, false)
+}
+
+func (s *session) delete(doc any, one bool) (*mongo.DeleteResult, error) {
+	name, err := s.collectionForStruct(doc)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := s.filters()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &mongo.DeleteResult{}
+	err = s.with(name, func(c *collection) error {
+		positions, _, err := c.match(filter)
+		if err != nil {
+			return err
+		}
+		if one && len(positions) > 1 {
+			positions = positions[:1]
+		}
+		c.remove(positions)
+		result.DeletedCount = int64(len(positions))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *session) SoftDeleteOne(doc any, ctx ...context.Context) error {
+	return s.softDelete(doc, false)
+}
+
+func (s *session) SoftDeleteMany(doc any, ctx ...context.Context) error {
+	return s.softDelete(doc, true)
+}
+
+func (s *session) softDelete(doc any, many bool) error {
+	name, err := s.collectionForStruct(doc)
+	if err != nil {
+		return err
+	}
+	filter, err := s.filters()
+	if err != nil {
+		return err
+	}
+	u := bson.D{{Key: "$set", Value: bson.D{{Key: "deleted_at", Value: primitive.NewDateTimeFromTime(time.Now())}}}}
+	_, err = s.update(name, filter, many, false, func(old bson.D, inserting bool) (bson.D, error) {
+		return applyUpdate(old, u, inserting)
+	})
+	return err
+}
+
+func (s *session) Clone() pie.Session {
+	sess := *s
+	sess.filter = s.filter.Clone()
+	sess.ids = append([]any(nil), s.ids...)
+	return &sess
+}
+
+func (s *session) Strict(strict bool) pie.Session {
+	s.strict = strict
+	return s
+}
+
+func (s *session) Limit(i int64) pie.Session {
+	s.findOptions = append(s.findOptions, options.Find().SetLimit(i))
+	return s
+}
+
+func (s *session) Skip(i int64) pie.Session {
+	s.findOptions = append(s.findOptions, options.Find().SetSkip(i))
+	s.findOneOptions = append(s.findOneOptions, options.FindOne().SetSkip(i))
+	return s
+}
+
+func (s *session) Select(dto any) pie.Session {
+	s.selected = true
+	return s.Project(pie.ProjectionOf(dto))
+}
+
+func (s *session) Populate(paths ...string) pie.Session {
+	s.populates = append(s.populates, paths...)
+	return s
+}
+
+// populate loads the relations named with Populate into result from the
+// collections of the referenced models.
+func (s *session) populate(result any) error {
+	return populate.Run(context.Background(), result, s.populates, s.registry(), func(_ context.Context, t reflect.Type, filter bson.D, results any) error {
+		coll, err := s.engine.CollectionNameForStruct(reflect.New(t).Interface())
+		if err != nil {
+			return err
+		}
+		normalized, err := mql.NormalizeDoc(filter)
+		if err != nil {
+			return err
+		}
+		var docs []bson.D
+		err = s.with(coll.Name, func(c *collection) error {
+			_, docs, err = c.find(normalized, findSpec{})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return s.decodeAll(docs, results)
+	})
+}
+
+func (s *session) Project(i any) pie.Session {
+	s.findOptions = append(s.findOptions, options.Find().SetProjection(i))
+	s.findOneOptions = append(s.findOneOptions, options.FindOne().SetProjection(i))
+	s.findOneAndDeleteOpts = append(s.findOneAndDeleteOpts, options.FindOneAndDelete().SetProjection(i))
+	return s
+}
+
+func (s *session) Count(i any, ctx ...context.Context) (int64, error) {
+	kind := reflect.TypeOf(i).Kind()
+	if kind == reflect.Ptr {
+		kind = reflect.TypeOf(reflect.Indirect(reflect.ValueOf(i)).Interface()).Kind()
+	}
+	var name string
+	var err error
+	switch kind {
+	case reflect.Slice:
+		name, err = s.collectionForSlice(i)
+	case reflect.Struct:
+		name, err = s.collectionForStruct(i)
+	default:
+		return 0, errors.New("need slice or struct")
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	filter, err := s.filters()
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	err = s.with(name, func(c *collection) error {
+		n, err = c.count(filter, options.MergeCountOptions(s.countOpts...))
+		return err
+	})
+	return n, err
+}
+
+func (s *session) UpdateOne(bean any, ctx ...context.Context) (*mongo.UpdateResult, error) {
+	name, err := s.collectionForStruct(bean)
+	if err != nil {
+		return nil, err
+	}
+	if utils.IsStructZero(reflect.ValueOf(bean).Elem()) {
+		return nil, nil
+	}
+	return s.updateWith(name, bson.M{"$set": bean}, false)
+}
+
+func (s *session) UpdateOneBson(coll any, bson any, ctx ...context.Context) (*mongo.UpdateResult, error) {
+	name, err := s.collectionForStruct(coll)
+	if err != nil {
+		return nil, err
+	}
+	return s.updateWith(name, bson, false)
+}
+
+func (s *session) UpdateManyBson(coll any, bson any, ctx ...context.Context) (*mongo.UpdateResult, error) {
+	name, err := s.collectionForStruct(coll)
+	if err != nil {
+		return nil, err
+	}
+	return s.updateWith(name, bson, true)
+}
+
+func (s *session) UpdateMany(bean any, ctx ...context.Context) (*mongo.UpdateResult, error) {
+	name, err := s.collectionForSlice(bean)
+	if err != nil {
+		return nil, err
+	}
+	return s.updateWith(name, bson.M{"$set": bean}, true)
+}
+
+func (s *session) updateWith(name string, update any, many bool) (*mongo.UpdateResult, error) {
+	filter, err := s.filters()
+	if err != nil {
+		return nil, err
+	}
+	opts := options.MergeUpdateOptions(s.updateOpts...)
+	if opts.ArrayFilters != nil {
+		return nil, errArrayFilters
+	}
+	u, err := s.encode(update)
+	if err != nil {
+		return nil, err
+	}
+	return s.update(name, filter, many, isTrue(opts.Upsert), func(old bson.D, inserting bool) (bson.D, error) {
+		return applyUpdate(old, u, inserting)
+	})
+}
+
+func (s *session) RegexFilter(key, pattern string) pie.Session {
+	s.filter.RegexFilter(key, pattern)
+	return s
+}
+
+func (s *session) ID(id any) pie.Session {
+	s.ids = append(s.ids, id)
+	return s
+}
+
+// resolveIDs adds the filters of the ids given to ID for model type t, as
+// pie does once the model is known.
+func (s *session) resolveIDs(t reflect.Type) error {
+	for _, id := range s.ids {
+		if t == nil {
+			s.filter.ID(id)
+			continue
+		}
+		d, err := pie.IDFilter(t, id, s.registry())
+		if err != nil {
+			return err
+		}
+		s.filter.FilterBson(d)
+	}
+	s.ids = nil
+	return nil
+}
+
+func (s *session) Asc(colNames ...string) pie.Session {
+	if len(colNames) == 0 {
+		return s
+	}
+	es := bson.M{}
+	for _, c := range colNames {
+		es[c] = 1
+	}
+	s.findOneOptions = append(s.findOneOptions, options.FindOne().SetSort(es))
+	s.findOptions = append(s.findOptions, options.Find().SetSort(es))
+	return s
+}
+
+func (s *session) Desc(colNames ...string) pie.Session {
+	if len(colNames) == 0 {
+		return s
+	}
+	es := bson.M{}
+	for _, c := range colNames {
+		es[c] = -1
+	}
+	s.findOptions = append(s.findOptions, options.Find().SetSort(es))
+	s.findOneOptions = append(s.findOneOptions, options.FindOne().SetSort(es))
+	return s
+}
+
+func (s *session) Sort(colNames ...string) pie.Session {
+	if len(colNames) == 0 {
+		return s
+	}
+	es := sortFields(bson.D{}, colNames)
+	s.findOptions = append(s.findOptions, options.Find().SetSort(es))
+	s.findOneOptions = append(s.findOneOptions, options.FindOne().SetSort(es))
+	return s
+}
+
+func sortFields(es bson.D, colNames []string) bson.D {
+	for _, field := range colNames {
+		if field != "" {
+			switch field[0] {
+			case '-':
+				es = append(es, bson.E{Key: field[1:], Value: -1})
+			default:
+				es = append(es, bson.E{Key: field, Value: 1})
+			}
+		}
+	}
+	return es
+}
+
+func (s *session) Soft(f bool) pie.Session {
+	s.filter.Exists("deleted_at", f)
+	return s
+}
+
+func (s *session) Filter(key string, value any) pie.Session {
+	return s.Eq(key, value)
+}
+
+func (s *session) FilterBson(d bson.D) pie.Session {
+	s.filter.FilterBson(d)
+	return s
+}
+
+func (s *session) Eq(key string, value any) pie.Session {
+	s.filter.Eq(key, value)
+	return s
+}
+
+func (s *session) Gt(key string, gt any) pie.Session {
+	s.filter.Gt(key, gt)
+	return s
+}
+
+func (s *session) Gte(key string, gte any) pie.Session {
+	s.filter.Gte(key, gte)
+	return s
+}
+
+func (s *session) In(key string, in any) pie.Session {
+	s.filter.In(key, in)
+	return s
+}
+
+func (s *session) Lt(key string, lt any) pie.Session {
+	s.filter.Lt(key, lt)
+	return s
+}
+
+func (s *session) Lte(key string, lte any) pie.Session {
+	s.filter.Lte(key, lte)
+	return s
+}
+
+func (s *session) Ne(key string, ne any) pie.Session {
+	s.filter.Ne(key, ne)
+	return s
+}
+
+func (s *session) Nin(key string, nin any) pie.Session {
+	s.filter.Nin(key, nin)
+	return s
+}
+
+func (s *session) And(c ...pie.Condition) pie.Session {
+	s.filter.And(c...)
+	return s
+}
+
+func (s *session) Not(key string, not any) pie.Session {
+	s.filter.Not(key, not)
+	return s
+}
+
+func (s *session) Nor(c ...pie.Condition) pie.Session {
+	s.filter.Nor(c...)
+	return s
+}
+
+func (s *session) Or(c ...pie.Condition) pie.Session {
+	s.filter.Or(c...)
+	return s
+}
+
+func (s *session) Exists(key string, exists bool, filter ...pie.Condition) pie.Session {
+	s.filter.Exists(key, exists, filter...)
+	return s
+}
+
+func (s *session) ElemMatch(key string, c pie.Condition) pie.Session {
+	s.filter.ElemMatch(key, c)
+	return s
+}
+
+func (s *session) All(key string, values any) pie.Session {
+	s.filter.All(key, values)
+	return s
+}
+
+func (s *session) Size(key string, n int) pie.Session {
+	s.filter.Size(key, n)
+	return s
+}
+
+func (s *session) Mod(key string, divisor, remainder int64) pie.Session {
+	s.filter.Mod(key, divisor, remainder)
+	return s
+}
+
+func (s *session) BitsAllSet(key string, bits any) pie.Session {
+	s.filter.BitsAllSet(key, bits)
+	return s
+}
+
+func (s *session) BitsAnySet(key string, bits any) pie.Session {
+	s.filter.BitsAnySet(key, bits)
+	return s
+}
+
+func (s *session) BitsAllClear(key string, bits any) pie.Session {
+	s.filter.BitsAllClear(key, bits)
+	return s
+}
+
+func (s *session) BitsAnyClear(key string, bits any) pie.Session {
+	s.filter.BitsAnyClear(key, bits)
+	return s
+}
+
+func (s *session) JSONSchema(schema any) pie.Session {
+	s.filter.JSONSchema(schema)
+	return s
+}
+
+func (s *session) Comment(comment string) pie.Session {
+	s.filter.Comment(comment)
+	return s
+}
+
+func (s *session) SetArrayFilters(filters options.ArrayFilters) pie.Session {
+	s.findOneAndUpdateOpts = append(s.findOneAndUpdateOpts,
+		options.FindOneAndUpdate().SetArrayFilters(filters))
+	s.updateOpts = append(s.updateOpts, options.Update().SetArrayFilters(filters))
+	return s
+}
+
+func (s *session) SetOrdered(ordered bool) pie.Session {
+	s.bulkWriteOptions = append(s.bulkWriteOptions, options.BulkWrite().SetOrdered(ordered))
+	return s
+}
+
+func (s *session) SetBypassDocumentValidation(b bool) pie.Session {
+	s.bulkWriteOptions = append(s.bulkWriteOptions, options.BulkWrite().SetBypassDocumentValidation(b))
+	s.findOneAndReplaceOpts = append(s.findOneAndReplaceOpts,
+		options.FindOneAndReplace().SetBypassDocumentValidation(b))
+	s.findOneAndUpdateOpts = append(s.findOneAndUpdateOpts, options.FindOneAndUpdate().SetBypassDocumentValidation(b))
+	s.updateOpts = append(s.updateOpts, options.Update().SetBypassDocumentValidation(b))
+	return s
+}
+
+func (s *session) SetReturnDocument(rd options.ReturnDocument) pie.Session {
+	s.findOneAndUpdateOpts = append(s.findOneAndUpdateOpts,
+		options.FindOneAndUpdate().SetReturnDocument(rd))
+	s.findOneAndReplaceOpts = append(s.findOneAndReplaceOpts,
+		options.FindOneAndReplace().SetReturnDocument(rd))
+	return s
+}
+
+func (s *session) SetUpsert(b bool) pie.Session {
+	s.findOneAndUpdateOpts = append(s.findOneAndUpdateOpts,
+		options.FindOneAndUpdate().SetUpsert(b))
+	s.findOneAndReplaceOpts = append(s.findOneAndReplaceOpts,
+		options.FindOneAndReplace().SetUpsert(b))
+	s.updateOpts = append(s.updateOpts, options.Update().SetUpsert(b))
+	s.replaceOpts = append(s.replaceOpts, options.Replace().SetUpsert(b))
+	return s
+}
+
+func (s *session) SetCollation(collation *options.Collation) pie.Session {
+	s.findOneAndUpdateOpts = append(s.findOneAndUpdateOpts,
+		options.FindOneAndUpdate().SetCollation(collation))
+	s.findOneAndReplaceOpts = append(s.findOneAndReplaceOpts,
+		options.FindOneAndReplace().SetCollation(collation))
+	s.findOneAndDeleteOpts = append(s.findOneAndDeleteOpts, options.FindOneAndDelete().SetCollation(collation))
+	s.updateOpts = append(s.updateOpts, options.Update().SetCollation(collation))
+	s.findOptions = append(s.findOptions, options.Find().SetCollation(collation))
+	s.findOneOptions = append(s.findOneOptions, options.FindOne().SetCollation(collation))
+	return s
+}
+
+func (s *session) SetMaxTime(d time.Duration) pie.Session {
+	s.findOneAndUpdateOpts = append(s.findOneAndUpdateOpts,
+		options.FindOneAndUpdate().SetMaxTime(d))
+	s.findOneAndReplaceOpts = append(s.findOneAndReplaceOpts,
+		options.FindOneAndReplace().SetMaxTime(d))
+	s.findOneAndDeleteOpts = append(s.findOneAndDeleteOpts, options.FindOneAndDelete().SetMaxTime(d))
+	return s
+}
+
+func (s *session) SetProjection(projection any) pie.Session {
+	s.findOneAndUpdateOpts = append(s.findOneAndUpdateOpts,
+		options.FindOneAndUpdate().SetProjection(projection))
+	s.findOneAndReplaceOpts = append(s.findOneAndReplaceOpts,
+		options.FindOneAndReplace().SetProjection(projection))
+	s.findOneAndDeleteOpts = append(s.findOneAndDeleteOpts, options.FindOneAndDelete().SetProjection(projection))
+	return s
+}
+
+func (s *session) SetSort(sort any) pie.Session {
+	s.findOneAndUpdateOpts = append(s.findOneAndUpdateOpts,
+		options.FindOneAndUpdate().SetSort(sort))
+	s.findOneAndReplaceOpts = append(s.findOneAndReplaceOpts,
+		options.FindOneAndReplace().SetSort(sort))
+	s.findOneAndDeleteOpts = append(s.findOneAndDeleteOpts, options.FindOneAndDelete().SetSort(sort))
+	return s
+}
+
+func (s *session) SetHint(hint any) pie.Session {
+	s.findOneAndUpdateOpts = append(s.findOneAndUpdateOpts,
+		options.FindOneAndUpdate().SetHint(hint))
+	s.findOneAndReplaceOpts = append(s.findOneAndReplaceOpts,
+		options.FindOneAndReplace().SetHint(hint))
+	s.findOneAndDeleteOpts = append(s.findOneAndDeleteOpts, options.FindOneAndDelete().SetHint(hint))
+	s.updateOpts = append(s.updateOpts, options.Update().SetHint(hint))
+	s.findOptions = append(s.findOptions, options.Find().SetHint(hint))
+	s.findOneOptions = append(s.findOneOptions, options.FindOne().SetHint(hint))
+	return s
+}
+
+func (s *session) Type(key string, t any) pie.Session {
+	s.filter.Type(key, t)
+	return s
+}
+
+func (s *session) Expr(expression any) pie.Session {
+	s.filter.Expr(expression)
+	return s
+}
+
+func (s *session) Regex(key string, pattern string, opts string) pie.Session {
+	s.filter.Regex(key, pattern, opts)
+	return s
+}
+
+func (s *session) StartsWith(key string, prefix string) pie.Session {
+	s.filter.StartsWith(key, prefix)
+	return s
+}
+
+func (s *session) EndsWith(key string, suffix string) pie.Session {
+	s.filter.EndsWith(key, suffix)
+	return s
+}
+
+func (s *session) Contains(key string, substr string) pie.Session {
+	s.filter.Contains(key, substr)
+	return s
+}
+
+func (s *session) EqualFold(key string, str string) pie.Session {
+	s.filter.EqualFold(key, str)
+	return s
+}
+
+func (s *session) Text(search, language string, caseSensitive, diacriticSensitive bool) pie.Session {
+	s.filter.Text(search, language, caseSensitive, diacriticSensitive)
+	return s
+}
+
+func (s *session) SortByScore(colNames ...string) pie.Session {
+	es := sortFields(bson.D{{Key: "score", Value: pie.TextScore()}}, colNames)
+	s.findOptions = append(s.findOptions, options.Find().SetSort(es))
+	s.findOneOptions = append(s.findOneOptions, options.FindOne().SetSort(es))
+	return s
+}
+
+func (s *session) ProjectScore(field string) pie.Session {
+	projection := bson.D{}
+	if p := options.MergeFindOptions(s.findOptions...).Projection; p != nil {
+		if d, err := mql.NormalizeDoc(p); err == nil {
+			projection = d
+		}
+	}
+	return s.Project(append(projection, bson.E{Key: field, Value: pie.TextScore()}))
+}
+
+func (s *session) Near(key string, point geo.Point, maxDistance, minDistance float64) pie.Session {
+	s.filter.Near(key, point, maxDistance, minDistance)
+	return s
+}
+
+func (s *session) NearSphere(key string, point geo.Point, maxDistance, minDistance float64) pie.Session {
+	s.filter.NearSphere(key, point, maxDistance, minDistance)
+	return s
+}
+
+func (s *session) GeoWithin(key string, shape geo.Shape) pie.Session {
+	s.filter.GeoWithin(key, shape)
+	return s
+}
+
+func (s *session) GeoIntersects(key string, geometry geo.Geometry) pie.Session {
+	s.filter.GeoIntersects(key, geometry)
+	return s
+}
+
+func (s *session) SetDatabase(db string) pie.Session {
+	s.db = db
+	return s
+}
+
+func (s *session) SetCollection(name string) pie.Session {
+	s.collection = name
+	return s
+}
+
+func (s *session) SetCollRegistry(r *bsoncodec.Registry) pie.Session {
+	s.collOpts = append(s.collOpts, options.Collection().SetRegistry(r))
+	return s
+}
+
+func (s *session) SetCollReadPreference(rp *readpref.ReadPref) pie.Session {
+	s.collOpts = append(s.collOpts, options.Collection().SetReadPreference(rp))
+	return s
+}
+
+func (s *session) SetCollWriteConcern(wc *writeconcern.WriteConcern) pie.Session {
+	s.collOpts = append(s.collOpts, options.Collection().SetWriteConcern(wc))
+	return s
+}
+
+func (s *session) SetReadConcern(rc *readconcern.ReadConcern) pie.Session {
+	s.collOpts = append(s.collOpts, options.Collection().SetReadConcern(rc))
+	return s
+}
+
+var errArrayFilters = errors.New("pietest: array filters are not supported")
+
+func (s *session) collectionForStruct(doc any) (string, error) {
+	coll, err := s.engine.CollectionNameForStruct(doc)
+	return s.collectionFor(coll, err)
+}
+
+func (s *session) collectionForSlice(doc any) (string, error) {
+	coll, err := s.engine.CollectionNameForSlice(doc)
+	return s.collectionFor(coll, err)
+}
+
+func (s *session) collectionFor(coll *schemas.Collection, err error) (string, error) {
+	var model reflect.Type
+	if err == nil {
+		model = coll.Type
+	}
+	if err := s.resolveIDs(model); err != nil {
+		return "", err
+	}
+	if s.collection != "" {
+		if err == nil {
+			if err := s.checkStrict(coll.Type); err != nil {
+				return "", err
+			}
+		}
+		return s.collection, nil
+	}
+	if s.selected {
+		return "", fmt.Errorf("select %w", errNoCollection)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := s.checkStrict(coll.Type); err != nil {
+		return "", err
+	}
+	return coll.Name, nil
+}
+
+// checkStrict validates the filter, sort and projection keys against model
+// type t with pie.ValidateFields when strict mode is on.
+func (s *session) checkStrict(t reflect.Type) error {
+	if !s.strict {
+		return nil
+	}
+	filters, err := s.filter.Filters()
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for _, o := range s.findOptions {
+		keys = append(keys, docKeys(o.Sort)...)
+		keys = append(keys, docKeys(o.Projection)...)
+	}
+	for _, o := range s.findOneOptions {
+		keys = append(keys, docKeys(o.Sort)...)
+		keys = append(keys, docKeys(o.Projection)...)
+	}
+	return pie.ValidateFields(reflect.Zero(t).Interface(), filters, keys...)
+}
+
+// docKeys returns the keys of a sort or projection document, without positional ".$" suffixes.
+func docKeys(doc any) []string {
+	if doc == nil {
+		return nil
+	}
+	d, err := mql.NormalizeDoc(doc)
+	if err != nil {
+		return nil
+	}
+	keys := make([]string, 0, len(d))
+	for _, e := range d {
+		// {$meta: "textScore"} names a computed value, not a field.
+		if meta, ok := e.Value.(bson.D); ok && len(meta) == 1 && meta[0].Key == "$meta" {
+			continue
+		}
+		keys = append(keys, strings.TrimSuffix(e.Key, ".$"))
+	}
+	return keys
+}
+
+func (s *session) with(name string, fn func(c *collection) error) error {
+	return s.engine.withCollection(s.db, name, fn)
+}
+
+// replaceFilters returns the session's filters, or the primary key filter of
+// doc when there are none, as pie does for ReplaceOne.
+func (s *session) replaceFilters(doc any) (bson.D, error) {
+	filter, err := s.filters()
+	if err != nil || len(filter) > 0 {
+		return filter, err
+	}
+	key, err := pie.KeyFilter(doc, s.registry())
+	if err != nil || key == nil {
+		return filter, err
+	}
+	return mql.NormalizeDoc(key)
+}
+
+func (s *session) filters() (bson.D, error) {
+	f, err := s.filter.Filters()
+	if err != nil {
+		return nil, err
+	}
+	return mql.NormalizeDoc(f)
+}
+
+// registry returns the codec registry the collection would have been opened with.
+func (s *session) registry() *bsoncodec.Registry {
+	if o := options.MergeCollectionOptions(s.collOpts...); o.Registry != nil {
+		return o.Registry
+	}
+	if r := s.engine.codecs.Registry(); r != nil {
+		return r
+	}
+	return s.engine.registry
+}
+
+func (s *session) encode(v any) (bson.D, error) {
+	raw, err := bson.MarshalWithRegistry(s.registry(), v)
+	if err != nil {
+		return nil, err
+	}
+	return mql.NormalizeDoc(bson.Raw(raw))
+}
+
+func (s *session) decode(doc bson.D, v any) error {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.UnmarshalWithRegistry(s.registry(), raw, v)
+}
+
+// decodeAll fills the slice rowsSlicePtr points to, the way Cursor.All does.
+func (s *session) decodeAll(docs []bson.D, rowsSlicePtr any) error {
+	sliceVal := reflect.ValueOf(rowsSlicePtr)
+	if sliceVal.Kind() != reflect.Ptr || sliceVal.Elem().Kind() != reflect.Slice {
+		return errors.New("results argument must be a pointer to a slice")
+	}
+	sliceVal = sliceVal.Elem()
+	elemType := sliceVal.Type().Elem()
+
+	out := reflect.MakeSlice(sliceVal.Type(), 0, len(docs))
+	for _, d := range docs {
+		elem := reflect.New(elemType)
+		if err := s.decode(d, elem.Interface()); err != nil {
+			return err
+		}
+		out = reflect.Append(out, elem.Elem())
+	}
+	sliceVal.Set(out)
+	return nil
+}
+
+// update applies fn to the first (or every, when many is set) document matching filter.
+func (s *session) update(name string, filter bson.D, many, upsert bool, fn func(bson.D, bool) (bson.D, error)) (*mongo.UpdateResult, error) {
+	result := &mongo.UpdateResult{}
+	err := s.with(name, func(c *collection) error {
+		positions, docs, err := c.match(filter)
+		if err != nil {
+			return err
+		}
+		if len(positions) == 0 {
+			if !upsert {
+				return nil
+			}
+			d, err := fn(upsertSeed(filter), true)
+			if err != nil {
+				return err
+			}
+			d, id := ensureID(d)
+			if err = c.insert(d); err != nil {
+				return err
+			}
+			result.UpsertedCount, result.UpsertedID = 1, id
+			return nil
+		}
+		if !many {
+			positions, docs = positions[:1], docs[:1]
+		}
+
+		for i, pos := range positions {
+			updated, err := fn(docs[i], false)
+			if err != nil {
+				return err
+			}
+			result.MatchedCount++
+			if changed(docs[i], updated) {
+				if err = c.replace(pos, updated); err != nil {
+					return err
+				}
+				result.ModifiedCount++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type modifySpec struct {
+	sort       any
+	projection any
+	upsert     bool
+	returnNew  bool
+	remove     bool
+	apply      func(bson.D, bool) (bson.D, error)
+}
+
+// findAndModify implements the findAndModify family. It returns the document
+// the command would send back, or nil when there is none.
+func (s *session) findAndModify(name string, filter bson.D, spec modifySpec) (bson.D, error) {
+	var found bson.D
+	err := s.with(name, func(c *collection) error {
+		positions, docs, err := c.find(filter, findSpec{sort: spec.sort, limit: 1})
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case len(positions) == 0 && spec.upsert:
+			d, err := spec.apply(upsertSeed(filter), true)
+			if err != nil {
+				return err
+			}
+			d, _ = ensureID(d)
+			if err = c.insert(d); err != nil {
+				return err
+			}
+			if spec.returnNew {
+				found = d
+			}
+		case len(positions) == 0:
+		case spec.remove:
+			c.remove(positions)
+			found = docs[0]
+		default:
+			updated, err := spec.apply(docs[0], false)
+			if err != nil {
+				return err
+			}
+			if err = c.replace(positions[0], updated); err != nil {
+				return err
+			}
+			found = docs[0]
+			if spec.returnNew {
+				found = updated
+			}
+		}
+		return nil
+	})
+	if err != nil || found == nil || spec.projection == nil {
+		return found, err
+	}
+	return project(found, spec.projection, nil)
+}
+
+// upsertSeed collects the equality conditions of filter, which MongoDB copies
+// into the document it inserts on upsert.
+func upsertSeed(filter bson.D) bson.D {
+	seed := bson.D{}
+	for _, e := range filter {
+		switch {
+		case e.Key == "$and":
+			arr, _ := e.Value.(bson.A)
+			for _, clause := range arr {
+				if d, ok := clause.(bson.D); ok {
+					for _, se := range upsertSeed(d) {
+						seed, _ = modifyDoc(seed, se.Key, true, func(any, bool) (any, bool, error) { return se.Value, true, nil })
+					}
+				}
+			}
+		case len(e.Key) > 0 && e.Key[0] == '$':
+		case mql.IsOperatorDoc(e.Value):
+			if d := e.Value.(bson.D); len(d) == 1 && d[0].Key == "$eq" {
+				seed, _ = modifyDoc(seed, e.Key, true, func(any, bool) (any, bool, error) { return d[0].Value, true, nil })
+			}
+		default:
+			value := e.Value
+			seed, _ = modifyDoc(seed, e.Key, true, func(any, bool) (any, bool, error) { return value, true, nil })
+		}
+	}
+	return seed
+}
+
+func changed(before, after bson.D) bool {
+	a, err := bson.Marshal(before)
+	if err != nil {
+		return true
+	}
+	b, err := bson.Marshal(after)
+	if err != nil {
+		return true
+	}
+	return !bytes.Equal(a, b)
+}
+
+func isTrue(b *bool) bool {
+	return b != nil && *b
+}
+
+func findSpecOf(opts *options.FindOptions) findSpec {
+	spec := findSpec{sort: opts.Sort, projection: opts.Projection}
+	if opts.Skip != nil {
+		spec.skip = *opts.Skip
+	}
+	if opts.Limit != nil {
+		spec.limit = *opts.Limit
+	}
+	return spec
+}
+
+// count implements CountDocuments, honouring the skip and limit count options.
+func (c *collection) count(filter bson.D, opts *options.CountOptions) (int64, error) {
+	positions, _, err := c.match(filter)
+	if err != nil {
+		return 0, err
+	}
+	n := int64(len(positions))
+	if opts.Skip != nil {
+		n -= *opts.Skip
+		if n < 0 {
+			n = 0
+		}
+	}
+	if opts.Limit != nil && *opts.Limit > 0 && n > *opts.Limit {
+		n = *opts.Limit
+	}
+	return n, nil
+}
+
+var errNoCollection = errors.New("needs a collection, set one with SetCollection")
+
+func (s *session) Export(ctx context.Context, w io.Writer, format pie.ExportFormat) error {
+	if s.collection == "" {
+		return fmt.Errorf("export %w", errNoCollection)
+	}
+	if err := s.resolveIDs(nil); err != nil {
+		return err
+	}
+	filter, err := s.filters()
+	if err != nil {
+		return err
+	}
+	opts := options.MergeFindOptions(s.findOptions...)
+	columns, err := docio.ProjectionColumns(opts.Projection)
+	if err != nil {
+		return err
+	}
+	enc, err := docio.NewEncoder(w, docio.Format(format), columns)
+	if err != nil {
+		return err
+	}
+
+	var docs []bson.D
+	err = s.with(s.collection, func(c *collection) error {
+		_, docs, err = c.find(filter, findSpecOf(opts))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, d := range docs {
+		raw, err := encode(d)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(raw); err != nil {
+			return err
+		}
+	}
+	return enc.Close()
+}
+
+func (s *session) Import(ctx context.Context, r io.Reader, opts ...*pie.ImportOptions) (*pie.ImportResult, error) {
+	if s.collection == "" {
+		return nil, fmt.Errorf("import %w", errNoCollection)
+	}
+	var o pie.ImportOptions
+	for _, opt := range opts {
+		if opt != nil {
+			o = *opt
+		}
+	}
+	fields := o.UpsertFields
+	if len(fields) == 0 {
+		fields = []string{"_id"}
+	}
+
+	write := func(ctx context.Context, docs []bson.D, lines []int) (docio.Stats, error) {
+		var stats docio.Stats
+		for i, d := range docs {
+			err := s.importDoc(d, o.Upsert, fields, &stats)
+			if err != nil {
+				stats.Failed++
+				stats.Errors = append(stats.Errors, fmt.Errorf("line %d: %w", lines[i], err))
+			}
+		}
+		return stats, nil
+	}
+	do := docio.ImportOptions{
+		Format:    docio.Format(o.Format),
+		BatchSize: o.BatchSize,
+		MaxErrors: o.MaxErrors,
+	}
+	if o.Progress != nil {
+		do.Progress = func(st docio.Stats) { o.Progress(pie.ImportResult(st)) }
+	}
+	stats, err := docio.Import(ctx, r, do, write)
+	res := pie.ImportResult(stats)
+	return &res, err
+}
+
+func (s *session) importDoc(d bson.D, upsert bool, fields []string, stats *docio.Stats) error {
+	if !upsert {
+		d, _ = ensureID(d)
+		if err := s.with(s.collection, func(c *collection) error { return c.insert(d) }); err != nil {
+			return err
+		}
+		stats.Inserted++
+		return nil
+	}
+	filter, err := docio.UpsertFilter(d, fields)
+	if err != nil {
+		return err
+	}
+	res, err := s.update(s.collection, filter, false, true, func(old bson.D, _ bool) (bson.D, error) {
+		return applyReplacement(old, d)
+	})
+	if err != nil {
+		return err
+	}
+	stats.Upserted += res.UpsertedCount
+	stats.Modified += res.ModifiedCount
+	return nil
+}
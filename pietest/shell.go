@@ -0,0 +1,118 @@
+package pietest
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/5xxxx/pie/internal/shell"
+	"github.com/5xxxx/pie/schemas"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var errNoShellCollection = errors.New("no collection to render: pass a document or use SetCollection")
+
+// Shell renders the find command pie's session would send for FindAll(doc).
+func (s *session) Shell(doc any) (string, error) {
+	if s.selected && s.collection == "" {
+		return "", fmt.Errorf("select %w", errNoCollection)
+	}
+	target, err := shellTarget(s.engine, s.db, s.collection, doc)
+	if err != nil {
+		return "", err
+	}
+	filters, err := s.shellFilters(doc)
+	if err != nil {
+		return "", err
+	}
+	return shell.Find(target, filters, options.MergeFindOptions(s.findOptions...))
+}
+
+// ShellUpdate renders the updateOne or updateMany command for update, or
+// the one of UpdateOne(doc) or UpdateMany(doc) when update is nil.
+func (s *session) ShellUpdate(doc any, update any, many bool) (string, error) {
+	target, err := shellTarget(s.engine, s.db, s.collection, doc)
+	if err != nil {
+		return "", err
+	}
+	filters, err := s.shellFilters(doc)
+	if err != nil {
+		return "", err
+	}
+	if update == nil {
+		update = bson.M{"$set": doc}
+	}
+	return shell.Update(target, filters, update, many, options.MergeUpdateOptions(s.updateOpts...))
+}
+
+func (s *session) String() string {
+	return shellString(s.Shell(nil))
+}
+
+// Shell renders the aggregate command with the options collected by the
+// setters, which the fake otherwise ignores.
+func (a *aggregate) Shell(doc any) (string, error) {
+	if a.doc != nil {
+		doc = a.doc
+	}
+	target, err := shellTarget(a.engine, a.db, "", doc)
+	if err != nil {
+		return "", err
+	}
+	return shell.Aggregate(target, a.pipeline, options.MergeAggregateOptions(a.opts...))
+}
+
+func (a *aggregate) String() string {
+	return shellString(a.Shell(nil))
+}
+
+func shellTarget(engine *Client, db, name string, doc any) (string, error) {
+	if name == "" {
+		if doc == nil {
+			return "", errNoShellCollection
+		}
+		var coll *schemas.Collection
+		var err error
+		if reflect.Indirect(reflect.ValueOf(doc)).Kind() == reflect.Slice {
+			coll, err = engine.CollectionNameForSlice(doc)
+		} else {
+			coll, err = engine.CollectionNameForStruct(doc)
+		}
+		if err != nil {
+			return "", err
+		}
+		name = coll.Name
+	}
+	return shell.Target(db, name), nil
+}
+
+// shellFilters returns the filter with the ids given to ID resolved for the
+// model of doc, leaving the session unchanged.
+func (s *session) shellFilters(doc any) (bson.D, error) {
+	var model reflect.Type
+	if doc != nil {
+		var coll *schemas.Collection
+		var err error
+		if reflect.Indirect(reflect.ValueOf(doc)).Kind() == reflect.Slice {
+			coll, err = s.engine.CollectionNameForSlice(doc)
+		} else {
+			coll, err = s.engine.CollectionNameForStruct(doc)
+		}
+		if err == nil {
+			model = coll.Type
+		}
+	}
+	sess := s.Clone().(*session)
+	if err := sess.resolveIDs(model); err != nil {
+		return nil, err
+	}
+	return sess.filter.Filters()
+}
+
+func shellString(s string, err error) string {
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+	return s
+}
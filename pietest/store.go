@@ -0,0 +1,258 @@
+package pietest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/5xxxx/pie/internal/mql"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// store holds every database the fake knows about. Documents are kept as
+// encoded BSON so that reads never share memory with the caller.
+type store struct {
+	mu  sync.RWMutex
+	dbs map[string]map[string]*collection
+}
+
+type collection struct {
+	docs    []bson.Raw
+	indexes []indexSpec
+}
+
+type indexSpec struct {
+	name    string
+	keys    bson.D
+	unique  bool
+	sparse  bool
+	partial bson.D
+	weights bson.D
+}
+
+var idIndex = indexSpec{name: "_id_", keys: bson.D{{Key: "_id", Value: int32(1)}}, unique: true}
+
+func newStore() *store {
+	return &store{dbs: map[string]map[string]*collection{}}
+}
+
+// collection returns the named collection, creating it on first use.
+// Callers must hold the write lock.
+func (s *store) collection(db, name string) *collection {
+	colls, ok := s.dbs[db]
+	if !ok {
+		colls = map[string]*collection{}
+		s.dbs[db] = colls
+	}
+	c, ok := colls[name]
+	if !ok {
+		c = &collection{}
+		colls[name] = c
+	}
+	return c
+}
+
+// snapshot copies the store so that a failed transaction can be rolled back.
+func (s *store) snapshot() map[string]map[string]*collection {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	dbs := make(map[string]map[string]*collection, len(s.dbs))
+	for db, colls := range s.dbs {
+		copied := make(map[string]*collection, len(colls))
+		for name, c := range colls {
+			copied[name] = &collection{
+				docs:    append([]bson.Raw(nil), c.docs...),
+				indexes: append([]indexSpec(nil), c.indexes...),
+			}
+		}
+		dbs[db] = copied
+	}
+	return dbs
+}
+
+func (s *store) restore(dbs map[string]map[string]*collection) {
+	s.mu.Lock()
+	s.dbs = dbs
+	s.mu.Unlock()
+}
+
+func decode(raw bson.Raw) bson.D {
+	var d bson.D
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		panic(fmt.Sprintf("pietest: stored document is corrupt: %v", err))
+	}
+	return d
+}
+
+func encode(d bson.D) (bson.Raw, error) {
+	return bson.Marshal(d)
+}
+
+// match returns the positions of the documents that satisfy filter, in insertion order.
+func (c *collection) match(filter bson.D) ([]int, []bson.D, error) {
+	positions, docs, _, err := c.matchScored(filter)
+	return positions, docs, err
+}
+
+// matchScored is match that also returns the text scores of the documents
+// when filter has a $text search, or nil scores otherwise.
+func (c *collection) matchScored(filter bson.D) ([]int, []bson.D, []float64, error) {
+	filter, text, err := splitText(filter)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var idx indexSpec
+	if text != nil {
+		var ok bool
+		if idx, ok = c.textIndex(); !ok {
+			return nil, nil, nil, errNoTextIndex
+		}
+	}
+
+	var positions []int
+	var docs []bson.D
+	var scores []float64
+	for i, raw := range c.docs {
+		d := decode(raw)
+		ok, err := mql.Match(filter, d)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !ok {
+			continue
+		}
+		if text != nil {
+			score := text.score(d, idx)
+			if score == 0 {
+				continue
+			}
+			scores = append(scores, score)
+		}
+		positions = append(positions, i)
+		docs = append(docs, d)
+	}
+	if text != nil && scores == nil {
+		scores = []float64{}
+	}
+	return positions, docs, scores, nil
+}
+
+func (c *collection) allIndexes() []indexSpec {
+	return append([]indexSpec{idIndex}, c.indexes...)
+}
+
+// insert validates doc against the unique indexes and appends it.
+func (c *collection) insert(doc bson.D) error {
+	if err := c.checkUnique(doc, -1); err != nil {
+		return err
+	}
+	raw, err := encode(doc)
+	if err != nil {
+		return err
+	}
+	c.docs = append(c.docs, raw)
+	return nil
+}
+
+// replace stores doc at position i after validating it against the unique indexes.
+func (c *collection) replace(i int, doc bson.D) error {
+	if err := c.checkUnique(doc, i); err != nil {
+		return err
+	}
+	raw, err := encode(doc)
+	if err != nil {
+		return err
+	}
+	c.docs[i] = raw
+	return nil
+}
+
+func (c *collection) remove(positions []int) {
+	sort.Sort(sort.Reverse(sort.IntSlice(positions)))
+	for _, i := range positions {
+		c.docs = append(c.docs[:i], c.docs[i+1:]...)
+	}
+}
+
+func (c *collection) checkUnique(doc bson.D, skip int) error {
+	for _, idx := range c.allIndexes() {
+		if !idx.unique {
+			continue
+		}
+		key, ok, err := idx.key(doc)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		for i, raw := range c.docs {
+			if i == skip {
+				continue
+			}
+			other, ok, err := idx.key(decode(raw))
+			if err != nil {
+				return err
+			}
+			if ok && mql.Equal(key, other) {
+				return duplicateKeyError(idx, key)
+			}
+		}
+	}
+	return nil
+}
+
+// key extracts the index key of doc. ok is false when the document is not
+// covered by the index, which happens for sparse and partial indexes.
+func (idx indexSpec) key(doc bson.D) (bson.A, bool, error) {
+	if idx.partial != nil {
+		ok, err := mql.Match(idx.partial, doc)
+		if err != nil || !ok {
+			return nil, false, err
+		}
+	}
+
+	key := make(bson.A, 0, len(idx.keys))
+	present := false
+	for _, k := range idx.keys {
+		values := mql.Lookup(doc, k.Key)
+		switch len(values) {
+		case 0:
+			key = append(key, nil)
+		case 1:
+			key = append(key, values[0])
+			present = true
+		default:
+			key = append(key, bson.A(values))
+			present = true
+		}
+	}
+	if idx.sparse && !present {
+		return nil, false, nil
+	}
+	return key, true, nil
+}
+
+func duplicateKeyError(idx indexSpec, key bson.A) error {
+	parts := make([]string, len(idx.keys))
+	for i, k := range idx.keys {
+		parts[i] = fmt.Sprintf("%s: %v", k.Key, key[i])
+	}
+	return mongo.WriteException{WriteErrors: mongo.WriteErrors{{
+		Code:    11000,
+		Message: fmt.Sprintf("E11000 duplicate key error index: %s dup key: { %s }", idx.name, strings.Join(parts, ", ")),
+	}}}
+}
+
+// ensureID prepends a generated ObjectID when doc has no _id, like the driver does.
+func ensureID(doc bson.D) (bson.D, any) {
+	if id, ok := mql.Get(doc, "_id"); ok {
+		return doc, id
+	}
+	id := primitive.NewObjectID()
+	return append(bson.D{{Key: "_id", Value: id}}, doc...), id
+}
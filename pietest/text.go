@@ -0,0 +1,223 @@
+package pietest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/5xxxx/pie/internal/mql"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// textSearch is a parsed $text query. The fake matches whole words, without
+// the server's stemming and stop words, and scores a document by the number
+// of matching words in each indexed field times the field's weight. Scores
+// therefore order documents like the server does in simple cases only.
+type textSearch struct {
+	terms              map[string]bool
+	negated            map[string]bool
+	phrases            []string
+	caseSensitive      bool
+	diacriticSensitive bool
+}
+
+var errNoTextIndex = errors.New("text index required for $text query")
+
+// splitText removes a top-level $text from filter and parses it.
+func splitText(filter bson.D) (bson.D, *textSearch, error) {
+	for i, e := range filter {
+		if e.Key != "$text" {
+			continue
+		}
+		t, err := parseTextSearch(e.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		rest := append(append(bson.D{}, filter[:i]...), filter[i+1:]...)
+		return rest, t, nil
+	}
+	return filter, nil, nil
+}
+
+func parseTextSearch(v any) (*textSearch, error) {
+	spec, ok := v.(bson.D)
+	if !ok {
+		return nil, errors.New("$text expects an object")
+	}
+	t := &textSearch{terms: map[string]bool{}, negated: map[string]bool{}}
+	var search string
+	var hasSearch bool
+	for _, e := range spec {
+		switch e.Key {
+		case "$search":
+			if search, hasSearch = e.Value.(string); !hasSearch {
+				return nil, errors.New("$search must be a string")
+			}
+		case "$language":
+		case "$caseSensitive":
+			t.caseSensitive, _ = e.Value.(bool)
+		case "$diacriticSensitive":
+			t.diacriticSensitive, _ = e.Value.(bool)
+		default:
+			return nil, fmt.Errorf("unknown $text argument %s", e.Key)
+		}
+	}
+	if !hasSearch {
+		return nil, errors.New("$text requires $search")
+	}
+
+	parts := strings.Split(search, `"`)
+	for i, part := range parts {
+		if i%2 == 1 {
+			// Words of a phrase count as terms as well.
+			if phrase := strings.Join(t.words(part), " "); phrase != "" {
+				t.phrases = append(t.phrases, phrase)
+			}
+			for _, w := range t.words(part) {
+				t.terms[w] = true
+			}
+			continue
+		}
+		for _, field := range strings.Fields(part) {
+			set := t.terms
+			if strings.HasPrefix(field, "-") {
+				set = t.negated
+			}
+			for _, w := range t.words(field) {
+				set[w] = true
+			}
+		}
+	}
+	return t, nil
+}
+
+// words splits s into words, folded as the search asks.
+func (t *textSearch) words(s string) []string {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, f := range fields {
+		fields[i] = t.fold(f)
+	}
+	return fields
+}
+
+func (t *textSearch) fold(s string) string {
+	if !t.caseSensitive {
+		s = strings.ToLower(s)
+	}
+	if !t.diacriticSensitive {
+		s = strings.Map(foldDiacritic, s)
+	}
+	return s
+}
+
+// score returns the relevance of doc, or zero when it does not match.
+func (t *textSearch) score(doc bson.D, idx indexSpec) float64 {
+	var score float64
+	var text []string
+	for _, k := range idx.keys {
+		if k.Value != "text" {
+			continue
+		}
+		var values []string
+		if k.Key == "$**" {
+			values = stringValues(doc)
+		} else {
+			for _, v := range mql.Lookup(doc, k.Key) {
+				values = append(values, stringValues(v)...)
+			}
+		}
+		weight := 1.0
+		if w, ok := mql.Get(idx.weights, k.Key); ok {
+			if f, ok := mql.Float(w); ok {
+				weight = f
+			}
+		}
+		for _, v := range values {
+			words := t.words(v)
+			for _, w := range words {
+				if t.negated[w] {
+					return 0
+				}
+				if t.terms[w] {
+					score += weight
+				}
+			}
+			text = append(text, " "+strings.Join(words, " ")+" ")
+		}
+	}
+	all := strings.Join(text, "\n")
+	for _, p := range t.phrases {
+		if !strings.Contains(all, " "+p+" ") {
+			return 0
+		}
+	}
+	return score
+}
+
+// stringValues returns the strings in v, descending into arrays and documents.
+func stringValues(v any) []string {
+	switch x := v.(type) {
+	case string:
+		return []string{x}
+	case bson.A:
+		var out []string
+		for _, e := range x {
+			out = append(out, stringValues(e)...)
+		}
+		return out
+	case bson.D:
+		var out []string
+		for _, e := range x {
+			out = append(out, stringValues(e.Value)...)
+		}
+		return out
+	}
+	return nil
+}
+
+// textIndex returns the collection's text index.
+func (c *collection) textIndex() (indexSpec, bool) {
+	for _, idx := range c.indexes {
+		for _, k := range idx.keys {
+			if k.Value == "text" {
+				return idx, true
+			}
+		}
+	}
+	return indexSpec{}, false
+}
+
+// isTextScore reports whether v is {$meta: "textScore"}.
+func isTextScore(v any) bool {
+	d, ok := v.(bson.D)
+	return ok && len(d) == 1 && d[0].Key == "$meta" && d[0].Value == "textScore"
+}
+
+var diacritics = map[rune]rune{}
+
+func init() {
+	for base, marked := range map[rune]string{
+		'a': "àáâãäåāăą", 'c': "çćĉċč", 'd': "ďđ", 'e': "èéêëēĕėęě",
+		'g': "ĝğġģ", 'h': "ĥħ", 'i': "ìíîïĩīĭįı", 'j': "ĵ", 'k': "ķ",
+		'l': "ĺļľŀł", 'n': "ñńņňŉ", 'o': "òóôõöøōŏő", 'r': "ŕŗř",
+		's': "śŝşš", 't': "ţťŧ", 'u': "ùúûüũūŭůűų", 'w': "ŵ", 'y': "ýÿŷ", 'z': "źżž",
+	} {
+		for _, r := range marked {
+			diacritics[r] = base
+			if up := unicode.ToUpper(r); up != r {
+				diacritics[up] = unicode.ToUpper(base)
+			}
+		}
+	}
+}
+
+// foldDiacritic maps accented Latin letters to their base letter.
+func foldDiacritic(r rune) rune {
+	if base, ok := diacritics[r]; ok {
+		return base
+	}
+	return r
+}
@@ -0,0 +1,405 @@
+package pietest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/5xxxx/pie/internal/mql"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// modifier receives the current value at a path and returns the new one.
+// Returning keep=false removes the field.
+type modifier func(old any, exists bool) (value any, keep bool, err error)
+
+// isUpdateDoc reports whether update is made of update operators rather than a replacement document.
+func isUpdateDoc(update bson.D) bool {
+	return len(update) > 0 && strings.HasPrefix(update[0].Key, "$")
+}
+
+// applyUpdate runs the update operators in update against doc.
+// inserting enables $setOnInsert and is set while building an upsert.
+func applyUpdate(doc bson.D, update bson.D, inserting bool) (bson.D, error) {
+	if !isUpdateDoc(update) {
+		return nil, errors.New("update document requires atomic operators")
+	}
+	id, hadID := mql.Get(doc, "_id")
+
+	for _, op := range update {
+		fields, ok := op.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("modifiers operate on fields but we found %T instead for %s", op.Value, op.Key)
+		}
+		for _, f := range fields {
+			var err error
+			doc, err = applyOperator(doc, op.Key, f, inserting)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if newID, _ := mql.Get(doc, "_id"); hadID && !mql.Equal(id, newID) {
+		return nil, errors.New("performing an update on the path '_id' would modify the immutable field '_id'")
+	}
+	return doc, nil
+}
+
+// applyReplacement swaps the content of doc for replacement while keeping its _id.
+func applyReplacement(doc bson.D, replacement bson.D) (bson.D, error) {
+	if isUpdateDoc(replacement) {
+		return nil, errors.New("replacement document cannot contain keys beginning with '$'")
+	}
+	id, hadID := mql.Get(doc, "_id")
+	if newID, ok := mql.Get(replacement, "_id"); ok && hadID && !mql.Equal(id, newID) {
+		return nil, errors.New("the _id field cannot be changed by a replacement")
+	}
+
+	out := make(bson.D, 0, len(replacement)+1)
+	if hadID {
+		out = append(out, bson.E{Key: "_id", Value: id})
+	}
+	for _, e := range replacement {
+		if e.Key != "_id" || !hadID {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+func applyOperator(doc bson.D, op string, f bson.E, inserting bool) (bson.D, error) {
+	arg := f.Value
+	switch op {
+	case "$set":
+		return modifyDoc(doc, f.Key, true, func(any, bool) (any, bool, error) { return arg, true, nil })
+	case "$setOnInsert":
+		if !inserting {
+			return doc, nil
+		}
+		return modifyDoc(doc, f.Key, true, func(any, bool) (any, bool, error) { return arg, true, nil })
+	case "$unset":
+		return modifyDoc(doc, f.Key, false, func(any, bool) (any, bool, error) { return nil, false, nil })
+	case "$inc", "$mul":
+		return modifyDoc(doc, f.Key, true, func(old any, exists bool) (any, bool, error) {
+			return arithmetic(op, old, exists, arg)
+		})
+	case "$min", "$max":
+		return modifyDoc(doc, f.Key, true, func(old any, exists bool) (any, bool, error) {
+			if !exists {
+				return arg, true, nil
+			}
+			c := mql.Compare(arg, old)
+			if op == "$min" && c < 0 || op == "$max" && c > 0 {
+				return arg, true, nil
+			}
+			return old, true, nil
+		})
+	case "$currentDate":
+		now := time.Now()
+		var value any = primitive.NewDateTimeFromTime(now)
+		if spec, ok := arg.(bson.D); ok {
+			if t, _ := mql.Get(spec, "$type"); t == "timestamp" {
+				value = primitive.Timestamp{T: uint32(now.Unix())}
+			}
+		}
+		return modifyDoc(doc, f.Key, true, func(any, bool) (any, bool, error) { return value, true, nil })
+	case "$rename":
+		to, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("the 'to' field for $rename must be a string: %s", f.Key)
+		}
+		values := mql.Lookup(doc, f.Key)
+		if len(values) != 1 {
+			return doc, nil
+		}
+		doc, err := modifyDoc(doc, f.Key, false, func(any, bool) (any, bool, error) { return nil, false, nil })
+		if err != nil {
+			return nil, err
+		}
+		return modifyDoc(doc, to, true, func(any, bool) (any, bool, error) { return values[0], true, nil })
+	case "$push", "$addToSet":
+		return modifyDoc(doc, f.Key, true, func(old any, exists bool) (any, bool, error) {
+			return push(op, old, exists, arg)
+		})
+	case "$pull", "$pullAll":
+		return modifyDoc(doc, f.Key, false, func(old any, exists bool) (any, bool, error) {
+			return pull(op, old, arg)
+		})
+	case "$pop":
+		return modifyDoc(doc, f.Key, false, func(old any, exists bool) (any, bool, error) {
+			arr, ok := old.(bson.A)
+			if !ok {
+				return nil, false, fmt.Errorf("path '%s' contains an element of non-array type", f.Key)
+			}
+			if len(arr) == 0 {
+				return arr, true, nil
+			}
+			if n, _ := mql.Float(arg); n < 0 {
+				return arr[1:], true, nil
+			}
+			return arr[:len(arr)-1], true, nil
+		})
+	}
+	return nil, fmt.Errorf("unknown modifier: %s", op)
+}
+
+func arithmetic(op string, old any, exists bool, arg any) (any, bool, error) {
+	if _, ok := mql.Float(arg); !ok {
+		return nil, false, fmt.Errorf("cannot %s with non-numeric argument", op[1:])
+	}
+	if !exists || old == nil && op == "$mul" {
+		if op == "$mul" {
+			return zeroOf(arg), true, nil
+		}
+		return arg, true, nil
+	}
+	if _, ok := mql.Float(old); !ok {
+		return nil, false, fmt.Errorf("cannot apply %s to a value of non-numeric type %T", op, old)
+	}
+
+	a, aInt := integer(old)
+	b, bInt := integer(arg)
+	if aInt && bInt {
+		var r int64
+		if op == "$inc" {
+			r = a + b
+		} else {
+			r = a * b
+		}
+		_, old32 := old.(int32)
+		_, arg32 := arg.(int32)
+		if old32 && arg32 && r >= math.MinInt32 && r <= math.MaxInt32 {
+			return int32(r), true, nil
+		}
+		return r, true, nil
+	}
+
+	x, _ := mql.Float(old)
+	y, _ := mql.Float(arg)
+	if op == "$inc" {
+		return x + y, true, nil
+	}
+	return x * y, true, nil
+}
+
+func integer(v any) (int64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+func zeroOf(v any) any {
+	switch v.(type) {
+	case int32:
+		return int32(0)
+	case int64:
+		return int64(0)
+	}
+	return float64(0)
+}
+
+func push(op string, old any, exists bool, arg any) (any, bool, error) {
+	var arr bson.A
+	if exists {
+		a, ok := old.(bson.A)
+		if !ok {
+			return nil, false, fmt.Errorf("the field is of non-array type %T", old)
+		}
+		arr = append(bson.A(nil), a...)
+	}
+
+	items := bson.A{arg}
+	position, slice := -1, 0
+	hasSlice := false
+	if spec, ok := arg.(bson.D); ok && len(spec) > 0 && spec[0].Key == "$each" {
+		each, ok := spec[0].Value.(bson.A)
+		if !ok {
+			return nil, false, errors.New("the argument to $each must be an array")
+		}
+		items = each
+		for _, e := range spec[1:] {
+			n, _ := mql.Float(e.Value)
+			switch e.Key {
+			case "$position":
+				position = int(n)
+			case "$slice":
+				slice, hasSlice = int(n), true
+			default:
+				return nil, false, fmt.Errorf("unsupported %s modifier %s", op, e.Key)
+			}
+		}
+	}
+
+	if op == "$addToSet" {
+		for _, item := range items {
+			if !containsValue(arr, item) {
+				arr = append(arr, item)
+			}
+		}
+		return arr, true, nil
+	}
+
+	if position < 0 || position > len(arr) {
+		position = len(arr)
+	}
+	out := append(bson.A(nil), arr[:position]...)
+	out = append(out, items...)
+	out = append(out, arr[position:]...)
+	if hasSlice {
+		switch {
+		case slice >= 0 && slice < len(out):
+			out = out[:slice]
+		case slice < 0 && -slice < len(out):
+			out = out[len(out)+slice:]
+		}
+	}
+	return out, true, nil
+}
+
+func pull(op string, old any, arg any) (any, bool, error) {
+	arr, ok := old.(bson.A)
+	if !ok {
+		return nil, false, errors.New("cannot apply $pull to a non-array value")
+	}
+
+	remove := func(elem any) (bool, error) {
+		if op == "$pullAll" {
+			values, ok := arg.(bson.A)
+			if !ok {
+				return false, errors.New("$pullAll requires an array argument")
+			}
+			return containsValue(values, elem), nil
+		}
+		if d, ok := arg.(bson.D); ok && !mql.IsOperatorDoc(d) {
+			if ed, ok := elem.(bson.D); ok {
+				return mql.Match(d, ed)
+			}
+			return false, nil
+		}
+		return mql.MatchValues([]any{elem}, arg)
+	}
+
+	out := bson.A{}
+	for _, elem := range arr {
+		drop, err := remove(elem)
+		if err != nil {
+			return nil, false, err
+		}
+		if !drop {
+			out = append(out, elem)
+		}
+	}
+	return out, true, nil
+}
+
+func containsValue(arr bson.A, v any) bool {
+	for _, e := range arr {
+		if mql.Equal(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// modifyDoc applies fn to the value at the dotted path. When create is false
+// missing intermediate fields are left alone instead of being created.
+func modifyDoc(doc bson.D, path string, create bool, fn modifier) (bson.D, error) {
+	out, err := modify(doc, strings.Split(path, "."), create, fn)
+	if err != nil {
+		return nil, err
+	}
+	return out.(bson.D), nil
+}
+
+func modify(container any, parts []string, create bool, fn modifier) (any, error) {
+	key, rest := parts[0], parts[1:]
+
+	switch c := container.(type) {
+	case bson.D:
+		pos := -1
+		for i, e := range c {
+			if e.Key == key {
+				pos = i
+				break
+			}
+		}
+		var old any
+		if pos >= 0 {
+			old = c[pos].Value
+		}
+		value, keep, err := modifyChild(old, pos >= 0, rest, create, fn)
+		if err != nil || value == skip {
+			return c, err
+		}
+		out := append(bson.D(nil), c...)
+		switch {
+		case !keep && pos >= 0:
+			out = append(out[:pos], out[pos+1:]...)
+		case !keep:
+		case pos >= 0:
+			out[pos].Value = value
+		default:
+			out = append(out, bson.E{Key: key, Value: value})
+		}
+		return out, nil
+	case bson.A:
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("cannot create field '%s' in an array", key)
+		}
+		exists := i < len(c)
+		var old any
+		if exists {
+			old = c[i]
+		}
+		value, keep, err := modifyChild(old, exists, rest, create, fn)
+		if err != nil || value == skip {
+			return c, err
+		}
+		out := append(bson.A(nil), c...)
+		for len(out) <= i {
+			out = append(out, nil)
+		}
+		if !keep {
+			value = nil
+		}
+		out[i] = value
+		return out, nil
+	}
+	return nil, fmt.Errorf("cannot create field '%s' in element of type %T", key, container)
+}
+
+// skip is returned by modifyChild when nothing has to change.
+var skip = &struct{}{}
+
+func modifyChild(old any, exists bool, rest []string, create bool, fn modifier) (any, bool, error) {
+	if len(rest) == 0 {
+		if !exists && !create {
+			return skip, true, nil
+		}
+		return fn(old, exists)
+	}
+
+	switch old.(type) {
+	case bson.D, bson.A:
+		v, err := modify(old, rest, create, fn)
+		return v, true, err
+	}
+	if !create {
+		return skip, true, nil
+	}
+	if exists && old != nil {
+		return nil, false, fmt.Errorf("cannot create field '%s' in element of type %T", rest[0], old)
+	}
+	v, err := modify(bson.D{}, rest, create, fn)
+	return v, true, err
+}
@@ -0,0 +1,181 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/5xxxx/pie/internal/bsonstruct"
+	"github.com/5xxxx/pie/internal/mql"
+	"github.com/5xxxx/pie/schemas"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PrimaryKey returns the bson names of the fields making up the primary key
+// of model type t: the fields tagged `pie:"pk"`, in order, or else _id when
+// t stores one. The type of the fields declares the type of the key, such as
+// a string, an int64, a uuid stored with `pie:"codec:uuid"` or a struct for a
+// composite _id.
+//
+// Example usage:
+//
+//	type Membership struct {
+//		Tenant string `bson:"tenant" pie:"pk"`
+//		UserID int64  `bson:"user_id" pie:"pk"`
+//	}
+//	err := client.ID(schemas.NewPK("acme", int64(42))).FindOne(&m)
+//	// filter: { tenant: "acme", user_id: 42 }
+func PrimaryKey(t reflect.Type) []string {
+	var names []string
+	for _, f := range primaryKeyFields(indirectType(t)) {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func primaryKeyFields(t reflect.Type) []bsonstruct.Field {
+	fields := bsonstruct.Fields(t)
+	var pk []bsonstruct.Field
+	for _, f := range fields {
+		if _, ok := bsonstruct.Tag(f.Field)["pk"]; ok {
+			pk = append(pk, f)
+		}
+	}
+	if len(pk) > 0 {
+		return pk
+	}
+	for _, f := range fields {
+		if f.Name == "_id" {
+			return []bsonstruct.Field{f}
+		}
+	}
+	return nil
+}
+
+// IDFilter returns the filter selecting the document of model type t whose
+// primary key is id, encoded with reg the way the key fields are stored. A
+// composite key is given as a schemas.PK holding a value per field, in
+// order. A hex string is accepted for an ObjectID key. Without a primary key
+// in t, _id is the ObjectID the driver generates, and id is matched as
+// Condition.ID does.
+func IDFilter(t reflect.Type, id any, reg *bsoncodec.Registry) (bson.D, error) {
+	fields := primaryKeyFields(indirectType(t))
+	if len(fields) == 0 {
+		return DefaultCondition().ID(id).Filters()
+	}
+	values := []any{id}
+	switch pk := id.(type) {
+	case schemas.PK:
+		values = pk
+	case *schemas.PK:
+		if pk != nil {
+			values = *pk
+		}
+	}
+	if len(values) != len(fields) {
+		return nil, fmt.Errorf("the primary key of %s has %d fields, got %d values", indirectType(t), len(fields), len(values))
+	}
+
+	// The values are encoded as fields of a struct holding only the key
+	// fields, so that their codecs and tags apply.
+	structFields := make([]reflect.StructField, len(fields))
+	for i, f := range fields {
+		structFields[i] = reflect.StructField{
+			Name: fmt.Sprintf("F%d", i),
+			Type: f.Field.Type,
+			Tag:  reflect.StructTag(fmt.Sprintf(`bson:%q pie:%q`, f.Name, f.Field.Tag.Get("pie"))),
+		}
+	}
+	key := reflect.New(reflect.StructOf(structFields)).Elem()
+	for i, f := range fields {
+		if err := setKey(key.Field(i), values[i]); err != nil {
+			return nil, fmt.Errorf("primary key %s of %s: %w", f.Name, indirectType(t), err)
+		}
+	}
+	raw, err := bson.MarshalWithRegistry(reg, key.Interface())
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// setKey sets the key field v to id, converting between numeric types and
+// from a hex string to an ObjectID.
+func setKey(v reflect.Value, id any) error {
+	if id == nil {
+		return errors.New("id can't be nil")
+	}
+	if v.Kind() == reflect.Ptr {
+		v.Set(reflect.New(v.Type().Elem()))
+		v = v.Elem()
+	}
+	idValue := reflect.ValueOf(id)
+	for idValue.Kind() == reflect.Ptr && !idValue.IsNil() && !idValue.Type().AssignableTo(v.Type()) {
+		idValue = idValue.Elem()
+	}
+	switch {
+	case idValue.Type().AssignableTo(v.Type()):
+		v.Set(idValue)
+	case v.Type() == reflect.TypeOf(primitive.ObjectID{}) && idValue.Kind() == reflect.String:
+		oid, err := primitive.ObjectIDFromHex(idValue.String())
+		if err != nil {
+			return fmt.Errorf("id can't parse %q: %w", idValue.String(), err)
+		}
+		v.Set(reflect.ValueOf(oid))
+	case convertibleKey(idValue.Type(), v.Type()):
+		v.Set(idValue.Convert(v.Type()))
+	default:
+		return fmt.Errorf("id %v is a %T, not a %s", id, id, v.Type())
+	}
+	if v.IsZero() {
+		return fmt.Errorf("id can't be zero %v", id)
+	}
+	return nil
+}
+
+// convertibleKey reports whether a value of type from converts to type to
+// without changing its meaning: between numbers, or between types of the
+// same kind.
+func convertibleKey(from, to reflect.Type) bool {
+	if !from.ConvertibleTo(to) {
+		return false
+	}
+	return from.Kind() == to.Kind() || isNumberKind(from.Kind()) && isNumberKind(to.Kind())
+}
+
+func isNumberKind(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64
+}
+
+// KeyFilter returns the filter selecting doc, a model struct or pointer, by
+// its own primary key as stored with reg, or nil when the key is missing or
+// zero.
+func KeyFilter(doc any, reg *bsoncodec.Registry) (bson.D, error) {
+	fields := primaryKeyFields(indirectType(reflect.TypeOf(doc)))
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	raw, err := bson.MarshalWithRegistry(reg, doc)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := mql.NormalizeDoc(bson.Raw(raw))
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	for _, f := range fields {
+		value, ok := mql.Get(stored, f.Name)
+		if !ok || value == nil || reflect.ValueOf(value).IsZero() {
+			return nil, nil
+		}
+		d = append(d, bson.E{Key: f.Name, Value: value})
+	}
+	return d, nil
+}
@@ -0,0 +1,107 @@
+package pie
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/5xxxx/pie/schemas"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type device struct {
+	ID   string `bson:"_id" pie:"codec:uuid"`
+	Name string `bson:"name"`
+}
+
+type membership struct {
+	Tenant string `bson:"tenant" pie:"pk"`
+	UserID int64  `bson:"user_id" pie:"pk"`
+	Role   string `bson:"role"`
+}
+
+type orderKey struct {
+	Shop string `bson:"shop"`
+	No   int    `bson:"no"`
+}
+
+type shopOrder struct {
+	Key   orderKey `bson:"_id"`
+	Total float64  `bson:"total"`
+}
+
+func TestPrimaryKeys(t *testing.T) {
+	codecs := NewCodecs()
+	if err := codecs.Prepare(reflect.TypeOf(device{})); err != nil {
+		t.Fatal(err)
+	}
+	reg := codecs.Registry()
+
+	Convey("PrimaryKey lists the key fields of a model", t, func() {
+		So(PrimaryKey(reflect.TypeOf(&membership{})), ShouldResemble, []string{"tenant", "user_id"})
+		So(PrimaryKey(reflect.TypeOf(device{})), ShouldResemble, []string{"_id"})
+		So(PrimaryKey(reflect.TypeOf(cardOrder{})), ShouldBeEmpty)
+	})
+
+	Convey("IDFilter encodes ids as the model stores them", t, func() {
+		oid := primitive.NewObjectID()
+		d, err := IDFilter(reflect.TypeOf(member{}), oid.Hex(), reg)
+		So(err, ShouldBeNil)
+		So(d, ShouldResemble, bson.D{{Key: "_id", Value: oid}})
+
+		d, err = IDFilter(reflect.TypeOf(device{}), "6ba7b810-9dad-11d1-80b4-00c04fd430c8", reg)
+		So(err, ShouldBeNil)
+		So(d[0].Value.(primitive.Binary).Subtype, ShouldEqual, 4)
+
+		d, err = IDFilter(reflect.TypeOf(membership{}), schemas.NewPK("acme", 42), reg)
+		So(err, ShouldBeNil)
+		So(d, ShouldResemble, bson.D{{Key: "tenant", Value: "acme"}, {Key: "user_id", Value: int64(42)}})
+
+		d, err = IDFilter(reflect.TypeOf(shopOrder{}), orderKey{Shop: "a", No: 7}, reg)
+		So(err, ShouldBeNil)
+		So(d, ShouldResemble, bson.D{{Key: "_id", Value: bson.D{{Key: "shop", Value: "a"}, {Key: "no", Value: int32(7)}}}})
+
+		d, err = IDFilter(reflect.TypeOf(cardOrder{}), oid.Hex(), reg)
+		So(err, ShouldBeNil)
+		So(d, ShouldResemble, bson.D{{Key: "_id", Value: oid}})
+		_, err = IDFilter(reflect.TypeOf(cardOrder{}), 3, reg)
+		So(err, ShouldNotBeNil)
+
+		_, err = IDFilter(reflect.TypeOf(membership{}), "acme", reg)
+		So(err, ShouldNotBeNil)
+		_, err = IDFilter(reflect.TypeOf(membership{}), schemas.NewPK("acme", "42"), reg)
+		So(err, ShouldNotBeNil)
+		_, err = IDFilter(reflect.TypeOf(member{}), "nope", reg)
+		So(err, ShouldNotBeNil)
+		_, err = IDFilter(reflect.TypeOf(member{}), primitive.NilObjectID, reg)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("KeyFilter selects a document by its own key", t, func() {
+		d, err := KeyFilter(&membership{Tenant: "acme", UserID: 42, Role: "admin"}, reg)
+		So(err, ShouldBeNil)
+		So(d, ShouldResemble, bson.D{{Key: "tenant", Value: "acme"}, {Key: "user_id", Value: int64(42)}})
+
+		d, err = KeyFilter(&membership{Tenant: "acme"}, reg)
+		So(err, ShouldBeNil)
+		So(d, ShouldBeNil)
+	})
+
+	Convey("Condition.ID takes ObjectIDs and their hex strings", t, func() {
+		id := primitive.NewObjectID()
+		d, err := DefaultCondition().ID(id.Hex()).Filters()
+		So(err, ShouldBeNil)
+		So(d, ShouldResemble, bson.D{{Key: "_id", Value: id}})
+
+		_, err = DefaultCondition().ID("sku-1").Filters()
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "id can't parse")
+		_, err = DefaultCondition().ID(int64(7)).Filters()
+		So(err, ShouldNotBeNil)
+		_, err = DefaultCondition().ID(schemas.NewPK("a", 1)).Filters()
+		So(err, ShouldNotBeNil)
+		_, err = DefaultCondition().ID("").Filters()
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,57 @@
+package pie
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/5xxxx/pie/internal/populate"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Populate loads the models referenced by relation fields after FindOne,
+// FindAll and FindPagination, with one $in query per relation. A relation
+// field has the type of the referenced model, a pointer to it or a slice of
+// either, and a `pie:"ref:<Field>"` tag naming the Go field that holds the
+// reference: an ID for one-to-one relations, a slice of IDs for one-to-many
+// ones. The referenced model is matched on _id unless the tag adds
+// "foreign:<bson field>", which allows reverse relations. Relation fields
+// should be tagged `bson:"-"` so that they are not stored.
+//
+// paths are relation field names; dotted paths populate the loaded models
+// in turn, as "Author.Company" loads the company of each post's author.
+//
+// Example usage:
+//
+//	type Post struct {
+//		ID       primitive.ObjectID   `bson:"_id"`
+//		AuthorID primitive.ObjectID   `bson:"author_id"`
+//		Author   *User                `bson:"-" pie:"ref:AuthorID"`
+//		TagIDs   []primitive.ObjectID `bson:"tag_ids"`
+//		Tags     []Tag                `bson:"-" pie:"ref:TagIDs"`
+//	}
+//
+//	type User struct {
+//		ID    primitive.ObjectID `bson:"_id"`
+//		Posts []Post             `bson:"-" pie:"ref:ID,foreign:author_id"`
+//	}
+//
+//	err := client.NewSession().Populate("Author", "Tags").FindAll(&posts)
+func (s *session) Populate(paths ...string) Session {
+	s.populates = append(s.populates, paths...)
+	return s
+}
+
+// populate loads the relations named with Populate into result.
+func (s *session) populate(ctx context.Context, result any) error {
+	return populate.Run(ctx, result, s.populates, s.registry(), func(ctx context.Context, t reflect.Type, filter bson.D, results any) error {
+		coll, err := s.engine.CollectionNameForStruct(reflect.New(t).Interface())
+		if err != nil {
+			return err
+		}
+		cursor, err := s.collectionByName(coll.Name).Find(ctx, filter)
+		if err != nil {
+			return err
+		}
+		return cursor.All(ctx, results)
+	})
+}
@@ -0,0 +1,233 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/5xxxx/pie/internal/bsonstruct"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Projection builds the projection of a find, for use with Session.Project.
+// Errors, such as mixing inclusion and exclusion, are kept and returned when
+// the projection is sent.
+//
+// Example usage:
+//
+//	p := pie.NewProjection().Include("name", "email").Slice("comments", -5).Exclude("_id")
+//	err := client.Eq("name", "frank").Project(p).FindOne(&user)
+type Projection struct {
+	d   bson.D
+	err error
+}
+
+// NewProjection returns an empty projection, which returns whole documents.
+func NewProjection() *Projection {
+	return &Projection{}
+}
+
+// Include returns fields, dotted paths, and leaves out the others, except _id.
+func (p *Projection) Include(fields ...string) *Projection {
+	for _, field := range fields {
+		p.set(field, 1)
+	}
+	return p
+}
+
+// Exclude leaves out fields and returns the others.
+func (p *Projection) Exclude(fields ...string) *Projection {
+	for _, field := range fields {
+		p.set(field, 0)
+	}
+	return p
+}
+
+// Slice returns the first limit elements of the array field, or the last
+// ones when limit is negative. The other fields are returned unless
+// Include is used.
+func (p *Projection) Slice(field string, limit int) *Projection {
+	p.set(field, bson.D{{Key: "$slice", Value: limit}})
+	return p
+}
+
+// SliceRange returns limit elements of the array field after skipping skip
+// of them; a negative skip counts from the end.
+func (p *Projection) SliceRange(field string, skip, limit int) *Projection {
+	if limit <= 0 {
+		p.err = fmt.Errorf("slice of %q: limit must be positive", field)
+		return p
+	}
+	p.set(field, bson.D{{Key: "$slice", Value: bson.A{skip, limit}}})
+	return p
+}
+
+// ElemMatch returns only the first element of the top-level array field that
+// matches c, built as for Condition.ElemMatch, and leaves out the field when
+// no element matches.
+//
+// Example usage:
+//
+//	pie.NewProjection().Include("name").ElemMatch("scores", pie.DefaultCondition().Gte("", 80))
+func (p *Projection) ElemMatch(field string, c Condition) *Projection {
+	if strings.Contains(field, ".") {
+		p.err = fmt.Errorf("elemMatch projection of %q: only top-level fields are supported", field)
+		return p
+	}
+	d, err := DefaultCondition().ElemMatch(field, c).Filters()
+	if err != nil {
+		p.err = err
+		return p
+	}
+	p.set(field, bson.D{{Key: "$elemMatch", Value: d[0].Value.(bson.M)["$elemMatch"]}})
+	return p
+}
+
+// Meta sets field to the metadata keyword, "textScore" or "indexKey".
+func (p *Projection) Meta(field, keyword string) *Projection {
+	p.set(field, bson.D{{Key: "$meta", Value: keyword}})
+	return p
+}
+
+// set adds field to the projection, replacing an earlier value of the same
+// field and rejecting the combinations the server rejects.
+func (p *Projection) set(field string, value any) {
+	if p.err != nil {
+		return
+	}
+	if field == "" {
+		p.err = errors.New("projection field cannot be empty")
+		return
+	}
+	at := -1
+	for i, e := range p.d {
+		switch {
+		case e.Key == field:
+			at = i
+		case strings.HasPrefix(e.Key, field+".") || strings.HasPrefix(field, e.Key+"."):
+			p.err = fmt.Errorf("projection path collision between %q and %q", e.Key, field)
+			return
+		}
+	}
+	if on, ok := projectionFlag(value); ok && field != "_id" {
+		for i, e := range p.d {
+			if other, ok := projectionFlag(e.Value); ok && other != on && i != at && e.Key != "_id" {
+				p.err = fmt.Errorf("projection cannot mix inclusion and exclusion: %q and %q", e.Key, field)
+				return
+			}
+		}
+	}
+	if at >= 0 {
+		p.d[at].Value = value
+		return
+	}
+	p.d = append(p.d, bson.E{Key: field, Value: value})
+}
+
+// projectionFlag reports whether value includes a field, and whether it is
+// an inclusion or exclusion at all. $elemMatch counts as an inclusion.
+func projectionFlag(value any) (include bool, ok bool) {
+	switch v := value.(type) {
+	case int:
+		return v != 0, true
+	case bson.D:
+		return true, v[0].Key == "$elemMatch"
+	}
+	return false, false
+}
+
+// Document returns the projection document and the first error of the builder.
+func (p *Projection) Document() (bson.D, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.d == nil {
+		return bson.D{}, nil
+	}
+	return p.d, nil
+}
+
+// Err returns the first error of the builder.
+func (p *Projection) Err() error {
+	return p.err
+}
+
+// MarshalBSON encodes the projection document, so a *Projection can be given
+// wherever the driver takes a projection.
+func (p *Projection) MarshalBSON() ([]byte, error) {
+	d, err := p.Document()
+	if err != nil {
+		return nil, err
+	}
+	return bson.Marshal(d)
+}
+
+// ProjectionOf returns the projection that fetches the bson fields of dto, a
+// struct or a pointer to a struct or slice of structs. Fields holding
+// embedded documents are projected field by field, so a nested DTO fetches
+// only its own fields too. _id is left out unless dto has it.
+//
+// Example usage:
+//
+//	type userCard struct {
+//		Name    string `bson:"name"`
+//		Address struct {
+//			City string `bson:"city"`
+//		} `bson:"address"`
+//	}
+//	pie.ProjectionOf(&userCard{}) // {name: 1, "address.city": 1, _id: 0}
+func ProjectionOf(dto any) *Projection {
+	p := NewProjection()
+	t := reflect.TypeOf(dto)
+	if t == nil {
+		p.err = errors.New("select needs a struct, got nil")
+		return p
+	}
+	t = indirectType(t)
+	if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = indirectType(t.Elem())
+	}
+	if t.Kind() != reflect.Struct {
+		p.err = fmt.Errorf("select needs a struct, got %T", dto)
+		return p
+	}
+	paths := selectPaths(t, "", map[reflect.Type]bool{})
+	if len(paths) == 0 {
+		p.err = fmt.Errorf("select: %s has no bson fields", t)
+		return p
+	}
+	p.Include(paths...)
+	hasID := false
+	for _, path := range paths {
+		hasID = hasID || path == "_id"
+	}
+	if !hasID {
+		p.Exclude("_id")
+	}
+	return p
+}
+
+// selectPaths lists the paths ProjectionOf includes for struct type t: the
+// leaves of embedded documents, and whole fields of other types and of
+// recursive or empty structs.
+func selectPaths(t reflect.Type, prefix string, seen map[reflect.Type]bool) []string {
+	seen[t] = true
+	defer delete(seen, t)
+	var paths []string
+	for _, f := range bsonstruct.Fields(t) {
+		path := prefix + f.Name
+		ft := indirectType(f.Field.Type)
+		if isArrayType(ft) {
+			ft = indirectType(ft.Elem())
+		}
+		if ft.Kind() == reflect.Struct && classOf(ft) == classDocument && !seen[ft] {
+			if sub := selectPaths(ft, path+".", seen); len(sub) > 0 {
+				paths = append(paths, sub...)
+				continue
+			}
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
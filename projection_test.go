@@ -0,0 +1,108 @@
+package pie
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type cardAddress struct {
+	City    string `bson:"city"`
+	Country string `bson:"country"`
+}
+
+type CardBase struct {
+	Name string `bson:"name"`
+}
+
+type userCard struct {
+	CardBase `bson:",inline"`
+	Address  cardAddress `bson:"address"`
+	Orders   []cardOrder `bson:"orders"`
+	Joined   time.Time   `bson:"joined"`
+	Parent   *userCard   `bson:"parent"`
+	Extra    bson.M      `bson:"extra"`
+	Empty    struct{}    `bson:"empty"`
+	Ignored  string      `bson:"-"`
+	Balance  primitive.Decimal128
+}
+
+type cardOrder struct {
+	Total float64 `bson:"total"`
+}
+
+func TestProjection(t *testing.T) {
+	Convey("Projection builder", t, func() {
+		Convey("Fields and operators are added in order", func() {
+			d, err := NewProjection().
+				Include("name", "address.city").
+				Slice("comments", -5).
+				SliceRange("tags", 2, 3).
+				ElemMatch("scores", DefaultCondition().Gte("", 80)).
+				Meta("score", "textScore").
+				Exclude("_id").
+				Document()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{
+				{Key: "name", Value: 1},
+				{Key: "address.city", Value: 1},
+				{Key: "comments", Value: bson.D{{Key: "$slice", Value: -5}}},
+				{Key: "tags", Value: bson.D{{Key: "$slice", Value: bson.A{2, 3}}}},
+				{Key: "scores", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "$gte", Value: 80}}}}},
+				{Key: "score", Value: bson.D{{Key: "$meta", Value: "textScore"}}},
+				{Key: "_id", Value: 0},
+			})
+		})
+
+		Convey("Invalid projections keep an error", func() {
+			So(NewProjection().Include("name").Exclude("email").Err(), ShouldNotBeNil)
+			So(NewProjection().Exclude("email").ElemMatch("scores", DefaultCondition().Gt("", 1)).Err(), ShouldNotBeNil)
+			So(NewProjection().Include("address").Include("address.city").Err(), ShouldNotBeNil)
+			So(NewProjection().ElemMatch("a.b", DefaultCondition().Gt("", 1)).Err(), ShouldNotBeNil)
+			So(NewProjection().SliceRange("tags", 0, 0).Err(), ShouldNotBeNil)
+			So(NewProjection().Include("").Err(), ShouldNotBeNil)
+			So(NewProjection().Include("a", "b").Exclude("a").Err(), ShouldNotBeNil)
+
+			_, err := bson.Marshal(bson.M{"p": NewProjection().Include("a").Exclude("b")})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Repeated fields are replaced", func() {
+			d, err := NewProjection().Include("name").Slice("name", 2).Document()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{{Key: "name", Value: bson.D{{Key: "$slice", Value: 2}}}})
+
+			d, err = NewProjection().Include("a").Exclude("a").Document()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{{Key: "a", Value: 0}})
+		})
+	})
+
+	Convey("ProjectionOf derives the fields of a DTO", t, func() {
+		d, err := ProjectionOf(&[]userCard{}).Document()
+		So(err, ShouldBeNil)
+		So(d, ShouldResemble, bson.D{
+			{Key: "name", Value: 1},
+			{Key: "address.city", Value: 1},
+			{Key: "address.country", Value: 1},
+			{Key: "orders.total", Value: 1},
+			{Key: "joined", Value: 1},
+			{Key: "parent", Value: 1},
+			{Key: "extra", Value: 1},
+			{Key: "empty", Value: 1},
+			{Key: "balance", Value: 1},
+			{Key: "_id", Value: 0},
+		})
+
+		d, err = ProjectionOf(person{}).Document()
+		So(err, ShouldBeNil)
+		So(d, ShouldResemble, bson.D{{Key: "_id", Value: 1}, {Key: "name", Value: 1}})
+
+		So(ProjectionOf(nil).Err(), ShouldNotBeNil)
+		So(ProjectionOf("name").Err(), ShouldNotBeNil)
+		So(ProjectionOf(&struct{ x int }{}).Err(), ShouldNotBeNil)
+	})
+}
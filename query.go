@@ -0,0 +1,548 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// QueryError reports a syntax or validation error in a text query.
+// Offset is the byte offset of the offending token; Line and Column are 1-based.
+type QueryError struct {
+	Offset int
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("query:%d:%d: %s", e.Line, e.Column, e.Msg)
+}
+
+// QueryParser compiles text queries into Conditions. The grammar is
+//
+//	expr       = and { "or" and }
+//	and        = unary { "and" unary }
+//	unary      = "not" unary | "(" expr ")" | comparison
+//	comparison = field ( "=" | "!=" | ">" | ">=" | "<" | "<=" ) value
+//	           | field [ "not" ] "in" list
+//	           | field "~" /pattern/flags
+//	           | field "exists"
+//	value      = string | number | true | false | null | list
+//	           | date("2006-01-02") | date("2006-01-02T15:04:05Z07:00") | oid("hex")
+//	list       = "[" [ value { "," value } ] "]"
+//
+// Keywords are case-insensitive, fields may be dotted paths and strings are
+// double-quoted Go string literals. For example:
+//
+//	status = "active" and age >= 18 and (name ~ /^jo/i or tags in ["a", "b"])
+type QueryParser struct {
+	allow func(field string) bool
+}
+
+// NewQueryParser returns a parser accepting every field.
+func NewQueryParser() *QueryParser {
+	return &QueryParser{}
+}
+
+// SetAllowlist makes the parser reject fields for which allow returns false.
+func (p *QueryParser) SetAllowlist(allow func(field string) bool) *QueryParser {
+	p.allow = allow
+	return p
+}
+
+// AllowFields makes the parser accept only the given fields.
+func (p *QueryParser) AllowFields(fields ...string) *QueryParser {
+	allowed := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		allowed[f] = true
+	}
+	return p.SetAllowlist(func(field string) bool {
+		return allowed[field]
+	})
+}
+
+// Parse compiles query into a Condition that can be chained further.
+// Errors are *QueryError values pointing at the offending token.
+func (p *QueryParser) Parse(query string) (Condition, error) {
+	tokens, err := lexQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	qp := &queryParser{src: query, tokens: tokens, allow: p.allow}
+	d, err := qp.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := qp.peek(); tok.kind != tokEOF {
+		return nil, qp.errorf(tok, "unexpected %s", tok)
+	}
+	return DefaultCondition().FilterBson(d), nil
+}
+
+// ParseQuery compiles query into a Condition using a parser that accepts every field.
+//
+// Example usage:
+//
+//	cond, err := pie.ParseQuery(`status = "active" and age >= 18`)
+//	filters, err := cond.Filters()
+//	err = client.FilterBson(filters).FindAll(&users)
+func ParseQuery(query string) (Condition, error) {
+	return NewQueryParser().Parse(query)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokRegex
+	tokOp
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of query"
+	case tokString:
+		return "string " + t.text
+	case tokNumber:
+		return "number " + t.text
+	case tokRegex:
+		return "regular expression " + t.text
+	}
+	return strconv.Quote(t.text)
+}
+
+func (t token) is(keyword string) bool {
+	return t.kind == tokIdent && strings.EqualFold(t.text, keyword)
+}
+
+func lexQuery(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		r, size := utf8.DecodeRuneInString(src[i:])
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+			continue
+		case r == '_' || unicode.IsLetter(r):
+			for i < len(src) {
+				r, size := utf8.DecodeRuneInString(src[i:])
+				if r != '_' && r != '.' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				i += size
+			}
+			tokens = append(tokens, token{tokIdent, src[start:i], start})
+		case r == '"':
+			end, err := scanString(src, i)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+			tokens = append(tokens, token{tokString, src[start:i], start})
+		case r == '-' || (r >= '0' && r <= '9'):
+			i++
+			for i < len(src) && strings.IndexByte("0123456789.eE+-", src[i]) >= 0 {
+				if (src[i] == '+' || src[i] == '-') && src[i-1] != 'e' && src[i-1] != 'E' {
+					break
+				}
+				i++
+			}
+			tokens = append(tokens, token{tokNumber, src[start:i], start})
+		case r == '/' && len(tokens) > 0 && tokens[len(tokens)-1].text == "~":
+			end, err := scanRegex(src, i)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+			tokens = append(tokens, token{tokRegex, src[start:i], start})
+		case strings.HasPrefix(src[i:], ">=") || strings.HasPrefix(src[i:], "<=") ||
+			strings.HasPrefix(src[i:], "!=") || strings.HasPrefix(src[i:], "=="):
+			i += 2
+			tokens = append(tokens, token{tokOp, src[start:i], start})
+		case strings.ContainsRune("=<>~", r):
+			i++
+			tokens = append(tokens, token{tokOp, src[start:i], start})
+		case strings.ContainsRune("()[],", r):
+			i++
+			kind := map[rune]tokenKind{'(': tokLParen, ')': tokRParen, '[': tokLBracket, ']': tokRBracket, ',': tokComma}[r]
+			tokens = append(tokens, token{kind, src[start:i], start})
+		default:
+			return nil, newQueryError(src, start, fmt.Sprintf("unexpected character %q", r))
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+func scanString(src string, start int) (int, error) {
+	for i := start + 1; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, nil
+		}
+	}
+	return 0, newQueryError(src, start, "unterminated string")
+}
+
+func scanRegex(src string, start int) (int, error) {
+	for i := start + 1; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case '/':
+			i++
+			for i < len(src) && unicode.IsLetter(rune(src[i])) {
+				i++
+			}
+			return i, nil
+		}
+	}
+	return 0, newQueryError(src, start, "unterminated regular expression")
+}
+
+func newQueryError(src string, offset int, msg string) *QueryError {
+	line := 1 + strings.Count(src[:offset], "\n")
+	lineStart := strings.LastIndexByte(src[:offset], '\n') + 1
+	return &QueryError{
+		Offset: offset,
+		Line:   line,
+		Column: utf8.RuneCountInString(src[lineStart:offset]) + 1,
+		Msg:    msg,
+	}
+}
+
+// maxQueryDepth bounds the nesting of parentheses, "not" and lists, so that
+// untrusted queries cannot exhaust the stack of the recursive parser.
+const maxQueryDepth = 64
+
+type queryParser struct {
+	src    string
+	tokens []token
+	next   int
+	depth  int
+	allow  func(field string) bool
+}
+
+func (p *queryParser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *queryParser) advance() token {
+	tok := p.tokens[p.next]
+	if tok.kind != tokEOF {
+		p.next++
+	}
+	return tok
+}
+
+func (p *queryParser) errorf(tok token, format string, a ...any) error {
+	return newQueryError(p.src, tok.pos, fmt.Sprintf(format, a...))
+}
+
+// enter opens a level of nesting at tok; leave closes it.
+func (p *queryParser) enter(tok token) error {
+	p.depth++
+	if p.depth > maxQueryDepth {
+		return p.errorf(tok, "query is nested deeper than %d levels", maxQueryDepth)
+	}
+	return nil
+}
+
+func (p *queryParser) leave() {
+	p.depth--
+}
+
+func (p *queryParser) expect(kind tokenKind, what string) (token, error) {
+	tok := p.advance()
+	if tok.kind != kind {
+		return tok, p.errorf(tok, "expected %s, found %s", what, tok)
+	}
+	return tok, nil
+}
+
+func (p *queryParser) parseExpr() (bson.D, error) {
+	clauses, err := p.parseList("or", p.parseAnd)
+	if err != nil || len(clauses) == 1 {
+		return first(clauses), err
+	}
+	return bson.D{{Key: "$or", Value: clauses}}, nil
+}
+
+func (p *queryParser) parseAnd() (bson.D, error) {
+	clauses, err := p.parseList("and", p.parseUnary)
+	if err != nil || len(clauses) == 1 {
+		return first(clauses), err
+	}
+	// Conjunctions are flattened into one document unless a key repeats.
+	seen := map[string]bool{}
+	var flat bson.D
+	for _, c := range clauses {
+		for _, e := range c.(bson.D) {
+			if seen[e.Key] {
+				return bson.D{{Key: "$and", Value: clauses}}, nil
+			}
+			seen[e.Key] = true
+			flat = append(flat, e)
+		}
+	}
+	return flat, nil
+}
+
+func (p *queryParser) parseList(keyword string, parse func() (bson.D, error)) (bson.A, error) {
+	var clauses bson.A
+	for {
+		d, err := parse()
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, d)
+		if !p.peek().is(keyword) {
+			return clauses, nil
+		}
+		p.advance()
+	}
+}
+
+func first(clauses bson.A) bson.D {
+	if len(clauses) == 0 {
+		return nil
+	}
+	return clauses[0].(bson.D)
+}
+
+func (p *queryParser) parseUnary() (bson.D, error) {
+	tok := p.peek()
+	if tok.is("not") || tok.kind == tokLParen {
+		if err := p.enter(tok); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+	}
+	switch {
+	case tok.is("not"):
+		p.advance()
+		d, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "$nor", Value: bson.A{d}}}, nil
+	case tok.kind == tokLParen:
+		p.advance()
+		d, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRParen, `")"`); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	return p.parseComparison()
+}
+
+var queryOperators = map[string]string{
+	"!=": "$ne",
+	">":  "$gt",
+	">=": "$gte",
+	"<":  "$lt",
+	"<=": "$lte",
+}
+
+func (p *queryParser) parseComparison() (bson.D, error) {
+	field, err := p.expect(tokIdent, "field name")
+	if err != nil {
+		return nil, err
+	}
+	if isQueryKeyword(field.text) {
+		return nil, p.errorf(field, "expected field name, found keyword %q", field.text)
+	}
+	for _, part := range strings.Split(field.text, ".") {
+		if part == "" {
+			return nil, p.errorf(field, "invalid field path %q", field.text)
+		}
+	}
+	if p.allow != nil && !p.allow(field.text) {
+		return nil, p.errorf(field, "field %q is not allowed", field.text)
+	}
+	key := field.text
+
+	op := p.advance()
+	switch {
+	case op.text == "=" || op.text == "==":
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: key, Value: v}}, nil
+	case queryOperators[op.text] != "":
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: key, Value: bson.D{{Key: queryOperators[op.text], Value: v}}}}, nil
+	case op.text == "~":
+		tok, err := p.expect(tokRegex, "regular expression")
+		if err != nil {
+			return nil, err
+		}
+		re, err := p.regex(tok)
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: key, Value: re}}, nil
+	case op.is("exists"):
+		return bson.D{{Key: key, Value: bson.D{{Key: "$exists", Value: true}}}}, nil
+	case op.is("in"), op.is("not") && p.peek().is("in"):
+		name := "$in"
+		if op.is("not") {
+			p.advance()
+			name = "$nin"
+		}
+		if p.peek().kind != tokLBracket {
+			return nil, p.errorf(p.peek(), "expected list, found %s", p.peek())
+		}
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: key, Value: bson.D{{Key: name, Value: v}}}}, nil
+	}
+	return nil, p.errorf(op, "expected operator after field %q, found %s", key, op)
+}
+
+func isQueryKeyword(s string) bool {
+	switch strings.ToLower(s) {
+	case "and", "or", "not", "in", "exists", "true", "false", "null":
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) regex(tok token) (primitive.Regex, error) {
+	end := strings.LastIndexByte(tok.text, '/')
+	pattern, flags := tok.text[1:end], tok.text[end+1:]
+	for i, f := range flags {
+		if !strings.ContainsRune("imsx", f) {
+			return primitive.Regex{}, newQueryError(p.src, tok.pos+end+1+i, fmt.Sprintf("unknown regular expression flag %q", f))
+		}
+	}
+	return primitive.Regex{Pattern: strings.ReplaceAll(pattern, `\/`, "/"), Options: flags}, nil
+}
+
+func (p *queryParser) parseValue() (any, error) {
+	tok := p.advance()
+	switch tok.kind {
+	case tokString:
+		s, err := strconv.Unquote(tok.text)
+		if err != nil {
+			return nil, p.errorf(tok, "invalid string %s", tok.text)
+		}
+		return s, nil
+	case tokNumber:
+		n, err := strconv.ParseInt(tok.text, 10, 64)
+		if err == nil {
+			return n, nil
+		}
+		if errors.Is(err, strconv.ErrRange) {
+			return nil, p.errorf(tok, "integer %s overflows int64", tok.text)
+		}
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.errorf(tok, "invalid number %s", tok.text)
+		}
+		return f, nil
+	case tokLBracket:
+		if err := p.enter(tok); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		list := bson.A{}
+		if p.peek().kind == tokRBracket {
+			p.advance()
+			return list, nil
+		}
+		for {
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			sep := p.advance()
+			if sep.kind == tokRBracket {
+				return list, nil
+			}
+			if sep.kind != tokComma {
+				return nil, p.errorf(sep, `expected "," or "]", found %s`, sep)
+			}
+		}
+	case tokIdent:
+		switch {
+		case tok.is("true"):
+			return true, nil
+		case tok.is("false"):
+			return false, nil
+		case tok.is("null"):
+			return nil, nil
+		case tok.is("date"), tok.is("oid"):
+			return p.parseTyped(tok)
+		}
+	}
+	return nil, p.errorf(tok, "expected value, found %s", tok)
+}
+
+// parseTyped parses the date("...") and oid("...") literals.
+func (p *queryParser) parseTyped(name token) (any, error) {
+	if _, err := p.expect(tokLParen, `"("`); err != nil {
+		return nil, err
+	}
+	arg, err := p.expect(tokString, "string")
+	if err != nil {
+		return nil, err
+	}
+	s, err := strconv.Unquote(arg.text)
+	if err != nil {
+		return nil, p.errorf(arg, "invalid string %s", arg.text)
+	}
+	if _, err := p.expect(tokRParen, `")"`); err != nil {
+		return nil, err
+	}
+
+	if name.is("oid") {
+		id, err := primitive.ObjectIDFromHex(s)
+		if err != nil {
+			return nil, p.errorf(arg, "invalid ObjectID %q", s)
+		}
+		return id, nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return nil, p.errorf(arg, "invalid date %q, expected 2006-01-02 or RFC 3339", s)
+}
@@ -0,0 +1,109 @@
+package pie
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseQuery(t *testing.T) {
+	Convey("Text queries compile into conditions", t, func() {
+		Convey("Conjunctions are flattened and disjunctions become $or", func() {
+			cond, err := ParseQuery(`status = "active" and age >= 18 and (name ~ /^jo/i or tags in ["a","b"])`)
+			So(err, ShouldBeNil)
+			d, err := cond.Filters()
+			So(err, ShouldBeNil)
+			So(d, ShouldResemble, bson.D{
+				{Key: "status", Value: "active"},
+				{Key: "age", Value: bson.D{{Key: "$gte", Value: int64(18)}}},
+				{Key: "$or", Value: bson.A{
+					bson.D{{Key: "name", Value: primitive.Regex{Pattern: "^jo", Options: "i"}}},
+					bson.D{{Key: "tags", Value: bson.D{{Key: "$in", Value: bson.A{"a", "b"}}}}},
+				}},
+			})
+		})
+
+		Convey("Repeated keys, negation and typed literals", func() {
+			cond, err := ParseQuery(`age > 1.5 AND age < 65 and not deleted exists and tags not in [] and ` +
+				`owner = oid("5f1d7a3c9d1e8a2b3c4d5e6f") and created_at >= date("2024-03-01")`)
+			So(err, ShouldBeNil)
+			d, err := cond.Filters()
+			So(err, ShouldBeNil)
+			id, _ := primitive.ObjectIDFromHex("5f1d7a3c9d1e8a2b3c4d5e6f")
+			So(d, ShouldResemble, bson.D{{Key: "$and", Value: bson.A{
+				bson.D{{Key: "age", Value: bson.D{{Key: "$gt", Value: 1.5}}}},
+				bson.D{{Key: "age", Value: bson.D{{Key: "$lt", Value: int64(65)}}}},
+				bson.D{{Key: "$nor", Value: bson.A{bson.D{{Key: "deleted", Value: bson.D{{Key: "$exists", Value: true}}}}}}},
+				bson.D{{Key: "tags", Value: bson.D{{Key: "$nin", Value: bson.A{}}}}},
+				bson.D{{Key: "owner", Value: id}},
+				bson.D{{Key: "created_at", Value: bson.D{{Key: "$gte", Value: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)}}}},
+			}}})
+		})
+
+		Convey("Compiled conditions evaluate like the query reads", func() {
+			cond, err := ParseQuery(`name ~ /^jo/i and (age < 18 or vip = true)`)
+			So(err, ShouldBeNil)
+			ok, err := cond.Match(bson.M{"name": "John", "age": 30, "vip": true})
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			ok, err = cond.Match(bson.M{"name": "John", "age": 30})
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Errors point at the offending token", func() {
+			cases := []struct {
+				query  string
+				column int
+			}{
+				{`age >= `, 8},
+				{`age >= 18 and (name = "x"`, 26},
+				{`name ~ /^a/q`, 12},
+				{`status = "active`, 10},
+				{`a = 1 b = 2`, 7},
+				{"a = 1 and\n  b # 2", 5},
+				{`id = oid("zz")`, 10},
+				{`a. = 1`, 1},
+				{`x = 1 or a..b = 1`, 10},
+				{`a = 9223372036854775808`, 5},
+				{`a = -9223372036854775809`, 5},
+			}
+			for _, c := range cases {
+				_, err := ParseQuery(c.query)
+				var qe *QueryError
+				So(errors.As(err, &qe), ShouldBeTrue)
+				So(qe.Column, ShouldEqual, c.column)
+			}
+			_, err := ParseQuery("a = 1 and\n  b # 2")
+			So(err.Error(), ShouldEqual, `query:2:5: unexpected character '#'`)
+		})
+
+		Convey("Nesting is bounded", func() {
+			_, err := ParseQuery(strings.Repeat("(", maxQueryDepth) + "a = 1" + strings.Repeat(")", maxQueryDepth))
+			So(err, ShouldBeNil)
+			for _, query := range []string{
+				strings.Repeat("(", 100000) + "a = 1",
+				strings.Repeat("not ", 100000) + "a = 1",
+				"a in " + strings.Repeat("[", 100000),
+			} {
+				_, err := ParseQuery(query)
+				var qe *QueryError
+				So(errors.As(err, &qe), ShouldBeTrue)
+			}
+		})
+
+		Convey("The allowlist rejects unknown fields", func() {
+			p := NewQueryParser().AllowFields("status", "age")
+			_, err := p.Parse(`status = "a" and age > 1`)
+			So(err, ShouldBeNil)
+			_, err = p.Parse(`status = "a" or password = "x"`)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, `query:1:17: field "password" is not allowed`)
+		})
+	})
+}
@@ -4,18 +4,20 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/5xxxx/pie/geo"
+	"github.com/5xxxx/pie/internal/mql"
+	"github.com/5xxxx/pie/schemas"
 	"github.com/5xxxx/pie/utils"
 	"go.mongodb.org/mongo-driver/bson/bsoncodec"
 	"go.mongodb.org/mongo-driver/mongo/readconcern"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"io"
 	"reflect"
 	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
-
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -46,7 +48,8 @@ type Session interface {
 	FindAll(rowsSlicePtr any, ctx ...context.Context) error
 
 	// InsertOne executes an insert command to insert a single document into the collectionByName.
-	InsertOne(doc any, ctx ...context.Context) (primitive.ObjectID, error)
+	// It returns the id of the document, see IDGenerators.
+	InsertOne(doc any, ctx ...context.Context) (any, error)
 
 	// InsertMany executes an insert command to insert multiple documents into the collectionByName.
 	InsertMany(docs any, ctx ...context.Context) (*mongo.InsertManyResult, error)
@@ -65,6 +68,13 @@ type Session interface {
 
 	Skip(i int64) Session
 	Project(i any) Session
+
+	// Select projects the bson fields of dto, a smaller struct the results are decoded into; see ProjectionOf.
+	// The collection must be named with SetCollection.
+	Select(dto any) Session
+
+	// Populate loads the models referenced by the `pie:"ref:..."` fields named by paths after FindOne, FindAll and FindPagination.
+	Populate(paths ...string) Session
 	Count(i any, ctx ...context.Context) (int64, error)
 
 	UpdateOne(bean any, ctx ...context.Context) (*mongo.UpdateResult, error)
@@ -123,7 +133,7 @@ type Session interface {
 	//        { $or: [ { qty: { $lt : 10 } }, { qty : { $gt: 50 } } ] },
 	//        { $or: [ { sale: true }, { price : { $lt : 5 } } ] }
 	// ]
-	And(c Condition) Session
+	And(c ...Condition) Session
 
 	// Not { field: { $not: { <operator-expression> } } }
 	//not and Regular Expressions
@@ -133,13 +143,43 @@ type Session interface {
 	// Nor { $nor: [ { price: 1.99 }, { price: { $exists: false } },
 	// { sale: true }, { sale: { $exists: false } } ] }
 	// price != 1.99 || sale != true || sale exists || sale exists
-	Nor(c Condition) Session
+	Nor(c ...Condition) Session
 
 	// Or { $or: [ { quantity: { $lt: 20 } }, { price: 10 } ] }
-	Or(c Condition) Session
+	Or(c ...Condition) Session
 
 	Exists(key string, exists bool, filter ...Condition) Session
 
+	// ElemMatch matches arrays with an element satisfying c; see Condition.ElemMatch.
+	ElemMatch(key string, c Condition) Session
+
+	// All matches arrays holding every value of values.
+	All(key string, values any) Session
+
+	// Size matches arrays with exactly n elements.
+	Size(key string, n int) Session
+
+	// Mod matches documents whose field key divided by divisor leaves remainder.
+	Mod(key string, divisor, remainder int64) Session
+
+	// BitsAllSet matches documents whose field key has all of bits set; see Condition.BitsAllSet.
+	BitsAllSet(key string, bits any) Session
+
+	// BitsAnySet matches documents whose field key has any of bits set.
+	BitsAnySet(key string, bits any) Session
+
+	// BitsAllClear matches documents whose field key has all of bits clear.
+	BitsAllClear(key string, bits any) Session
+
+	// BitsAnyClear matches documents whose field key has any of bits clear.
+	BitsAnyClear(key string, bits any) Session
+
+	// JSONSchema matches documents valid against schema.
+	JSONSchema(schema any) Session
+
+	// Comment tags the query in the server's logs and profiler.
+	Comment(comment string) Session
+
 	// SetArrayFilters sets the value for the ArrayFilters field.
 	SetArrayFilters(filters options.ArrayFilters) Session
 
@@ -179,15 +219,57 @@ type Session interface {
 
 	// Expr Allows the use of aggregation expressions within the query language.
 	//{ $expr: { <expression> } }
-	//$expr can build query expressions that compare fields from the same document in a $match stage
-	//todo 没用过，不知道行不行。。https://docs.mongodb.com/manual/reference/operator/query/expr/#op._S_expr
-	Expr(c Condition) Session
-
-	// Regex todo 简单实现，后续增加支持
-	Regex(key string, value string) Session
+	//$expr can build query expressions that compare fields from the same document in a $match stage;
+	//the expression is a Condition or a value built with package expr
+	Expr(expression any) Session
+
+	// Regex { field: { $regex: pattern, $options: opts } }; opts holds the options i, m, s and x
+	Regex(key string, pattern string, opts string) Session
+	// StartsWith, EndsWith, Contains and EqualFold match user input literally
+	StartsWith(key string, prefix string) Session
+	EndsWith(key string, suffix string) Session
+	Contains(key string, substr string) Session
+	EqualFold(key string, s string) Session
+
+	// Text searches the collection's text index; see Condition.Text.
+	Text(search, language string, caseSensitive, diacriticSensitive bool) Session
+	// SortByScore sorts by text search relevance, best first, then by colNames
+	// as in Sort.
+	SortByScore(colNames ...string) Session
+	// ProjectScore adds the text search relevance to the projection as field.
+	ProjectScore(field string) Session
+
+	// Near matches documents near point, nearest first; see Condition.Near.
+	Near(key string, point geo.Point, maxDistance, minDistance float64) Session
+	// NearSphere is Near with $nearSphere.
+	NearSphere(key string, point geo.Point, maxDistance, minDistance float64) Session
+	// GeoWithin matches documents lying within shape.
+	GeoWithin(key string, shape geo.Shape) Session
+	// GeoIntersects matches documents intersecting geometry.
+	GeoIntersects(key string, geometry geo.Geometry) Session
 
 	SetDatabase(db string) Session
 
+	// SetCollection makes the session's operations target the named collection
+	// instead of the one derived from the document type.
+	SetCollection(name string) Session
+
+	// Export streams the matching documents of the collection set with SetCollection to w.
+	Export(ctx context.Context, w io.Writer, format ExportFormat) error
+
+	// Import inserts or upserts the JSON Lines documents read from r into the collection set with SetCollection.
+	Import(ctx context.Context, r io.Reader, opts ...*ImportOptions) (*ImportResult, error)
+
+	// Shell renders the find command FindAll(doc) sends as mongosh syntax.
+	Shell(doc any) (string, error)
+
+	// ShellUpdate renders the updateOne, or updateMany, command UpdateOneBson(doc, update) sends as mongosh syntax;
+	// a nil update renders the command of UpdateOne(doc).
+	ShellUpdate(doc any, update any, many bool) (string, error)
+
+	// String renders the find command on the collection set with SetCollection.
+	String() string
+
 	SetCollRegistry(r *bsoncodec.Registry) Session
 
 	SetCollReadPreference(rp *readpref.ReadPref) Session
@@ -195,6 +277,9 @@ type Session interface {
 	SetCollWriteConcern(wc *writeconcern.WriteConcern) Session
 
 	SetReadConcern(rc *readconcern.ReadConcern) Session
+
+	// Strict turns on checking filter, sort and projection keys against the model's bson fields.
+	Strict(strict bool) Session
 }
 
 type session struct {
@@ -215,6 +300,11 @@ type session struct {
 	replaceOpts           []*options.ReplaceOptions
 	bulkWriteOptions      []*options.BulkWriteOptions
 	collOpts              []*options.CollectionOptions
+	strict                bool
+	collection            string
+	populates             []string
+	ids                   []any
+	selected              bool
 }
 
 func (s *session) Project(i any) Session {
@@ -224,6 +314,21 @@ func (s *session) Project(i any) Session {
 	return s
 }
 
+// Select sets the projection to the bson fields of dto, as ProjectionOf
+// derives them, so that the results decode into dto without fetching the
+// rest of the document. The results are not the model stored in the
+// collection, so it must be named with SetCollection: the session's queries
+// fail without it rather than query the collection of the DTO.
+//
+// Example usage:
+//
+//	var cards []userCard
+//	err := client.NewSession().SetCollection("user").Select(&userCard{}).Eq("active", true).FindAll(&cards)
+func (s *session) Select(dto any) Session {
+	s.selected = true
+	return s.Project(ProjectionOf(dto))
+}
+
 // Soft sets the `deleted_at` field of the session's filter object to the given value.
 // If `f` is true, it indicates that the session is soft-deleted.
 // If `f` is false, it indicates that the session is not soft-deleted.
@@ -302,6 +407,9 @@ func (s *session) FindPagination(needCount bool, rowsSlicePtr any, ctx ...contex
 	if err = cursor.All(c, rowsSlicePtr); err != nil {
 		return 0, err
 	}
+	if err = s.populate(c, rowsSlicePtr); err != nil {
+		return 0, err
+	}
 	return rowCount, nil
 }
 
@@ -322,10 +430,13 @@ func (s *session) BulkWrite(docs any, ctx ...context.Context) (*mongo.BulkWriteR
 	if err != nil {
 		return nil, err
 	}
-	values := reflect.ValueOf(docs)
+	many, err := s.assignIDs(docs)
+	if err != nil {
+		return nil, err
+	}
 	var mods []mongo.WriteModel
-	for i := 0; i < values.Len(); i++ {
-		mods = append(mods, mongo.NewInsertOneModel().SetDocument(values.Index(i).Interface()))
+	for _, doc := range many {
+		mods = append(mods, mongo.NewInsertOneModel().SetDocument(doc))
 	}
 	c := s.prepareContext(ctx...)
 
@@ -372,6 +483,8 @@ func (s *session) Distinct(doc any, columns string, ctx ...context.Context) ([]a
 // Then, it retrieves the filters from the session's filter object using the s.filter.Filters method.
 // If an error occurs during this retrieval, it is returned along with nil as the *mongo.UpdateResult.
 // It prepares the context by creating a new context if ctx is not provided or using the provided context otherwise.
+// Without filters, the document matching the primary key of doc is replaced, see KeyFilter;
+// with SetUpsert(true) this saves doc by its key.
 // Finally, it calls the coll.ReplaceOne method to perform the replacement and returns the result or any error encountered.
 func (s *session) ReplaceOne(doc any, ctx ...context.Context) (*mongo.UpdateResult, error) {
 	coll, err := s.collectionForStruct(doc)
@@ -379,14 +492,16 @@ func (s *session) ReplaceOne(doc any, ctx ...context.Context) (*mongo.UpdateResu
 		return nil, err
 	}
 
-	filters, err := s.filter.Filters()
+	filters, err := s.replaceFilters(doc)
 	if err != nil {
 		return nil, err
 	}
 
 	c := s.prepareContext(ctx...)
 
-	return coll.ReplaceOne(c, filters, doc, s.replaceOpts...)
+	result, err := coll.ReplaceOne(c, filters, doc, s.replaceOpts...)
+	s.invalidate(coll, filters)
+	return result, err
 }
 
 // FindOneAndReplace executes a find and replace command for one document in the collection.
@@ -394,6 +509,7 @@ func (s *session) ReplaceOne(doc any, ctx ...context.Context) (*mongo.UpdateResu
 // If the document is not found, an error is returned.
 // The function returns an error if there was an issue finding the collection or if there was an error
 // decoding the replaced document into the original document variable.
+// Without filters, the document matching the primary key of doc is replaced, as for ReplaceOne.
 // If a context is provided, it is used for the operation. Otherwise, a default background context is used.
 func (s *session) FindOneAndReplace(doc any, ctx ...context.Context) error {
 	coll, err := s.collectionForStruct(doc)
@@ -401,14 +517,30 @@ func (s *session) FindOneAndReplace(doc any, ctx ...context.Context) error {
 		return err
 	}
 
-	filters, err := s.filter.Filters()
+	filters, err := s.replaceFilters(doc)
 	if err != nil {
 		return err
 	}
 
 	c := s.prepareContext(ctx...)
 
-	return coll.FindOneAndReplace(c, filters, doc, s.findOneAndReplaceOpts...).Decode(&doc)
+	result := coll.FindOneAndReplace(c, filters, doc, s.findOneAndReplaceOpts...)
+	s.invalidate(coll, filters)
+	return result.Decode(doc)
+}
+
+// replaceFilters returns the session's filters, or the primary key filter
+// of doc when there are none.
+func (s *session) replaceFilters(doc any) (bson.D, error) {
+	filters, err := s.filter.Filters()
+	if err != nil || len(filters) > 0 {
+		return filters, err
+	}
+	key, err := KeyFilter(doc, s.registry())
+	if err != nil || key == nil {
+		return filters, err
+	}
+	return key, nil
 }
 
 // FindOneAndUpdateBson executes a find and update command on the collection.
@@ -431,7 +563,9 @@ func (s *session) FindOneAndUpdateBson(coll any, bson any, ctx ...context.Contex
 	}
 
 	cc := s.prepareContext(ctx...)
-	return c.FindOneAndUpdate(cc, filters, bson, s.findOneAndUpdateOpts...), nil
+	result := c.FindOneAndUpdate(cc, filters, bson, s.findOneAndUpdateOpts...)
+	s.invalidate(c, filters)
+	return result, nil
 }
 
 // FindOneAndUpdate updates a single document in the given collection based on the specified filter conditions.
@@ -456,7 +590,9 @@ func (s *session) FindOneAndUpdate(doc any, ctx ...context.Context) (*mongo.Sing
 		return nil, err
 	}
 	c := s.prepareContext(ctx...)
-	return coll.FindOneAndUpdate(c, filters, bson.M{"$set": doc}, s.findOneAndUpdateOpts...), nil
+	result := coll.FindOneAndUpdate(c, filters, bson.M{"$set": doc}, s.findOneAndUpdateOpts...)
+	s.invalidate(coll, filters)
+	return result, nil
 }
 
 // FindAndDelete deletes a single document from the collection based on the provided filters.
@@ -482,7 +618,9 @@ func (s *session) FindAndDelete(doc any, ctx ...context.Context) error {
 		return err
 	}
 	c := s.prepareContext(ctx...)
-	return coll.FindOneAndDelete(c, filters, s.findOneAndDeleteOpts...).Decode(&doc)
+	result := coll.FindOneAndDelete(c, filters, s.findOneAndDeleteOpts...)
+	s.invalidate(coll, filters)
+	return result.Decode(doc)
 }
 
 // FindOne finds a single document in the collection that matches the specified filters.
@@ -491,6 +629,10 @@ func (s *session) FindAndDelete(doc any, ctx ...context.Context) error {
 // The document struct must be provided as a pointer, and it will be populated with the found document's data.
 // The method first determines the appropriate collection for the provided document using the collectionForStruct method.
 // If an error occurs during this process, it is
+//
+// When the client has a Cache, reads selecting a single document by _id, by a
+// field tagged `pie:"unique"` or by its primary key are served from it and
+// fill it on a miss.
 func (s *session) FindOne(doc any, ctx ...context.Context) error {
 	coll, err := s.collectionForStruct(doc)
 	if err != nil {
@@ -501,16 +643,31 @@ func (s *session) FindOne(doc any, ctx ...context.Context) error {
 		return err
 	}
 	c := s.prepareContext(ctx...)
+	cached := s.cachedRead(c, coll, doc, filters)
+	if cached != nil {
+		if raw, ok := cached.lookup(filters); ok {
+			if err = bson.UnmarshalWithRegistry(s.registry(), raw, doc); err != nil {
+				return err
+			}
+			return s.populate(c, doc)
+		}
+	}
 	result := coll.FindOne(c, filters, s.findOneOptions...)
 	if err = result.Err(); err != nil {
 		return err
 	}
 
+	if cached != nil {
+		if raw, err := result.DecodeBytes(); err == nil {
+			cached.store(raw)
+		}
+	}
+
 	if err = result.Decode(doc); err != nil {
 		return err
 	}
 
-	return nil
+	return s.populate(c, doc)
 }
 
 // FindAll retrieves all documents from the collection specified by the session's filter
@@ -538,13 +695,14 @@ func (s *session) FindAll(rowsSlicePtr any, ctx ...context.Context) error {
 		return err
 	}
 
-	return nil
+	return s.populate(c, rowsSlicePtr)
 }
 
 // InsertOne inserts a single document into the collection.
-// It returns the inserted document's ObjectID and any error that occurred during the insertion.
-// If an error occurs during the insertion, the returned ObjectID will be [12]byte{} and the error will be non-nil.
-// The inserted document's ObjectID can be retrieved by performing a type assertion on the InsertedID field of the returned result.
+// A zero id field is first set by the generator of the document's model, see IDGenerators.
+// It returns the inserted document's id and any error that occurred during the insertion:
+// the value of the model's id field, typed as the model declares it, or else the _id the driver generated.
+// If an error occurs during the insertion, the returned id will be nil and the error will be non-nil.
 // Example:
 //
 //	insertedID, err := session.InsertOne(document)
@@ -553,20 +711,24 @@ func (s *session) FindAll(rowsSlicePtr any, ctx ...context.Context) error {
 //	} else {
 //	  // handle success
 //	}
-func (s *session) InsertOne(doc any, ctx ...context.Context) (primitive.ObjectID, error) {
+func (s *session) InsertOne(doc any, ctx ...context.Context) (any, error) {
 	coll, err := s.collectionForStruct(doc)
 	if err != nil {
-		return [12]byte{}, err
+		return nil, err
+	}
+	doc, id, err := s.engine.IDGenerators().Assign(doc)
+	if err != nil {
+		return nil, err
 	}
 	c := s.prepareContext(ctx...)
 	result, err := coll.InsertOne(c, doc, s.insertOneOpts...)
 	if err != nil {
-		return [12]byte{}, err
+		return nil, err
 	}
-	if id, ok := result.InsertedID.(primitive.ObjectID); ok {
-		return id, err
+	if id != nil {
+		return id, nil
 	}
-	return [12]byte{}, err
+	return result.InsertedID, nil
 }
 
 // InsertMany inserts multiple documents into the collection.
@@ -582,15 +744,34 @@ func (s *session) InsertMany(docs any, ctx ...context.Context) (*mongo.InsertMan
 		return nil, err
 	}
 
-	value := reflect.ValueOf(docs)
-	var many []any
-	for index := 0; index < value.Len(); index++ {
-		many = append(many, value.Index(index).Interface())
+	many, err := s.assignIDs(docs)
+	if err != nil {
+		return nil, err
 	}
 	c := s.prepareContext(ctx...)
 	return coll.InsertMany(c, many, s.insertManyOpts...)
 }
 
+// assignIDs returns the elements of the slice docs with their zero id fields
+// set by the generators of their models, see IDGenerators.
+func (s *session) assignIDs(docs any) ([]any, error) {
+	values := reflect.Indirect(reflect.ValueOf(docs))
+	many := make([]any, 0, values.Len())
+	for i := 0; i < values.Len(); i++ {
+		value := values.Index(i)
+		if value.Kind() == reflect.Struct && value.CanAddr() {
+			// Set the id of the element itself.
+			value = value.Addr()
+		}
+		doc, _, err := s.engine.IDGenerators().Assign(value.Interface())
+		if err != nil {
+			return nil, err
+		}
+		many = append(many, doc)
+	}
+	return many, nil
+}
+
 // DeleteOne executes a delete command and returns a DeleteResult for one document in the collection.
 // It takes in the document to be deleted and allows for an optional context.
 // If an error occurs during the operation, it returns nil for DeleteResult and the error.
@@ -613,7 +794,9 @@ func (s *session) DeleteOne(doc any, ctx ...context.Context) (*mongo.DeleteResul
 		return nil, err
 	}
 	c := s.prepareContext(ctx...)
-	return coll.DeleteOne(c, filters, s.deleteOpts...)
+	result, err := coll.DeleteOne(c, filters, s.deleteOpts...)
+	s.invalidate(coll, filters)
+	return result, err
 }
 
 // SoftDeleteOne soft deletes one document in the collection.
@@ -638,7 +821,7 @@ func (s *session) SoftDeleteOne(doc any, ctx ...context.Context) error {
 	}
 	c := s.prepareContext(ctx...)
 	_, err = coll.UpdateOne(c, filters, bson.D{{Key: "$set", Value: bson.M{"deleted_at": time.Now()}}})
-
+	s.invalidate(coll, filters)
 	return err
 }
 
@@ -656,7 +839,9 @@ func (s *session) DeleteMany(doc any, ctx ...context.Context) (*mongo.DeleteResu
 		return nil, err
 	}
 	c := s.prepareContext(ctx...)
-	return coll.DeleteMany(c, filters, s.deleteOpts...)
+	result, err := coll.DeleteMany(c, filters, s.deleteOpts...)
+	s.invalidate(coll, filters)
+	return result, err
 }
 
 // SoftDeleteMany executes an update command to "soft delete" multiple documents in the collection.
@@ -675,7 +860,7 @@ func (s *session) SoftDeleteMany(doc any, ctx ...context.Context) error {
 	}
 	c := s.prepareContext(ctx...)
 	_, err = coll.UpdateMany(c, filters, bson.D{{Key: "$set", Value: bson.M{"deleted_at": time.Now()}}})
-
+	s.invalidate(coll, filters)
 	return err
 }
 
@@ -701,6 +886,11 @@ func (s *session) Clone() Session {
 		findOneAndUpdateOpts:  s.findOneAndUpdateOpts,
 		replaceOpts:           s.replaceOpts,
 		bulkWriteOptions:      s.bulkWriteOptions,
+		strict:                s.strict,
+		collection:            s.collection,
+		populates:             s.populates,
+		ids:                   append([]any(nil), s.ids...),
+		selected:              s.selected,
 	}
 
 	return &sess
@@ -821,7 +1011,9 @@ func (s *session) UpdateOne(bean any, ctx ...context.Context) (*mongo.UpdateResu
 		return nil, err
 	}
 	c := s.prepareContext(ctx...)
-	return coll.UpdateOne(c, filters, bson.M{"$set": bean}, s.updateOpts...)
+	result, err := coll.UpdateOne(c, filters, bson.M{"$set": bean}, s.updateOpts...)
+	s.invalidate(coll, filters)
+	return result, err
 }
 
 // UpdateOneBson updates a single document in the collection corresponding to the given struct
@@ -853,7 +1045,9 @@ func (s *session) UpdateOneBson(coll any, bson any, ctx ...context.Context) (*mo
 		return nil, err
 	}
 	cc := s.prepareContext(ctx...)
-	return c.UpdateOne(cc, filters, bson, s.updateOpts...)
+	result, err := c.UpdateOne(cc, filters, bson, s.updateOpts...)
+	s.invalidate(c, filters)
+	return result, err
 }
 
 // UpdateManyBson updates multiple documents in the collection
@@ -879,7 +1073,9 @@ func (s *session) UpdateManyBson(coll any, bson any, ctx ...context.Context) (*m
 		return nil, err
 	}
 	cc := s.prepareContext(ctx...)
-	return c.UpdateMany(cc, filters, bson, s.updateOpts...)
+	result, err := c.UpdateMany(cc, filters, bson, s.updateOpts...)
+	s.invalidate(c, filters)
+	return result, err
 }
 
 func (s *session) toBson(obj any) bson.M {
@@ -957,8 +1153,9 @@ func (s *session) UpdateMany(bean any, ctx ...context.Context) (*mongo.UpdateRes
 		return nil, err
 	}
 	c := s.prepareContext(ctx...)
-	return coll.UpdateMany(c, filters, bson.M{"$set": bean}, s.updateOpts...)
-
+	result, err := coll.UpdateMany(c, filters, bson.M{"$set": bean}, s.updateOpts...)
+	s.invalidate(coll, filters)
+	return result, err
 }
 
 func (s *session) RegexFilter(key, pattern string) Session {
@@ -968,13 +1165,39 @@ func (s *session) RegexFilter(key, pattern string) Session {
 
 // ID sets the filter condition on the session's filter object
 // to search for records with the specified ID value.
-// The provided 'id' parameter is used as the value to filter by.
+// The filter is built when the model is known, from its primary key as
+// IDFilter does: id is converted to the key's type and encoded as stored,
+// and a schemas.PK selects a composite key. Without a model, as after
+// SetCollection with a map, it is built as Condition.ID does.
 // The method then returns the session object itself for method chaining.
+//
+// Example usage:
+//
+//	err := client.ID("6ba7b810-9dad-11d1-80b4-00c04fd430c8").FindOne(&device) // uuid _id
+//	err = client.ID(schemas.NewPK("acme", int64(42))).FindOne(&membership)
 func (s *session) ID(id any) Session {
-	s.filter.ID(id)
+	s.ids = append(s.ids, id)
 	return s
 }
 
+// resolveIDs adds the filters of the ids given to ID for model type t, or
+// as Condition.ID does when t is nil.
+func (s *session) resolveIDs(t reflect.Type) error {
+	for _, id := range s.ids {
+		if t == nil {
+			s.filter.ID(id)
+			continue
+		}
+		d, err := IDFilter(t, id, s.registry())
+		if err != nil {
+			return err
+		}
+		s.filter.FilterBson(d)
+	}
+	s.ids = nil
+	return nil
+}
+
 // Asc sets the sorting order on the session's find options.
 // The provided column names are used to determine the order of sorting.
 // Multiple column names can be provided to define a multi-column sort.
@@ -1039,7 +1262,14 @@ func (s *session) Sort(colNames ...string) Session {
 	if len(colNames) == 0 {
 		return s
 	}
-	es := bson.D{}
+	es := sortFields(bson.D{}, colNames)
+	s.findOptions = append(s.findOptions, options.Find().SetSort(es))
+	s.findOneOptions = append(s.findOneOptions, options.FindOne().SetSort(es))
+	return s
+}
+
+// sortFields appends the sort order of colNames, in Sort's syntax, to es.
+func sortFields(es bson.D, colNames []string) bson.D {
 	for _, field := range colNames {
 		if field != "" {
 			switch field[0] {
@@ -1050,9 +1280,7 @@ func (s *session) Sort(colNames ...string) Session {
 			}
 		}
 	}
-	s.findOptions = append(s.findOptions, options.Find().SetSort(es))
-	s.findOneOptions = append(s.findOneOptions, options.FindOne().SetSort(es))
-	return s
+	return es
 }
 
 func (s *session) Filter(key string, value any) Session {
@@ -1124,8 +1352,8 @@ func (s *session) Nin(key string, nin any) Session {
 //	{ $or: [ { sale: true }, { price : { $lt : 5 } } ] }
 //
 // ]
-func (s *session) And(c Condition) Session {
-	s.filter.And(c)
+func (s *session) And(c ...Condition) Session {
+	s.filter.And(c...)
 	return s
 
 }
@@ -1141,14 +1369,14 @@ func (s *session) Not(key string, not any) Session {
 // Nor { $nor: [ { price: 1.99 }, { price: { $exists: false } },
 // { sale: true }, { sale: { $exists: false } } ] }
 // price != 1.99 || sale != true || sale exists || sale exists
-func (s *session) Nor(c Condition) Session {
-	s.filter.Nor(c)
+func (s *session) Nor(c ...Condition) Session {
+	s.filter.Nor(c...)
 	return s
 }
 
 // Or { $or: [ { quantity: { $lt: 20 } }, { price: 10 } ] }
-func (s *session) Or(c Condition) Session {
-	s.filter.Or(c)
+func (s *session) Or(c ...Condition) Session {
+	s.filter.Or(c...)
 	return s
 }
 
@@ -1157,6 +1385,66 @@ func (s *session) Exists(key string, exists bool, filter ...Condition) Session {
 	return s
 }
 
+// ElemMatch adds an $elemMatch condition on key to the session's filter.
+func (s *session) ElemMatch(key string, c Condition) Session {
+	s.filter.ElemMatch(key, c)
+	return s
+}
+
+// All adds an $all condition on key to the session's filter.
+func (s *session) All(key string, values any) Session {
+	s.filter.All(key, values)
+	return s
+}
+
+// Size adds a $size condition on key to the session's filter.
+func (s *session) Size(key string, n int) Session {
+	s.filter.Size(key, n)
+	return s
+}
+
+// Mod adds a $mod condition on key to the session's filter.
+func (s *session) Mod(key string, divisor, remainder int64) Session {
+	s.filter.Mod(key, divisor, remainder)
+	return s
+}
+
+// BitsAllSet adds a $bitsAllSet condition on key to the session's filter.
+func (s *session) BitsAllSet(key string, bits any) Session {
+	s.filter.BitsAllSet(key, bits)
+	return s
+}
+
+// BitsAnySet adds a $bitsAnySet condition on key to the session's filter.
+func (s *session) BitsAnySet(key string, bits any) Session {
+	s.filter.BitsAnySet(key, bits)
+	return s
+}
+
+// BitsAllClear adds a $bitsAllClear condition on key to the session's filter.
+func (s *session) BitsAllClear(key string, bits any) Session {
+	s.filter.BitsAllClear(key, bits)
+	return s
+}
+
+// BitsAnyClear adds a $bitsAnyClear condition on key to the session's filter.
+func (s *session) BitsAnyClear(key string, bits any) Session {
+	s.filter.BitsAnyClear(key, bits)
+	return s
+}
+
+// JSONSchema adds a $jsonSchema condition to the session's filter.
+func (s *session) JSONSchema(schema any) Session {
+	s.filter.JSONSchema(schema)
+	return s
+}
+
+// Comment adds a $comment to the session's filter.
+func (s *session) Comment(comment string) Session {
+	s.filter.Comment(comment)
+	return s
+}
+
 // SetArrayFilters sets the value for the ArrayFilters field.
 func (s *session) SetArrayFilters(filters options.ArrayFilters) Session {
 	s.findOneAndUpdateOpts = append(s.findOneAndUpdateOpts,
@@ -1198,10 +1486,11 @@ func (s *session) SetUpsert(b bool) Session {
 	s.findOneAndReplaceOpts = append(s.findOneAndReplaceOpts,
 		options.FindOneAndReplace().SetUpsert(b))
 	s.updateOpts = append(s.updateOpts, options.Update().SetUpsert(b))
+	s.replaceOpts = append(s.replaceOpts, options.Replace().SetUpsert(b))
 	return s
 }
 
-// SetCollation sets the value for the Collation field.
+// SetCollation sets the collation of finds, updates and the findOneAndX operations.
 func (s *session) SetCollation(collation *options.Collation) Session {
 	s.findOneAndUpdateOpts = append(s.findOneAndUpdateOpts,
 		options.FindOneAndUpdate().SetCollation(collation))
@@ -1209,6 +1498,8 @@ func (s *session) SetCollation(collation *options.Collation) Session {
 		options.FindOneAndReplace().SetCollation(collation))
 	s.findOneAndDeleteOpts = append(s.findOneAndDeleteOpts, options.FindOneAndDelete().SetCollation(collation))
 	s.updateOpts = append(s.updateOpts, options.Update().SetCollation(collation))
+	s.findOptions = append(s.findOptions, options.Find().SetCollation(collation))
+	s.findOneOptions = append(s.findOneOptions, options.FindOne().SetCollation(collation))
 	return s
 }
 
@@ -1249,7 +1540,7 @@ func (s *session) SetSort(sort any) Session {
 	return s
 }
 
-// SetHint sets the hint for the session's operations.
+// SetHint sets the index hint of finds, updates and the findOneAndX operations.
 func (s *session) SetHint(hint any) Session {
 	s.findOneAndUpdateOpts = append(s.findOneAndUpdateOpts,
 		options.FindOneAndUpdate().SetHint(hint))
@@ -1257,6 +1548,8 @@ func (s *session) SetHint(hint any) Session {
 		options.FindOneAndReplace().SetHint(hint))
 	s.findOneAndDeleteOpts = append(s.findOneAndDeleteOpts, options.FindOneAndDelete().SetHint(hint))
 	s.updateOpts = append(s.updateOpts, options.Update().SetHint(hint))
+	s.findOptions = append(s.findOptions, options.Find().SetHint(hint))
+	s.findOneOptions = append(s.findOneOptions, options.FindOne().SetHint(hint))
 	return s
 }
 
@@ -1271,16 +1564,106 @@ func (s *session) Type(key string, t any) Session {
 }
 
 // Expr sets a custom filter expression on the session's filter object.
-// The provided Condition value represents the custom filter expression.
+// The expression is a Condition or a value built with package expr.
 // The method then returns the session object itself for method chaining.
-func (s *session) Expr(c Condition) Session {
-	s.filter.Expr(c)
+func (s *session) Expr(expression any) Session {
+	s.filter.Expr(expression)
+	return s
+}
+
+// Regex { field: { $regex: pattern, $options: opts } }
+func (s *session) Regex(key string, pattern string, opts string) Session {
+	s.filter.Regex(key, pattern, opts)
+	return s
+}
+
+// StartsWith matches a literal, case-sensitive prefix, which can use an index.
+func (s *session) StartsWith(key string, prefix string) Session {
+	s.filter.StartsWith(key, prefix)
+	return s
+}
+
+// EndsWith matches a literal suffix.
+func (s *session) EndsWith(key string, suffix string) Session {
+	s.filter.EndsWith(key, suffix)
+	return s
+}
+
+// Contains matches a literal substring.
+func (s *session) Contains(key string, substr string) Session {
+	s.filter.Contains(key, substr)
+	return s
+}
+
+// EqualFold matches a string ignoring case.
+func (s *session) EqualFold(key string, str string) Session {
+	s.filter.EqualFold(key, str)
+	return s
+}
+
+// Text adds a $text search to the session's filter.
+func (s *session) Text(search, language string, caseSensitive, diacriticSensitive bool) Session {
+	s.filter.Text(search, language, caseSensitive, diacriticSensitive)
+	return s
+}
+
+// SortByScore sorts the results of a $text search by relevance, best first,
+// then by colNames, which take the "-" prefix of Sort. It replaces the sort
+// order set before. The sort key is "score"; servers before 4.4 need the
+// score projected under that name with ProjectScore("score").
+//
+// Example usage:
+//
+//	err := client.NewSession().Text("coffee", "", false, false).
+//		SortByScore("-created_at").ProjectScore("score").Limit(10).FindAll(&posts)
+func (s *session) SortByScore(colNames ...string) Session {
+	es := sortFields(bson.D{{Key: "score", Value: TextScore()}}, colNames)
+	s.findOptions = append(s.findOptions, options.Find().SetSort(es))
+	s.findOneOptions = append(s.findOneOptions, options.FindOne().SetSort(es))
+	return s
+}
+
+// ProjectScore adds the relevance of a $text search to the projection as
+// field, keeping the fields projected before. Decode it into a float64 field
+// of the result, e.g. `bson:"score,omitempty"`.
+func (s *session) ProjectScore(field string) Session {
+	projection := bson.D{}
+	if p := options.MergeFindOptions(s.findOptions...).Projection; p != nil {
+		// Projections that are not documents cannot be extended and are replaced.
+		if d, err := mql.NormalizeDoc(p); err == nil {
+			projection = d
+		}
+	}
+	return s.Project(append(projection, bson.E{Key: field, Value: TextScore()}))
+}
+
+// TextScore returns {$meta: "textScore"}, the relevance of a $text search,
+// for use in projections, sorts and aggregation expressions.
+func TextScore() bson.D {
+	return bson.D{{Key: "$meta", Value: "textScore"}}
+}
+
+// Near adds a $near condition on key to the session's filter.
+func (s *session) Near(key string, point geo.Point, maxDistance, minDistance float64) Session {
+	s.filter.Near(key, point, maxDistance, minDistance)
+	return s
+}
+
+// NearSphere adds a $nearSphere condition on key to the session's filter.
+func (s *session) NearSphere(key string, point geo.Point, maxDistance, minDistance float64) Session {
+	s.filter.NearSphere(key, point, maxDistance, minDistance)
+	return s
+}
+
+// GeoWithin adds a $geoWithin condition on key to the session's filter.
+func (s *session) GeoWithin(key string, shape geo.Shape) Session {
+	s.filter.GeoWithin(key, shape)
 	return s
 }
 
-// Regex todo 简单实现，后续增加支持
-func (s *session) Regex(key string, value string) Session {
-	s.filter.Regex(key, value)
+// GeoIntersects adds a $geoIntersects condition on key to the session's filter.
+func (s *session) GeoIntersects(key string, geometry geo.Geometry) Session {
+	s.filter.GeoIntersects(key, geometry)
 	return s
 }
 
@@ -1292,20 +1675,55 @@ func (s *session) SetDatabase(db string) Session {
 	return s
 }
 
+// SetCollection sets the collection the session's operations target. Documents
+// of any type, including bson.D and bson.M, can then be used with it.
+//
+// Example usage:
+//
+//	_, err := client.NewSession().SetCollection("audit_log").InsertMany([]bson.D{entry})
+func (s *session) SetCollection(name string) Session {
+	s.collection = name
+	return s
+}
+
 func (s *session) collectionForStruct(doc any) (*mongo.Collection, error) {
 	coll, err := s.engine.CollectionNameForStruct(doc)
-	if err != nil {
-		return nil, err
-	}
-
-	return s.collectionByName(coll.Name), nil
+	return s.collectionFor(coll, err)
 }
 
 func (s *session) collectionForSlice(doc any) (*mongo.Collection, error) {
 	coll, err := s.engine.CollectionNameForSlice(doc)
+	return s.collectionFor(coll, err)
+}
+
+// collectionFor returns the collection for a parsed document type. A collection
+// set with SetCollection takes precedence, and then the type is only needed
+// for strict mode and for the ids given to ID.
+func (s *session) collectionFor(coll *schemas.Collection, err error) (*mongo.Collection, error) {
+	var model reflect.Type
+	if err == nil {
+		model = coll.Type
+	}
+	if err := s.resolveIDs(model); err != nil {
+		return nil, err
+	}
+	if s.collection != "" {
+		if err == nil {
+			if err := s.checkStrict(coll.Type); err != nil {
+				return nil, err
+			}
+		}
+		return s.collectionByName(s.collection), nil
+	}
+	if s.selected {
+		return nil, fmt.Errorf("select %w", errNoCollection)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if err := s.checkStrict(coll.Type); err != nil {
+		return nil, err
+	}
 	return s.collectionByName(coll.Name), nil
 }
 
@@ -0,0 +1,163 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/5xxxx/pie/internal/shell"
+	"github.com/5xxxx/pie/schemas"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var errNoShellCollection = errors.New("no collection to render: pass a document or use SetCollection")
+
+// Shell returns the filter conditions as a mongosh document, the way they
+// are sent to the server.
+//
+// Example usage:
+//
+//	s, err := DefaultCondition().Eq("name", "frank").Gte("age", 18).Shell()
+//	// s is { name: "frank", age: { $gte: 18 } }
+func (f *filter) Shell() (string, error) {
+	if f.err != nil {
+		return "", f.err
+	}
+	return shell.Value(f.d)
+}
+
+// String returns Shell's output, or the filter's error in angle brackets.
+func (f *filter) String() string {
+	return shellString(f.Shell())
+}
+
+// Shell returns the find command the session runs for FindAll(doc) as a mongosh
+// command: the filter, projection, sort, skip, limit, hint and collation. doc
+// selects the collection as it does for FindAll and may be nil after SetCollection.
+//
+// Example usage:
+//
+//	s, err := client.Gte("age", 18).Desc("age").Limit(10).Shell(&[]User{})
+//	// s is db.getCollection("user").find({ age: { $gte: 18 } }).sort({ age: -1 }).limit(10)
+func (s *session) Shell(doc any) (string, error) {
+	if s.selected && s.collection == "" {
+		return "", fmt.Errorf("select %w", errNoCollection)
+	}
+	target, err := shellTarget(s.engine, s.db, s.collection, doc)
+	if err != nil {
+		return "", err
+	}
+	filters, err := s.shellFilters(doc)
+	if err != nil {
+		return "", err
+	}
+	return shell.Find(target, filters, options.MergeFindOptions(s.findOptions...))
+}
+
+// ShellUpdate returns the updateOne command UpdateOneBson(doc, update) sends,
+// or the updateMany command of UpdateManyBson when many is true; update is
+// rendered as it is. A nil update renders the command of UpdateOne(doc) or
+// UpdateMany(doc), which set doc with $set.
+//
+// Example usage:
+//
+//	s, err := client.Eq("name", "frank").ShellUpdate(&User{}, bson.M{"$inc": bson.M{"age": 1}}, false)
+//	// s is db.getCollection("user").updateOne({ name: "frank" }, { $inc: { age: 1 } })
+//
+//	s, err = client.Eq("name", "frank").ShellUpdate(&User{Age: 30}, nil, false)
+//	// s is db.getCollection("user").updateOne({ name: "frank" }, { $set: { name: "", age: 30 } })
+func (s *session) ShellUpdate(doc any, update any, many bool) (string, error) {
+	target, err := shellTarget(s.engine, s.db, s.collection, doc)
+	if err != nil {
+		return "", err
+	}
+	filters, err := s.shellFilters(doc)
+	if err != nil {
+		return "", err
+	}
+	if update == nil {
+		update = bson.M{"$set": doc}
+	}
+	return shell.Update(target, filters, update, many, options.MergeUpdateOptions(s.updateOpts...))
+}
+
+// String returns Shell(nil), or the error in angle brackets.
+func (s *session) String() string {
+	return shellString(s.Shell(nil))
+}
+
+// Shell returns the aggregate command as a mongosh command with its pipeline
+// and options. doc selects the collection unless Collection was called.
+//
+// Example usage:
+//
+//	s, err := client.Aggregate().Match(DefaultCondition().Eq("status", "A")).SetAllowDiskUse(true).Shell(&[]Order{})
+//	// s is db.getCollection("order").aggregate([ { $match: { status: "A" } } ], { allowDiskUse: true })
+func (a *aggregate) Shell(doc any) (string, error) {
+	if a.doc != nil {
+		doc = a.doc
+	}
+	target, err := shellTarget(a.engine, a.db, "", doc)
+	if err != nil {
+		return "", err
+	}
+	return shell.Aggregate(target, a.pipeline, options.MergeAggregateOptions(a.opts...))
+}
+
+// String returns Shell(nil), or the error in angle brackets.
+func (a *aggregate) String() string {
+	return shellString(a.Shell(nil))
+}
+
+// shellTarget returns the shell expression of collection name, or of the
+// collection of doc when name is empty.
+func shellTarget(engine Client, db, name string, doc any) (string, error) {
+	if name == "" {
+		if doc == nil {
+			return "", errNoShellCollection
+		}
+		var coll *schemas.Collection
+		var err error
+		if reflect.Indirect(reflect.ValueOf(doc)).Kind() == reflect.Slice {
+			coll, err = engine.CollectionNameForSlice(doc)
+		} else {
+			coll, err = engine.CollectionNameForStruct(doc)
+		}
+		if err != nil {
+			return "", err
+		}
+		name = coll.Name
+	}
+	return shell.Target(db, name), nil
+}
+
+// shellFilters returns the session's filter with the ids given to ID
+// resolved for the model of doc, leaving the session unchanged.
+func (s *session) shellFilters(doc any) (bson.D, error) {
+	var model reflect.Type
+	if doc != nil {
+		var coll *schemas.Collection
+		var err error
+		if reflect.Indirect(reflect.ValueOf(doc)).Kind() == reflect.Slice {
+			coll, err = s.engine.CollectionNameForSlice(doc)
+		} else {
+			coll, err = s.engine.CollectionNameForStruct(doc)
+		}
+		if err == nil {
+			model = coll.Type
+		}
+	}
+	sess := s.Clone().(*session)
+	if err := sess.resolveIDs(model); err != nil {
+		return nil, err
+	}
+	return sess.filter.Filters()
+}
+
+func shellString(s string, err error) string {
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+	return s
+}
@@ -0,0 +1,118 @@
+package pie
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/5xxxx/pie/internal/shell"
+	"github.com/5xxxx/pie/names"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestShell(t *testing.T) {
+	Convey("Conditions, sessions and aggregates render as mongosh", t, func() {
+		mc, err := mongo.NewClient(options.Client().ApplyURI("mongodb://127.0.0.1:27017"))
+		So(err, ShouldBeNil)
+		mapper := names.NewCacheMapper(new(names.SnakeMapper))
+		client := &defaultClient{client: mc, parser: NewParser(mapper, mapper), db: "test"}
+		id, _ := primitive.ObjectIDFromHex("5f1d7a3c9d1e8a2b3c4d5e6f")
+		at := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+		decimal, _ := primitive.ParseDecimal128("2.5")
+
+		Convey("Values use the shell's constructors", func() {
+			c := DefaultCondition().
+				ID(id).
+				Gte("created_at", at).
+				Eq("visits", int64(3)).
+				Regex("name", "^a/b", "i").
+				Regex("bio", "go # lang", "x").
+				In("score", []any{1.5, decimal}).
+				Eq("first.name", `say "hi"`).
+				Exists("tags", true)
+			So(c.String(), ShouldEqual, `{ _id: ObjectId("5f1d7a3c9d1e8a2b3c4d5e6f"), `+
+				`created_at: { $gte: ISODate("2024-03-01T12:30:00.000Z") }, visits: NumberLong(3), `+
+				`name: /^a\/b/i, bio: BSONRegExp("go # lang", "x"), score: { $in: [ 1.5, NumberDecimal("2.5") ] }, `+
+				`"first.name": "say \"hi\"", tags: { $exists: true } }`)
+			So(DefaultCondition().Mod("qty", 0, 1).String(), ShouldStartWith, "<")
+		})
+
+		Convey("Find renders the options that are set", func() {
+			s := client.Gte("age", 18).Desc("age").Project(bson.D{{Key: "name", Value: 1}}).
+				Skip(20).Limit(10).SetHint("age_1").
+				SetCollation(&options.Collation{Locale: "en", Strength: 2})
+			out, err := s.Shell(&[]member{})
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, `db.getCollection("member").find({ age: { $gte: 18 } }, { name: 1 })`+
+				`.sort({ age: -1 }).skip(20).limit(10).hint("age_1").collation({ locale: "en", strength: 2 })`)
+
+			So(client.NewSession().SetDatabase("app").SetCollection("audit_log").String(), ShouldEqual,
+				`db.getSiblingDB("app").getCollection("audit_log").find({})`)
+			_, err = client.NewSession().Shell(nil)
+			So(err, ShouldNotBeNil)
+
+			// The DTO of Select does not name the collection queried.
+			_, err = client.Select(&[]member{}).Shell(&[]member{})
+			So(err, ShouldNotBeNil)
+			So(client.NewSession().SetCollection("user").Select(&[]member{}).String(), ShouldEqual,
+				`db.getCollection("user").find({}, { _id: 1, email: 1, name: 1 })`)
+		})
+
+		Convey("Updates render the document the update methods send", func() {
+			// The driver encodes the update before it finds the client
+			// disconnected, so the top-level bson.M it is given is recorded.
+			var sent any
+			client.codecs = NewCodecs()
+			client.RegisterCodec(reflect.TypeOf(bson.M{}), bsoncodec.ValueEncoderFunc(func(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, v reflect.Value) error {
+				if sent == nil {
+					sent = v.Interface()
+				}
+				return bsoncodec.NewMapCodec().EncodeValue(ec, vw, v)
+			}), nil)
+			sends := func(update func(s Session)) string {
+				sent = nil
+				update(client.Eq("name", "a"))
+				So(sent, ShouldNotBeNil)
+				out, err := shell.Update(`db.getCollection("member")`, bson.D{{Key: "name", Value: "a"}}, sent, false, options.Update())
+				So(err, ShouldBeNil)
+				return out
+			}
+
+			bean := &member{ID: id, Name: "b"}
+			out, err := client.Eq("name", "a").ShellUpdate(bean, nil, false)
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, sends(func(s Session) { _, _ = s.UpdateOne(bean) }))
+			So(out, ShouldEqual, `db.getCollection("member").updateOne({ name: "a" }, `+
+				`{ $set: { _id: ObjectId("5f1d7a3c9d1e8a2b3c4d5e6f"), email: "", name: "b" } })`)
+
+			inc := bson.M{"$inc": bson.M{"visits": 1}}
+			out, err = client.Eq("name", "a").ShellUpdate(&member{}, inc, false)
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, sends(func(s Session) { _, _ = s.UpdateOneBson(&member{}, inc) }))
+			So(out, ShouldEqual, `db.getCollection("member").updateOne({ name: "a" }, { $inc: { visits: 1 } })`)
+
+			out, err = client.NewSession().Eq("name", "a").SetUpsert(true).
+				ShellUpdate(&member{}, bson.D{{Key: "$set", Value: bson.D{{Key: "email", Value: "a@example.com"}}}}, true)
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, `db.getCollection("member").updateMany({ name: "a" }, `+
+				`{ $set: { email: "a@example.com" } }, { upsert: true })`)
+		})
+
+		Convey("Aggregates render the pipeline and options", func() {
+			a := client.Aggregate().Match(DefaultCondition().Eq("status", "A")).
+				Pipeline(bson.A{bson.D{{Key: "$count", Value: "n"}}}).
+				SetAllowDiskUse(true).SetMaxTime(time.Second)
+			out, err := a.Shell(&[]member{})
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, `db.getCollection("member").aggregate([ { $match: { status: "A" } }, { $count: "n" } ], `+
+				`{ allowDiskUse: true, maxTimeMS: 1000 })`)
+			So(a.String(), ShouldStartWith, "<")
+		})
+	})
+}
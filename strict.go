@@ -0,0 +1,365 @@
+package pie
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/5xxxx/pie/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// FieldError reports a key that does not name a field of the model, or a
+// value that can never match the field it is compared with.
+type FieldError struct {
+	Model string
+	Path  string
+	// Suggestions lists the model paths closest to an unknown Path.
+	Suggestions []string
+	Msg         string
+}
+
+func (e *FieldError) Error() string {
+	msg := fmt.Sprintf("field %q of %s: %s", e.Path, e.Model, e.Msg)
+	switch len(e.Suggestions) {
+	case 0:
+		return msg
+	case 1:
+		return fmt.Sprintf("%s, did you mean %q?", msg, e.Suggestions[0])
+	}
+	quoted := make([]string, len(e.Suggestions))
+	for i, s := range e.Suggestions {
+		quoted[i] = fmt.Sprintf("%q", s)
+	}
+	return fmt.Sprintf("%s, did you mean one of %s?", msg, strings.Join(quoted, ", "))
+}
+
+// Strict turns on validation of the session's field paths. When the target
+// model of an operation is known, every key of the filter, the sort order and
+// the projection must be a bson path of the model, dotted paths included,
+// and compared values must be able to match the field's type. Violations are
+// returned as *FieldError values joined into one error, before anything is sent.
+//
+// Example usage:
+//
+//	err := client.NewSession().Strict(true).Eq("nick_nmae", "frank").FindOne(&user)
+//	// field "nick_nmae" of User: unknown field, did you mean "nick_name"?
+func (s *session) Strict(strict bool) Session {
+	s.strict = strict
+	return s
+}
+
+// checkStrict validates the session against model type t when strict mode is on.
+func (s *session) checkStrict(t reflect.Type) error {
+	if !s.strict {
+		return nil
+	}
+	filters, err := s.filter.Filters()
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for _, o := range s.findOptions {
+		keys = append(keys, sortKeys(o.Sort)...)
+		keys = append(keys, projectionKeys(o.Projection)...)
+	}
+	for _, o := range s.findOneOptions {
+		keys = append(keys, sortKeys(o.Sort)...)
+		keys = append(keys, projectionKeys(o.Projection)...)
+	}
+	return validateFields(t, filters, keys)
+}
+
+// ValidateFields checks filter and the sort or projection keys against model,
+// a struct, a pointer to one or a pointer to a slice of them, the way a
+// session in strict mode does.
+func ValidateFields(model any, filter bson.D, keys ...string) error {
+	t := reflect.TypeOf(model)
+	if t == nil {
+		return errors.New("needs a struct")
+	}
+	t = indirectType(t)
+	if t.Kind() == reflect.Slice {
+		t = indirectType(t.Elem())
+	}
+	if t.Kind() != reflect.Struct {
+		return errors.New("needs a struct")
+	}
+	return validateFields(t, filter, keys)
+}
+
+func validateFields(t reflect.Type, filter bson.D, keys []string) error {
+	v := &fieldValidator{model: t}
+	v.filter(filter)
+	for _, key := range keys {
+		v.resolve(key)
+	}
+	return errors.Join(v.errs...)
+}
+
+func sortKeys(sort any) []string {
+	var keys []string
+	for _, e := range entries(sort) {
+		if !isMeta(e.Value) {
+			keys = append(keys, e.Key)
+		}
+	}
+	return keys
+}
+
+func projectionKeys(projection any) []string {
+	var keys []string
+	for _, e := range entries(projection) {
+		if !isMeta(e.Value) {
+			keys = append(keys, strings.TrimSuffix(e.Key, ".$"))
+		}
+	}
+	return keys
+}
+
+// isMeta reports whether v is a {$meta: ...} document such as TextScore,
+// whose key names a computed value rather than a field.
+func isMeta(v any) bool {
+	e := entries(v)
+	return len(e) == 1 && e[0].Key == "$meta"
+}
+
+// entries returns the elements of a document given as bson.D, bson.E, a
+// *Projection or a string-keyed map, with map keys in sorted order.
+func entries(doc any) []bson.E {
+	switch d := doc.(type) {
+	case bson.D:
+		return d
+	case *Projection:
+		pd, _ := d.Document()
+		return pd
+	case bson.E:
+		return []bson.E{d}
+	case bson.M:
+		return mapEntries(d)
+	case map[string]any:
+		return mapEntries(d)
+	}
+	return nil
+}
+
+func mapEntries(m map[string]any) []bson.E {
+	out := make([]bson.E, 0, len(m))
+	for k, v := range m {
+		out = append(out, bson.E{Key: k, Value: v})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+type fieldValidator struct {
+	model reflect.Type
+	paths []string
+	errs  []error
+}
+
+func (v *fieldValidator) fail(path string, suggestions []string, format string, a ...any) {
+	v.errs = append(v.errs, &FieldError{
+		Model:       v.model.Name(),
+		Path:        path,
+		Suggestions: suggestions,
+		Msg:         fmt.Sprintf(format, a...),
+	})
+}
+
+func (v *fieldValidator) filter(doc any) {
+	for _, e := range entries(doc) {
+		switch {
+		case e.Key == "$and" || e.Key == "$or" || e.Key == "$nor":
+			list := reflect.ValueOf(e.Value)
+			if list.Kind() != reflect.Slice && list.Kind() != reflect.Array {
+				continue
+			}
+			for i := 0; i < list.Len(); i++ {
+				v.filter(list.Index(i).Interface())
+			}
+		case strings.HasPrefix(e.Key, "$"):
+			// $expr, $text, $where, $comment and friends do not name fields.
+		default:
+			if t, ok := v.resolve(e.Key); ok {
+				v.condition(e.Key, t, e.Value)
+			}
+		}
+	}
+}
+
+// resolve returns the type at path, reporting unknown paths with the closest model paths.
+func (v *fieldValidator) resolve(path string) (reflect.Type, bool) {
+	if t, ok := resolveFieldPath(v.model, path); ok {
+		return t, true
+	}
+	if v.paths == nil {
+		v.paths = fieldPaths(v.model)
+	}
+	v.fail(path, closestPaths(path, v.paths), "unknown field")
+	return nil, false
+}
+
+func closestPaths(path string, paths []string) []string {
+	type candidate struct {
+		path     string
+		distance int
+	}
+	limit := max(2, len(path)/3)
+	var candidates []candidate
+	for _, p := range paths {
+		if d := utils.Levenshtein(strings.ToLower(path), strings.ToLower(p)); d <= limit {
+			candidates = append(candidates, candidate{p, d})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].distance < candidates[j].distance })
+	var out []string
+	for i := 0; i < len(candidates) && i < 3; i++ {
+		out = append(out, candidates[i].path)
+	}
+	return out
+}
+
+// condition checks the value a field is compared with, which is either a
+// plain value or a document of query operators.
+func (v *fieldValidator) condition(path string, t reflect.Type, value any) {
+	ops := entries(value)
+	if len(ops) == 0 || !strings.HasPrefix(ops[0].Key, "$") {
+		v.value(path, t, value)
+		return
+	}
+	for _, op := range ops {
+		switch op.Key {
+		case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+			v.value(path, t, op.Value)
+		case "$in", "$nin", "$all":
+			list := reflect.ValueOf(op.Value)
+			if list.Kind() != reflect.Slice && list.Kind() != reflect.Array {
+				continue
+			}
+			for i := 0; i < list.Len(); i++ {
+				v.value(path, t, list.Index(i).Interface())
+			}
+		case "$regex":
+			v.value(path, t, primitive.Regex{})
+		case "$not":
+			v.condition(path, t, op.Value)
+		case "$elemMatch":
+			v.elemMatch(path, t, op.Value)
+		}
+	}
+}
+
+// elemMatch checks an $elemMatch operand: operators apply to the elements
+// of the array, and conditions on fields to those of its embedded documents.
+func (v *fieldValidator) elemMatch(path string, t reflect.Type, cond any) {
+	conds := entries(cond)
+	if len(conds) > 0 && strings.HasPrefix(conds[0].Key, "$") && !isLogical(conds[0].Key) {
+		v.condition(path, t, cond)
+		return
+	}
+	for _, e := range conds {
+		if strings.HasPrefix(e.Key, "$") {
+			continue
+		}
+		sub := path + "." + e.Key
+		if st, ok := v.resolve(sub); ok {
+			v.condition(sub, st, e.Value)
+		}
+	}
+}
+
+func isLogical(op string) bool {
+	return op == "$and" || op == "$or" || op == "$nor"
+}
+
+func (v *fieldValidator) value(path string, t reflect.Type, value any) {
+	if !canMatch(t, value) {
+		v.fail(path, nil, "a %T value can never match a %s field", value, t)
+	}
+}
+
+// valueClass groups Go types by the BSON values they are stored as.
+type valueClass int
+
+const (
+	classAny valueClass = iota
+	classNumber
+	classString
+	classBool
+	classDate
+	classObjectID
+	classDocument
+	classArray
+	classBinary
+	classRegex
+)
+
+var (
+	valueMarshalerType = reflect.TypeOf((*bsoncodec.ValueMarshaler)(nil)).Elem()
+	marshalerType      = reflect.TypeOf((*bson.Marshaler)(nil)).Elem()
+)
+
+func classOf(t reflect.Type) valueClass {
+	t = indirectType(t)
+	if t.Implements(valueMarshalerType) || t.Implements(marshalerType) ||
+		reflect.PointerTo(t).Implements(valueMarshalerType) || reflect.PointerTo(t).Implements(marshalerType) {
+		return classAny
+	}
+	switch t {
+	case timeType, reflect.TypeOf(primitive.DateTime(0)):
+		return classDate
+	case objectIDType:
+		return classObjectID
+	case reflect.TypeOf(primitive.Decimal128{}):
+		return classNumber
+	case reflect.TypeOf(primitive.Binary{}):
+		return classBinary
+	case reflect.TypeOf(primitive.Regex{}):
+		return classRegex
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return classNumber
+	case reflect.String:
+		return classString
+	case reflect.Bool:
+		return classBool
+	case reflect.Struct, reflect.Map:
+		return classDocument
+	case reflect.Slice, reflect.Array:
+		if isArrayType(t) {
+			return classArray
+		}
+		return classBinary
+	}
+	return classAny
+}
+
+// canMatch reports whether a field of type t can ever equal or compare to value.
+// Array fields also match values of their element type, and regular
+// expressions match string fields.
+func canMatch(t reflect.Type, value any) bool {
+	vt := reflect.TypeOf(value)
+	if value == nil || vt == nil {
+		return true
+	}
+	if vt.Kind() == reflect.Ptr && reflect.ValueOf(value).IsNil() {
+		return true
+	}
+	t = indirectType(t)
+	if isArrayType(t) && canMatch(t.Elem(), value) {
+		return true
+	}
+	field, val := classOf(t), classOf(vt)
+	if val == classRegex {
+		val = classString
+	}
+	return field == classAny || val == classAny || field == val
+}
@@ -0,0 +1,128 @@
+package pie
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/5xxxx/pie/names"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type profile struct {
+	ID       primitive.ObjectID `bson:"_id"`
+	NickName string             `bson:"nick_name"`
+	Age      int                `bson:"age"`
+	Tags     []string           `bson:"tags"`
+	Joined   time.Time          `bson:"joined"`
+	Address  struct {
+		City string `bson:"city"`
+	} `bson:"address"`
+	Orders []struct {
+		Total float64 `bson:"total"`
+	} `bson:"orders"`
+	Extra map[string]any `bson:"extra"`
+}
+
+func fieldErrors(err error) []*FieldError {
+	var out []*FieldError
+	for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var fe *FieldError
+		if errors.As(e, &fe) {
+			out = append(out, fe)
+		}
+	}
+	return out
+}
+
+func TestValidateFields(t *testing.T) {
+	Convey("ValidateFields checks keys and values against the model", t, func() {
+		Convey("Known paths and matching values pass", func() {
+			filter, err := DefaultCondition().
+				Eq("nick_name", "frank").
+				Gt("age", 18).
+				Eq("tags", "admin").
+				In("address.city", []string{"Paris", "Oslo"}).
+				Lt("orders.total", 9.5).
+				Gte("joined", time.Now()).
+				Exists("extra.anything", true).
+				RegexFilter("nick_name", "^fr").
+				Filters()
+			So(err, ShouldBeNil)
+			So(ValidateFields(&profile{}, filter, "age", "orders.0.total", "tags"), ShouldBeNil)
+		})
+
+		Convey("Unknown paths are reported with close matches", func() {
+			err := ValidateFields(&[]profile{}, bson.D{{Key: "nick_nmae", Value: "frank"}}, "adress.city")
+			So(err, ShouldNotBeNil)
+			errs := fieldErrors(err)
+			So(errs, ShouldHaveLength, 2)
+			So(errs[0].Path, ShouldEqual, "nick_nmae")
+			So(errs[0].Suggestions, ShouldResemble, []string{"nick_name"})
+			So(errs[0].Error(), ShouldEqual, `field "nick_nmae" of profile: unknown field, did you mean "nick_name"?`)
+			So(errs[1].Suggestions, ShouldResemble, []string{"address.city"})
+		})
+
+		Convey("$elemMatch conditions resolve against the array's elements", func() {
+			filter, err := DefaultCondition().
+				ElemMatch("orders", DefaultCondition().Gt("total", 5).Eq("totl", 1)).
+				ElemMatch("tags", DefaultCondition().Eq("", 3)).
+				Filters()
+			So(err, ShouldBeNil)
+			errs := fieldErrors(ValidateFields(profile{}, filter))
+			So(errs, ShouldHaveLength, 2)
+			So(errs[0].Path, ShouldEqual, "orders.totl")
+			So(errs[0].Suggestions, ShouldResemble, []string{"orders.total"})
+			So(errs[1].Path, ShouldEqual, "tags")
+		})
+
+		Convey("Values that can never match are reported", func() {
+			filter := bson.D{
+				{Key: "age", Value: "18"},
+				{Key: "_id", Value: bson.M{"$in": bson.A{"5f1d7f1e2a6b3c0001a1b2c3"}}},
+				{Key: "$or", Value: bson.A{bson.D{{Key: "joined", Value: true}}}},
+			}
+			errs := fieldErrors(ValidateFields(profile{}, filter))
+			So(errs, ShouldHaveLength, 3)
+			So(errs[0].Path, ShouldEqual, "age")
+			So(errs[0].Msg, ShouldEqual, "a string value can never match a int field")
+			So(errs[1].Path, ShouldEqual, "_id")
+			So(errs[2].Path, ShouldEqual, "joined")
+		})
+	})
+}
+
+func TestStrictSession(t *testing.T) {
+	Convey("Given a session in strict mode", t, func() {
+		mc, err := mongo.NewClient(options.Client().ApplyURI("mongodb://127.0.0.1:27017"))
+		So(err, ShouldBeNil)
+		mapper := names.NewCacheMapper(new(names.SnakeMapper))
+		client := &defaultClient{client: mc, parser: NewParser(mapper, mapper), db: "test"}
+
+		Convey("Unknown filter and sort keys fail before the query is sent", func() {
+			s := client.NewSession().Strict(true).Eq("nick_nmae", "frank").Sort("-agee").(*session)
+			_, err := s.collectionForStruct(&profile{})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `did you mean "nick_name"?`)
+			So(err.Error(), ShouldContainSubstring, `field "agee" of profile`)
+
+			_, err = s.Clone().(*session).collectionForSlice(&[]profile{})
+			So(err, ShouldNotBeNil)
+
+			_, err = client.NewSession().Strict(true).Project(NewProjection().Include("nick_nmae")).(*session).collectionForStruct(&profile{})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `did you mean "nick_name"?`)
+		})
+
+		Convey("Valid keys and non-strict sessions pass", func() {
+			_, err := client.NewSession().Strict(true).Eq("address.city", "Oslo").Project(bson.M{"tags.$": 1}).(*session).collectionForStruct(&profile{})
+			So(err, ShouldBeNil)
+			_, err = client.NewSession().Eq("nick_nmae", "frank").(*session).collectionForStruct(&profile{})
+			So(err, ShouldBeNil)
+		})
+	})
+}
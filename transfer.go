@@ -0,0 +1,221 @@
+package pie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/5xxxx/pie/internal/docio"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ExportFormat selects how Session.Export writes documents.
+type ExportFormat int
+
+const (
+	// ExportJSONLines writes one relaxed Extended JSON document per line.
+	ExportJSONLines = ExportFormat(docio.JSONLines)
+	// ExportCanonicalJSONLines writes one canonical Extended JSON document per
+	// line, which keeps every BSON type and imports back losslessly.
+	ExportCanonicalJSONLines = ExportFormat(docio.CanonicalJSONLines)
+	// ExportCSV writes a header row and one row per document. The columns are
+	// the fields of an inclusion projection, in order when it is a bson.D and
+	// sorted when it is a map, or the fields of the first document.
+	// Embedded documents and arrays are written as relaxed Extended JSON.
+	ExportCSV = ExportFormat(docio.CSV)
+)
+
+// ErrTooManyImportErrors is returned by Session.Import when more documents
+// failed than ImportOptions.MaxErrors allows.
+var ErrTooManyImportErrors = docio.ErrTooManyErrors
+
+// errNoCollection is returned by Export and Import on a session without SetCollection.
+var errNoCollection = errors.New("needs a collection, set one with SetCollection")
+
+// ImportOptions configures Session.Import.
+type ImportOptions struct {
+	// Format is the format of the input. It defaults to ExportJSONLines,
+	// which reads both JSON Lines formats as well as an Extended JSON array.
+	// ExportCSV reads a header row of dotted field paths and types the
+	// values as Export writes them; a string that reads as a number, date or
+	// ObjectID is imported as one, so use JSON Lines for exact round trips.
+	Format ExportFormat
+	// BatchSize is the number of documents written at once. It defaults to 1000.
+	BatchSize int
+	// Upsert replaces the documents matching UpsertFields instead of inserting.
+	Upsert bool
+	// UpsertFields are the fields an upsert matches on. They default to _id.
+	UpsertFields []string
+	// MaxErrors is the number of failed documents tolerated before the import
+	// stops. Zero stops at the first failure and a negative value never stops.
+	MaxErrors int
+	// Progress is called after every batch with the totals so far.
+	Progress func(ImportResult)
+}
+
+// ImportResult counts the documents Session.Import processed.
+type ImportResult struct {
+	Read     int64
+	Inserted int64
+	Upserted int64
+	Modified int64
+	Failed   int64
+	// Errors holds the errors of the failed documents, prefixed with their line numbers.
+	Errors []error
+}
+
+// Export streams the documents of the session's collection that match its
+// filter, in its sort order, skip, limit and projection, to w. The collection
+// is set with SetCollection.
+//
+// Example usage:
+//
+//	f, err := os.Create("users.jsonl")
+//	err = client.NewSession().SetCollection("users").Gte("created_at", since).
+//		Export(ctx, f, pie.ExportCanonicalJSONLines)
+func (s *session) Export(ctx context.Context, w io.Writer, format ExportFormat) error {
+	if s.collection == "" {
+		return fmt.Errorf("export %w", errNoCollection)
+	}
+	if err := s.resolveIDs(nil); err != nil {
+		return err
+	}
+	filters, err := s.filter.Filters()
+	if err != nil {
+		return err
+	}
+	opts := options.MergeFindOptions(s.findOptions...)
+	columns, err := docio.ProjectionColumns(opts.Projection)
+	if err != nil {
+		return err
+	}
+	enc, err := docio.NewEncoder(w, docio.Format(format), columns)
+	if err != nil {
+		return err
+	}
+
+	cursor, err := s.collectionByName(s.collection).Find(ctx, filters, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(ctx) {
+		if err := enc.Encode(cursor.Current); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// Import reads documents written by Export, or an Extended JSON array, from r
+// and inserts them into the session's collection in batches, or
+// upserts them with ImportOptions.Upsert. Documents that fail to parse or to
+// write are counted and reported in the result rather than stopping the import,
+// up to ImportOptions.MaxErrors.
+//
+// Example usage:
+//
+//	res, err := client.NewSession().SetCollection("users").Import(ctx, f, &pie.ImportOptions{
+//		Upsert:    true,
+//		MaxErrors: 100,
+//		Progress:  func(r pie.ImportResult) { log.Printf("%d documents", r.Read) },
+//	})
+func (s *session) Import(ctx context.Context, r io.Reader, opts ...*ImportOptions) (*ImportResult, error) {
+	if s.collection == "" {
+		return nil, fmt.Errorf("import %w", errNoCollection)
+	}
+	o := mergeImportOptions(opts)
+	coll := s.collectionByName(s.collection)
+	write := func(ctx context.Context, docs []bson.D, lines []int) (docio.Stats, error) {
+		if o.Upsert {
+			return upsertBatch(ctx, coll, docs, lines, o.UpsertFields)
+		}
+		return insertBatch(ctx, coll, docs, lines)
+	}
+	stats, err := docio.Import(ctx, r, importOptions(o), write)
+	s.invalidate(coll, nil)
+	res := ImportResult(stats)
+	return &res, err
+}
+
+func mergeImportOptions(opts []*ImportOptions) ImportOptions {
+	var o ImportOptions
+	for _, opt := range opts {
+		if opt != nil {
+			o = *opt
+		}
+	}
+	if len(o.UpsertFields) == 0 {
+		o.UpsertFields = []string{"_id"}
+	}
+	return o
+}
+
+func importOptions(o ImportOptions) docio.ImportOptions {
+	do := docio.ImportOptions{
+		Format:    docio.Format(o.Format),
+		BatchSize: o.BatchSize,
+		MaxErrors: o.MaxErrors,
+	}
+	if o.Progress != nil {
+		do.Progress = func(s docio.Stats) { o.Progress(ImportResult(s)) }
+	}
+	return do
+}
+
+func insertBatch(ctx context.Context, coll *mongo.Collection, docs []bson.D, lines []int) (docio.Stats, error) {
+	many := make([]any, len(docs))
+	for i, d := range docs {
+		many[i] = d
+	}
+	var stats docio.Stats
+	res, err := coll.InsertMany(ctx, many, options.InsertMany().SetOrdered(false))
+	if res != nil {
+		stats.Inserted = int64(len(res.InsertedIDs))
+	}
+	return stats, writeFailures(&stats, err, lines)
+}
+
+func upsertBatch(ctx context.Context, coll *mongo.Collection, docs []bson.D, lines []int, fields []string) (docio.Stats, error) {
+	var stats docio.Stats
+	var models []mongo.WriteModel
+	var modelLines []int
+	for i, d := range docs {
+		filter, err := docio.UpsertFilter(d, fields)
+		if err != nil {
+			stats.Failed++
+			stats.Errors = append(stats.Errors, fmt.Errorf("line %d: %w", lines[i], err))
+			continue
+		}
+		models = append(models, mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(d).SetUpsert(true))
+		modelLines = append(modelLines, lines[i])
+	}
+	if len(models) == 0 {
+		return stats, nil
+	}
+	res, err := coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if res != nil {
+		stats.Upserted, stats.Modified = res.UpsertedCount, res.ModifiedCount
+	}
+	return stats, writeFailures(&stats, err, modelLines)
+}
+
+// writeFailures records the per-document errors of a bulk write in stats and
+// returns err only when it is not such an error.
+func writeFailures(stats *docio.Stats, err error, lines []int) error {
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || len(bwe.WriteErrors) == 0 {
+		return err
+	}
+	for _, we := range bwe.WriteErrors {
+		stats.Failed++
+		stats.Errors = append(stats.Errors, fmt.Errorf("line %d: %s", lines[we.Index], we.Message))
+	}
+	return nil
+}
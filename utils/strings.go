@@ -33,3 +33,26 @@ func SplitNNoCase(s, sep string, n int) []string {
 	}
 	return strings.SplitN(s, s[idx:idx+len(sep)], n)
 }
+
+// Levenshtein returns the edit distance between a and b: the number of single
+// rune insertions, deletions and substitutions turning a into b.
+func Levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
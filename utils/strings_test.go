@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevenshtein(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"nick_name", "nick_name", 0},
+		{"nick_nmae", "nick_name", 2},
+		{"kitten", "sitting", 3},
+		{"名字", "名子", 1},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, Levenshtein(c.a, c.b), "%q -> %q", c.a, c.b)
+		assert.Equal(t, c.want, Levenshtein(c.b, c.a), "%q -> %q", c.b, c.a)
+	}
+}